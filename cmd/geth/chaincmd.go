@@ -17,11 +17,15 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -31,9 +35,13 @@ import (
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/eth"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/logger"
 	"github.com/ethereum/go-ethereum/logger/glog"
+	"github.com/ethereum/go-ethereum/replay"
+	"github.com/ethereum/go-ethereum/replay/provenance"
+	"github.com/ethereum/go-ethereum/replay/schema"
 	"github.com/ethereum/go-ethereum/trie"
 	"github.com/syndtr/goleveldb/leveldb/util"
 	"gopkg.in/urfave/cli.v1"
@@ -106,6 +114,247 @@ The arguments are interpreted as block numbers or hashes.
 Use "ethereum dump 0" to dump the genesis block.
 `,
 	}
+	replayCommandFromFlag = cli.Uint64Flag{
+		Name:  "from",
+		Usage: "First block of the range to replay",
+	}
+	replayCommandToFlag = cli.Uint64Flag{
+		Name:  "to",
+		Usage: "Last block of the range to replay (defaults to the first block)",
+	}
+	replayCommandOutFlag = cli.StringFlag{
+		Name:  "out",
+		Value: "replay",
+		Usage: "Directory to write the replay documents into",
+	}
+	replayCommandMergeFlag = cli.BoolFlag{
+		Name:  "merge",
+		Usage: "Write the whole range into a single file, one document per line",
+	}
+	replayCommandVerifyFlag = cli.BoolFlag{
+		Name:  "verify",
+		Usage: "Verify every replayed block against the stored receipts and state root",
+	}
+	replayCommandCheckpointFlag = cli.StringFlag{
+		Name:  "checkpoint",
+		Usage: "File to save the replay progress into, resuming from it if it exists",
+	}
+	replayCommandRetriesFlag = cli.IntFlag{
+		Name:  "retries",
+		Value: 3,
+		Usage: "Number of times to retry failing blocks of checkpointed replays",
+	}
+	replayCommandFormatFlag = cli.StringFlag{
+		Name:  "format",
+		Value: "deepinsight",
+		Usage: `Format of the documents to write ("deepinsight" or "parity")`,
+	}
+	replayCommandPresetFlag = cli.StringFlag{
+		Name:  "preset",
+		Usage: `Parts of the transactions to emit ("storageTransfers" or "stateDiff")`,
+	}
+	replayCommandAccountsFlag = cli.StringFlag{
+		Name:  "accounts",
+		Usage: "Comma separated accounts whose instructions to emit",
+	}
+	replayCommandExcludeAccountsFlag = cli.StringFlag{
+		Name:  "excludeaccounts",
+		Usage: "Comma separated accounts whose instructions to leave out",
+	}
+	replayCommandOpcodesFlag = cli.StringFlag{
+		Name:  "opcodes",
+		Usage: "Comma separated opcodes to emit (e.g. SLOAD,SSTORE)",
+	}
+	replayCommandMaxDepthFlag = cli.IntFlag{
+		Name:  "maxdepth",
+		Usage: "Maximum call depth of the instructions to emit (0 = unlimited)",
+	}
+	replayCommandMaxInstructionsFlag = cli.IntFlag{
+		Name:  "maxinstructions",
+		Usage: "Maximum number of instructions to emit per transaction (0 = unlimited)",
+	}
+	replayCommandContentHashFlag = cli.BoolFlag{
+		Name:  "contenthash",
+		Usage: "Close every transaction and block document with the hash of its content",
+	}
+	replayCommandDedupCodeFlag = cli.BoolFlag{
+		Name:  "dedupcode",
+		Usage: "Reference contract code by hash, emitting each code once per block document",
+	}
+	replayCommandWorkersFlag = cli.IntFlag{
+		Name:  "workers",
+		Value: runtime.NumCPU(),
+		Usage: "Number of blocks to replay concurrently",
+	}
+	replayStatsFormatFlag = cli.StringFlag{
+		Name:  "format",
+		Value: "json",
+		Usage: `Format of the statistics to print ("json" or "csv")`,
+	}
+	replayStatsPerBlockFlag = cli.BoolFlag{
+		Name:  "perblock",
+		Usage: "Print the statistics of every block before the total",
+	}
+	replayCommand = cli.Command{
+		Action:    replayChain,
+		Name:      "replay",
+		Usage:     "Replay a range of blocks into DeepInsight documents",
+		ArgsUsage: " ",
+		Category:  "BLOCKCHAIN COMMANDS",
+		Description: `
+The replay command re-executes the blocks between --from and --to (inclusive)
+directly from the local chain database and writes their DeepInsight replay
+documents into the --out directory, one <number>.json file per block. With
+--merge the whole range is written into a single <from>-<to>.json file instead,
+holding one document per line. Blocks are replayed concurrently by --workers
+threads, but always written in block order. With the global --replayindex flag
+the storage writes and transfers of the replayed blocks are also recorded in the
+replay index of the data directory. With --verify every block is checked against
+its stored receipts and state root; the outcome is recorded in the documents and
+the replay stops at the first diverging block, after writing it.
+
+With --checkpoint the progress is saved into the given file every few seconds,
+and a replay of the same range started again resumes from it, rewriting at most
+the blocks completed since the last save. With --merge the progress is saved
+after every block instead, so that no block is appended twice. Failing blocks
+are retried --retries times before giving up on them, blocks failing --verify
+right away; the blocks given up on are recorded in the checkpoint and the replay
+carries on.
+
+The code traces written can be limited to the instructions of --accounts, not of
+--excludeaccounts, of the given --opcodes and up to --maxdepth, and capped at
+--maxinstructions per transaction. The storageTransfers --preset keeps only the
+storage accesses, the stateDiff preset drops the code traces altogether. The
+provenance of the emitted instructions is still tracked over the full execution.
+Limited replays cannot be recorded in the replay index. With --contenthash every
+transaction and block document ends with the Keccak256 hash of its content, so
+that replays can be compared by hash across runs and node versions. With
+--dedupcode the transactions reference the code they touched by hash, and every
+block document holds each piece of code once, in its codeTable. The schema
+package decoders inflate such documents back into the full form.
+
+With --format parity the blocks are written in the shape of Parity's
+trace_replayBlockTransactions instead, holding the call trace and state diff of
+every transaction. Parity documents cannot be limited.
+`,
+		Flags: []cli.Flag{
+			replayCommandFromFlag,
+			replayCommandToFlag,
+			replayCommandOutFlag,
+			replayCommandMergeFlag,
+			replayCommandVerifyFlag,
+			replayCommandWorkersFlag,
+			replayCommandCheckpointFlag,
+			replayCommandRetriesFlag,
+			replayCommandFormatFlag,
+			replayCommandPresetFlag,
+			replayCommandAccountsFlag,
+			replayCommandExcludeAccountsFlag,
+			replayCommandOpcodesFlag,
+			replayCommandMaxDepthFlag,
+			replayCommandMaxInstructionsFlag,
+			replayCommandContentHashFlag,
+			replayCommandDedupCodeFlag,
+		},
+		Subcommands: []cli.Command{
+			replaySliceCommand,
+			replayGraphCommand,
+			replayTaintCommand,
+			replayWhatIfCommand,
+			replayStatsCommand,
+		},
+	}
+	replaySliceCommand = cli.Command{
+		Action:    replaySlice,
+		Name:      "slice",
+		Usage:     "Trace back what influenced a value computed by a transaction",
+		ArgsUsage: "<txHash> <seq> [<operand>]",
+		Description: `
+The slice command replays a transaction and prints the backward data flow slice
+of an operand of the instruction with sequence number <seq>: every instruction
+that contributed to the value, and its calldata, storage, code or environment
+roots. The operand is a stack input name as emitted in the replay document (e.g.
+storeValue for SSTORE, value for CALL), "memory" for the memory the instruction
+reads, or "output" (the default) for the value the instruction produced.
+`,
+	}
+	replayGraphCommand = cli.Command{
+		Action:    replayGraph,
+		Name:      "graph",
+		Usage:     "Render the data flow graph of a transaction for Graphviz",
+		ArgsUsage: "<txHash> [<seq>]",
+		Description: `
+The graph command replays a transaction and prints its data flow graph in the
+DOT language of Graphviz, e.g. for rendering with "dot -Tsvg". Instructions are
+labeled with their sequence number, opcode, pc, contract and call depth, edges
+with the stack operand or memory byte range a value flows into. Reverted
+instructions are drawn dashed and in red.
+
+If the sequence number <seq> of an instruction is given, e.g. of an SSTORE, CALL
+or LOG, only the instructions feeding it are drawn.
+`,
+	}
+	replayTaintCommand = cli.Command{
+		Action:    replayTaint,
+		Name:      "taint",
+		Usage:     "Find the state changes influenced by a taint source",
+		ArgsUsage: "<source>",
+		Description: `
+The taint command replays the blocks between --from and --to (inclusive) and
+propagates the given taint source forward through every transaction, printing
+one JSON line per transaction whose storage writes, logs, calls or transfers
+are influenced by it. The source is one of:
+
+    calldata[:<offset>[:<length>]]  bytes of the transaction input
+    callvalue                       the value sent with the transaction
+    storage[:<slot>]                storage as it was before the transaction
+    <OPCODE>                        an environment opcode, e.g. TIMESTAMP
+`,
+		Flags: []cli.Flag{
+			replayCommandFromFlag,
+			replayCommandToFlag,
+			replayCommandWorkersFlag,
+		},
+	}
+	replayWhatIfCommand = cli.Command{
+		Action:    replayWhatIf,
+		Name:      "whatif",
+		Usage:     "Replay a block under alternative chain rules",
+		ArgsUsage: "<number> <fork>=<value>...",
+		Description: `
+The whatif command replays a block both under the rules of the chain and under
+the rules changed as given, and prints how its transactions fared differently:
+the gas used, failure reasons, transfers and storage writes that changed. The
+forks homestead, dao, eip150, eip155 and eip158 take the block number they
+activate at or "off", daoSupport takes true or false, e.g.
+
+    geth replay whatif 2463000 eip150=off
+
+Transactions that are invalid under the changed rules are skipped, and the
+reason they were rejected for is reported in their "invalid" field.
+`,
+	}
+	replayStatsCommand = cli.Command{
+		Action:    replayStats,
+		Name:      "stats",
+		Usage:     "Aggregate opcode and gas statistics over a range of blocks",
+		ArgsUsage: " ",
+		Description: `
+The stats command replays the blocks between --from and --to (inclusive) without
+writing their documents, and prints statistics of the instructions executed:
+opcode frequencies and gas, gas by contract, instructions by call depth,
+precompile usage and failure reasons. The gas forwarded by calls is counted
+where it is spent. With --perblock the statistics of every block are printed
+before the total, as JSON lines or CSV records labelled with the block number.
+`,
+		Flags: []cli.Flag{
+			replayCommandFromFlag,
+			replayCommandToFlag,
+			replayCommandWorkersFlag,
+			replayStatsFormatFlag,
+			replayStatsPerBlockFlag,
+		},
+	}
 )
 
 // initGenesis will initialise the given JSON format genesis file and writes it as
@@ -325,6 +574,387 @@ func dump(ctx *cli.Context) error {
 	return nil
 }
 
+// replayRange returns the block range selected by the --from and --to flags.
+func replayRange(ctx *cli.Context) (uint64, uint64) {
+	first, last := ctx.Uint64(replayCommandFromFlag.Name), ctx.Uint64(replayCommandToFlag.Name)
+	if !ctx.IsSet(replayCommandToFlag.Name) {
+		last = first
+	}
+	if last < first {
+		utils.Fatalf("Replay error: last block #%d before first block #%d", last, first)
+	}
+	return first, last
+}
+
+// replayConfig assembles the replay output options from the command line flags,
+// returning nil if none were given.
+func replayConfig(ctx *cli.Context) *replay.ReplayConfig {
+	var set bool
+	for _, flag := range []cli.Flag{replayCommandPresetFlag, replayCommandAccountsFlag, replayCommandExcludeAccountsFlag, replayCommandOpcodesFlag, replayCommandMaxDepthFlag, replayCommandMaxInstructionsFlag, replayCommandContentHashFlag, replayCommandDedupCodeFlag} {
+		set = set || ctx.IsSet(flag.GetName())
+	}
+	if !set {
+		return nil
+	}
+	config := &replay.ReplayConfig{
+		Preset:          ctx.String(replayCommandPresetFlag.Name),
+		Accounts:        replayAccounts(ctx.String(replayCommandAccountsFlag.Name)),
+		ExcludeAccounts: replayAccounts(ctx.String(replayCommandExcludeAccountsFlag.Name)),
+		MaxDepth:        ctx.Int(replayCommandMaxDepthFlag.Name),
+		MaxInstructions: ctx.Int(replayCommandMaxInstructionsFlag.Name),
+		ContentHash:     ctx.Bool(replayCommandContentHashFlag.Name),
+		DedupCode:       ctx.Bool(replayCommandDedupCodeFlag.Name),
+	}
+	if ops := ctx.String(replayCommandOpcodesFlag.Name); ops != "" {
+		config.Opcodes = strings.Split(ops, ",")
+	}
+	if err := config.Validate(); err != nil {
+		utils.Fatalf("Invalid replay options: %v", err)
+	}
+	return config
+}
+
+// replayAccounts parses a comma separated list of accounts.
+func replayAccounts(list string) []common.Address {
+	var accounts []common.Address
+	for _, account := range strings.Split(list, ",") {
+		if account = strings.TrimSpace(account); account == "" {
+			continue
+		}
+		if !common.IsHexAddress(account) {
+			utils.Fatalf("Invalid account %q", account)
+		}
+		accounts = append(accounts, common.HexToAddress(account))
+	}
+	return accounts
+}
+
+// replayChain re-executes a range of blocks from the local database and writes
+// their replay documents to disk.
+func replayChain(ctx *cli.Context) error {
+	first, last := replayRange(ctx)
+	config := replayConfig(ctx)
+	format := ctx.String(replayCommandFormatFlag.Name)
+	switch format {
+	case "deepinsight":
+	case "parity":
+		if config != nil && config.Limited() {
+			utils.Fatalf("Replay error: parity documents cannot be limited")
+		}
+	default:
+		utils.Fatalf("Replay error: unknown format %q", format)
+	}
+	out := ctx.String(replayCommandOutFlag.Name)
+	if err := os.MkdirAll(out, 0755); err != nil {
+		utils.Fatalf("Failed to create output directory: %v", err)
+	}
+	stack := makeFullNode(ctx)
+	chain, chainDb := utils.MakeChain(ctx, stack)
+	defer chainDb.Close()
+
+	if head := chain.CurrentBlock().NumberU64(); last > head {
+		utils.Fatalf("Replay error: last block #%d beyond chain head #%d", last, head)
+	}
+	var index *eth.ReplayIndex
+	if ctx.GlobalBool(utils.ReplayIndexFlag.Name) {
+		if config != nil && config.Limited() {
+			utils.Fatalf("Replay error: limited replays cannot be indexed")
+		}
+		index = utils.MakeReplayIndex(ctx, stack)
+		defer index.Close()
+	}
+	// Open the merged output file if the whole range goes into one
+	var (
+		merged     *os.File
+		checkpoint = ctx.String(replayCommandCheckpointFlag.Name)
+	)
+	if ctx.Bool(replayCommandMergeFlag.Name) {
+		// Resumed replays append to the output of the earlier runs, fresh
+		// ones replace any output left without a checkpoint
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if checkpoint != "" {
+			cp, err := eth.NewReplayCheckpointFile(checkpoint).Load()
+			if err != nil {
+				utils.Fatalf("Failed to load checkpoint: %v", err)
+			}
+			if cp != nil {
+				flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+			}
+		}
+		var err error
+		if merged, err = os.OpenFile(filepath.Join(out, fmt.Sprintf("%d-%d.json", first, last)), flags, 0644); err != nil {
+			utils.Fatalf("Failed to create output file: %v", err)
+		}
+		defer merged.Close()
+	}
+	write := func(number uint64, doc string) error {
+		if index != nil {
+			if err := index.IndexDocument([]byte(doc)); err != nil {
+				return fmt.Errorf("block #%d: indexing failed: %v", number, err)
+			}
+		}
+		if format == "parity" {
+			var err error
+			if doc, err = parityDocument(chain, doc); err != nil {
+				return fmt.Errorf("block #%d: %v", number, err)
+			}
+		}
+		if merged != nil {
+			_, err := merged.WriteString(doc + "\n")
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(out, fmt.Sprintf("%d.json", number)), []byte(doc), 0644)
+	}
+	var (
+		start   = time.Now()
+		workers = ctx.Int(replayCommandWorkersFlag.Name)
+		err     error
+	)
+	switch {
+	case checkpoint != "":
+		return replayCheckpointed(ctx, chain, chainDb, checkpoint, first, last, config, write, merged != nil)
+	case ctx.Bool(replayCommandVerifyFlag.Name):
+		err = eth.VerifyReplayRange(chain, chainDb, first, last, workers, config, write)
+	default:
+		err = eth.ReplayRange(chain, first, last, workers, config, write)
+	}
+	if err != nil {
+		utils.Fatalf("Replay error: %v", err)
+	}
+	fmt.Printf("Replay of %d blocks done in %v.\n", last-first+1, time.Since(start))
+	return nil
+}
+
+// replayCheckpointed replays a range of blocks as a checkpointed job, stopping
+// it on interrupts so that its progress is saved. If write appends to its
+// output, the progress is saved after every block.
+func replayCheckpointed(ctx *cli.Context, chain *core.BlockChain, chainDb ethdb.Database, checkpoint string, first, last uint64, config *replay.ReplayConfig, write func(uint64, string) error, appends bool) error {
+	var verifyDb ethdb.Database
+	if ctx.Bool(replayCommandVerifyFlag.Name) {
+		verifyDb = chainDb
+	}
+	store := eth.NewReplayCheckpointFile(checkpoint)
+	job, err := eth.NewChainReplayJob(store, chain, verifyDb, first, last, ctx.Int(replayCommandRetriesFlag.Name), ctx.Int(replayCommandWorkersFlag.Name), config, write)
+	if err != nil {
+		utils.Fatalf("Replay error: %v", err)
+	}
+	if appends {
+		job.CheckpointEveryBlock()
+	}
+	if status := job.Status(); status.Next > first {
+		fmt.Printf("Resuming replay at block #%d.\n", status.Next)
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt)
+	defer signal.Stop(sigc)
+	go func() {
+		if _, ok := <-sigc; ok {
+			glog.V(logger.Info).Infoln("Interrupted, saving replay checkpoint")
+			job.Stop()
+		}
+	}()
+	start := time.Now()
+	err = job.Run()
+	status := job.Status()
+	for _, failure := range status.Failures {
+		fmt.Printf("Block #%d failed after %d attempts: %s\n", failure.Block, failure.Attempts, failure.Error)
+	}
+	if err != nil {
+		utils.Fatalf("Replay error at block #%d: %v", status.Next, err)
+	}
+	fmt.Printf("Replay of blocks #%d-#%d done in %v, %d failed.\n", first, last, time.Since(start), len(status.Failures))
+	return nil
+}
+
+// parityDocument converts the replay document of a block into the traces and
+// state diffs of its transactions, as returned by trace_replayBlockTransactions.
+func parityDocument(chain *core.BlockChain, doc string) (string, error) {
+	block, err := schema.DecodeBlock([]byte(doc))
+	if err != nil {
+		return "", fmt.Errorf("invalid replay document: %v", err)
+	}
+	results, err := eth.ParityReplayBlockTransactions(chain, block, []string{"trace", "stateDiff"})
+	if err != nil {
+		return "", err
+	}
+	out, err := json.Marshal(results)
+	return string(out), err
+}
+
+func replaySlice(ctx *cli.Context) error {
+	if len(ctx.Args()) < 2 {
+		utils.Fatalf("This command requires a transaction hash and an instruction sequence number.")
+	}
+	seq, err := strconv.Atoi(ctx.Args().Get(1))
+	if err != nil {
+		utils.Fatalf("Invalid instruction sequence number: %v", err)
+	}
+	stack := makeFullNode(ctx)
+	chain, chainDb := utils.MakeChain(ctx, stack)
+	defer chainDb.Close()
+
+	doc, err := eth.ReplayTransaction(chain, chainDb, common.HexToHash(ctx.Args().First()))
+	if err != nil {
+		utils.Fatalf("Replay error: %v", err)
+	}
+	tx, err := schema.DecodeTransaction([]byte(doc))
+	if err != nil {
+		utils.Fatalf("Invalid replay document: %v", err)
+	}
+	slice, err := provenance.BackwardSlice(tx, seq, ctx.Args().Get(2))
+	if err != nil {
+		utils.Fatalf("Slice error: %v", err)
+	}
+	out, _ := json.MarshalIndent(slice, "", "  ")
+	fmt.Println(string(out))
+	return nil
+}
+
+func replayGraph(ctx *cli.Context) error {
+	if len(ctx.Args()) < 1 {
+		utils.Fatalf("This command requires a transaction hash.")
+	}
+	seq := -1
+	if len(ctx.Args()) > 1 {
+		var err error
+		if seq, err = strconv.Atoi(ctx.Args().Get(1)); err != nil || seq < 0 {
+			utils.Fatalf("Invalid instruction sequence number: %s", ctx.Args().Get(1))
+		}
+	}
+	stack := makeFullNode(ctx)
+	chain, chainDb := utils.MakeChain(ctx, stack)
+	defer chainDb.Close()
+
+	doc, err := eth.ReplayTransaction(chain, chainDb, common.HexToHash(ctx.Args().First()))
+	if err != nil {
+		utils.Fatalf("Replay error: %v", err)
+	}
+	tx, err := schema.DecodeTransaction([]byte(doc))
+	if err != nil {
+		utils.Fatalf("Invalid replay document: %v", err)
+	}
+	if err := provenance.WriteDOT(os.Stdout, tx, seq); err != nil {
+		utils.Fatalf("Graph error: %v", err)
+	}
+	return nil
+}
+
+func replayWhatIf(ctx *cli.Context) error {
+	if len(ctx.Args()) < 2 {
+		utils.Fatalf("This command requires a block number and at least one rule change.")
+	}
+	number, err := strconv.ParseUint(ctx.Args().First(), 10, 64)
+	if err != nil {
+		utils.Fatalf("Invalid block number: %v", err)
+	}
+	rules := make(eth.ReplayRules)
+	for _, arg := range ctx.Args()[1:] {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			utils.Fatalf("Invalid rule change %q, want <fork>=<value>", arg)
+		}
+		rules[parts[0]] = parts[1]
+	}
+	stack := makeFullNode(ctx)
+	chain, chainDb := utils.MakeChain(ctx, stack)
+	defer chainDb.Close()
+
+	diff, err := eth.ReplayBlockWithRules(chain, number, rules)
+	if err != nil {
+		utils.Fatalf("Replay error: %v", err)
+	}
+	out, _ := json.MarshalIndent(diff, "", "  ")
+	fmt.Println(string(out))
+	return nil
+}
+
+func replayStats(ctx *cli.Context) error {
+	first, last := replayRange(ctx)
+	format := ctx.String(replayStatsFormatFlag.Name)
+	if format != "json" && format != "csv" {
+		utils.Fatalf("Replay error: unknown format %q", format)
+	}
+	stack := makeFullNode(ctx)
+	chain, chainDb := utils.MakeChain(ctx, stack)
+	defer chainDb.Close()
+
+	if head := chain.CurrentBlock().NumberU64(); last > head {
+		utils.Fatalf("Replay error: last block #%d beyond chain head #%d", last, head)
+	}
+	// Print the statistics as JSON lines or CSV records, labelled by block
+	emit := func(label string, stats *replay.ReplayStats) error {
+		if format == "csv" {
+			return stats.WriteCSV(os.Stdout, label)
+		}
+		out, err := json.Marshal(struct {
+			Label string `json:"label"`
+			*replay.ReplayStats
+		}{label, stats})
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Println(string(out))
+		return err
+	}
+	if format == "csv" {
+		fmt.Println("label,section,key,count,gas")
+	}
+	var block func(number uint64, stats *replay.ReplayStats) error
+	if ctx.Bool(replayStatsPerBlockFlag.Name) {
+		block = func(number uint64, stats *replay.ReplayStats) error {
+			return emit(strconv.FormatUint(number, 10), stats)
+		}
+	}
+	total, err := eth.ReplayRangeStats(chain, first, last, ctx.Int(replayCommandWorkersFlag.Name), block)
+	if err != nil {
+		utils.Fatalf("Replay error: %v", err)
+	}
+	if err := emit(fmt.Sprintf("%d-%d", first, last), total); err != nil {
+		utils.Fatalf("Failed to print statistics: %v", err)
+	}
+	return nil
+}
+
+func replayTaint(ctx *cli.Context) error {
+	if len(ctx.Args()) < 1 {
+		utils.Fatalf("This command requires a taint source.")
+	}
+	src, err := provenance.ParseTaintSource(ctx.Args().First())
+	if err != nil {
+		utils.Fatalf("Invalid taint source: %v", err)
+	}
+	first, last := replayRange(ctx)
+
+	stack := makeFullNode(ctx)
+	chain, chainDb := utils.MakeChain(ctx, stack)
+	defer chainDb.Close()
+
+	if head := chain.CurrentBlock().NumberU64(); last > head {
+		utils.Fatalf("Replay error: last block #%d beyond chain head #%d", last, head)
+	}
+	var tainted int
+	err = eth.ReplayRange(chain, first, last, ctx.Int(replayCommandWorkersFlag.Name), nil, func(number uint64, doc string) error {
+		block, err := schema.DecodeBlock([]byte(doc))
+		if err != nil {
+			return fmt.Errorf("block #%d: %v", number, err)
+		}
+		for _, taint := range provenance.BlockTaint(block, src) {
+			if !taint.Tainted() {
+				continue
+			}
+			out, _ := json.Marshal(taint)
+			fmt.Println(string(out))
+			tainted++
+		}
+		return nil
+	})
+	if err != nil {
+		utils.Fatalf("Replay error: %v", err)
+	}
+	glog.V(logger.Info).Infof("Found %d tainted transactions in %d blocks", tainted, last-first+1)
+	return nil
+}
+
 // hashish returns true for strings that look like hashes.
 func hashish(x string) bool {
 	_, err := strconv.Atoi(x)
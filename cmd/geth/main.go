@@ -69,6 +69,7 @@ func init() {
 		upgradedbCommand,
 		removedbCommand,
 		dumpCommand,
+		replayCommand,
 		// See monitorcmd.go:
 		monitorCommand,
 		// See accountcmd.go:
@@ -135,6 +136,12 @@ func init() {
 		utils.VMJitCacheFlag,
 		utils.VMEnableJitFlag,
 		utils.VMEnableDebugFlag,
+		utils.ReplayIndexFlag,
+		utils.ReplaySinkFlag,
+		utils.ReplayOutputDirFlag,
+		utils.ReplayRotateSizeFlag,
+		utils.ReplayRotateBlocksFlag,
+		utils.ReplayVerifyFlag,
 		utils.NetworkIdFlag,
 		utils.RPCCORSDomainFlag,
 		utils.EthStatsURLFlag,
@@ -158,6 +158,17 @@ var AppHelpFlagGroups = []flagGroup{
 			utils.VMEnableDebugFlag,
 		},
 	},
+	{
+		Name: "REPLAY",
+		Flags: []cli.Flag{
+			utils.ReplayIndexFlag,
+			utils.ReplaySinkFlag,
+			utils.ReplayOutputDirFlag,
+			utils.ReplayRotateSizeFlag,
+			utils.ReplayRotateBlocksFlag,
+			utils.ReplayVerifyFlag,
+		},
+	},
 	{
 		Name: "LOGGING AND DEBUGGING",
 		Flags: append([]cli.Flag{
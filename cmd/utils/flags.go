@@ -232,6 +232,31 @@ var (
 		Name:  "vmdebug",
 		Usage: "Record information useful for VM and contract debugging",
 	}
+	ReplayIndexFlag = cli.BoolFlag{
+		Name:  "replayindex",
+		Usage: "Index the storage writes and transfers of replayed blocks for provenance and transfer queries",
+	}
+	ReplayVerifyFlag = cli.BoolFlag{
+		Name:  "replayverify",
+		Usage: "Verify replays served over RPC against the stored receipts and state roots",
+	}
+	ReplaySinkFlag = cli.StringFlag{
+		Name:  "replaysink",
+		Usage: "Replay blocks while importing them, writing the documents to a directory, file:<path> (one per line), gzip:<dir> (compressed, rotated), ldb:<dir> (database by block number) or unix:<path> (socket stream)",
+	}
+	ReplayOutputDirFlag = DirectoryFlag{
+		Name:  "replayoutdir",
+		Usage: "Directory the replay outputs requested over RPC are confined to (disabled if empty)",
+	}
+	ReplayRotateSizeFlag = cli.Uint64Flag{
+		Name:  "replayrotatesize",
+		Usage: "Compressed bytes after which gzip replay sinks start a new file (0 = never)",
+		Value: 256 * 1024 * 1024,
+	}
+	ReplayRotateBlocksFlag = cli.Uint64Flag{
+		Name:  "replayrotateblocks",
+		Usage: "Blocks after which gzip replay sinks start a new file (0 = never)",
+	}
 	// Logging and debug settings
 	EthStatsURLFlag = cli.StringFlag{
 		Name:  "ethstats",
@@ -752,6 +777,12 @@ func RegisterEthService(ctx *cli.Context, stack *node.Node, extra []byte) {
 		SolcPath:                ctx.GlobalString(SolcPathFlag.Name),
 		AutoDAG:                 ctx.GlobalBool(AutoDAGFlag.Name) || ctx.GlobalBool(MiningEnabledFlag.Name),
 		EnablePreimageRecording: ctx.GlobalBool(VMEnableDebugFlag.Name),
+		ReplayIndex:             ctx.GlobalBool(ReplayIndexFlag.Name),
+		ReplaySink:              ctx.GlobalString(ReplaySinkFlag.Name),
+		ReplayVerify:            ctx.GlobalBool(ReplayVerifyFlag.Name),
+		ReplayOutputDir:         ctx.GlobalString(ReplayOutputDirFlag.Name),
+		ReplayRotateSize:        ctx.GlobalUint64(ReplayRotateSizeFlag.Name),
+		ReplayRotateBlocks:      ctx.GlobalUint64(ReplayRotateBlocksFlag.Name),
 	}
 
 	// Override any default configs in dev mode or the test net
@@ -905,6 +936,19 @@ func MakeChainDatabase(ctx *cli.Context, stack *node.Node) ethdb.Database {
 	return chainDb
 }
 
+// MakeReplayIndex opens the storage write and transfer index of replayed blocks.
+func MakeReplayIndex(ctx *cli.Context, stack *node.Node) *eth.ReplayIndex {
+	db, err := stack.OpenDatabase(eth.ReplayIndexDbName, ctx.GlobalInt(CacheFlag.Name), MakeDatabaseHandles())
+	if err != nil {
+		Fatalf("Could not open replay index: %v", err)
+	}
+	index, err := eth.NewReplayIndex(db)
+	if err != nil {
+		Fatalf("Could not open replay index: %v", err)
+	}
+	return index
+}
+
 // MakeChain creates a chain manager from set command line flags.
 func MakeChain(ctx *cli.Context, stack *node.Node) (chain *core.BlockChain, chainDb ethdb.Database) {
 	var err error
@@ -24,12 +24,14 @@ import (
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/replay"
 )
 
 func BenchmarkInsertChain_empty_memdb(b *testing.B) {
@@ -68,6 +70,22 @@ func BenchmarkInsertChain_ring1000_memdb(b *testing.B) {
 func BenchmarkInsertChain_ring1000_diskdb(b *testing.B) {
 	benchInsertChain(b, true, genTxRing(1000))
 }
+func BenchmarkInsertChain_contractTx_memdb(b *testing.B) {
+	benchInsertContractChain(b, false, genContractTx(10))
+}
+func BenchmarkInsertChain_contractTx_diskdb(b *testing.B) {
+	benchInsertContractChain(b, true, genContractTx(10))
+}
+
+// The untraced benchmarks run the EVM the way block import does, while the
+// traced ones install a tracer discarding every hook, measuring the cost of the
+// hooks themselves.
+func BenchmarkEVMCall_untraced(b *testing.B) {
+	benchEVMCall(b, nil)
+}
+func BenchmarkEVMCall_nopTracer(b *testing.B) {
+	benchEVMCall(b, new(replay.DefaultTracer))
+}
 
 var (
 	// This is the content of the genesis block used by the benchmarks.
@@ -89,6 +107,33 @@ func genValueTx(nbytes int) func(int, *BlockGen) {
 	}
 }
 
+// benchContractConfig are the rules the contract benchmarks run under.
+var benchContractConfig = &params.ChainConfig{HomesteadBlock: new(big.Int)}
+
+// benchLoopCode is the runtime code of a contract looping 200 times over an
+// increment, a comparison and a memory store, exercising the interpreter loop.
+var benchLoopCode = common.FromHex("6000" + "5b" + "80600052" + "600101" + "8060c811" + "600257" + "00")
+
+// genContractTx returns a block generator that deploys the looping contract
+// in the first block and calls it n times in every following block.
+func genContractTx(n int) func(int, *BlockGen) {
+	return func(i int, gen *BlockGen) {
+		signer := types.HomesteadSigner{}
+		if i == 0 {
+			// CODECOPY the runtime code into memory and RETURN it
+			code := append(common.FromHex("6012600c60003960126000f3"), benchLoopCode...)
+			tx, _ := types.SignTx(types.NewContractCreation(gen.TxNonce(benchRootAddr), new(big.Int), big.NewInt(100000), nil, code), signer, benchRootKey)
+			gen.AddTx(tx)
+			return
+		}
+		contract := crypto.CreateAddress(benchRootAddr, 0)
+		for j := 0; j < n; j++ {
+			tx, _ := types.SignTx(types.NewTransaction(gen.TxNonce(benchRootAddr), contract, new(big.Int), big.NewInt(100000), nil, nil), signer, benchRootKey)
+			gen.AddTx(tx)
+		}
+	}
+}
+
 var (
 	ringKeys  = make([]*ecdsa.PrivateKey, 1000)
 	ringAddrs = make([]common.Address, len(ringKeys))
@@ -178,6 +223,38 @@ func benchInsertChain(b *testing.B, disk bool, gen func(int, *BlockGen)) {
 	}
 }
 
+// benchInsertContractChain is benchInsertChain for chains deploying contracts,
+// which are generated and inserted under the same benchContractConfig rules so
+// that the contract creations yield the same state.
+func benchInsertContractChain(b *testing.B, disk bool, gen func(int, *BlockGen)) {
+	var db ethdb.Database
+	if !disk {
+		db, _ = ethdb.NewMemDatabase()
+	} else {
+		dir, err := ioutil.TempDir("", "eth-core-bench")
+		if err != nil {
+			b.Fatalf("cannot create temporary directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		db, err = ethdb.NewLDBDatabase(dir, 128, 128)
+		if err != nil {
+			b.Fatalf("cannot create temporary database: %v", err)
+		}
+		defer db.Close()
+	}
+	genesis := WriteGenesisBlockForTesting(db, GenesisAccount{benchRootAddr, benchRootFunds})
+	chain, _ := GenerateChain(benchContractConfig, genesis, db, b.N, gen)
+
+	evmux := new(event.TypeMux)
+	chainman, _ := NewBlockChain(db, benchContractConfig, FakePow{}, evmux, vm.Config{})
+	defer chainman.Stop()
+	b.ReportAllocs()
+	b.ResetTimer()
+	if i, err := chainman.InsertChain(chain); err != nil {
+		b.Fatalf("insert error (block %d): %v\n", i, err)
+	}
+}
+
 func BenchmarkChainRead_header_10k(b *testing.B) {
 	benchReadChain(b, false, 10000)
 }
@@ -296,3 +373,33 @@ func benchReadChain(b *testing.B, full bool, count uint64) {
 		db.Close()
 	}
 }
+
+// benchEVMCall calls the looping contract b.N times, each in a fresh EVM hooked
+// into the given DeepInsight tracer, if any.
+func benchEVMCall(b *testing.B, tracer replay.Tracer) {
+	db, _ := ethdb.NewMemDatabase()
+	statedb, _ := state.New(common.Hash{}, db)
+
+	contract := common.BytesToAddress([]byte("loop"))
+	statedb.SetCode(contract, benchLoopCode)
+	sender := statedb.GetOrNewStateObject(benchRootAddr)
+
+	context := vm.Context{
+		CanTransfer: CanTransfer,
+		Transfer:    Transfer,
+		GetHash:     func(uint64) common.Hash { return common.Hash{} },
+		BlockNumber: big.NewInt(1),
+		Time:        big.NewInt(0),
+		Difficulty:  big.NewInt(0),
+		GasLimit:    params.GenesisGasLimit,
+		GasPrice:    new(big.Int),
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		evm := vm.NewReplayEVM(context, statedb, benchContractConfig, vm.Config{}, tracer)
+		if _, err := evm.Call(sender, contract, nil, big.NewInt(100000), new(big.Int)); err != nil {
+			b.Fatalf("call failed: %v", err)
+		}
+	}
+}
@@ -80,26 +80,26 @@ type EVM struct {
 	// NOTE: must be set atomically
 	abort int32
 
-	// Tracer is DeepInsight's data stream tracker
+	// Tracer is DeepInsight's data stream tracker. It is nil when the execution
+	// is not traced, in which case the interpreter skips every tracing hook.
 	Tracer replay.Tracer
 }
 
-// NewEVM retutrns a new EVM evmironment.
+// NewEVM retutrns a new EVM evmironment, without any DeepInsight tracer.
 func NewEVM(ctx Context, statedb StateDB, chainConfig *params.ChainConfig, vmConfig Config) *EVM {
-	a := replay.DefaultTracer{}
 	evm := &EVM{
 		Context:     ctx,
 		StateDB:     statedb,
 		vmConfig:    vmConfig,
 		chainConfig: chainConfig,
-		Tracer:      &a,
 	}
 
 	evm.interpreter = NewInterpreter(evm, vmConfig)
 	return evm
 }
 
-// NewReplayEVM retutrns a new EVM evmironment.
+// NewReplayEVM retutrns a new EVM evmironment feeding the given DeepInsight
+// tracer. A nil tracer disables tracing, like NewEVM.
 func NewReplayEVM(ctx Context, statedb StateDB, chainConfig *params.ChainConfig, vmConfig Config, tracer replay.Tracer) *EVM {
 	evm := &EVM{
 		Context:     ctx,
@@ -157,31 +157,39 @@ func (evm *EVM) Call(caller ContractRef, addr common.Address, input []byte, gas,
 		to = evm.StateDB.GetAccount(addr)
 	}
 	evm.Transfer(evm.StateDB, caller.Address(), to.Address(), value)
-	evm.Tracer.AddTransfer(caller.Address().Hex(), to.Address().Hex(), value, "CallTransfer")
-	evm.Tracer.SetTransferSeq()
+	if evm.Tracer != nil {
+		evm.Tracer.AddTransfer(caller.Address().Hex(), to.Address().Hex(), value, "CallTransfer")
+		evm.Tracer.SetTransferSeq()
+	}
 
 	// initialise a new contract and set the code that is to be used by the
 	// E The contract is a scoped evmironment for this execution context
 	// only.
 	contract := NewContract(caller, to, value, gas)
 	contract.SetCallCode(&addr, evm.StateDB.GetCodeHash(addr), evm.StateDB.GetCode(addr))
-	evm.Tracer.AddCode(addr, evm.StateDB.GetCode(addr))
 	defer contract.Finalise()
 
-	evm.Tracer.EnterEnv(contract.Address())
+	if evm.Tracer != nil {
+		evm.Tracer.AddCode(addr, contract.Code)
+		evm.Tracer.EnterEnv(contract.Address())
+	}
 	ret, err = evm.interpreter.Run(contract, input)
 	// When an error was returned by the EVM or when setting the creation code
 	// above we revert to the snapshot and consume any gas remaining. Additionally
 	// when we're in homestead this also counts for code storage gas errors.
 	if err != nil {
 		contract.UseGas(contract.Gas)
-		if evm.Tracer.GetDepth() == 0 {
+		if evm.Tracer != nil && evm.Tracer.GetDepth() == 0 {
 			evm.Tracer.FailTx(err)
 		}
 		evm.StateDB.RevertToSnapshot(snapshot)
-		evm.Tracer.RevertStore()
+		if evm.Tracer != nil {
+			evm.Tracer.RevertStore()
+		}
+	}
+	if evm.Tracer != nil {
+		evm.Tracer.ExitEnv()
 	}
-	evm.Tracer.ExitEnv()
 	return ret, err
 }
 
@@ -215,26 +223,34 @@ func (evm *EVM) CallCode(caller ContractRef, addr common.Address, input []byte,
 		to       = evm.StateDB.GetAccount(caller.Address())
 	)
 
-	evm.Tracer.SetInputAccount(addr, evm.StateDB.GetCodeHash(addr), evm.StateDB.GetBalance(addr), evm.StateDB.GetNonce(addr))
+	if evm.Tracer != nil {
+		evm.Tracer.SetInputAccount(addr, evm.StateDB.GetCodeHash(addr), evm.StateDB.GetBalance(addr), evm.StateDB.GetNonce(addr))
+	}
 
 	// initialise a new contract and set the code that is to be used by the
 	// E The contract is a scoped evmironment for this execution context
 	// only.
 	contract := NewContract(caller, to, value, gas)
 	contract.SetCallCode(&addr, evm.StateDB.GetCodeHash(addr), evm.StateDB.GetCode(addr))
-	evm.Tracer.AddCode(addr, evm.StateDB.GetCode(addr))
 	defer contract.Finalise()
 
-	evm.Tracer.EnterEnv(contract.Address())
+	if evm.Tracer != nil {
+		evm.Tracer.AddCode(addr, contract.Code)
+		evm.Tracer.EnterEnv(contract.Address())
+	}
 	ret, err = evm.interpreter.Run(contract, input)
 	if err != nil {
 		contract.UseGas(contract.Gas)
 
 		evm.StateDB.RevertToSnapshot(snapshot)
-		evm.Tracer.RevertStore()
+		if evm.Tracer != nil {
+			evm.Tracer.RevertStore()
+		}
 	}
 
-	evm.Tracer.ExitEnv()
+	if evm.Tracer != nil {
+		evm.Tracer.ExitEnv()
+	}
 	return ret, err
 }
 
@@ -262,24 +278,32 @@ func (evm *EVM) DelegateCall(caller ContractRef, addr common.Address, input []by
 		to       = evm.StateDB.GetAccount(caller.Address())
 	)
 
-	evm.Tracer.SetInputAccount(addr, evm.StateDB.GetCodeHash(addr), evm.StateDB.GetBalance(addr), evm.StateDB.GetNonce(addr))
+	if evm.Tracer != nil {
+		evm.Tracer.SetInputAccount(addr, evm.StateDB.GetCodeHash(addr), evm.StateDB.GetBalance(addr), evm.StateDB.GetNonce(addr))
+	}
 
 	// Iinitialise a new contract and make initialise the delegate values
 	contract := NewContract(caller, to, caller.Value(), gas).AsDelegate()
 	contract.SetCallCode(&addr, evm.StateDB.GetCodeHash(addr), evm.StateDB.GetCode(addr))
-	evm.Tracer.AddCode(addr, evm.StateDB.GetCode(addr))
 	defer contract.Finalise()
 
-	evm.Tracer.EnterEnv(contract.Address())
+	if evm.Tracer != nil {
+		evm.Tracer.AddCode(addr, contract.Code)
+		evm.Tracer.EnterEnv(contract.Address())
+	}
 	ret, err = evm.interpreter.Run(contract, input)
 	if err != nil {
 		contract.UseGas(contract.Gas)
 
 		evm.StateDB.RevertToSnapshot(snapshot)
-		evm.Tracer.RevertStore()
+		if evm.Tracer != nil {
+			evm.Tracer.RevertStore()
+		}
 	}
 
-	evm.Tracer.ExitEnv()
+	if evm.Tracer != nil {
+		evm.Tracer.ExitEnv()
+	}
 	return ret, err
 }
 
@@ -310,16 +334,20 @@ func (evm *EVM) Create(caller ContractRef, code []byte, gas, value *big.Int) (re
 
 	snapshot := evm.StateDB.Snapshot()
 	contractAddr = crypto.CreateAddress(caller.Address(), nonce)
-	evm.Tracer.SetInputAccount(contractAddr, evm.StateDB.GetCodeHash(contractAddr),
-		evm.StateDB.GetBalance(contractAddr), evm.StateDB.GetNonce(contractAddr))
+	if evm.Tracer != nil {
+		evm.Tracer.SetInputAccount(contractAddr, evm.StateDB.GetCodeHash(contractAddr),
+			evm.StateDB.GetBalance(contractAddr), evm.StateDB.GetNonce(contractAddr))
+	}
 
 	to := evm.StateDB.CreateAccount(contractAddr)
 	if evm.ChainConfig().IsEIP158(evm.BlockNumber) {
 		evm.StateDB.SetNonce(contractAddr, 1)
 	}
 	evm.Transfer(evm.StateDB, caller.Address(), to.Address(), value)
-	evm.Tracer.AddTransfer(caller.Address().Hex(), to.Address().Hex(), value, "CallTransfer")
-	evm.Tracer.SetTransferSeq()
+	if evm.Tracer != nil {
+		evm.Tracer.AddTransfer(caller.Address().Hex(), to.Address().Hex(), value, "CallTransfer")
+		evm.Tracer.SetTransferSeq()
+	}
 
 	// initialise a new contract and set the code that is to be used by the
 	// E The contract is a scoped evmironment for this execution context
@@ -328,10 +356,11 @@ func (evm *EVM) Create(caller ContractRef, code []byte, gas, value *big.Int) (re
 	contract.SetCallCode(&contractAddr, crypto.Keccak256Hash(code), code)
 	defer contract.Finalise()
 
-	evm.Tracer.EnterEnv(contract.Address())
-
-	idx := evm.Tracer.GetSeq()
-
+	var idx int
+	if evm.Tracer != nil {
+		evm.Tracer.EnterEnv(contract.Address())
+		idx = evm.Tracer.GetSeq()
+	}
 	ret, err = evm.interpreter.Run(contract, nil)
 
 	// check whether the max code size has been exceeded
@@ -345,7 +374,9 @@ func (evm *EVM) Create(caller ContractRef, code []byte, gas, value *big.Int) (re
 		dataGas.Mul(dataGas, params.CreateDataGas)
 		if contract.UseGas(dataGas) {
 			evm.StateDB.SetCode(contractAddr, ret)
-			evm.Tracer.AddCode(contractAddr, ret)
+			if evm.Tracer != nil {
+				evm.Tracer.AddCode(contractAddr, ret)
+			}
 		} else {
 			err = ErrCodeStoreOutOfGas
 		}
@@ -358,24 +389,25 @@ func (evm *EVM) Create(caller ContractRef, code []byte, gas, value *big.Int) (re
 		(err != nil && (evm.ChainConfig().IsHomestead(evm.BlockNumber) || err != ErrCodeStoreOutOfGas)) {
 		contract.UseGas(contract.Gas)
 
-		// In this situation, even if init code finished with no error, but we still mark them as failed.
-		if maxCodeSizeExceeded {
-			// Also set the opCreate to be unfinished...
-			evm.Tracer.FailCreate(idx, fmt.Errorf("MaxCodeSizeExceeded"))
-		} else {
-			evm.Tracer.FailCreate(idx+1, err)
-		}
-
 		evm.StateDB.RevertToSnapshot(snapshot)
-		evm.Tracer.RevertStore()
-		if evm.Tracer.GetDepth() == 0 {
+		if evm.Tracer != nil {
+			// In this situation, even if init code finished with no error, but we still mark them as failed.
 			if maxCodeSizeExceeded {
-				evm.Tracer.FailTx(fmt.Errorf("MaxCodeSizeExceeded"))
+				// Also set the opCreate to be unfinished...
+				evm.Tracer.FailCreate(idx, fmt.Errorf("MaxCodeSizeExceeded"))
 			} else {
-				evm.Tracer.FailTx(err)
+				evm.Tracer.FailCreate(idx+1, err)
+			}
+			evm.Tracer.RevertStore()
+			if evm.Tracer.GetDepth() == 0 {
+				if maxCodeSizeExceeded {
+					evm.Tracer.FailTx(fmt.Errorf("MaxCodeSizeExceeded"))
+				} else {
+					evm.Tracer.FailTx(err)
+				}
 			}
+			evm.Tracer.ExitEnv()
 		}
-		evm.Tracer.ExitEnv()
 		// Nothing should be returned when an error is thrown.
 		return nil, contractAddr, err
 	}
@@ -385,7 +417,9 @@ func (evm *EVM) Create(caller ContractRef, code []byte, gas, value *big.Int) (re
 	if err != nil {
 		ret = nil
 	}
-	evm.Tracer.ExitEnv()
+	if evm.Tracer != nil {
+		evm.Tracer.ExitEnv()
+	}
 	return ret, contractAddr, err
 }
 
@@ -27,6 +27,7 @@ import (
 	"github.com/ethereum/go-ethereum/logger"
 	"github.com/ethereum/go-ethereum/logger/glog"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/replay"
 )
 
 // Config are the configuration options for the Interpreter
@@ -91,7 +92,9 @@ func (evm *Interpreter) Run(contract *Contract, input []byte) (ret []byte, err e
 			if err != nil {
 				nerr = 1
 			}
-			evm.env.Tracer.SetPrecompiled(*contract.CodeAddr, int(p.RequiredGas(len(input)).Int64()), nerr, input, ret)
+			if evm.env.Tracer != nil {
+				evm.env.Tracer.SetPrecompiled(*contract.CodeAddr, int(p.RequiredGas(len(input)).Int64()), nerr, input, ret)
+			}
 			return ret, err
 		}
 	}
@@ -114,6 +117,9 @@ func (evm *Interpreter) Run(contract *Contract, input []byte) (ret []byte, err e
 		// It's theoretically possible to go above 2^64. The YP defines the PC to be uint256. Practically much less so feasible.
 		pc   = uint64(0) // program counter
 		cost *big.Int
+		// The DeepInsight tracer, hoisted out of the loop so that untraced
+		// executions pay a single nil check per instruction
+		tracer = evm.env.Tracer
 	)
 	contract.Input = input
 
@@ -145,16 +151,20 @@ func (evm *Interpreter) Run(contract *Contract, input []byte) (ret []byte, err e
 
 		// if the op is invalid abort the process and return an error
 		if !operation.valid {
-			idx := evm.env.Tracer.InitTrace(op.String(), 0, 0, evm.env.depth)
-			evm.env.Tracer.Fail(idx, fmt.Errorf("Invalid opcode %x", op), true)
+			if tracer != nil {
+				idx := tracer.InitTrace(op.String(), 0, 0, evm.env.depth)
+				tracer.Fail(idx, fmt.Errorf("Invalid opcode %x", op), true)
+			}
 			return nil, fmt.Errorf("invalid opcode %x", op)
 		}
 
 		// validate the stack and make sure there enough stack items available
 		// to perform the operation
 		if err := operation.validateStack(stack); err != nil {
-			idx := evm.env.Tracer.InitTrace(op.String(), 0, 0, evm.env.depth)
-			evm.env.Tracer.Fail(idx, fmt.Errorf("stack underflow"), true)
+			if tracer != nil {
+				idx := tracer.InitTrace(op.String(), 0, 0, evm.env.depth)
+				tracer.Fail(idx, fmt.Errorf("stack underflow"), true)
+			}
 			return nil, err
 		}
 
@@ -173,72 +183,40 @@ func (evm *Interpreter) Run(contract *Contract, input []byte) (ret []byte, err e
 			// cost is explicitly set so that the capture state defer method cas get the proper cost
 			cost = operation.gasCost(evm.gasTable, evm.env, contract, stack, mem, memorySize)
 			if !contract.UseGas(cost) {
-				idx := evm.env.Tracer.InitTrace(op.String(), 0, 0, evm.env.depth)
-				evm.env.Tracer.Fail(idx, ErrOutOfGas, true)
+				if tracer != nil {
+					idx := tracer.InitTrace(op.String(), 0, 0, evm.env.depth)
+					tracer.Fail(idx, ErrOutOfGas, true)
+				}
 
 				return nil, ErrOutOfGas
 			}
 		}
 
-		idx := evm.env.Tracer.InitTrace(op.String(), int(pc), int(cost.Int64()), evm.env.depth)
-
-		if memorySize != nil {
-			if mem.Len() < int(memorySize.Int64()) {
-				evm.env.Tracer.AddMemSize(idx, mem.Len(), int(memorySize.Int64()))
+		var idx int
+		if tracer != nil {
+			idx = tracer.InitTrace(op.String(), int(pc), int(cost.Int64()), evm.env.depth)
+			if memorySize != nil && mem.Len() < int(memorySize.Int64()) {
+				tracer.AddMemSize(idx, mem.Len(), int(memorySize.Int64()))
 			}
+		}
+		if memorySize != nil {
 			mem.Resize(memorySize.Uint64())
-			evm.env.Tracer.ResizeMemory(int(memorySize.Int64()))
+			if tracer != nil {
+				tracer.ResizeMemory(int(memorySize.Int64()))
+			}
 		}
 
 		if evm.cfg.Debug {
 			evm.cfg.Tracer.CaptureState(evm.env, pc, op, contract.Gas, cost, mem, stack, contract, evm.env.depth, err)
 		}
 
-		switch op.String() {
-		case "ISZERO", "NOT", "BALANCE", "CALLDATALOAD", "EXTCODESIZE", "BLOCKHASH", "POP", "MLOAD", "SLOAD":
-			fallthrough
-		case "JUMP", "SUICIDE":
-			evm.env.Tracer.SetStackInput(idx, 1)
-		case "ADD", "SUB", "MUL", "DIV", "SDIV", "MOD", "SMOD", "EXP", "SIGNEXTEND":
-			fallthrough
-		case "LT", "GT", "SLT", "SGT", "EQ", "AND", "OR", "XOR", "BYTE":
-			fallthrough
-		case "SHA3":
-			fallthrough
-		case "JUMPI", "RETURN":
-			fallthrough
-		case "MSTORE", "MSTORE8", "SSTORE":
-			evm.env.Tracer.SetStackInput(idx, 2)
-		case "ADDMOD", "MULMOD", "CALLDATACOPY", "CODECOPY", "CREATE":
-			evm.env.Tracer.SetStackInput(idx, 3)
-		case "EXTCODECOPY":
-			evm.env.Tracer.SetStackInput(idx, 4)
-		case "DELEGATECALL":
-			evm.env.Tracer.SetStackInput(idx, 6)
-		case "CALL", "CALLCODE":
-			evm.env.Tracer.SetStackInput(idx, 7)
-		default:
+		if tracer != nil {
+			traceStackInput(tracer, idx, op)
 		}
 		// execute the operation
 		res, err := operation.execute(&pc, evm.env, contract, mem, stack)
-		switch op.String() {
-		case "ADD", "SUB", "MUL", "DIV", "SDIV", "MOD", "SMOD", "ADDMOD", "MULMOD", "EXP", "SIGNEXTEND":
-			fallthrough
-		case "LT", "GT", "SLT", "SGT", "EQ", "ISZERO", "AND", "OR", "XOR", "NOT", "BYTE":
-			fallthrough
-		case "SHA3":
-			fallthrough
-		case "ADDRESS", "BALANCE", "ORIGIN", "CALLER", "CALLVALUE", "CALLDATALOAD", "CALLDATASIZE", "CODESIZE", "GASPRICE", "EXTCODESIZE":
-			fallthrough
-		case "BLOCKHASH", "COINBASE", "TIMESTAMP", "NUMBER", "DIFFICULTY", "GASLIMIT":
-			fallthrough
-		case "MLOAD", "SLOAD", "MSIZE", "GAS":
-			fallthrough
-		case "CREATE", "CALL", "CALLCODE", "DELEGATECALL":
-			fallthrough
-		case "PC":
-			evm.env.Tracer.SetStackOutput(idx, stack.peek())
-		default:
+		if tracer != nil {
+			traceStackOutput(tracer, idx, op, stack)
 		}
 		switch {
 		case err != nil:
@@ -251,3 +229,55 @@ func (evm *Interpreter) Run(contract *Contract, input []byte) (ret []byte, err e
 	}
 	return nil, nil
 }
+
+// traceStackInput records the stack items consumed by the instruction idx.
+func traceStackInput(tracer replay.Tracer, idx int, op OpCode) {
+	switch op.String() {
+	case "ISZERO", "NOT", "BALANCE", "CALLDATALOAD", "EXTCODESIZE", "BLOCKHASH", "POP", "MLOAD", "SLOAD":
+		fallthrough
+	case "JUMP", "SELFDESTRUCT":
+		tracer.SetStackInput(idx, 1)
+	case "ADD", "SUB", "MUL", "DIV", "SDIV", "MOD", "SMOD", "EXP", "SIGNEXTEND":
+		fallthrough
+	case "LT", "GT", "SLT", "SGT", "EQ", "AND", "OR", "XOR", "BYTE":
+		fallthrough
+	case "SHA3":
+		fallthrough
+	case "JUMPI", "RETURN":
+		fallthrough
+	case "MSTORE", "MSTORE8", "SSTORE":
+		tracer.SetStackInput(idx, 2)
+	case "ADDMOD", "MULMOD", "CALLDATACOPY", "CODECOPY", "CREATE":
+		tracer.SetStackInput(idx, 3)
+	case "EXTCODECOPY":
+		tracer.SetStackInput(idx, 4)
+	case "DELEGATECALL":
+		tracer.SetStackInput(idx, 6)
+	case "CALL", "CALLCODE":
+		tracer.SetStackInput(idx, 7)
+	default:
+	}
+}
+
+// traceStackOutput records the stack item produced by the instruction idx.
+func traceStackOutput(tracer replay.Tracer, idx int, op OpCode, stack *Stack) {
+	switch op.String() {
+	case "ADD", "SUB", "MUL", "DIV", "SDIV", "MOD", "SMOD", "ADDMOD", "MULMOD", "EXP", "SIGNEXTEND":
+		fallthrough
+	case "LT", "GT", "SLT", "SGT", "EQ", "ISZERO", "AND", "OR", "XOR", "NOT", "BYTE":
+		fallthrough
+	case "SHA3":
+		fallthrough
+	case "ADDRESS", "BALANCE", "ORIGIN", "CALLER", "CALLVALUE", "CALLDATALOAD", "CALLDATASIZE", "CODESIZE", "GASPRICE", "EXTCODESIZE":
+		fallthrough
+	case "BLOCKHASH", "COINBASE", "TIMESTAMP", "NUMBER", "DIFFICULTY", "GASLIMIT":
+		fallthrough
+	case "MLOAD", "SLOAD", "MSIZE", "GAS":
+		fallthrough
+	case "CREATE", "CALL", "CALLCODE", "DELEGATECALL":
+		fallthrough
+	case "PC":
+		tracer.SetStackOutput(idx, stack.peek())
+	default:
+	}
+}
@@ -41,6 +41,7 @@ import (
 	"github.com/ethereum/go-ethereum/logger/glog"
 	"github.com/ethereum/go-ethereum/miner"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/replay"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/rpc"
 	"golang.org/x/net/context"
@@ -566,3 +567,30 @@ func (api *PrivateDebugAPI) Preimage(ctx context.Context, hash common.Hash) (hex
 	db := core.PreimageTable(api.eth.ChainDb())
 	return db.Get(hash.Bytes())
 }
+
+// ReplayBlockWithRules replays the canonical block with the given number under
+// the chain rules changed as given, e.g. {"eip150": "off"}, and returns how its
+// transactions fared compared to the canonical replay: the gas used, failures,
+// transfers and storage writes that changed, and the transactions the changed
+// rules reject. See ReplayRules for the forks.
+func (api *PrivateDebugAPI) ReplayBlockWithRules(number uint64, rules ReplayRules) (*ReplayWhatIf, error) {
+	return ReplayBlockWithRules(api.eth.BlockChain(), number, rules)
+}
+
+// ReplayStats replays the canonical blocks between first and last (inclusive)
+// without writing their documents, and returns statistics of the instructions
+// they executed: opcode frequencies and gas, gas by contract, instructions by
+// call depth, precompile usage and failure reasons. At most 10000 blocks are
+// replayed per call, larger ranges are to be split up and their stats added.
+func (api *PrivateDebugAPI) ReplayStats(first, last uint64) (*replay.ReplayStats, error) {
+	if last < first {
+		return nil, fmt.Errorf("last block #%d before first block #%d", last, first)
+	}
+	if last-first >= maxReplayStatsBlocks {
+		return nil, fmt.Errorf("range of %d blocks exceeds the limit of %d per call", last-first+1, maxReplayStatsBlocks)
+	}
+	if head := api.eth.BlockChain().CurrentBlock().NumberU64(); last > head {
+		return nil, fmt.Errorf("last block #%d beyond chain head #%d", last, head)
+	}
+	return ReplayRangeStats(api.eth.BlockChain(), first, last, runtime.NumCPU(), nil)
+}
@@ -17,6 +17,8 @@
 package eth
 
 import (
+	"bytes"
+	"io"
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/accounts"
@@ -30,7 +32,10 @@ import (
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/internal/ethapi"
+	"github.com/ethereum/go-ethereum/logger"
+	"github.com/ethereum/go-ethereum/logger/glog"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/replay"
 	"github.com/ethereum/go-ethereum/rpc"
 	"golang.org/x/net/context"
 )
@@ -79,15 +84,79 @@ func (b *EthApiBackend) BlockByNumber(ctx context.Context, blockNr rpc.BlockNumb
 	return b.eth.blockchain.GetBlockByNumber(uint64(blockNr)), nil
 }
 
-func (b *EthApiBackend) ReplayBlockByNumber(ctx context.Context, blockNr rpc.BlockNumber) string {
-	blk := b.eth.blockchain.GetBlockByNumber(uint64(blockNr))
-	prvBlk := b.eth.blockchain.GetBlockByNumber(uint64(blockNr) - 1)
-	config := b.eth.blockchain.Config()
-	bc := b.eth.blockchain
-	db, _ := bc.StateAt(prvBlk.Root())
-	return replayBlock(blk, db, config, bc)
-	//return b.eth.blockchain.GetBlockByNumber(uint64(blockNr)), nil
+func (b *EthApiBackend) ReplayBlockByNumber(ctx context.Context, blockNr rpc.BlockNumber, config *replay.ReplayConfig) (string, error) {
+	var buf bytes.Buffer
+	if err := b.writeReplayBlock(&buf, b.replayNumber(blockNr), config); err != nil {
+		return "", err
+	}
+	b.indexReplay(buf.Bytes(), config)
+	return buf.String(), nil
+}
+
+func (b *EthApiBackend) SaveReplayBlock(ctx context.Context, blockNr rpc.BlockNumber, name string, config *replay.ReplayConfig) error {
+	path, err := b.eth.replaySinks.sandboxPath(name)
+	if err != nil {
+		return err
+	}
+	return writeReplayFile(path, func(w io.Writer) error {
+		if b.eth.replayIndex == nil || (config != nil && config.Limited()) {
+			return b.writeReplayBlock(w, b.replayNumber(blockNr), config)
+		}
+		var buf bytes.Buffer
+		if err := b.writeReplayBlock(io.MultiWriter(w, &buf), b.replayNumber(blockNr), config); err != nil {
+			return err
+		}
+		b.indexReplay(buf.Bytes(), config)
+		return nil
+	})
+}
+
+// writeReplayBlock replays a block, verifying it against the chain if enabled.
+// Diverging replays are reported as errors.
+func (b *EthApiBackend) writeReplayBlock(w io.Writer, number uint64, config *replay.ReplayConfig) error {
+	if b.eth.replayVerify {
+		return VerifyReplayBlock(w, b.eth.blockchain, b.eth.chainDb, number, config)
+	}
+	return WriteReplayBlock(w, b.eth.blockchain, number, config)
+}
+
+// indexReplay feeds a replayed block document into the replay index, if enabled.
+// Documents limited by a replay config miss storage accesses, so are skipped.
+// Indexing failures are logged, the replay itself succeeded.
+func (b *EthApiBackend) indexReplay(doc []byte, config *replay.ReplayConfig) {
+	if b.eth.replayIndex == nil || (config != nil && config.Limited()) {
+		return
+	}
+	if err := b.eth.replayIndex.IndexDocument(doc); err != nil {
+		glog.V(logger.Warn).Infof("Failed to index replayed block: %v", err)
+	}
+}
+
+// replayNumber resolves the number of the block to replay, replaying the chain
+// head in place of the pending block.
+func (b *EthApiBackend) replayNumber(blockNr rpc.BlockNumber) uint64 {
+	if blockNr == rpc.LatestBlockNumber || blockNr == rpc.PendingBlockNumber {
+		return b.eth.blockchain.CurrentBlock().NumberU64()
+	}
+	return uint64(blockNr)
+}
 
+func (b *EthApiBackend) ReplayTransaction(ctx context.Context, txHash common.Hash, config *replay.ReplayConfig) (string, error) {
+	var buf bytes.Buffer
+	if err := WriteReplayTransaction(&buf, b.eth.blockchain, b.eth.chainDb, txHash, config); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (b *EthApiBackend) ReplayCall(ctx context.Context, msg core.Message, state ethapi.State, header *types.Header, config *replay.ReplayConfig) (string, error) {
+	statedb := state.(EthApiState).state
+
+	var buf bytes.Buffer
+	if err := WriteReplayCall(&buf, b.eth.blockchain, statedb, header, msg, config); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
 }
 
 func (b *EthApiBackend) StateAndHeaderByNumber(ctx context.Context, blockNr rpc.BlockNumber) (ethapi.State, *types.Header, error) {
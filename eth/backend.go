@@ -98,6 +98,12 @@ type Config struct {
 	GpobaseCorrectionFactor int
 
 	EnablePreimageRecording bool
+	ReplayIndex             bool   // Index the storage writes and transfers of replayed blocks
+	ReplaySink              string // Replay imported blocks into this sink (see NewReplaySink)
+	ReplayVerify            bool   // Verify replays served over RPC against the chain
+	ReplayOutputDir         string // Directory replay outputs requested over RPC are confined to
+	ReplayRotateSize        uint64 // Compressed bytes after which gzip replay sinks rotate
+	ReplayRotateBlocks      uint64 // Blocks after which gzip replay sinks rotate
 
 	TestGenesisBlock *types.Block   // Genesis block to seed the chain database with (testing only!)
 	TestGenesisState ethdb.Database // Genesis state to seed the database with (testing only!)
@@ -122,7 +128,13 @@ type Ethereum struct {
 	protocolManager *ProtocolManager
 	lesServer       LesServer
 	// DB interfaces
-	chainDb ethdb.Database // Block chain database
+	chainDb     ethdb.Database // Block chain database
+	replayIndex *ReplayIndex   // Storage write index of replayed blocks, nil if disabled
+
+	replayProcessor *ReplayProcessor  // Live replay of imported blocks, nil if disabled
+	replayJobs      *replayJobs       // Checkpointed replay jobs started over RPC
+	replayVerify    bool              // Whether replays served over RPC are verified
+	replaySinks     *ReplaySinkConfig // Output directory and rotation of replay sinks
 
 	eventMux       *event.TypeMux
 	pow            pow.PoW
@@ -175,7 +187,14 @@ func New(ctx *node.ServiceContext, config *Config) (*Ethereum, error) {
 		MinerThreads:   config.MinerThreads,
 		AutoDAG:        config.AutoDAG,
 		solcPath:       config.SolcPath,
+		replayVerify:   config.ReplayVerify,
+		replaySinks: &ReplaySinkConfig{
+			Dir:          config.ReplayOutputDir,
+			RotateSize:   config.ReplayRotateSize,
+			RotateBlocks: config.ReplayRotateBlocks,
+		},
 	}
+	eth.replayJobs = newReplayJobs(eth)
 
 	if err := upgradeChainDatabase(chainDb); err != nil {
 		return nil, err
@@ -221,6 +240,29 @@ func New(ctx *node.ServiceContext, config *Config) (*Ethereum, error) {
 		}
 		return nil, err
 	}
+	// Open the replay index only once nothing but the replay sink and the protocol
+	// manager can fail anymore, releasing the live replay again if either does
+	if config.ReplayIndex {
+		indexDb, err := ctx.OpenDatabase(ReplayIndexDbName, config.DatabaseCache, config.DatabaseHandles)
+		if err != nil {
+			return nil, err
+		}
+		if eth.replayIndex, err = NewReplayIndex(indexDb); err != nil {
+			indexDb.Close()
+			return nil, err
+		}
+	}
+	if config.ReplaySink != "" {
+		sink, err := NewReplaySink(config.ReplaySink, eth.replaySinks)
+		if err != nil {
+			eth.closeReplay()
+			return nil, fmt.Errorf("failed to open replay sink: %v", err)
+		}
+		eth.replayProcessor = NewReplayProcessor(eth.blockchain, eth.eventMux, sink, eth.replayIndex)
+		eth.blockchain.SetProcessor(eth.replayProcessor)
+
+		glog.V(logger.Info).Infof("Replaying imported blocks into %s", config.ReplaySink)
+	}
 	newPool := core.NewTxPool(eth.chainConfig, eth.EventMux(), eth.blockchain.State, eth.blockchain.GasLimit)
 	eth.txPool = newPool
 
@@ -236,6 +278,7 @@ func New(ctx *node.ServiceContext, config *Config) (*Ethereum, error) {
 	}
 
 	if eth.protocolManager, err = NewProtocolManager(eth.chainConfig, config.FastSync, config.NetworkId, maxPeers, eth.eventMux, eth.txPool, eth.pow, eth.blockchain, chainDb); err != nil {
+		eth.closeReplay()
 		return nil, err
 	}
 	eth.miner = miner.New(eth, eth.chainConfig, eth.EventMux(), eth.pow)
@@ -256,6 +299,17 @@ func New(ctx *node.ServiceContext, config *Config) (*Ethereum, error) {
 	return eth, nil
 }
 
+// closeReplay stops the live replay of imported blocks and closes the replay
+// index, if enabled, when the node fails to start.
+func (s *Ethereum) closeReplay() {
+	if s.replayProcessor != nil {
+		s.replayProcessor.Stop()
+	}
+	if s.replayIndex != nil {
+		s.replayIndex.Close()
+	}
+}
+
 // CreateDB creates the chain database.
 func CreateDB(ctx *node.ServiceContext, config *Config, name string) (ethdb.Database, error) {
 	db, err := ctx.OpenDatabase(name, config.DatabaseCache, config.DatabaseHandles)
@@ -308,12 +362,35 @@ func CreatePoW(config *Config) (pow.PoW, error) {
 // APIs returns the collection of RPC services the ethereum package offers.
 // NOTE, some of these services probably need to be moved to somewhere else.
 func (s *Ethereum) APIs() []rpc.API {
-	return append(ethapi.GetAPIs(s.ApiBackend, s.solcPath), []rpc.API{
+	apis := ethapi.GetAPIs(s.ApiBackend, s.solcPath)
+	if s.replayIndex != nil {
+		apis = append(apis, rpc.API{
+			Namespace: "eth",
+			Version:   "1.0",
+			Service:   NewPublicReplayIndexAPI(s),
+			Public:    true,
+		}, rpc.API{
+			Namespace: "deepinsight",
+			Version:   "1.0",
+			Service:   NewPublicDeepInsightAPI(s),
+			Public:    true,
+		})
+	}
+	return append(apis, []rpc.API{
 		{
 			Namespace: "eth",
 			Version:   "1.0",
 			Service:   NewPublicEthereumAPI(s),
 			Public:    true,
+		}, {
+			Namespace: "trace",
+			Version:   "1.0",
+			Service:   NewPublicParityTraceAPI(s),
+			Public:    true,
+		}, {
+			Namespace: "deepinsight",
+			Version:   "1.0",
+			Service:   NewPrivateReplayJobAPI(s),
 		}, {
 			Namespace: "eth",
 			Version:   "1.0",
@@ -399,6 +476,7 @@ func (s *Ethereum) TxPool() *core.TxPool               { return s.txPool }
 func (s *Ethereum) EventMux() *event.TypeMux           { return s.eventMux }
 func (s *Ethereum) Pow() pow.PoW                       { return s.pow }
 func (s *Ethereum) ChainDb() ethdb.Database            { return s.chainDb }
+func (s *Ethereum) ReplayIndex() *ReplayIndex          { return s.replayIndex }
 func (s *Ethereum) IsListening() bool                  { return true } // Always listening
 func (s *Ethereum) EthVersion() int                    { return int(s.protocolManager.SubProtocols[0].Version) }
 func (s *Ethereum) NetVersion() int                    { return s.netVersionId }
@@ -425,6 +503,9 @@ func (s *Ethereum) Start(srvr *p2p.Server) error {
 	if s.lesServer != nil {
 		s.lesServer.Start(srvr)
 	}
+	if err := s.replayJobs.start(); err != nil {
+		glog.V(logger.Warn).Infof("Failed to resume replay jobs: %v", err)
+	}
 	return nil
 }
 
@@ -434,7 +515,11 @@ func (s *Ethereum) Stop() error {
 	if s.stopDbUpgrade != nil {
 		s.stopDbUpgrade()
 	}
+	s.replayJobs.stop()
 	s.blockchain.Stop()
+	if s.replayProcessor != nil {
+		s.replayProcessor.Stop()
+	}
 	s.protocolManager.Stop()
 	if s.lesServer != nil {
 		s.lesServer.Stop()
@@ -446,6 +531,9 @@ func (s *Ethereum) Stop() error {
 	s.StopAutoDAG()
 
 	s.chainDb.Close()
+	if s.replayIndex != nil {
+		s.replayIndex.Close()
+	}
 	close(s.shutdownChan)
 
 	return nil
@@ -0,0 +1,99 @@
+package eth
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/replay"
+)
+
+// ReplayCall executes a message on top of the given state under the replay
+// tracer, as if it were the only transaction of a block with the given header,
+// and returns the replay document of that hypothetical transaction along with
+// its transfers. The state is modified by the call.
+func ReplayCall(bc *core.BlockChain, statedb *state.StateDB, header *types.Header, msg core.Message) (string, error) {
+	var buf bytes.Buffer
+	if err := WriteReplayCall(&buf, bc, statedb, header, msg, nil); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// WriteReplayCall executes a message on top of the given state under the replay
+// tracer, streaming the replay document of the hypothetical transaction into w.
+// The document carries a zero hash and signature, as the message is unsigned.
+// The code trace is limited according to config, if given.
+//
+// Like eth_call, the call is not refused for a lack of funds: a sender unable to
+// pay for the gas and value of the message is credited the difference after its
+// real balance is recorded, and the credit reported in the senderCredit field.
+func WriteReplayCall(w io.Writer, bc *core.BlockChain, statedb *state.StateDB, header *types.Header, msg core.Message, config *replay.ReplayConfig) error {
+	var (
+		tracer = replay.ReplayTracer{}
+		hook   = replayHook(&tracer, config)
+		from   = msg.From()
+		nonce  = statedb.GetNonce(from)
+	)
+	hook.BlockInit()
+	if err := tracer.SetConfig(config); err != nil {
+		return err
+	}
+	hook.TxInit(0)
+	hook.SetInputAccount(header.Coinbase, statedb.GetCodeHash(header.Coinbase), statedb.GetBalance(header.Coinbase), statedb.GetNonce(header.Coinbase))
+
+	tracer.TxBasic += fmt.Sprintf("\"sender\":\"%s\"", from.Hex())
+	hook.SetInputAccount(from, statedb.GetCodeHash(from), statedb.GetBalance(from), nonce)
+	if msg.To() != nil {
+		address := *msg.To()
+		if !statedb.Exist(address) {
+			hook.AddTxCreatedAccount(address)
+		}
+		hook.SetInputAccount(address, statedb.GetCodeHash(address), statedb.GetBalance(address), statedb.GetNonce(address))
+	}
+	cost := new(big.Int).Add(new(big.Int).Mul(msg.Gas(), msg.GasPrice()), msg.Value())
+	var credit *big.Int
+	if balance := statedb.GetBalance(from); balance.Cmp(cost) < 0 {
+		credit = new(big.Int).Sub(cost, balance)
+		statedb.AddBalance(from, credit)
+	}
+	// Execute the message without a block gas limit, like eth_call does
+	context := core.NewEVMContext(msg, header, bc)
+	vmenv := vm.NewReplayEVM(context, statedb, bc.Config(), vm.Config{}, hook)
+
+	_, gas, err := core.ApplyMessage(vmenv, msg, new(core.GasPool).AddGas(common.MaxBig))
+	if err != nil {
+		return err
+	}
+	if msg.To() == nil && hook.GetTxFailReason() == "" {
+		hook.SetCreatedAddress(crypto.CreateAddress(from, nonce))
+	}
+	var data, init, to string
+	if msg.To() == nil {
+		init, to = "0x"+common.Bytes2Hex(msg.Data()), "NIL"
+	} else {
+		data, to = "0x"+common.Bytes2Hex(msg.Data()), msg.To().Hex()
+	}
+	hook.StrTxBasic(nonce, msg.GasPrice().Uint64(), msg.Gas().Uint64(), gas.Uint64(),
+		data, init, to, msg.Value().String(), 0, "0", "0", common.Hash{}.Hex())
+
+	hook.ScanTrace()
+	for _, key := range hook.GetInputAccounts() {
+		addr := common.HexToAddress(key)
+		hook.SetOutputAccount(addr, statedb.GetCodeHash(addr), statedb.GetBalance(addr), statedb.GetNonce(addr))
+	}
+	hook.ValidateTransfer(0)
+
+	fields := txDocumentFields(&tracer, 0, config)
+	if credit != nil {
+		fields = append([]string{strField("senderCredit", credit.String())}, fields...)
+	}
+	return tracer.WriteTransaction(w, fields...)
+}
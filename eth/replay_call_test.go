@@ -0,0 +1,163 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/internal/ethapi"
+	"github.com/ethereum/go-ethereum/replay/schema"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Tests that unsigned calls can be replayed against historical states.
+func TestReplayCall(t *testing.T) {
+	bc, _ := newTestReplayChain(t, 3, testReplayCounter)
+	counter := crypto.CreateAddress(testBank.Address, 0)
+
+	// Increment the counter on top of every block, loading the value of that block
+	for number := uint64(1); number <= 3; number++ {
+		header := bc.GetHeaderByNumber(number)
+		statedb, err := bc.StateAt(header.Root)
+		if err != nil {
+			t.Fatalf("block %d: failed to retrieve state: %v", number, err)
+		}
+		msg := types.NewMessage(testReplayAddr, &counter, 0, new(big.Int), big.NewInt(100000), new(big.Int), nil, false)
+		doc, err := ReplayCall(bc, statedb, header, msg)
+		if err != nil {
+			t.Fatalf("block %d: failed to replay call: %v", number, err)
+		}
+		tx, err := schema.DecodeTransaction([]byte(doc))
+		if err != nil {
+			t.Fatalf("block %d: failed to decode call: %v", number, err)
+		}
+		if tx.Sender != testReplayAddr || tx.Hash != (common.Hash{}) || tx.To != counter.Hex() {
+			t.Errorf("block %d: call basics mismatch: sender %x, hash %x, to %s", number, tx.Sender, tx.Hash, tx.To)
+		}
+		// Block 1 deploys the counter, 2 increments it twice and 3 once more
+		want := []int64{1, 3, 4}[number-1]
+		var stored *schema.Content
+		for _, state := range tx.OutputStates {
+			if state.Address == counter {
+				stored = state.Storage[common.Hash{}.Hex()]
+			}
+		}
+		if stored == nil || new(big.Int).SetBytes(stored.Value).Int64() != want {
+			t.Errorf("block %d: stored counter mismatch: have %v, want %d", number, stored, want)
+		}
+		if tx.Traces[5].Name != "SSTORE" {
+			t.Errorf("block %d: trace mismatch: have %s at 5, want SSTORE", number, tx.Traces[5].Name)
+		}
+		if tx.SenderCredit != nil {
+			t.Errorf("block %d: free call credited %v", number, tx.SenderCredit)
+		}
+	}
+	// Calls deploying contracts report the account they create
+	header := bc.CurrentBlock().Header()
+	statedb, _ := bc.StateAt(header.Root)
+	code := common.FromHex("600a600c600039600a6000f3" + "600054600101600055" + "00")
+	msg := types.NewMessage(testBank.Address, nil, 0, new(big.Int), big.NewInt(100000), new(big.Int), code, false)
+
+	doc, err := ReplayCall(bc, statedb, header, msg)
+	if err != nil {
+		t.Fatalf("failed to replay creation: %v", err)
+	}
+	tx, err := schema.DecodeTransaction([]byte(doc))
+	if err != nil {
+		t.Fatalf("failed to decode creation: %v", err)
+	}
+	created := crypto.CreateAddress(testBank.Address, statedb.GetNonce(testBank.Address)-1)
+	if tx.To != "NIL" || len(tx.CreatedAccounts) != 1 || common.HexToAddress(tx.CreatedAccounts[0]) != created {
+		t.Errorf("creation mismatch: to %s, created %v, want %x", tx.To, tx.CreatedAccounts, created)
+	}
+}
+
+// Tests that calls from senders unable to pay for them record the real balance
+// of the sender and report the credit covering the difference.
+func TestReplayCallCredit(t *testing.T) {
+	bc, _ := newTestReplayChain(t, 1, testReplayCounter)
+	counter := crypto.CreateAddress(testBank.Address, 0)
+
+	header := bc.CurrentBlock().Header()
+	statedb, _ := bc.StateAt(header.Root)
+	statedb.AddBalance(testReplayAddr, big.NewInt(1000))
+
+	msg := types.NewMessage(testReplayAddr, &counter, 0, big.NewInt(5000), big.NewInt(100000), big.NewInt(2), nil, false)
+	doc, err := ReplayCall(bc, statedb, header, msg)
+	if err != nil {
+		t.Fatalf("failed to replay call: %v", err)
+	}
+	tx, err := schema.DecodeTransaction([]byte(doc))
+	if err != nil {
+		t.Fatalf("failed to decode call: %v", err)
+	}
+	// Gas and value cost 2*100000+5000, of which the sender has 1000
+	if tx.SenderCredit == nil || tx.SenderCredit.ToInt().Int64() != 204000 {
+		t.Errorf("sender credit mismatch: have %v, want 204000", tx.SenderCredit)
+	}
+	var balance *schema.Decimal
+	for _, state := range tx.InputStates {
+		if state.Address == testReplayAddr {
+			balance = state.Balance
+		}
+	}
+	if balance == nil || balance.ToInt().Int64() != 1000 {
+		t.Errorf("sender input balance mismatch: have %v, want 1000", balance)
+	}
+}
+
+// Tests that the analyses replaying transactions and calls are served in the
+// deepinsight namespace and not in the public eth one.
+func TestReplayAPINamespace(t *testing.T) {
+	bc, db := newTestReplayChain(t, 3, testReplayCounter)
+	eth := &Ethereum{blockchain: bc, chainDb: db}
+	eth.ApiBackend = &EthApiBackend{eth: eth}
+
+	server := rpc.NewServer()
+	for _, api := range ethapi.GetAPIs(eth.ApiBackend, "") {
+		if err := server.RegisterName(api.Namespace, api.Service); err != nil {
+			t.Fatalf("failed to register %s API: %v", api.Namespace, err)
+		}
+	}
+	client := rpc.DialInProc(server)
+	defer client.Close()
+
+	txHash := bc.GetBlockByNumber(2).Transactions()[0].Hash()
+	var graph string
+	if err := client.Call(&graph, "deepinsight_getReplayGraph", txHash); err != nil {
+		t.Fatalf("failed to retrieve graph: %v", err)
+	}
+	if !strings.HasPrefix(graph, "digraph") {
+		t.Errorf("graph mismatch: have %q", graph)
+	}
+	var doc json.RawMessage
+	call := map[string]interface{}{"from": testBank.Address, "to": crypto.CreateAddress(testBank.Address, 0)}
+	if err := client.Call(&doc, "deepinsight_replayCall", call, "latest"); err != nil {
+		t.Fatalf("failed to replay call: %v", err)
+	}
+	for _, method := range []string{"eth_getReplaySlice", "eth_getReplayGraph", "eth_getReplayTaint", "eth_replayCall"} {
+		if err := client.Call(nil, method); err == nil || !strings.Contains(err.Error(), "not exist") {
+			t.Errorf("%s: still served, error %v", method, err)
+		}
+	}
+}
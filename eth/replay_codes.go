@@ -0,0 +1,261 @@
+package eth
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+var (
+	// replayCodeTable and replayCodeRefs start the code table of a block document
+	// replayed with DedupCode, before and after splitReplayCodes moved it out.
+	replayCodeTable = []byte(`"codeTable":{`)
+	replayCodeRefs  = []byte(`"codeTable":[`)
+
+	replayCodePrefix = []byte("code-") // replayCodePrefix + code hash -> code, in ldb sinks
+)
+
+// replayCodeFile is the file gzip replay sinks keep the code of their documents
+// in, one {"<hash>":"<code>"} object per line.
+const replayCodeFile = "code.ndjson"
+
+// splitReplayCodes moves the code table out of a block document replayed with
+// DedupCode, leaving the hashes of the code in its place in the order of the
+// table: "codeTable":{"0x1..":"0x6..",...} becomes "codeTable":["0x1..",...].
+// Documents without a code table are returned as they are.
+//
+// Sinks storing every piece of code once across all their documents keep the
+// code returned aside, and restore the table with joinReplayCodes when reading
+// the documents back, byte for byte so that content hashes still hold.
+func splitReplayCodes(doc []byte) ([]byte, []string, map[string]string, error) {
+	start := bytes.Index(doc, replayCodeTable)
+	if start < 0 {
+		return doc, nil, nil, nil
+	}
+	// Code tables hold hex strings only, so the first closing brace ends it
+	end := bytes.IndexByte(doc[start:], '}')
+	if end < 0 {
+		return nil, nil, nil, errors.New("unterminated code table")
+	}
+	end += start + 1
+
+	hashes, table, err := decodeReplayCodeTable(doc[start+len(replayCodeTable)-1 : end])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid code table: %v", err)
+	}
+	refs, _ := json.Marshal(hashes)
+	split := make([]byte, 0, start+len(replayCodeRefs)+len(refs)+len(doc)-end)
+	split = append(split, doc[:start]...)
+	split = append(split, replayCodeRefs[:len(replayCodeRefs)-1]...)
+	split = append(split, refs...)
+	split = append(split, doc[end:]...)
+	return split, hashes, table, nil
+}
+
+// decodeReplayCodeTable decodes a code table, returning its hashes in the order
+// they appear in.
+func decodeReplayCodeTable(input []byte) ([]string, map[string]string, error) {
+	var (
+		dec    = json.NewDecoder(bytes.NewReader(input))
+		hashes = []string{}
+		table  = make(map[string]string)
+	)
+	if _, err := dec.Token(); err != nil {
+		return nil, nil, err
+	}
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		hash, _ := token.(string)
+
+		var code string
+		if err := dec.Decode(&code); err != nil {
+			return nil, nil, err
+		}
+		hashes = append(hashes, hash)
+		table[hash] = code
+	}
+	return hashes, table, nil
+}
+
+// joinReplayCodes restores the code table of a document split by
+// splitReplayCodes, looking up the code of every hash it references.
+func joinReplayCodes(doc []byte, code func(hash string) (string, error)) ([]byte, error) {
+	start := bytes.Index(doc, replayCodeRefs)
+	if start < 0 {
+		return doc, nil
+	}
+	end := bytes.IndexByte(doc[start:], ']')
+	if end < 0 {
+		return nil, errors.New("unterminated code references")
+	}
+	end += start + 1
+
+	var hashes []string
+	if err := json.Unmarshal(doc[start+len(replayCodeRefs)-1:end], &hashes); err != nil {
+		return nil, fmt.Errorf("invalid code references: %v", err)
+	}
+	var joined bytes.Buffer
+	joined.Write(doc[:start])
+	joined.Write(replayCodeTable)
+	for i, hash := range hashes {
+		c, err := code(hash)
+		if err != nil {
+			return nil, fmt.Errorf("code %s: %v", hash, err)
+		}
+		if i != 0 {
+			joined.WriteString(",")
+		}
+		fmt.Fprintf(&joined, "\"%s\":\"%s\"", hash, c)
+	}
+	joined.WriteString("}")
+	joined.Write(doc[end:])
+	return joined.Bytes(), nil
+}
+
+// ReadReplayDocument returns the replay document of a block stored by an ldb
+// replay sink, or nil if there is none. The code table of documents replayed
+// with DedupCode is restored from the code stored aside by the sink.
+func ReadReplayDocument(db ethdb.Database, number uint64) ([]byte, error) {
+	doc, err := db.Get(replayDocumentKey(number))
+	if err != nil {
+		return nil, nil
+	}
+	return joinReplayCodes(doc, func(hash string) (string, error) {
+		code, err := db.Get(replayCodeKey(hash))
+		if err != nil {
+			return "", errors.New("missing from database")
+		}
+		return string(code), nil
+	})
+}
+
+func replayCodeKey(hash string) []byte {
+	return append(append([]byte{}, replayCodePrefix...), hash...)
+}
+
+// ReadReplayGzip reads the documents written by a gzip replay sink into dir,
+// calling fn with every document in the order of the block numbers the files
+// start at. The code table of documents replayed with DedupCode is restored
+// from the code file of the directory.
+func ReadReplayGzip(dir string, fn func(doc []byte) error) error {
+	codes := make(map[string]string)
+	if file, err := os.Open(filepath.Join(dir, replayCodeFile)); err == nil {
+		codes, _, err = readReplayCodes(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	code := func(hash string) (string, error) {
+		if c, ok := codes[hash]; ok {
+			return c, nil
+		}
+		return "", errors.New("missing from code file")
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var numbers uint64s
+	for _, file := range files {
+		if name := file.Name(); strings.HasSuffix(name, ".ndjson.gz") {
+			if number, err := strconv.ParseUint(strings.TrimSuffix(name, ".ndjson.gz"), 10, 64); err == nil {
+				numbers = append(numbers, number)
+			}
+		}
+	}
+	sort.Sort(numbers)
+
+	for _, number := range numbers {
+		path := filepath.Join(dir, fmt.Sprintf("%d.ndjson.gz", number))
+		if err := readReplayGzipFile(path, func(doc []byte) error {
+			joined, err := joinReplayCodes(doc, code)
+			if err != nil {
+				return err
+			}
+			return fn(joined)
+		}); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// readReplayGzipFile calls fn with every line of a gzip compressed file. Files
+// still being written, or left unfinished by a crash, are read up to the last
+// document flushed.
+func readReplayGzipFile(path string, fn func(doc []byte) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(gz)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 1 && line[len(line)-1] == '\n' {
+			if err := fn(line[:len(line)-1]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readReplayCodes loads the code kept aside by a gzip replay sink, returning it
+// along with the length of the complete lines read. A last line left incomplete
+// by a crash is ignored.
+func readReplayCodes(r io.Reader) (map[string]string, int64, error) {
+	var (
+		codes = make(map[string]string)
+		br    = bufio.NewReader(r)
+		size  int64
+	)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return codes, size, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := json.Unmarshal(line, &codes); err != nil {
+			return nil, 0, fmt.Errorf("invalid code line: %v", err)
+		}
+		size += int64(len(line))
+	}
+}
+
+// uint64s sorts block numbers in increasing order.
+type uint64s []uint64
+
+func (s uint64s) Len() int           { return len(s) }
+func (s uint64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s uint64s) Less(i, j int) bool { return s[i] < s[j] }
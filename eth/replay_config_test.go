@@ -0,0 +1,168 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/replay"
+	"github.com/ethereum/go-ethereum/replay/schema"
+)
+
+// replayLimited replays a block limited by the given config and decodes it.
+func replayLimited(t *testing.T, bc *core.BlockChain, number uint64, config *replay.ReplayConfig) *schema.Block {
+	var buf bytes.Buffer
+	if err := WriteReplayBlock(&buf, bc, number, config); err != nil {
+		t.Fatalf("failed to replay block %d: %v", number, err)
+	}
+	block, err := schema.DecodeBlock(buf.Bytes())
+	if err != nil {
+		t.Fatalf("failed to decode block %d: %v", number, err)
+	}
+	return block
+}
+
+// Tests that replay configs limit the code traces emitted, leaving the rest of
+// the documents and the provenance of the emitted instructions intact.
+func TestReplayConfig(t *testing.T) {
+	bc, _ := newTestReplayChain(t, 3, testReplayCounter)
+	counter := crypto.CreateAddress(testBank.Address, 0)
+
+	full := replayLimited(t, bc, 2, nil)
+	for i, tx := range full.Transactions {
+		if tx.Omitted != 0 || tx.Truncated {
+			t.Errorf("tx %d: full replay has limits: omitted %d, truncated %v", i, tx.Omitted, tx.Truncated)
+		}
+	}
+	tests := []struct {
+		config    *replay.ReplayConfig
+		seqs      []int // emitted instructions of the second transaction
+		truncated bool
+	}{
+		{&replay.ReplayConfig{}, []int{0, 1, 2, 3, 4, 5, 6}, false},
+		{&replay.ReplayConfig{Preset: replay.PresetStorageTransfers}, []int{1, 5}, false},
+		{&replay.ReplayConfig{Preset: replay.PresetStateDiff}, []int{}, false},
+		{&replay.ReplayConfig{Opcodes: []string{"push1", "SLOAD"}}, []int{0, 1, 2, 4}, false},
+		{&replay.ReplayConfig{Opcodes: []string{"PUSH1"}, MaxInstructions: 2}, []int{0, 2}, true},
+		{&replay.ReplayConfig{Accounts: []common.Address{counter}}, []int{0, 1, 2, 3, 4, 5, 6}, false},
+		{&replay.ReplayConfig{ExcludeAccounts: []common.Address{counter}}, []int{}, false},
+		{&replay.ReplayConfig{Accounts: []common.Address{testBank.Address}}, []int{}, false},
+		{&replay.ReplayConfig{MaxDepth: 1, MaxInstructions: 3}, []int{0, 1, 2}, true},
+	}
+	for i, tt := range tests {
+		block := replayLimited(t, bc, 2, tt.config)
+		tx := block.Transactions[1]
+
+		var seqs []int
+		for _, trace := range tx.Traces {
+			seqs = append(seqs, trace.Seq)
+		}
+		if len(seqs) != len(tt.seqs) {
+			t.Errorf("test %d: emitted instructions mismatch: have %v, want %v", i, seqs, tt.seqs)
+			continue
+		}
+		for j := range seqs {
+			if seqs[j] != tt.seqs[j] {
+				t.Errorf("test %d: emitted instructions mismatch: have %v, want %v", i, seqs, tt.seqs)
+				break
+			}
+		}
+		if tx.InstructionCount != full.Transactions[1].InstructionCount || tx.Omitted != tx.InstructionCount-len(tt.seqs) || tx.Truncated != tt.truncated {
+			t.Errorf("test %d: limit markers mismatch: count %d, omitted %d, truncated %v", i, tx.InstructionCount, tx.Omitted, tx.Truncated)
+		}
+		if len(tx.OutputStates) != len(full.Transactions[1].OutputStates) {
+			t.Errorf("test %d: output states mismatch: have %d, want %d", i, len(tx.OutputStates), len(full.Transactions[1].OutputStates))
+		}
+		// The loads still refer to the write of the first transaction
+		for _, trace := range tx.Traces {
+			if trace.Name != "SLOAD" {
+				continue
+			}
+			if src := trace.StackOutput.Src[0]; src.Type != schema.SourceCrossTx || src.TxInstrSeq == nil || *src.TxInstrSeq != 5 {
+				t.Errorf("test %d: load source mismatch: have %s", i, src.Type)
+			}
+		}
+	}
+	// Invalid configs are rejected
+	var buf bytes.Buffer
+	if err := WriteReplayBlock(&buf, bc, 2, &replay.ReplayConfig{Preset: "everything"}); err == nil {
+		t.Errorf("unknown preset accepted")
+	}
+}
+
+// Tests that deduplicated replays carry every piece of code once, and that they
+// decode to the same code as full replays.
+func TestReplayDedupCode(t *testing.T) {
+	bc, db := newTestReplayChain(t, 3, testReplayCounter)
+	counter := crypto.CreateAddress(testBank.Address, 0)
+	code := common.Bytes2Hex(common.FromHex("600054600101600055" + "00"))
+
+	var buf bytes.Buffer
+	if err := WriteReplayBlock(&buf, bc, 2, &replay.ReplayConfig{DedupCode: true}); err != nil {
+		t.Fatalf("failed to replay block: %v", err)
+	}
+	if n := bytes.Count(buf.Bytes(), []byte(code)); n != 1 {
+		t.Errorf("code occurrences mismatch: have %d, want 1", n)
+	}
+	if bytes.Contains(buf.Bytes(), []byte(`"codeStorage"`)) {
+		t.Errorf("deduplicated replay embeds code")
+	}
+	full := replayLimited(t, bc, 2, nil)
+	dedup, err := schema.DecodeBlock(buf.Bytes())
+	if err != nil {
+		t.Fatalf("failed to decode block: %v", err)
+	}
+	if dedup.CodeTable != nil {
+		t.Errorf("code table left after inflating")
+	}
+	for i, tx := range dedup.Transactions {
+		if !reflect.DeepEqual(tx.Code, full.Transactions[i].Code) {
+			t.Errorf("tx %d: code mismatch: have %v, want %v", i, tx.Code, full.Transactions[i].Code)
+		}
+		if tx.CodeRefs != nil {
+			t.Errorf("tx %d: code references left after inflating", i)
+		}
+	}
+	if len(full.Transactions[0].Code) != 1 || full.Transactions[0].Code[counter.Hex()] == "" {
+		t.Errorf("counter code missing from full replay: %v", full.Transactions[0].Code)
+	}
+	// Standalone transaction documents carry their own table
+	buf.Reset()
+	tx := bc.GetBlockByNumber(2).Transactions()[1]
+	if err := WriteReplayTransaction(&buf, bc, db, tx.Hash(), &replay.ReplayConfig{DedupCode: true}); err != nil {
+		t.Fatalf("failed to replay transaction: %v", err)
+	}
+	single, err := schema.DecodeTransaction(buf.Bytes())
+	if err != nil {
+		t.Fatalf("failed to decode transaction: %v", err)
+	}
+	if !reflect.DeepEqual(single.Code, full.Transactions[1].Code) {
+		t.Errorf("transaction code mismatch: have %v, want %v", single.Code, full.Transactions[1].Code)
+	}
+	// Extra table entries are tolerated, missing tables reported
+	if _, err := schema.DecodeTransaction(bytes.Replace(buf.Bytes(), []byte(`"codeTable":{`), []byte(`"codeTable":{"0x00":"0x00",`), 1)); err != nil {
+		t.Errorf("extra table entry rejected: %v", err)
+	}
+	if _, err := schema.DecodeTransaction(bytes.Replace(buf.Bytes(), []byte(`"codeTable"`), []byte(`"ignored"`), 1)); err == nil {
+		t.Errorf("missing code table accepted")
+	}
+}
@@ -0,0 +1,330 @@
+package eth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/replay/schema"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// ReplayIndexDbName is the name of the database holding the replay index,
+// separate from the chain database.
+const ReplayIndexDbName = "replayindex"
+
+// indexedBlockPrefix is the prefix of the entries listing the keys indexed for
+// each block number. Being shorter than the slot write and transfer keys, they
+// never show up in the prefix scans of either.
+var indexedBlockPrefix = []byte("block-")
+
+// errReplayIndexUnsupported is returned if the replay index is backed by a
+// database that cannot be iterated.
+var errReplayIndexUnsupported = errors.New("replay index database not iterable")
+
+// SlotWrite is a write of a storage slot recorded by the replay index.
+type SlotWrite struct {
+	Block uint64        `json:"block"`
+	Tx    int           `json:"tx"`  // index of the transaction within the block
+	Seq   int           `json:"seq"` // sequence number of the SSTORE, -1 if unknown
+	Value hexutil.Bytes `json:"value"`
+}
+
+// ReplayIndex is an on-disk index of the storage writes seen in replayed
+// blocks, mapping every (contract, slot) pair to the history of its writes.
+//
+// Entries are keyed by contract (20 bytes), slot (32 bytes), block number (8
+// bytes), transaction index (4 bytes) and instruction sequence number (4 bytes),
+// so that the writes of a slot are stored in chain order. The index also holds
+// the transfers of every address, see IndexedTransfer.
+//
+// Only one block is indexed per number: indexing a block deletes the entries of
+// the block indexed at its number before, such as one replaced by a reorg or an
+// earlier replay of the same block.
+type ReplayIndex struct {
+	db ethdb.Database
+}
+
+// NewReplayIndex creates a replay index on top of the given database, which must
+// be a LevelDB or memory database.
+func NewReplayIndex(db ethdb.Database) (*ReplayIndex, error) {
+	switch db.(type) {
+	case *ethdb.LDBDatabase, *ethdb.MemDatabase:
+		return &ReplayIndex{db: db}, nil
+	}
+	return nil, errReplayIndexUnsupported
+}
+
+// Close closes the database backing the index.
+func (idx *ReplayIndex) Close() {
+	idx.db.Close()
+}
+
+// IndexBlock records the storage writes of a replayed block, one per slot and
+// transaction, along with its transfers. Only writes surviving the transaction
+// are recorded.
+func (idx *ReplayIndex) IndexBlock(block *schema.Block) error {
+	// Replace the entries of any block indexed at the same number before
+	batch := &keyRecordingBatch{Batch: idx.db.NewBatch()}
+	if err := idx.unindexBlock(batch.Batch, block.Header.Number); err != nil {
+		return err
+	}
+	if err := indexTransfers(batch, block); err != nil {
+		return err
+	}
+	for i, tx := range block.Transactions {
+		stores := lastStores(tx)
+		for _, state := range tx.OutputStates {
+			for key, content := range state.Storage {
+				slot := common.HexToHash(key)
+				seq, ok := stores[slotKey(state.Address, slot)]
+				if !ok {
+					seq = -1
+				}
+				if err := batch.Put(writeKey(state.Address, slot, block.Header.Number, i, seq), content.Value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	keys, err := rlp.EncodeToBytes(batch.keys)
+	if err != nil {
+		return err
+	}
+	if err := batch.Batch.Put(indexedBlockKey(block.Header.Number), keys); err != nil {
+		return err
+	}
+	return batch.Write()
+}
+
+// unindexBlock adds the deletion of the entries of the block indexed at the
+// given number to the batch.
+func (idx *ReplayIndex) unindexBlock(batch ethdb.Batch, number uint64) error {
+	enc, err := idx.db.Get(indexedBlockKey(number))
+	if err != nil {
+		return nil // nothing indexed yet
+	}
+	var keys [][]byte
+	if err := rlp.DecodeBytes(enc, &keys); err != nil {
+		return fmt.Errorf("corrupt index entry of block #%d: %v", number, err)
+	}
+	for _, key := range keys {
+		if err := batch.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyRecordingBatch is a database batch remembering the keys put into it.
+type keyRecordingBatch struct {
+	ethdb.Batch
+	keys [][]byte
+}
+
+func (b *keyRecordingBatch) Put(key, value []byte) error {
+	b.keys = append(b.keys, key)
+	return b.Batch.Put(key, value)
+}
+
+// indexedBlockKey assembles the key of the entry listing the keys indexed for a
+// block number.
+func indexedBlockKey(number uint64) []byte {
+	key := make([]byte, len(indexedBlockPrefix)+8)
+	copy(key, indexedBlockPrefix)
+	binary.BigEndian.PutUint64(key[len(indexedBlockPrefix):], number)
+	return key
+}
+
+// IndexDocument decodes a replay block document and records its storage writes.
+func (idx *ReplayIndex) IndexDocument(doc []byte) error {
+	block, err := schema.DecodeBlock(doc)
+	if err != nil {
+		return err
+	}
+	return idx.IndexBlock(block)
+}
+
+// History returns all indexed writes of a storage slot in chain order.
+func (idx *ReplayIndex) History(contract common.Address, slot common.Hash) ([]*SlotWrite, error) {
+	var writes []*SlotWrite
+	err := idx.scan(append(contract.Bytes(), slot.Bytes()...), func(key, value []byte) bool {
+		writes = append(writes, decodeWrite(key, value))
+		return true
+	})
+	return writes, err
+}
+
+// LastWrite returns the last indexed write of a storage slot preceding the given
+// transaction of a block, or nil if the slot was never written before.
+func (idx *ReplayIndex) LastWrite(contract common.Address, slot common.Hash, number uint64, txIndex int) (*SlotWrite, error) {
+	prefix := append(contract.Bytes(), slot.Bytes()...)
+	bound := writeKey(contract, slot, number, txIndex, 0)[:len(prefix)+12]
+
+	if ldb, ok := idx.db.(*ethdb.LDBDatabase); ok {
+		// Seek past the bound and step back to the preceding entry
+		it := ldb.LDB().NewIterator(util.BytesPrefix(prefix), nil)
+		defer it.Release()
+
+		found := it.Seek(bound)
+		if found {
+			found = it.Prev()
+		} else {
+			found = it.Last()
+		}
+		if !found {
+			return nil, it.Error()
+		}
+		return decodeWrite(common.CopyBytes(it.Key()), common.CopyBytes(it.Value())), nil
+	}
+	var last *SlotWrite
+	err := idx.scan(prefix, func(key, value []byte) bool {
+		if bytes.Compare(key, bound) >= 0 {
+			return false
+		}
+		last = decodeWrite(key, value)
+		return true
+	})
+	return last, err
+}
+
+// ResolveLoad returns the write a storage load of a replayed transaction reads,
+// looking across earlier blocks and transactions. The transaction is the one at
+// index txIndex of the given block, and seq the sequence number of the SLOAD.
+func (idx *ReplayIndex) ResolveLoad(number uint64, txIndex int, tx *schema.Transaction, seq int) (*SlotWrite, error) {
+	traces := make(map[int]*schema.Trace, len(tx.Traces))
+	for _, trace := range tx.Traces {
+		traces[trace.Seq] = trace
+	}
+	load, ok := traces[seq]
+	if !ok || load.Name != "SLOAD" || len(load.StackInputs) == 0 {
+		return nil, errors.New("instruction is not a storage load")
+	}
+	key, ok := traces[load.StackInputs[0]]
+	if !ok || key.StackOutput == nil {
+		return nil, errors.New("storage slot of load unknown")
+	}
+	return idx.LastWrite(load.Address, common.BytesToHash(key.StackOutput.Value), number, txIndex)
+}
+
+// scan iterates over the entries stored under a prefix in key order, until the
+// callback returns false.
+func (idx *ReplayIndex) scan(prefix []byte, fn func(key, value []byte) bool) error {
+	return idx.scanRange(util.BytesPrefix(prefix), fn)
+}
+
+// scanRange iterates over the entries stored within a key range in key order,
+// until the callback returns false.
+func (idx *ReplayIndex) scanRange(rng *util.Range, fn func(key, value []byte) bool) error {
+	switch db := idx.db.(type) {
+	case *ethdb.LDBDatabase:
+		it := db.LDB().NewIterator(rng, nil)
+		defer it.Release()
+
+		for it.Next() {
+			if !fn(common.CopyBytes(it.Key()), common.CopyBytes(it.Value())) {
+				break
+			}
+		}
+		return it.Error()
+
+	case *ethdb.MemDatabase:
+		var keys [][]byte
+		for _, key := range db.Keys() {
+			if bytes.Compare(key, rng.Start) >= 0 && (rng.Limit == nil || bytes.Compare(key, rng.Limit) < 0) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Sort(byteSlices(keys))
+		for _, key := range keys {
+			value, _ := db.Get(key)
+			if !fn(key, value) {
+				break
+			}
+		}
+		return nil
+	}
+	return errReplayIndexUnsupported
+}
+
+// lastStores returns the sequence number of the last SSTORE of every slot written
+// by a transaction, keyed by slotKey. Reverted stores are skipped.
+func lastStores(tx *schema.Transaction) map[string]int {
+	traces := make(map[int]*schema.Trace, len(tx.Traces))
+	for _, trace := range tx.Traces {
+		traces[trace.Seq] = trace
+	}
+	stores := make(map[string]int)
+	for _, trace := range tx.Traces {
+		if trace.Name != "SSTORE" || trace.Reverted != 0 || len(trace.StackInputs) == 0 {
+			continue
+		}
+		if key, ok := traces[trace.StackInputs[0]]; ok && key.StackOutput != nil {
+			stores[slotKey(trace.Address, common.BytesToHash(key.StackOutput.Value))] = trace.Seq
+		}
+	}
+	return stores
+}
+
+func slotKey(contract common.Address, slot common.Hash) string {
+	return string(contract.Bytes()) + string(slot.Bytes())
+}
+
+// writeKey assembles the index key of a slot write.
+func writeKey(contract common.Address, slot common.Hash, number uint64, txIndex, seq int) []byte {
+	key := make([]byte, common.AddressLength+common.HashLength+16)
+	copy(key, contract.Bytes())
+	copy(key[common.AddressLength:], slot.Bytes())
+	binary.BigEndian.PutUint64(key[common.AddressLength+common.HashLength:], number)
+	binary.BigEndian.PutUint32(key[common.AddressLength+common.HashLength+8:], uint32(txIndex))
+	binary.BigEndian.PutUint32(key[common.AddressLength+common.HashLength+12:], uint32(int32(seq)))
+	return key
+}
+
+// decodeWrite disassembles an index entry into the write it records.
+func decodeWrite(key, value []byte) *SlotWrite {
+	rest := key[common.AddressLength+common.HashLength:]
+	return &SlotWrite{
+		Block: binary.BigEndian.Uint64(rest),
+		Tx:    int(binary.BigEndian.Uint32(rest[8:])),
+		Seq:   int(int32(binary.BigEndian.Uint32(rest[12:]))),
+		Value: common.CopyBytes(value),
+	}
+}
+
+// byteSlices implements sort.Interface for lexicographic byte slice ordering.
+type byteSlices [][]byte
+
+func (s byteSlices) Len() int           { return len(s) }
+func (s byteSlices) Less(i, j int) bool { return bytes.Compare(s[i], s[j]) < 0 }
+func (s byteSlices) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// PublicReplayIndexAPI provides queries of the storage write index built from
+// replayed blocks. It is only available if the node runs with the index enabled.
+type PublicReplayIndexAPI struct {
+	eth *Ethereum
+}
+
+// NewPublicReplayIndexAPI creates a new replay index API.
+func NewPublicReplayIndexAPI(eth *Ethereum) *PublicReplayIndexAPI {
+	return &PublicReplayIndexAPI{eth: eth}
+}
+
+// GetReplaySlotHistory returns the indexed writes of a storage slot of a contract
+// in chain order.
+func (api *PublicReplayIndexAPI) GetReplaySlotHistory(contract common.Address, slot common.Hash) ([]*SlotWrite, error) {
+	writes, err := api.eth.replayIndex.History(contract, slot)
+	if err != nil {
+		return nil, err
+	}
+	if writes == nil {
+		writes = []*SlotWrite{}
+	}
+	return writes, nil
+}
@@ -0,0 +1,238 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/replay/schema"
+)
+
+// testReplayCounter deploys a counter running SSTORE(0, SLOAD(0) + 1) and
+// increments it twice in the second block and once in the third.
+func testReplayCounter(i int, block *core.BlockGen) {
+	signer := types.HomesteadSigner{}
+	switch i {
+	case 0:
+		code := common.FromHex("600a600c600039600a6000f3" + "600054600101600055" + "00")
+		tx, _ := types.SignTx(types.NewContractCreation(block.TxNonce(testBank.Address), new(big.Int), big.NewInt(100000), nil, code), signer, testBankKey)
+		block.AddTx(tx)
+	case 1, 2:
+		for j := 0; j < 3-i; j++ {
+			tx, _ := types.SignTx(types.NewTransaction(block.TxNonce(testBank.Address), crypto.CreateAddress(testBank.Address, 0), new(big.Int), big.NewInt(100000), nil, nil), signer, testBankKey)
+			block.AddTx(tx)
+		}
+	}
+}
+
+func TestReplayIndexMemory(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	testReplayIndex(t, db)
+}
+
+func TestReplayIndexLevelDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replayindex")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := ethdb.NewLDBDatabase(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	testReplayIndex(t, db)
+}
+
+func testReplayIndex(t *testing.T, db ethdb.Database) {
+	index, err := NewReplayIndex(db)
+	if err != nil {
+		t.Fatalf("failed to create index: %v", err)
+	}
+	defer index.Close()
+
+	bc, chainDb := newTestReplayChain(t, 3, testReplayCounter)
+	for number := uint64(1); number <= 3; number++ {
+		doc, err := ReplayBlockByNumber(bc, number)
+		if err != nil {
+			t.Fatalf("block %d: failed to replay: %v", number, err)
+		}
+		// Indexing a block twice must not duplicate its writes
+		for i := 0; i < 2; i++ {
+			if err := index.IndexDocument([]byte(doc)); err != nil {
+				t.Fatalf("block %d: failed to index: %v", number, err)
+			}
+		}
+	}
+	counter, slot := crypto.CreateAddress(testBank.Address, 0), common.Hash{}
+
+	// Every increment is recorded in chain order, along with its SSTORE
+	history, err := index.History(counter, slot)
+	if err != nil {
+		t.Fatalf("failed to retrieve history: %v", err)
+	}
+	want := []SlotWrite{{Block: 2, Tx: 0, Seq: 5}, {Block: 2, Tx: 1, Seq: 5}, {Block: 3, Tx: 0, Seq: 5}}
+	if len(history) != len(want) {
+		t.Fatalf("history length mismatch: have %d, want %d", len(history), len(want))
+	}
+	for i, write := range history {
+		if write.Block != want[i].Block || write.Tx != want[i].Tx || write.Seq != want[i].Seq {
+			t.Errorf("write %d: position mismatch: have #%d/%d/%d, want #%d/%d/%d", i, write.Block, write.Tx, write.Seq, want[i].Block, want[i].Tx, want[i].Seq)
+		}
+		if value := new(big.Int).SetBytes(write.Value); value.Int64() != int64(i+1) {
+			t.Errorf("write %d: value mismatch: have %v, want %d", i, value, i+1)
+		}
+	}
+	if history, _ := index.History(counter, common.BytesToHash([]byte{1})); len(history) != 0 {
+		t.Errorf("unwritten slot has history: %v", history)
+	}
+	// Last writes only consider earlier transactions
+	tests := []struct {
+		number  uint64
+		txIndex int
+		block   uint64
+		tx      int
+	}{
+		{2, 0, 0, -1},
+		{2, 1, 2, 0},
+		{3, 0, 2, 1},
+		{4, 0, 3, 0},
+	}
+	for i, tt := range tests {
+		write, err := index.LastWrite(counter, slot, tt.number, tt.txIndex)
+		if err != nil {
+			t.Fatalf("test %d: failed to retrieve last write: %v", i, err)
+		}
+		if tt.tx == -1 {
+			if write != nil {
+				t.Errorf("test %d: unexpected write: %+v", i, write)
+			}
+			continue
+		}
+		if write == nil || write.Block != tt.block || write.Tx != tt.tx {
+			t.Errorf("test %d: last write mismatch: have %+v, want #%d/%d", i, write, tt.block, tt.tx)
+		}
+	}
+	// The standalone replay of the last increment resolves its load across blocks
+	hash := bc.GetBlockByNumber(3).Transactions()[0].Hash()
+	doc, err := ReplayTransaction(bc, chainDb, hash)
+	if err != nil {
+		t.Fatalf("failed to replay transaction: %v", err)
+	}
+	tx, err := schema.DecodeTransaction([]byte(doc))
+	if err != nil {
+		t.Fatalf("failed to decode transaction: %v", err)
+	}
+	write, err := index.ResolveLoad(3, 0, tx, 1)
+	if err != nil {
+		t.Fatalf("failed to resolve load: %v", err)
+	}
+	if write == nil || write.Block != 2 || write.Tx != 1 || write.Seq != 5 {
+		t.Errorf("load origin mismatch: have %+v, want #2/1/5", write)
+	}
+	if _, err := index.ResolveLoad(3, 0, tx, 0); err == nil {
+		t.Errorf("resolved a non-load instruction")
+	}
+}
+
+// Tests that indexing a block replacing an earlier one at the same number, as
+// after a reorg, drops the storage writes and transfers of the replaced block.
+func TestReplayIndexReplaceMemory(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	testReplayIndexReplace(t, db)
+}
+
+func TestReplayIndexReplaceLevelDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replayindex")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := ethdb.NewLDBDatabase(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	testReplayIndexReplace(t, db)
+}
+
+func testReplayIndexReplace(t *testing.T, db ethdb.Database) {
+	index, err := NewReplayIndex(db)
+	if err != nil {
+		t.Fatalf("failed to create index: %v", err)
+	}
+	defer index.Close()
+
+	// Index a chain, then the last block of a fork not incrementing the counter
+	bc, _ := newTestReplayChain(t, 3, testReplayCounter)
+	for number := uint64(1); number <= 3; number++ {
+		doc, err := ReplayBlockByNumber(bc, number)
+		if err != nil {
+			t.Fatalf("block %d: failed to replay: %v", number, err)
+		}
+		if err := index.IndexDocument([]byte(doc)); err != nil {
+			t.Fatalf("block %d: failed to index: %v", number, err)
+		}
+	}
+	counter, slot := crypto.CreateAddress(testBank.Address, 0), common.Hash{}
+	miner := bc.GetBlockByNumber(3).Coinbase()
+	if transfers, _, _ := index.Transfers(miner, 3, 3, nil, 10); len(transfers) == 0 {
+		t.Fatalf("no reward indexed for block 3")
+	}
+	fork, _ := newTestReplayChain(t, 3, func(i int, block *core.BlockGen) {
+		if i < 2 {
+			testReplayCounter(i, block)
+		} else {
+			block.SetCoinbase(common.Address{0x01})
+		}
+	})
+	doc, err := ReplayBlockByNumber(fork, 3)
+	if err != nil {
+		t.Fatalf("failed to replay fork block: %v", err)
+	}
+	if err := index.IndexDocument([]byte(doc)); err != nil {
+		t.Fatalf("failed to index fork block: %v", err)
+	}
+	history, err := index.History(counter, slot)
+	if err != nil {
+		t.Fatalf("failed to retrieve history: %v", err)
+	}
+	if len(history) != 2 || history[1].Block != 2 {
+		t.Errorf("history of replaced block not dropped: %+v", history)
+	}
+	if write, _ := index.LastWrite(counter, slot, 4, 0); write == nil || write.Block != 2 || write.Tx != 1 {
+		t.Errorf("last write mismatch: have %+v, want #2/1", write)
+	}
+	if transfers, _, _ := index.Transfers(miner, 3, 3, nil, 10); len(transfers) != 0 {
+		t.Errorf("transfers of replaced block not dropped: %+v", transfers)
+	}
+	// Indexing the same block again deletes and puts the same entries at once
+	if err := index.IndexDocument([]byte(doc)); err != nil {
+		t.Fatalf("failed to index fork block again: %v", err)
+	}
+	if transfers, _, _ := index.Transfers(common.Address{0x01}, 3, 3, nil, 10); len(transfers) == 0 {
+		t.Errorf("entries of reindexed block dropped")
+	}
+}
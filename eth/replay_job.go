@@ -0,0 +1,645 @@
+package eth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/logger"
+	"github.com/ethereum/go-ethereum/logger/glog"
+	"github.com/ethereum/go-ethereum/replay"
+	"github.com/ethereum/go-ethereum/rpc"
+	"golang.org/x/net/context"
+)
+
+// Replay job states, as reported in ReplayJobStatus.
+const (
+	ReplayJobRunning = "running"
+	ReplayJobStopped = "stopped"
+	ReplayJobDone    = "done"
+	ReplayJobFailed  = "failed" // the job itself failed, not just some blocks
+)
+
+var (
+	// replayCheckpointInterval is the minimum time between two saves of the
+	// checkpoint of a running job. Blocks completed after the last save are
+	// replayed and written again when the job resumes, unless the job saves
+	// after every block, see CheckpointEveryBlock.
+	replayCheckpointInterval = 5 * time.Second
+
+	// replayRetryDelay is the delay before the first retry of a failed block,
+	// doubled on every further attempt.
+	replayRetryDelay = time.Second
+)
+
+var errReplayJobStopped = errors.New("replay job stopped")
+
+// ReplayCheckpoint is the persisted progress of a replay job over the blocks
+// between First and Last (inclusive).
+type ReplayCheckpoint struct {
+	First    uint64           `json:"first"`
+	Last     uint64           `json:"last"`
+	Next     uint64           `json:"next"`     // first block not completed yet
+	Failures []*ReplayFailure `json:"failures"` // blocks given up on, in block order
+}
+
+// ReplayFailure is a block a replay job gave up on after exhausting its retries.
+type ReplayFailure struct {
+	Block    uint64 `json:"block"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error"`
+}
+
+// ReplayCheckpointStore persists the checkpoint of a replay job.
+type ReplayCheckpointStore interface {
+	// Load returns the stored checkpoint, or nil if there is none yet.
+	Load() (*ReplayCheckpoint, error)
+
+	// Save replaces the stored checkpoint.
+	Save(cp *ReplayCheckpoint) error
+}
+
+// replayCheckpointFile stores a checkpoint as a JSON file, replaced atomically
+// on every save.
+type replayCheckpointFile struct {
+	path string
+}
+
+// NewReplayCheckpointFile creates a checkpoint store backed by a JSON file.
+func NewReplayCheckpointFile(path string) ReplayCheckpointStore {
+	return &replayCheckpointFile{path: path}
+}
+
+func (f *replayCheckpointFile) Load() (*ReplayCheckpoint, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cp := new(ReplayCheckpoint)
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s: %v", f.path, err)
+	}
+	return cp, nil
+}
+
+func (f *replayCheckpointFile) Save(cp *ReplayCheckpoint) error {
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(f.path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.path+".tmp", f.path)
+}
+
+// replayCheckpointDB stores a checkpoint under a database key.
+type replayCheckpointDB struct {
+	db  ethdb.Database
+	key []byte
+}
+
+func (s *replayCheckpointDB) Load() (*ReplayCheckpoint, error) {
+	data, err := s.db.Get(s.key)
+	if err != nil || len(data) == 0 {
+		return nil, nil
+	}
+	cp := new(ReplayCheckpoint)
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %q: %v", s.key, err)
+	}
+	return cp, nil
+}
+
+func (s *replayCheckpointDB) Save(cp *ReplayCheckpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(s.key, data)
+}
+
+// ReplayJobStatus is a snapshot of the progress of a replay job.
+type ReplayJobStatus struct {
+	State    string           `json:"state"`
+	First    uint64           `json:"first"`
+	Last     uint64           `json:"last"`
+	Next     uint64           `json:"next"`
+	Progress float64          `json:"progress"` // completed fraction of the range
+	Rate     float64          `json:"rate"`     // blocks per second since the job (re)started
+	Failures []*ReplayFailure `json:"failures"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// ReplayJob is a resumable replay of a range of blocks. Its progress is saved
+// to a checkpoint store as blocks complete, so that a job interrupted by a
+// crash or restart continues from the last completed block. Blocks failing to
+// replay are retried a bounded number of times and then recorded as failures
+// in the checkpoint, without stopping the job. So are blocks diverging from the
+// chain in verified replays.
+type ReplayJob struct {
+	store   ReplayCheckpointStore
+	retries int
+	workers int
+	replay  func(number uint64) (string, error)
+	write   func(number uint64, doc string) error
+
+	interval time.Duration // minimum time between checkpoint saves
+
+	lock    sync.RWMutex
+	cp      *ReplayCheckpoint
+	state   string
+	err     error
+	failed  map[uint64]*ReplayFailure // blocks given up on, not yet written
+	started time.Time
+	resumed uint64 // next block when the job (re)started
+	saved   time.Time
+	quit    chan struct{}
+}
+
+// NewReplayJob creates a replay job over the blocks between first and last
+// (inclusive), resuming from the checkpoint in store if there is one. Blocks are
+// replayed by the replay callback on the given number of workers, and handed to
+// the write callback in block order, see ReplayRange.
+func NewReplayJob(store ReplayCheckpointStore, first, last uint64, retries, workers int, replay func(number uint64) (string, error), write func(number uint64, doc string) error) (*ReplayJob, error) {
+	if first > last {
+		return nil, fmt.Errorf("invalid block range #%d-#%d", first, last)
+	}
+	cp, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	if cp == nil {
+		cp = &ReplayCheckpoint{First: first, Last: last, Next: first}
+	} else if cp.First != first || cp.Last != last {
+		return nil, fmt.Errorf("checkpoint covers blocks #%d-#%d, not #%d-#%d", cp.First, cp.Last, first, last)
+	}
+	if retries < 0 {
+		retries = 0
+	}
+	job := &ReplayJob{
+		store:    store,
+		retries:  retries,
+		workers:  workers,
+		replay:   replay,
+		write:    write,
+		interval: replayCheckpointInterval,
+		cp:       cp,
+		state:    ReplayJobStopped,
+		quit:     make(chan struct{}),
+	}
+	if cp.Next > cp.Last {
+		job.state = ReplayJobDone
+	}
+	return job, nil
+}
+
+// CheckpointEveryBlock makes the job save its checkpoint after every completed
+// block. This is needed for writers appending the documents to their output,
+// which would otherwise get the blocks completed after the last save appended
+// a second time when the job resumes.
+func (j *ReplayJob) CheckpointEveryBlock() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.interval = 0
+}
+
+// Run replays the remaining blocks of the job, returning once all are completed,
+// the job is stopped or it fails. Blocks given up on do not fail the job.
+func (j *ReplayJob) Run() error {
+	j.lock.Lock()
+	if j.state == ReplayJobDone {
+		j.lock.Unlock()
+		return nil
+	}
+	j.state, j.err = ReplayJobRunning, nil
+	j.failed = make(map[uint64]*ReplayFailure)
+	j.started, j.saved, j.resumed = time.Now(), time.Now(), j.cp.Next
+	first, last := j.cp.Next, j.cp.Last
+	j.lock.Unlock()
+
+	var err error
+	select {
+	case <-j.quit:
+		err = errReplayJobStopped
+	default:
+		replayDoc, writeDoc := replayDocuments(j.replayRetrying, j.writeCheckpointed)
+		err = replayRange(first, last, j.workers, replayDoc, writeDoc)
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	// Rearm the job for resuming later
+	j.quit = make(chan struct{})
+	if saveErr := j.store.Save(j.cp); err == nil {
+		err = saveErr
+	}
+	switch {
+	case err == nil:
+		j.state = ReplayJobDone
+	case err == errReplayJobStopped:
+		j.state = ReplayJobStopped
+	default:
+		j.state, j.err = ReplayJobFailed, err
+	}
+	return err
+}
+
+// Stop interrupts a running job after the block being written, saving its
+// checkpoint. It returns immediately, Run returns once the job stopped. Stopping
+// a job not running yet makes its next Run return right away.
+func (j *ReplayJob) Stop() {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	select {
+	case <-j.quit:
+	default:
+		close(j.quit)
+	}
+}
+
+// Status returns the current progress of the job.
+func (j *ReplayJob) Status() *ReplayJobStatus {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+
+	status := &ReplayJobStatus{
+		State:    j.state,
+		First:    j.cp.First,
+		Last:     j.cp.Last,
+		Next:     j.cp.Next,
+		Progress: float64(j.cp.Next-j.cp.First) / float64(j.cp.Last-j.cp.First+1),
+		Failures: append([]*ReplayFailure{}, j.cp.Failures...),
+	}
+	if j.state == ReplayJobRunning {
+		if elapsed := time.Since(j.started).Seconds(); elapsed > 0 {
+			status.Rate = float64(j.cp.Next-j.resumed) / elapsed
+		}
+	}
+	if j.err != nil {
+		status.Error = j.err.Error()
+	}
+	return status
+}
+
+// replayRetrying replays a block, retrying failures with a growing delay. Blocks
+// still failing after the last retry are remembered for the writer, so that
+// the range carries on. Blocks diverging from the chain are given up on right
+// away, as replaying them again yields the same result.
+func (j *ReplayJob) replayRetrying(number uint64) (string, error) {
+	delay := replayRetryDelay
+	for attempt := 1; ; attempt++ {
+		doc, err := j.replay(number)
+		if err == nil {
+			return doc, nil
+		}
+		if _, mismatch := err.(*ReplayMismatchError); mismatch || attempt > j.retries {
+			glog.V(logger.Warn).Infof("Giving up on replaying block #%d after %d attempts: %v", number, attempt, err)
+
+			j.lock.Lock()
+			j.failed[number] = &ReplayFailure{Block: number, Attempts: attempt, Error: err.Error()}
+			j.lock.Unlock()
+			return "", nil
+		}
+		glog.V(logger.Debug).Infof("Replay of block #%d failed, retrying: %v", number, err)
+		select {
+		case <-time.After(delay):
+		case <-j.quit:
+			return "", errReplayJobStopped
+		}
+		delay *= 2
+	}
+}
+
+// writeCheckpointed writes a replayed block, or records it as failed, and
+// advances the checkpoint past it.
+func (j *ReplayJob) writeCheckpointed(number uint64, doc string) error {
+	j.lock.Lock()
+	failure := j.failed[number]
+	delete(j.failed, number)
+	j.lock.Unlock()
+
+	if failure == nil {
+		if err := j.write(number, doc); err != nil {
+			return err
+		}
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.cp.Next = number + 1
+	if failure != nil {
+		j.cp.Failures = append(j.cp.Failures, failure)
+	}
+	if failure != nil || time.Since(j.saved) >= j.interval {
+		if err := j.store.Save(j.cp); err != nil {
+			return err
+		}
+		j.saved = time.Now()
+	}
+	select {
+	case <-j.quit:
+		return errReplayJobStopped
+	default:
+		return nil
+	}
+}
+
+var (
+	replayJobsKey          = []byte("replay-jobs")            // ids of all replay jobs, JSON encoded
+	replayJobPrefix        = []byte("replay-job-")            // replayJobPrefix + id -> replayJobRecord
+	replayCheckpointPrefix = []byte("replay-job-checkpoint-") // replayCheckpointPrefix + id -> ReplayCheckpoint
+)
+
+// ReplayJobSpec describes a replay job started over RPC: the blocks between From
+// and To (inclusive) are replayed into the replay sink Sink, confined to the
+// replay output directory (see NewSandboxedReplaySink).
+type ReplayJobSpec struct {
+	From    uint64               `json:"from"`
+	To      uint64               `json:"to"`
+	Sink    string               `json:"sink"`
+	Retries int                  `json:"retries"` // attempts per block after the first
+	Workers int                  `json:"workers"` // blocks replayed concurrently, 1 if unset
+	Config  *replay.ReplayConfig `json:"config,omitempty"`
+}
+
+// replayJobRecord is the database entry of a replay job.
+type replayJobRecord struct {
+	Spec    *ReplayJobSpec `json:"spec"`
+	Stopped bool           `json:"stopped"` // stopped over RPC, not resumed on startup
+}
+
+// replayJobs runs the replay jobs of a node, persisting them in the chain
+// database. Jobs interrupted by a shutdown are resumed on startup.
+type replayJobs struct {
+	eth  *Ethereum
+	db   ethdb.Database
+	lock sync.Mutex
+	ids  []uint64
+	jobs map[uint64]*managedReplayJob
+	wg   sync.WaitGroup
+}
+
+// managedReplayJob is a replay job along with its database entry.
+type managedReplayJob struct {
+	*ReplayJob
+	rec     *replayJobRecord
+	sink    ReplaySink // open while running
+	running bool
+}
+
+func newReplayJobs(eth *Ethereum) *replayJobs {
+	return &replayJobs{
+		eth:  eth,
+		db:   eth.chainDb,
+		jobs: make(map[uint64]*managedReplayJob),
+	}
+}
+
+// start loads the persisted jobs and resumes the ones not stopped or done.
+func (m *replayJobs) start() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if data, _ := m.db.Get(replayJobsKey); len(data) > 0 {
+		if err := json.Unmarshal(data, &m.ids); err != nil {
+			return fmt.Errorf("invalid replay job list: %v", err)
+		}
+	}
+	for _, id := range m.ids {
+		data, _ := m.db.Get(replayJobKey(replayJobPrefix, id))
+		rec := new(replayJobRecord)
+		if err := json.Unmarshal(data, rec); err != nil {
+			return fmt.Errorf("invalid replay job %d: %v", id, err)
+		}
+		job, err := m.newJob(id, rec)
+		if err != nil {
+			return fmt.Errorf("replay job %d: %v", id, err)
+		}
+		m.jobs[id] = job
+		if status := job.Status(); !rec.Stopped && status.State != ReplayJobDone {
+			glog.V(logger.Info).Infof("Resuming replay job %d at block #%d", id, status.Next)
+			m.run(id, job)
+		}
+	}
+	return nil
+}
+
+// stop interrupts all running jobs, leaving them to be resumed on startup.
+func (m *replayJobs) stop() {
+	m.lock.Lock()
+	for _, job := range m.jobs {
+		job.Stop()
+	}
+	m.lock.Unlock()
+
+	m.wg.Wait()
+}
+
+// newJob creates the replay job described by a database entry. Blocks are
+// replayed through the API backend, so that they are verified and indexed as
+// configured.
+func (m *replayJobs) newJob(id uint64, rec *replayJobRecord) (*managedReplayJob, error) {
+	var (
+		spec  = rec.Spec
+		store = &replayCheckpointDB{db: m.db, key: replayJobKey(replayCheckpointPrefix, id)}
+		job   = &managedReplayJob{rec: rec}
+	)
+	replay := func(number uint64) (string, error) {
+		return m.eth.ApiBackend.ReplayBlockByNumber(context.Background(), rpc.BlockNumber(number), spec.Config)
+	}
+	write := func(number uint64, doc string) error {
+		return job.sink.WriteBlock(number, []byte(doc))
+	}
+	var err error
+	if job.ReplayJob, err = NewReplayJob(store, spec.From, spec.To, spec.Retries, spec.Workers, replay, write); err != nil {
+		return nil, err
+	}
+	if replaySinkAppends(spec.Sink) {
+		job.CheckpointEveryBlock()
+	}
+	return job, nil
+}
+
+// run runs a job in the background, writing into its sink. The lock must be
+// held.
+func (m *replayJobs) run(id uint64, job *managedReplayJob) {
+	job.running = true
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer func() {
+			m.lock.Lock()
+			job.running = false
+			m.lock.Unlock()
+		}()
+		var err error
+		if job.sink, err = NewSandboxedReplaySink(job.rec.Spec.Sink, m.eth.replaySinks); err != nil {
+			glog.V(logger.Warn).Infof("Replay job %d failed to open its sink: %v", id, err)
+			return
+		}
+		defer job.sink.Close()
+
+		if err := job.Run(); err != nil && err != errReplayJobStopped {
+			glog.V(logger.Warn).Infof("Replay job %d failed: %v", id, err)
+			return
+		}
+		status := job.Status()
+		glog.V(logger.Info).Infof("Replay job %d %s at block #%d, %d blocks failed", id, status.State, status.Next, len(status.Failures))
+	}()
+}
+
+// add persists and starts a new job.
+func (m *replayJobs) add(spec *ReplayJobSpec) (uint64, error) {
+	if spec.Config != nil {
+		if err := spec.Config.Validate(); err != nil {
+			return 0, err
+		}
+	}
+	if head := m.eth.blockchain.CurrentBlock().NumberU64(); spec.To > head {
+		return 0, fmt.Errorf("last block #%d beyond chain head #%d", spec.To, head)
+	}
+	_, path, err := parseReplaySink(spec.Sink)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := m.eth.replaySinks.sandboxPath(path); err != nil {
+		return 0, err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	id := uint64(len(m.ids) + 1)
+	rec := &replayJobRecord{Spec: spec}
+	job, err := m.newJob(id, rec)
+	if err != nil {
+		return 0, err
+	}
+	if err := m.save(id, rec); err != nil {
+		return 0, err
+	}
+	ids, _ := json.Marshal(append(m.ids, id))
+	if err := m.db.Put(replayJobsKey, ids); err != nil {
+		return 0, err
+	}
+	m.ids = append(m.ids, id)
+	m.jobs[id] = job
+	m.run(id, job)
+	return id, nil
+}
+
+// setStopped stops or resumes a job, persisting the choice across restarts.
+func (m *replayJobs) setStopped(id uint64, stopped bool) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	job := m.jobs[id]
+	if job == nil {
+		return fmt.Errorf("replay job %d not found", id)
+	}
+	if !stopped {
+		if job.running {
+			return fmt.Errorf("replay job %d is running", id)
+		}
+		if job.Status().State == ReplayJobDone {
+			return fmt.Errorf("replay job %d is done", id)
+		}
+	}
+	job.rec.Stopped = stopped
+	if err := m.save(id, job.rec); err != nil {
+		return err
+	}
+	if stopped {
+		// Stopping an idle job would make its next resume return right away
+		if job.running {
+			job.Stop()
+		}
+	} else {
+		m.run(id, job)
+	}
+	return nil
+}
+
+// status returns the progress of a job, nil if unknown.
+func (m *replayJobs) status(id uint64) *ReplayJobStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if job := m.jobs[id]; job != nil {
+		return job.Status()
+	}
+	return nil
+}
+
+func (m *replayJobs) save(id uint64, rec *replayJobRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return m.db.Put(replayJobKey(replayJobPrefix, id), data)
+}
+
+// replayJobKey assembles the database key of a job entry.
+func replayJobKey(prefix []byte, id uint64) []byte {
+	return append(common.CopyBytes(prefix), []byte(fmt.Sprint(id))...)
+}
+
+// PrivateReplayJobAPI manages the replay jobs of the node. It is private as
+// jobs write into the local filesystem, if only into the replay output
+// directory.
+type PrivateReplayJobAPI struct {
+	jobs *replayJobs
+}
+
+// NewPrivateReplayJobAPI creates a new replay job API.
+func NewPrivateReplayJobAPI(eth *Ethereum) *PrivateReplayJobAPI {
+	return &PrivateReplayJobAPI{jobs: eth.replayJobs}
+}
+
+// StartJob starts a checkpointed replay of a block range into a replay sink,
+// returning the id of the job.
+func (api *PrivateReplayJobAPI) StartJob(spec ReplayJobSpec) (uint64, error) {
+	return api.jobs.add(&spec)
+}
+
+// StopJob stops a replay job. Stopped jobs are not resumed on startup.
+func (api *PrivateReplayJobAPI) StopJob(id uint64) error {
+	return api.jobs.setStopped(id, true)
+}
+
+// ResumeJob resumes a stopped or failed replay job from its checkpoint.
+func (api *PrivateReplayJobAPI) ResumeJob(id uint64) error {
+	return api.jobs.setStopped(id, false)
+}
+
+// GetJob returns the progress of a replay job.
+func (api *PrivateReplayJobAPI) GetJob(id uint64) (*ReplayJobStatus, error) {
+	if status := api.jobs.status(id); status != nil {
+		return status, nil
+	}
+	return nil, fmt.Errorf("replay job %d not found", id)
+}
+
+// ListJobs returns the progress of all replay jobs, by id.
+func (api *PrivateReplayJobAPI) ListJobs() map[uint64]*ReplayJobStatus {
+	api.jobs.lock.Lock()
+	defer api.jobs.lock.Unlock()
+
+	jobs := make(map[uint64]*ReplayJobStatus, len(api.jobs.jobs))
+	for id, job := range api.jobs.jobs {
+		jobs[id] = job.Status()
+	}
+	return jobs
+}
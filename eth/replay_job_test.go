@@ -0,0 +1,222 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/replay/schema"
+)
+
+// Tests that failing blocks are retried and, once the retries are exhausted,
+// recorded in the checkpoint without stopping the job.
+func TestReplayJobRetries(t *testing.T) {
+	defer func(delay time.Duration) { replayRetryDelay = delay }(replayRetryDelay)
+	replayRetryDelay = 0
+
+	db, _ := ethdb.NewMemDatabase()
+	store := &replayCheckpointDB{db: db, key: []byte("checkpoint")}
+
+	attempts := make(map[uint64]int)
+	replay := func(number uint64) (string, error) {
+		attempts[number]++
+		switch {
+		case number == 2 && attempts[number] == 1:
+			return "", errors.New("transient")
+		case number == 3:
+			return "", errors.New("permanent")
+		}
+		return fmt.Sprint(number), nil
+	}
+	var written []uint64
+	write := func(number uint64, doc string) error {
+		written = append(written, number)
+		return nil
+	}
+	job, err := NewReplayJob(store, 1, 5, 2, 1, replay, write)
+	if err != nil {
+		t.Fatalf("failed to create job: %v", err)
+	}
+	if err := job.Run(); err != nil {
+		t.Fatalf("job failed: %v", err)
+	}
+	if want := []uint64{1, 2, 4, 5}; !reflect.DeepEqual(written, want) {
+		t.Errorf("written blocks mismatch: have %v, want %v", written, want)
+	}
+	if attempts[3] != 3 {
+		t.Errorf("attempt count mismatch: have %d, want 3", attempts[3])
+	}
+	status := job.Status()
+	if status.State != ReplayJobDone || status.Next != 6 || status.Progress != 1 {
+		t.Errorf("status mismatch: %+v", status)
+	}
+	cp, err := store.Load()
+	if err != nil || cp == nil {
+		t.Fatalf("failed to load checkpoint: %v", err)
+	}
+	if want := []*ReplayFailure{{Block: 3, Attempts: 3, Error: "permanent"}}; !reflect.DeepEqual(cp.Failures, want) {
+		t.Errorf("failures mismatch: have %+v, want %+v", cp.Failures, want[0])
+	}
+	// Done jobs stay done
+	if job, err = NewReplayJob(store, 1, 5, 2, 1, replay, write); err != nil || job.Status().State != ReplayJobDone {
+		t.Errorf("reloaded job not done: %v", err)
+	}
+}
+
+// Tests that blocks diverging from the chain are recorded as failures without
+// retrying them, and that jobs checkpointing every block save before each write.
+func TestReplayJobMismatch(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	store := &replayCheckpointDB{db: db, key: []byte("checkpoint")}
+
+	attempts := make(map[uint64]int)
+	replay := func(number uint64) (string, error) {
+		attempts[number]++
+		if number == 3 {
+			return "diverging", &ReplayMismatchError{Number: 3, Mismatches: []*schema.Mismatch{{Tx: -1, Field: "stateRoot"}}}
+		}
+		return fmt.Sprint(number), nil
+	}
+	var written []uint64
+	write := func(number uint64, doc string) error {
+		if cp, _ := store.Load(); number > 1 && (cp == nil || cp.Next != number) {
+			t.Errorf("block %d: checkpoint not saved after the previous block: %+v", number, cp)
+		}
+		written = append(written, number)
+		return nil
+	}
+	job, err := NewReplayJob(store, 1, 5, 2, 1, replay, write)
+	if err != nil {
+		t.Fatalf("failed to create job: %v", err)
+	}
+	job.CheckpointEveryBlock()
+	if err := job.Run(); err != nil {
+		t.Fatalf("job failed: %v", err)
+	}
+	if want := []uint64{1, 2, 4, 5}; !reflect.DeepEqual(written, want) {
+		t.Errorf("written blocks mismatch: have %v, want %v", written, want)
+	}
+	if attempts[3] != 1 {
+		t.Errorf("diverging block retried: %d attempts", attempts[3])
+	}
+	status := job.Status()
+	if status.State != ReplayJobDone || len(status.Failures) != 1 || status.Failures[0].Block != 3 || status.Failures[0].Attempts != 1 {
+		t.Errorf("status mismatch: %+v", status)
+	}
+}
+
+// Tests that a stopped job saves its checkpoint and resumes from it.
+func TestReplayJobResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replayjob")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	bc, _ := newTestReplayChain(t, 5, testReplayTransfers)
+	store := NewReplayCheckpointFile(filepath.Join(dir, "checkpoint.json"))
+
+	var (
+		job     *ReplayJob
+		written []uint64
+	)
+	write := func(number uint64, doc string) error {
+		if len(doc) == 0 {
+			return errors.New("empty document")
+		}
+		written = append(written, number)
+		if number == 3 {
+			job.Stop()
+		}
+		return nil
+	}
+	if job, err = NewChainReplayJob(store, bc, nil, 1, 5, 0, 2, nil, write); err != nil {
+		t.Fatalf("failed to create job: %v", err)
+	}
+	if err := job.Run(); err != errReplayJobStopped {
+		t.Fatalf("stop error mismatch: have %v, want %v", err, errReplayJobStopped)
+	}
+	if status := job.Status(); status.State != ReplayJobStopped || status.Next != 4 {
+		t.Errorf("stopped status mismatch: %+v", status)
+	}
+	// A job over another range cannot pick up the checkpoint
+	if _, err := NewChainReplayJob(store, bc, nil, 1, 4, 0, 2, nil, write); err == nil {
+		t.Errorf("checkpoint of another range accepted")
+	}
+	if job, err = NewChainReplayJob(store, bc, nil, 1, 5, 0, 2, nil, write); err != nil {
+		t.Fatalf("failed to reload job: %v", err)
+	}
+	if err := job.Run(); err != nil {
+		t.Fatalf("resumed job failed: %v", err)
+	}
+	if want := []uint64{1, 2, 3, 4, 5}; !reflect.DeepEqual(written, want) {
+		t.Errorf("written blocks mismatch: have %v, want %v", written, want)
+	}
+	// Stopping an idle job makes it return right away
+	job, _ = NewReplayJob(NewReplayCheckpointFile(filepath.Join(dir, "idle.json")), 1, 5, 0, 1, chainReplayer(bc, nil), write)
+	job.Stop()
+	if err := job.Run(); err != errReplayJobStopped || job.Status().Next != 1 {
+		t.Errorf("idle stop mismatch: %v, %+v", err, job.Status())
+	}
+}
+
+// Tests that stopping an idle job more than once does not keep it from being
+// resumed.
+func TestReplayJobsStopResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replayjobs")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	bc, db := newTestReplayChain(t, 3, testReplayCounter)
+	eth := &Ethereum{blockchain: bc, chainDb: db, replaySinks: &ReplaySinkConfig{Dir: dir}}
+	eth.ApiBackend = &EthApiBackend{eth: eth}
+	jobs := newReplayJobs(eth)
+
+	rec := &replayJobRecord{Spec: &ReplayJobSpec{From: 1, To: 3, Sink: "blocks"}, Stopped: true}
+	job, err := jobs.newJob(1, rec)
+	if err != nil {
+		t.Fatalf("failed to create job: %v", err)
+	}
+	jobs.jobs[1] = job
+
+	for i := 0; i < 2; i++ {
+		if err := jobs.setStopped(1, true); err != nil {
+			t.Fatalf("stop %d failed: %v", i, err)
+		}
+	}
+	if err := jobs.setStopped(1, false); err != nil {
+		t.Fatalf("resume failed: %v", err)
+	}
+	jobs.wg.Wait()
+
+	if status := jobs.status(1); status.State != ReplayJobDone || status.Next != 4 {
+		t.Errorf("status mismatch: %+v", status)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "blocks")); len(files) != 3 {
+		t.Errorf("written blocks mismatch: have %d, want 3", len(files))
+	}
+}
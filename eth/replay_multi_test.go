@@ -0,0 +1,82 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/replay"
+)
+
+// countingTracer counts the transactions and instructions it is hooked into.
+type countingTracer struct {
+	replay.DefaultTracer
+	txs, instructions int
+}
+
+func (c *countingTracer) TxInit(seq int) { c.txs++ }
+
+func (c *countingTracer) InitTrace(name string, pc int, gas int, calldepth int) int {
+	c.instructions++
+	return c.DefaultTracer.InitTrace(name, pc, gas, calldepth)
+}
+
+// Tests that tracers added to the replay config are fed the same execution as
+// the replay tracer, without altering the replay documents.
+func TestReplayMultiTracer(t *testing.T) {
+	bc, chainDb := newTestReplayChain(t, 3, testReplayCounter)
+
+	var plain, multi bytes.Buffer
+	if err := WriteReplayBlock(&plain, bc, 2, nil); err != nil {
+		t.Fatalf("failed to replay block: %v", err)
+	}
+	counter := new(countingTracer)
+	if err := WriteReplayBlock(&multi, bc, 2, &replay.ReplayConfig{Tracers: []replay.Tracer{counter}}); err != nil {
+		t.Fatalf("failed to replay block with extra tracers: %v", err)
+	}
+	if !bytes.Equal(plain.Bytes(), multi.Bytes()) {
+		t.Errorf("extra tracers altered the document:\nhave %s\nwant %s", multi.String(), plain.String())
+	}
+	block := replayLimited(t, bc, 2, nil)
+	instructions := 0
+	for _, tx := range block.Transactions {
+		instructions += tx.InstructionCount
+	}
+	if counter.txs != len(block.Transactions) {
+		t.Errorf("counted transactions mismatch: have %d, want %d", counter.txs, len(block.Transactions))
+	}
+	if counter.instructions != instructions {
+		t.Errorf("counted instructions mismatch: have %d, want %d", counter.instructions, instructions)
+	}
+
+	// A second replay tracer fed the same hooks must record the same transaction
+	tx := bc.GetBlockByNumber(2).Transactions()[1]
+	secondary := new(replay.ReplayTracer)
+	var want, have bytes.Buffer
+	if err := WriteReplayTransaction(&want, bc, chainDb, tx.Hash(), &replay.ReplayConfig{Tracers: []replay.Tracer{secondary}}); err != nil {
+		t.Fatalf("failed to replay transaction: %v", err)
+	}
+	if err := secondary.WriteTransaction(&have, fmt.Sprintf("\"transferTrace\":%s", secondary.StrTxTransfer(1)), numField("schemaVersion", replay.SchemaVersion)); err != nil {
+		t.Fatalf("failed to write secondary transaction: %v", err)
+	}
+	// The sender is only recorded by the primary tracer, see replayApplyTransaction
+	if !bytes.Contains(want.Bytes(), bytes.TrimPrefix(have.Bytes(), []byte("{"))) {
+		t.Errorf("secondary tracer recorded a different transaction:\nhave %s\nwant %s", have.String(), want.String())
+	}
+}
@@ -0,0 +1,204 @@
+package eth
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/replay/parity"
+	"github.com/ethereum/go-ethereum/replay/schema"
+	"github.com/ethereum/go-ethereum/rpc"
+	"golang.org/x/net/context"
+)
+
+// Parity trace types accepted by trace_replayBlockTransactions.
+const (
+	parityTraceType     = "trace"
+	parityStateDiffType = "stateDiff"
+	parityVmTraceType   = "vmTrace"
+)
+
+// ParityTraceResults is the replay of a single transaction in the shape of
+// Parity's trace_replayBlockTransactions. The trace and state diff are only set
+// if requested, the VM trace is not supported.
+type ParityTraceResults struct {
+	Output          hexutil.Bytes    `json:"output"`
+	StateDiff       parity.StateDiff `json:"stateDiff"`
+	Trace           []*parity.Trace  `json:"trace"`
+	VmTrace         interface{}      `json:"vmTrace"`
+	TransactionHash common.Hash      `json:"transactionHash"`
+}
+
+// ParityReplayBlockTransactions derives the Parity traces and state diffs of
+// the transactions of a replayed block, as selected by traceTypes.
+func ParityReplayBlockTransactions(bc *core.BlockChain, doc *schema.Block, traceTypes []string) ([]*ParityTraceResults, error) {
+	var traces, stateDiffs bool
+	for _, kind := range traceTypes {
+		switch kind {
+		case parityTraceType:
+			traces = true
+		case parityStateDiffType:
+			stateDiffs = true
+		case parityVmTraceType:
+			return nil, fmt.Errorf("trace type %q not supported", kind)
+		default:
+			return nil, fmt.Errorf("unknown trace type %q", kind)
+		}
+	}
+	var readers []parity.StorageReader
+	if stateDiffs {
+		var err error
+		if readers, err = replayPreStorage(bc, doc); err != nil {
+			return nil, err
+		}
+	}
+	homestead := bc.Config().IsHomestead(new(big.Int).SetUint64(doc.Header.Number))
+
+	results := make([]*ParityTraceResults, len(doc.Transactions))
+	for i, tx := range doc.Transactions {
+		txTraces, output, err := parity.TransactionTraces(tx, homestead)
+		if err != nil {
+			return nil, fmt.Errorf("transaction %d: %v", i, err)
+		}
+		results[i] = &ParityTraceResults{Output: output, TransactionHash: tx.Hash}
+		if traces {
+			results[i].Trace = txTraces
+		}
+		if stateDiffs {
+			results[i].StateDiff = parity.TransactionStateDiff(tx, readers[i])
+		}
+	}
+	return results, nil
+}
+
+// replayPreStorage executes the transactions of a replayed block once more
+// without tracing, recording the values the storage slots each transaction
+// writes held right before it. Replay documents only carry the original values
+// of the slots read.
+func replayPreStorage(bc *core.BlockChain, doc *schema.Block) ([]parity.StorageReader, error) {
+	if len(doc.Transactions) == 0 {
+		return nil, nil
+	}
+	block := bc.GetBlock(doc.Header.Hash, doc.Header.Number)
+	if block == nil {
+		return nil, fmt.Errorf("block %x not found", doc.Header.Hash)
+	}
+	parent := bc.GetBlock(block.ParentHash(), block.NumberU64()-1)
+	if parent == nil {
+		return nil, fmt.Errorf("parent of block %x not found", doc.Header.Hash)
+	}
+	statedb, err := bc.StateAt(parent.Root())
+	if err != nil {
+		return nil, fmt.Errorf("state of block %x unavailable: %v", doc.Header.Hash, err)
+	}
+	var (
+		cfg     = bc.Config()
+		header  = block.Header()
+		usedGas = big.NewInt(0)
+		gp      = new(core.GasPool).AddGas(block.GasLimit())
+		readers = make([]parity.StorageReader, len(doc.Transactions))
+	)
+	if cfg.DAOForkSupport && cfg.DAOForkBlock != nil && cfg.DAOForkBlock.Cmp(block.Number()) == 0 {
+		core.ApplyDAOHardFork(statedb)
+	}
+	for i, tx := range block.Transactions() {
+		if i >= len(doc.Transactions) {
+			break
+		}
+		slots := make(map[common.Address]map[common.Hash]common.Hash)
+		for _, state := range doc.Transactions[i].OutputStates {
+			for key := range state.Storage {
+				if slots[state.Address] == nil {
+					slots[state.Address] = make(map[common.Hash]common.Hash)
+				}
+				slot := common.HexToHash(key)
+				slots[state.Address][slot] = statedb.GetState(state.Address, slot)
+			}
+		}
+		readers[i] = func(addr common.Address, slot common.Hash) common.Hash {
+			return slots[addr][slot]
+		}
+		statedb.StartRecord(tx.Hash(), block.Hash(), i)
+		if _, _, err := core.ApplyTransaction(cfg, bc, gp, statedb, header, tx, usedGas, vm.Config{}); err != nil {
+			return nil, fmt.Errorf("transaction %d of block #%d failed: %v", i, block.NumberU64(), err)
+		}
+	}
+	return readers, nil
+}
+
+// PublicParityTraceAPI serves the replay of blocks and transactions in the shape
+// of Parity's trace module, for tools built against it.
+type PublicParityTraceAPI struct {
+	eth *Ethereum
+}
+
+// NewPublicParityTraceAPI creates a new Parity trace API.
+func NewPublicParityTraceAPI(eth *Ethereum) *PublicParityTraceAPI {
+	return &PublicParityTraceAPI{eth: eth}
+}
+
+// replayBlock replays the requested block and decodes its document.
+func (api *PublicParityTraceAPI) replayBlock(ctx context.Context, blockNr rpc.BlockNumber) (*schema.Block, error) {
+	doc, err := api.eth.ApiBackend.ReplayBlockByNumber(ctx, blockNr, nil)
+	if err != nil {
+		return nil, err
+	}
+	block, err := schema.DecodeBlock([]byte(doc))
+	if err != nil {
+		return nil, fmt.Errorf("invalid replay document: %v", err)
+	}
+	return block, nil
+}
+
+// Block returns the call trees of all the transactions of the requested block,
+// followed by its rewards.
+func (api *PublicParityTraceAPI) Block(ctx context.Context, blockNr rpc.BlockNumber) ([]*parity.Trace, error) {
+	block, err := api.replayBlock(ctx, blockNr)
+	if err != nil {
+		return nil, err
+	}
+	traces, err := parity.BlockTraces(block, api.eth.blockchain.Config())
+	if err != nil {
+		return nil, err
+	}
+	if traces == nil {
+		traces = []*parity.Trace{}
+	}
+	return traces, nil
+}
+
+// Transaction returns the call tree of the transaction with the given hash.
+func (api *PublicParityTraceAPI) Transaction(ctx context.Context, txHash common.Hash) ([]*parity.Trace, error) {
+	_, blockHash, number, index := core.GetTransaction(api.eth.chainDb, txHash)
+	doc, err := api.eth.ApiBackend.ReplayTransaction(ctx, txHash, nil)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := schema.DecodeTransaction([]byte(doc))
+	if err != nil {
+		return nil, fmt.Errorf("invalid replay document: %v", err)
+	}
+	homestead := api.eth.blockchain.Config().IsHomestead(new(big.Int).SetUint64(number))
+	traces, _, err := parity.TransactionTraces(tx, homestead)
+	if err != nil {
+		return nil, err
+	}
+	for _, trace := range traces {
+		trace.Localize(blockHash, number, txHash, int(index))
+	}
+	return traces, nil
+}
+
+// ReplayBlockTransactions returns the traces and state diffs of every
+// transaction of the requested block, as selected by traceTypes ("trace" and
+// "stateDiff").
+func (api *PublicParityTraceAPI) ReplayBlockTransactions(ctx context.Context, blockNr rpc.BlockNumber, traceTypes []string) ([]*ParityTraceResults, error) {
+	block, err := api.replayBlock(ctx, blockNr)
+	if err != nil {
+		return nil, err
+	}
+	return ParityReplayBlockTransactions(api.eth.blockchain, block, traceTypes)
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/replay/parity"
+	"github.com/ethereum/go-ethereum/replay/schema"
+)
+
+// Tests that the Parity traces and state diffs of a block are derived from its
+// replay, with the original values of slots written blindly looked up in the
+// state before each transaction.
+func TestParityReplayBlockTransactions(t *testing.T) {
+	// Deploy a contract storing the call value without reading the slot, then
+	// call it twice in the same block
+	contract := crypto.CreateAddress(testBank.Address, 0)
+	bc, _ := newTestReplayChain(t, 2, func(i int, block *core.BlockGen) {
+		signer := types.HomesteadSigner{}
+		if i == 0 {
+			// SSTORE(0, CALLVALUE)
+			code := common.FromHex("6434600055006000526005601bf3")
+			tx, _ := types.SignTx(types.NewContractCreation(block.TxNonce(testBank.Address), new(big.Int), big.NewInt(100000), nil, code), signer, testBankKey)
+			block.AddTx(tx)
+			return
+		}
+		for j := int64(1); j <= 2; j++ {
+			tx, _ := types.SignTx(types.NewTransaction(block.TxNonce(testBank.Address), contract, big.NewInt(j), big.NewInt(100000), nil, nil), signer, testBankKey)
+			block.AddTx(tx)
+		}
+	})
+	doc, err := ReplayBlockByNumber(bc, 2)
+	if err != nil {
+		t.Fatalf("failed to replay block: %v", err)
+	}
+	block, err := schema.DecodeBlock([]byte(doc))
+	if err != nil {
+		t.Fatalf("invalid replay document: %v", err)
+	}
+	if _, err := ParityReplayBlockTransactions(bc, block, []string{"vmTrace"}); err == nil {
+		t.Errorf("vmTrace accepted")
+	}
+	results, err := ParityReplayBlockTransactions(bc, block, []string{"trace", "stateDiff"})
+	if err != nil {
+		t.Fatalf("failed to derive traces: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("result count mismatch: have %d, want 2", len(results))
+	}
+	for i, res := range results {
+		if res.TransactionHash != block.Transactions[i].Hash {
+			t.Errorf("tx %d: hash mismatch: have %x, want %x", i, res.TransactionHash, block.Transactions[i].Hash)
+		}
+		if len(res.Trace) != 1 || res.Trace[0].Type != parity.TypeCall || res.Trace[0].Error != "" {
+			t.Errorf("tx %d: trace mismatch: %+v", i, res.Trace)
+		}
+		account := res.StateDiff[contract.Hex()]
+		if account == nil {
+			t.Fatalf("tx %d: contract missing from state diff", i)
+		}
+		slot := account.Storage[common.Hash{}.Hex()]
+		want := &parity.Diff{From: common.BigToHash(big.NewInt(int64(i))).Hex(), To: common.BigToHash(big.NewInt(int64(i + 1))).Hex()}
+		if slot == nil || *slot != *want {
+			t.Errorf("tx %d: slot diff mismatch: have %+v, want %+v", i, slot, want)
+		}
+	}
+	// Traces only leave the state diffs out
+	results, err = ParityReplayBlockTransactions(bc, block, []string{"trace"})
+	if err != nil {
+		t.Fatalf("failed to derive traces: %v", err)
+	}
+	if results[0].StateDiff != nil || results[0].Trace == nil {
+		t.Errorf("trace types not honoured: %+v", results[0])
+	}
+}
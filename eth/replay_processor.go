@@ -0,0 +1,172 @@
+package eth
+
+import (
+	"bytes"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/logger"
+	"github.com/ethereum/go-ethereum/logger/glog"
+	"github.com/hashicorp/golang-lru"
+)
+
+// replayPendingLimit is the number of processed blocks whose documents are kept
+// while waiting for the blocks to be inserted into the chain.
+const replayPendingLimit = 256
+
+// ReplayProcessor is a core.Processor running blocks through the replay tracer
+// while they are imported, instead of the plain EVM. The replay documents are
+// emitted into a sink once their blocks become part of the canonical chain, so
+// that no block needs to be executed twice.
+//
+// Blocks reaching the chain without being processed, such as locally mined ones,
+// are replayed from the chain when their insertion is announced. A reorg only
+// announces the new head, so the blocks between it and the last emitted block
+// it shares an ancestor with are emitted before it.
+type ReplayProcessor struct {
+	bc    *core.BlockChain
+	sink  ReplaySink
+	index *ReplayIndex // optional, fed with every emitted document
+
+	pending *lru.Cache // documents of processed blocks awaiting insertion, by hash
+	emitted *lru.Cache // hashes of the recently emitted blocks, by number
+	first   uint64     // number of the first emitted block
+	started bool       // whether any block was emitted yet
+
+	sub *event.TypeMuxSubscription
+	wg  sync.WaitGroup
+}
+
+// NewReplayProcessor creates a replay processor for the given chain, emitting
+// the documents of imported blocks into sink. It does not install itself, see
+// core.BlockChain.SetProcessor.
+func NewReplayProcessor(bc *core.BlockChain, mux *event.TypeMux, sink ReplaySink, index *ReplayIndex) *ReplayProcessor {
+	pending, _ := lru.New(replayPendingLimit)
+	emitted, _ := lru.New(replayPendingLimit)
+	p := &ReplayProcessor{
+		bc:      bc,
+		sink:    sink,
+		index:   index,
+		pending: pending,
+		emitted: emitted,
+		sub:     mux.Subscribe(core.ChainEvent{}),
+	}
+	p.wg.Add(1)
+	go p.loop()
+	return p
+}
+
+// Process implements core.Processor, executing the block under the replay
+// tracer and keeping its document until the block is inserted.
+func (p *ReplayProcessor) Process(block *types.Block, statedb *state.StateDB, cfg vm.Config) (types.Receipts, []*types.Log, *big.Int, error) {
+	var buf bytes.Buffer
+	receipts, logs, usedGas, err := replayBlock(&buf, block, statedb, p.bc.Config(), p.bc, cfg, nil, nil, nil)
+	if err != nil {
+		if txErr, ok := err.(*replayTxError); ok {
+			err = txErr.err
+		}
+		return nil, nil, nil, err
+	}
+	p.pending.Add(block.Hash(), buf.Bytes())
+	return receipts, logs, usedGas, nil
+}
+
+// Stop stops emitting documents and closes the sink.
+func (p *ReplayProcessor) Stop() {
+	p.sub.Unsubscribe()
+	p.wg.Wait()
+	p.sink.Close()
+}
+
+// loop emits the document of every block inserted into the canonical chain.
+func (p *ReplayProcessor) loop() {
+	defer p.wg.Done()
+
+	for obj := range p.sub.Chan() {
+		ev := obj.Data.(core.ChainEvent)
+
+		// Skip blocks already replaced by a later reorg, the announcement of the
+		// new head emits their replacements
+		if canon := p.bc.GetBlockByNumber(ev.Block.NumberU64()); canon == nil || canon.Hash() != ev.Hash {
+			continue
+		}
+		for _, block := range p.missing(ev.Block) {
+			p.emit(block)
+		}
+		p.emit(ev.Block)
+	}
+}
+
+// missing returns the ancestors of a canonical block that were not emitted yet,
+// oldest first: the blocks a reorg made canonical without announcing them, back
+// to the last emitted block the old and the new chain share.
+func (p *ReplayProcessor) missing(block *types.Block) []*types.Block {
+	if !p.started {
+		return nil
+	}
+	var blocks []*types.Block
+	for parent := p.bc.GetBlock(block.ParentHash(), block.NumberU64()-1); parent != nil && parent.NumberU64() >= p.first; parent = p.bc.GetBlock(parent.ParentHash(), parent.NumberU64()-1) {
+		if hash, ok := p.emitted.Get(parent.NumberU64()); ok && hash.(common.Hash) == parent.Hash() {
+			break
+		}
+		if len(blocks) == replayPendingLimit {
+			glog.V(logger.Warn).Infof("Reorg below #%d too deep to replay, older blocks not emitted", blocks[len(blocks)-1].NumberU64())
+			break
+		}
+		blocks = append(blocks, parent)
+	}
+	for i, j := 0, len(blocks)-1; i < j; i, j = i+1, j-1 {
+		blocks[i], blocks[j] = blocks[j], blocks[i]
+	}
+	return blocks
+}
+
+// emit writes the document of a canonical block into the sink and the index.
+func (p *ReplayProcessor) emit(block *types.Block) {
+	number, hash := block.NumberU64(), block.Hash()
+	p.emitted.Add(number, hash)
+	if !p.started {
+		p.first, p.started = number, true
+	}
+	doc, err := p.document(block)
+	if err != nil {
+		glog.V(logger.Warn).Infof("Failed to replay block #%d [%x…]: %v", number, hash[:4], err)
+		return
+	}
+	if err := p.sink.WriteBlock(number, doc); err != nil {
+		glog.V(logger.Warn).Infof("Failed to emit replay of block #%d [%x…]: %v", number, hash[:4], err)
+	}
+	if p.index != nil {
+		if err := p.index.IndexDocument(doc); err != nil {
+			glog.V(logger.Warn).Infof("Failed to index replay of block #%d [%x…]: %v", number, hash[:4], err)
+		}
+	}
+}
+
+// document returns the replay document of an inserted block, replaying it from
+// the chain if it was not processed by the replay processor.
+func (p *ReplayProcessor) document(block *types.Block) ([]byte, error) {
+	if doc, ok := p.pending.Get(block.Hash()); ok {
+		p.pending.Remove(block.Hash())
+		return doc.([]byte), nil
+	}
+	parent := p.bc.GetBlock(block.ParentHash(), block.NumberU64()-1)
+	if parent == nil {
+		return nil, core.ParentError(block.ParentHash())
+	}
+	statedb, err := p.bc.StateAt(parent.Root())
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, _, _, err := replayBlock(&buf, block, statedb, p.bc.Config(), p.bc, vm.Config{}, nil, nil, nil); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,625 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/replay"
+	"github.com/ethereum/go-ethereum/replay/schema"
+)
+
+// testReplaySink collects the emitted documents for inspection.
+type testReplaySink struct {
+	docs chan []byte
+}
+
+func (s *testReplaySink) WriteBlock(number uint64, doc []byte) error {
+	s.docs <- doc
+	return nil
+}
+
+func (s *testReplaySink) Close() error { return nil }
+
+// Tests that blocks imported through the replay processor are accepted and their
+// documents emitted, matching a replay of the imported blocks on demand.
+func TestReplayProcessor(t *testing.T) {
+	var (
+		db, _       = ethdb.NewMemDatabase()
+		genesis     = core.WriteGenesisBlockForTesting(db, testBank)
+		chainConfig = &params.ChainConfig{HomesteadBlock: big.NewInt(0)}
+		mux         = new(event.TypeMux)
+	)
+	blockchain, err := core.NewBlockChain(db, chainConfig, new(core.FakePow), mux, vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to create blockchain: %v", err)
+	}
+	sink := &testReplaySink{docs: make(chan []byte, 3)}
+	processor := NewReplayProcessor(blockchain, mux, sink, nil)
+	defer processor.Stop()
+	blockchain.SetProcessor(processor)
+
+	gendb, _ := ethdb.NewMemDatabase()
+	chain, _ := core.GenerateChain(chainConfig, core.WriteGenesisBlockForTesting(gendb, testBank), gendb, 3, testReplayCounter)
+	if genesis.Hash() != chain[0].ParentHash() {
+		t.Fatalf("genesis mismatch")
+	}
+	if _, err := blockchain.InsertChain(chain); err != nil {
+		t.Fatalf("failed to import chain: %v", err)
+	}
+	for number := uint64(1); number <= 3; number++ {
+		select {
+		case doc := <-sink.docs:
+			want, err := ReplayBlockByNumber(blockchain, number)
+			if err != nil {
+				t.Fatalf("block %d: failed to replay: %v", number, err)
+			}
+			have, err := schema.DecodeBlock(doc)
+			if err != nil {
+				t.Fatalf("block %d: invalid document: %v", number, err)
+			}
+			replayed, _ := schema.DecodeBlock([]byte(want))
+			if have.Header.Hash != replayed.Header.Hash {
+				t.Errorf("block %d: hash mismatch: have %x, want %x", number, have.Header.Hash, replayed.Header.Hash)
+			}
+			if len(have.Transactions) != len(replayed.Transactions) {
+				t.Fatalf("block %d: transaction count mismatch: have %d, want %d", number, len(have.Transactions), len(replayed.Transactions))
+			}
+			for i, tx := range have.Transactions {
+				if tx.Hash != replayed.Transactions[i].Hash || len(tx.Traces) != len(replayed.Transactions[i].Traces) {
+					t.Errorf("block %d, tx %d: trace mismatch: have %x (%d traces), want %x (%d traces)", number, i, tx.Hash, len(tx.Traces), replayed.Transactions[i].Hash, len(replayed.Transactions[i].Traces))
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("block %d: document not emitted", number)
+		}
+	}
+}
+
+// Tests that the replay processor fails invalid blocks with the error of the
+// failing transaction itself, as the state processor does.
+func TestReplayProcessorInvalidBlock(t *testing.T) {
+	var (
+		db, _       = ethdb.NewMemDatabase()
+		genesis     = core.WriteGenesisBlockForTesting(db, testBank)
+		chainConfig = &params.ChainConfig{HomesteadBlock: big.NewInt(0)}
+		mux         = new(event.TypeMux)
+	)
+	blockchain, err := core.NewBlockChain(db, chainConfig, new(core.FakePow), mux, vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to create blockchain: %v", err)
+	}
+	processor := NewReplayProcessor(blockchain, mux, &testReplaySink{docs: make(chan []byte, 1)}, nil)
+	defer processor.Stop()
+
+	tx, _ := types.SignTx(types.NewTransaction(5, testReplayAddr, big.NewInt(1), params.TxGas, nil, nil), types.HomesteadSigner{}, testBankKey)
+	header := &types.Header{
+		ParentHash: genesis.Hash(),
+		Number:     big.NewInt(1),
+		GasLimit:   genesis.GasLimit(),
+		Difficulty: genesis.Difficulty(),
+		Time:       big.NewInt(10),
+	}
+	block := types.NewBlock(header, []*types.Transaction{tx}, nil, nil)
+
+	statedb, _ := blockchain.StateAt(genesis.Root())
+	if _, _, _, err := processor.Process(block, statedb, vm.Config{}); !core.IsNonceErr(err) {
+		t.Fatalf("error mismatch: have %v, want nonce error", err)
+	}
+}
+
+// Tests that the blocks a reorg makes canonical are all emitted, in order, even
+// though only the new head is announced.
+func TestReplayProcessorReorg(t *testing.T) {
+	var (
+		db, _       = ethdb.NewMemDatabase()
+		genesis     = core.WriteGenesisBlockForTesting(db, testBank)
+		chainConfig = &params.ChainConfig{HomesteadBlock: big.NewInt(0)}
+		mux         = new(event.TypeMux)
+	)
+	blockchain, err := core.NewBlockChain(db, chainConfig, new(core.FakePow), mux, vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to create blockchain: %v", err)
+	}
+	sink := &testReplaySink{docs: make(chan []byte, 8)}
+	processor := NewReplayProcessor(blockchain, mux, sink, nil)
+	defer processor.Stop()
+	blockchain.SetProcessor(processor)
+
+	// Import a chain of three blocks, then a heavier fork off its first block
+	gendb, _ := ethdb.NewMemDatabase()
+	chain, _ := core.GenerateChain(chainConfig, core.WriteGenesisBlockForTesting(gendb, testBank), gendb, 3, testReplayCounter)
+	fork, _ := core.GenerateChain(chainConfig, chain[0], gendb, 3, func(i int, block *core.BlockGen) {
+		block.SetCoinbase(common.Address{0x01})
+	})
+	if genesis.Hash() != chain[0].ParentHash() {
+		t.Fatalf("genesis mismatch")
+	}
+	if _, err := blockchain.InsertChain(chain); err != nil {
+		t.Fatalf("failed to import chain: %v", err)
+	}
+	for i := range chain {
+		select {
+		case <-sink.docs:
+		case <-time.After(time.Second):
+			t.Fatalf("document %d not emitted", i)
+		}
+	}
+	if _, err := blockchain.InsertChain(fork); err != nil {
+		t.Fatalf("failed to import fork: %v", err)
+	}
+	if head := blockchain.CurrentBlock().Hash(); head != fork[2].Hash() {
+		t.Fatalf("fork not canonical: head %x", head)
+	}
+	for i, block := range fork {
+		select {
+		case doc := <-sink.docs:
+			have, err := schema.DecodeBlock(doc)
+			if err != nil {
+				t.Fatalf("fork block %d: invalid document: %v", i, err)
+			}
+			if have.Header.Hash != block.Hash() {
+				t.Errorf("fork block %d: hash mismatch: have %x, want %x", i, have.Header.Hash, block.Hash())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("fork block %d: document not emitted", i)
+		}
+	}
+	select {
+	case doc := <-sink.docs:
+		t.Errorf("unexpected document emitted: %.100s", doc)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Tests that the file based replay sinks lay out the documents as expected.
+func TestReplayFileSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replaysink")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Directory sinks write a file per block
+	sink, err := NewReplaySink(filepath.Join(dir, "blocks"), nil)
+	if err != nil {
+		t.Fatalf("failed to create directory sink: %v", err)
+	}
+	for number := uint64(1); number <= 2; number++ {
+		if err := sink.WriteBlock(number, []byte(`{"block":1}`)); err != nil {
+			t.Fatalf("failed to write block %d: %v", number, err)
+		}
+	}
+	sink.Close()
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "blocks")); len(files) != 2 || files[0].Name() != "1.json" {
+		t.Errorf("directory sink layout mismatch: have %d files", len(files))
+	}
+	// File sinks append a line per block, across restarts
+	for i := 0; i < 2; i++ {
+		sink, err := NewReplaySink("file:"+filepath.Join(dir, "blocks.json"), nil)
+		if err != nil {
+			t.Fatalf("failed to create file sink: %v", err)
+		}
+		sink.WriteBlock(uint64(i), []byte(`{}`))
+		sink.Close()
+	}
+	if blob, _ := ioutil.ReadFile(filepath.Join(dir, "blocks.json")); string(blob) != "{}\n{}\n" {
+		t.Errorf("file sink content mismatch: have %q", blob)
+	}
+}
+
+// Tests that gzip replay sinks rotate their files by block count and size.
+func TestReplayGzipSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replaysink")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink, err := NewReplaySink("gzip:"+filepath.Join(dir, "blocks"), &ReplaySinkConfig{RotateBlocks: 2})
+	if err != nil {
+		t.Fatalf("failed to create gzip sink: %v", err)
+	}
+	for number := uint64(1); number <= 5; number++ {
+		if err := sink.WriteBlock(number, []byte(fmt.Sprintf(`{"block":%d}`, number))); err != nil {
+			t.Fatalf("failed to write block %d: %v", number, err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("failed to close sink: %v", err)
+	}
+	want := map[string]string{
+		"1.ndjson.gz": "{\"block\":1}\n{\"block\":2}\n",
+		"3.ndjson.gz": "{\"block\":3}\n{\"block\":4}\n",
+		"5.ndjson.gz": "{\"block\":5}\n",
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "blocks"))
+	if len(files) != len(want) {
+		t.Fatalf("file count mismatch: have %d, want %d", len(files), len(want))
+	}
+	for name, content := range want {
+		if have := readGzipFile(t, filepath.Join(dir, "blocks", name)); have != content {
+			t.Errorf("%s: content mismatch: have %q, want %q", name, have, content)
+		}
+	}
+	// A tiny size limit starts a new file for every block
+	sink, _ = NewReplaySink("gzip:"+filepath.Join(dir, "sized"), &ReplaySinkConfig{RotateSize: 1})
+	for number := uint64(1); number <= 3; number++ {
+		sink.WriteBlock(number, []byte(`{}`))
+	}
+	sink.Close()
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "sized")); len(files) != 3 {
+		t.Errorf("size rotation mismatch: have %d files, want 3", len(files))
+	}
+}
+
+func readGzipFile(t *testing.T, path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("failed to decompress %s: %v", path, err)
+	}
+	blob, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	return string(blob)
+}
+
+// Tests that database replay sinks store the documents by block number.
+func TestReplayDatabaseSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replaysink")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink, err := NewReplaySink("ldb:"+dir, nil)
+	if err != nil {
+		t.Fatalf("failed to create database sink: %v", err)
+	}
+	sink.WriteBlock(7, []byte(`{"block":7}`))
+	sink.Close()
+
+	db, err := ethdb.NewLDBDatabase(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to reopen database: %v", err)
+	}
+	defer db.Close()
+
+	if doc, err := ReadReplayDocument(db, 7); err != nil || string(doc) != `{"block":7}` {
+		t.Errorf("document mismatch: have %q, %v", doc, err)
+	}
+	if doc, err := ReadReplayDocument(db, 8); doc != nil || err != nil {
+		t.Errorf("unexpected document for missing block: %q, %v", doc, err)
+	}
+}
+
+// Tests that gzip and database sinks store the code of deduplicated documents
+// once across all documents, and that their readers restore the documents.
+func TestReplaySinkDedupCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replaysink")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	bc, _ := newTestReplayChain(t, 3, testReplayCounter)
+	code := common.Bytes2Hex(common.FromHex("600054600101600055" + "00"))
+	config := &replay.ReplayConfig{DedupCode: true, ContentHash: true}
+
+	docs := make([][]byte, 4)
+	for number := uint64(1); number <= 3; number++ {
+		var buf bytes.Buffer
+		if err := WriteReplayBlock(&buf, bc, number, config); err != nil {
+			t.Fatalf("failed to replay block %d: %v", number, err)
+		}
+		docs[number] = buf.Bytes()
+	}
+	// Write the blocks in two runs, the second picking up the code of the first
+	for _, spec := range []string{"gzip:" + filepath.Join(dir, "gzip"), "ldb:" + filepath.Join(dir, "ldb")} {
+		for _, blocks := range [][]uint64{{1, 2}, {3}} {
+			sink, err := NewReplaySink(spec, &ReplaySinkConfig{RotateBlocks: 1})
+			if err != nil {
+				t.Fatalf("%s: failed to create sink: %v", spec, err)
+			}
+			for _, number := range blocks {
+				if err := sink.WriteBlock(number, docs[number]); err != nil {
+					t.Fatalf("%s: failed to write block %d: %v", spec, number, err)
+				}
+			}
+			sink.Close()
+		}
+	}
+	// Block 2 and 3 call the counter deployed in block 1, stored once
+	for _, name := range []string{"1.ndjson.gz", "2.ndjson.gz", "3.ndjson.gz"} {
+		if strings.Contains(readGzipFile(t, filepath.Join(dir, "gzip", name)), string(replayCodeTable)) {
+			t.Errorf("%s: code table left in document", name)
+		}
+	}
+	blob, _ := ioutil.ReadFile(filepath.Join(dir, "gzip", replayCodeFile))
+	if n := strings.Count(string(blob), code); n != 1 {
+		t.Errorf("gzip code occurrences mismatch: have %d, want 1", n)
+	}
+	if n := strings.Count(string(blob), "\n"); n != 1 {
+		t.Errorf("gzip code count mismatch: have %d, want 1", n)
+	}
+	var read [][]byte
+	if err := ReadReplayGzip(filepath.Join(dir, "gzip"), func(doc []byte) error {
+		read = append(read, doc)
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to read gzip sink: %v", err)
+	}
+	if len(read) != 3 {
+		t.Fatalf("gzip document count mismatch: have %d, want 3", len(read))
+	}
+	db, err := ethdb.NewLDBDatabase(filepath.Join(dir, "ldb"), 0, 0)
+	if err != nil {
+		t.Fatalf("failed to reopen database: %v", err)
+	}
+	defer db.Close()
+
+	for number := uint64(1); number <= 3; number++ {
+		if !bytes.Equal(read[number-1], docs[number]) {
+			t.Errorf("block %d: gzip document mismatch", number)
+		}
+		doc, err := ReadReplayDocument(db, number)
+		if err != nil || !bytes.Equal(doc, docs[number]) {
+			t.Errorf("block %d: database document mismatch: %v", number, err)
+		}
+		if err := schema.CheckContentHash(doc); err != nil {
+			t.Errorf("block %d: %v", number, err)
+		}
+		if stored, _ := db.Get(replayDocumentKey(number)); bytes.Contains(stored, replayCodeTable) {
+			t.Errorf("block %d: code table left in database document", number)
+		}
+	}
+	// Documents referencing code missing from the sink are reported
+	db.Delete(replayCodeKey(crypto.Keccak256Hash(common.FromHex(code)).Hex()))
+	if _, err := ReadReplayDocument(db, 2); err == nil {
+		t.Errorf("missing code accepted")
+	}
+}
+
+// Tests that the outputs requested over RPC cannot leave the output directory.
+func TestReplaySandbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replaysink")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	os.Mkdir(out, 0755)
+	os.Symlink(dir, filepath.Join(out, "escape"))
+
+	if _, err := (*ReplaySinkConfig)(nil).sandboxPath("blocks"); err != errReplayOutputDisabled {
+		t.Errorf("disabled error mismatch: have %v, want %v", err, errReplayOutputDisabled)
+	}
+	config := &ReplaySinkConfig{Dir: out}
+	for _, path := range []string{"", "/etc/passwd", "..", "../blocks", "a/../../blocks", "escape/blocks", "escape"} {
+		if _, err := config.sandboxPath(path); err == nil {
+			t.Errorf("path %q accepted", path)
+		}
+	}
+	for _, path := range []string{"blocks", "a/b/blocks.json.gz", "a/../blocks"} {
+		if _, err := config.sandboxPath(path); err != nil {
+			t.Errorf("path %q rejected: %v", path, err)
+		}
+	}
+	if _, err := NewSandboxedReplaySink("file:../blocks.json", config); err == nil {
+		t.Errorf("escaping sink accepted")
+	}
+	// Saved files are replaced, not overwritten in place
+	path, _ := config.sandboxPath("block.json")
+	for _, doc := range []string{`{"long":"document"}`, `{}`} {
+		if err := writeReplayFile(path, func(w io.Writer) error { _, err := io.WriteString(w, doc); return err }); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+	if blob, _ := ioutil.ReadFile(path); string(blob) != `{}` {
+		t.Errorf("saved content mismatch: have %q", blob)
+	}
+	if err := writeReplayFile(path, func(w io.Writer) error { return errors.New("failed") }); err == nil {
+		t.Errorf("write failure not reported")
+	}
+	if files, _ := ioutil.ReadDir(out); len(files) != 2 {
+		t.Errorf("leftover temporary files: have %d entries, want 2", len(files))
+	}
+}
+
+// Tests that the socket replay sink streams documents to its clients.
+func TestReplaySocketSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replaysink")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "replay.sock")
+	sink, err := NewReplaySink("unix:"+path, nil)
+	if err != nil {
+		t.Fatalf("failed to create socket sink: %v", err)
+	}
+	defer sink.Close()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// Wait for the client to be registered before emitting
+	for i := 0; ; i++ {
+		sink.(*replaySocketSink).lock.Lock()
+		n := len(sink.(*replaySocketSink).conns)
+		sink.(*replaySocketSink).lock.Unlock()
+		if n > 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("client not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sink.WriteBlock(1, []byte(`{"block":1}`))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read document: %v", err)
+	}
+	if line != "{\"block\":1}\n" {
+		t.Errorf("document mismatch: have %q", line)
+	}
+}
+
+// Tests that the socket replay sink replaces a stale socket, but refuses to
+// remove a file that is not a socket.
+func TestReplaySocketSinkExisting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replaysink")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Leave a socket behind as a crashed run would
+	path := filepath.Join(dir, "replay.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("failed to create stale socket: %v", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	sink, err := NewReplaySink("unix:"+path, nil)
+	if err != nil {
+		t.Fatalf("failed to replace stale socket: %v", err)
+	}
+	sink.Close()
+
+	// Regular files are left alone
+	path = filepath.Join(dir, "replay.txt")
+	if err := ioutil.WriteFile(path, []byte("keep"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if _, err := NewReplaySink("unix:"+path, nil); err == nil {
+		t.Fatalf("replaced a regular file")
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "keep" {
+		t.Errorf("regular file modified: %q, %v", data, err)
+	}
+}
+
+// Tests that a socket client not reading its documents is dropped without
+// holding up the sink or new clients.
+func TestReplaySocketSinkStalled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replaysink")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "replay.sock")
+	sink, err := NewReplaySink("unix:"+path, nil)
+	if err != nil {
+		t.Fatalf("failed to create socket sink: %v", err)
+	}
+	defer sink.Close()
+	socket := sink.(*replaySocketSink)
+
+	clients := func() int {
+		socket.lock.Lock()
+		defer socket.lock.Unlock()
+		return len(socket.conns)
+	}
+	stalled, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer stalled.Close()
+	for i := 0; clients() == 0; i++ {
+		if i == 100 {
+			t.Fatalf("client not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Emit far more than the socket and the backlog hold, without blocking
+	doc := make([]byte, 64*1024)
+	for i := range doc {
+		doc[i] = 'x'
+	}
+	start := time.Now()
+	for i := 0; i < 4*replaySocketBacklog; i++ {
+		sink.WriteBlock(uint64(i), doc)
+	}
+	if elapsed := time.Since(start); elapsed > replaySocketTimeout/2 {
+		t.Errorf("stalled client held up the sink for %v", elapsed)
+	}
+	if n := clients(); n != 0 {
+		t.Fatalf("stalled client not dropped, %d clients", n)
+	}
+	// New clients are still accepted and served
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	for i := 0; clients() == 0; i++ {
+		if i == 100 {
+			t.Fatalf("client not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sink.WriteBlock(1, []byte(`{"block":1}`))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read document: %v", err)
+	}
+	if line != "{\"block\":1}\n" {
+		t.Errorf("document mismatch: have %q", line)
+	}
+}
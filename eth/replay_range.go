@@ -0,0 +1,171 @@
+package eth
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/logger"
+	"github.com/ethereum/go-ethereum/logger/glog"
+	"github.com/ethereum/go-ethereum/replay"
+)
+
+// replayAhead is the number of blocks per worker that may be replayed ahead of
+// the next block to write, bounding the documents held in memory.
+const replayAhead = 2
+
+// replayResult is the outcome of replaying a single block of a range.
+type replayResult struct {
+	number uint64
+	result interface{}
+	err    error
+}
+
+// ReplayRange replays the canonical blocks between first and last (inclusive)
+// concurrently on the given number of workers, and hands their documents to the
+// write callback in block order. Replaying stops at the first failure. The code
+// traces are limited according to config, if given.
+func ReplayRange(bc *core.BlockChain, first, last uint64, workers int, config *replay.ReplayConfig, write func(number uint64, doc string) error) error {
+	replayDoc, writeDoc := replayDocuments(chainReplayer(bc, config), write)
+	return replayRange(first, last, workers, replayDoc, writeDoc)
+}
+
+// VerifyReplayRange is like ReplayRange, but verifies every block against the
+// receipts and state roots stored in chainDb. A diverging block is still handed
+// to the write callback, after which replaying stops with a *ReplayMismatchError.
+func VerifyReplayRange(bc *core.BlockChain, chainDb ethdb.Database, first, last uint64, workers int, config *replay.ReplayConfig, write func(number uint64, doc string) error) error {
+	replayDoc, writeDoc := replayDocuments(chainVerifier(bc, chainDb, config), write)
+	return replayRange(first, last, workers, replayDoc, writeDoc)
+}
+
+// NewChainReplayJob creates a checkpointed replay job over blocks of the local
+// chain, see NewReplayJob. If chainDb is given, every block is verified like in
+// VerifyReplayRange.
+func NewChainReplayJob(store ReplayCheckpointStore, bc *core.BlockChain, chainDb ethdb.Database, first, last uint64, retries, workers int, config *replay.ReplayConfig, write func(number uint64, doc string) error) (*ReplayJob, error) {
+	replayer := chainReplayer(bc, config)
+	if chainDb != nil {
+		replayer = chainVerifier(bc, chainDb, config)
+	}
+	return NewReplayJob(store, first, last, retries, workers, replayer, write)
+}
+
+// chainReplayer returns a function replaying blocks of the chain by number.
+func chainReplayer(bc *core.BlockChain, config *replay.ReplayConfig) func(number uint64) (string, error) {
+	return func(number uint64) (string, error) {
+		var buf bytes.Buffer
+		if err := WriteReplayBlock(&buf, bc, number, config); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
+}
+
+// chainVerifier is like chainReplayer, but verifies the replayed blocks. The
+// documents of diverging blocks are returned along with a *ReplayMismatchError.
+func chainVerifier(bc *core.BlockChain, chainDb ethdb.Database, config *replay.ReplayConfig) func(number uint64) (string, error) {
+	return func(number uint64) (string, error) {
+		var buf bytes.Buffer
+		err := VerifyReplayBlock(&buf, bc, chainDb, number, config)
+		if _, ok := err.(*ReplayMismatchError); err != nil && !ok {
+			return "", err
+		}
+		return buf.String(), err
+	}
+}
+
+// replayDocuments adapts the replay and write functions of block documents to
+// replayRange.
+func replayDocuments(replay func(number uint64) (string, error), write func(number uint64, doc string) error) (func(number uint64) (interface{}, error), func(number uint64, result interface{}) error) {
+	replayDoc := func(number uint64) (interface{}, error) {
+		return replay(number)
+	}
+	writeDoc := func(number uint64, result interface{}) error {
+		return write(number, result.(string))
+	}
+	return replayDoc, writeDoc
+}
+
+// replayRange runs the given replay function over a range of blocks, handing
+// the results to the write function in block order.
+func replayRange(first, last uint64, workers int, replay func(number uint64) (interface{}, error), write func(number uint64, result interface{}) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		tasks   = make(chan uint64)
+		results = make(chan *replayResult, workers)
+		slots   = make(chan struct{}, workers*replayAhead)
+		quit    = make(chan struct{})
+		wg      sync.WaitGroup
+	)
+	// Start the workers, each replaying on its own tracer and state
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for number := range tasks {
+				result, err := replay(number)
+				results <- &replayResult{number: number, result: result, err: err}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	// Feed the block numbers to the workers, waiting for the writer to catch up
+	go func() {
+		defer close(tasks)
+		for number := first; ; number++ {
+			select {
+			case slots <- struct{}{}:
+			case <-quit:
+				return
+			}
+			select {
+			case tasks <- number:
+			case <-quit:
+				return
+			}
+			if number == last {
+				return
+			}
+		}
+	}()
+	// Write the results in block order, reporting progress every now and then
+	var (
+		pending = make(map[uint64]*replayResult)
+		next    = first
+		report  = time.Now()
+		err     error
+	)
+	for res := range results {
+		if err != nil {
+			continue // drain the remaining workers
+		}
+		pending[res.number] = res
+		for res, ok := pending[next]; ok; res, ok = pending[next] {
+			delete(pending, next)
+			// Diverging blocks are written too, recording the mismatches
+			if _, ok := res.err.(*ReplayMismatchError); res.err == nil || ok {
+				err = write(res.number, res.result)
+			}
+			if err == nil {
+				err = res.err
+			}
+			if err != nil {
+				close(quit)
+				break
+			}
+			<-slots
+			if time.Since(report) > 8*time.Second {
+				glog.V(logger.Info).Infof("Replayed %d of %d blocks, currently at #%d", next-first+1, last-first+1, next)
+				report = time.Now()
+			}
+			next++
+		}
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// Tests that concurrently replayed blocks are written in block order.
+func TestReplayRangeOrdering(t *testing.T) {
+	bc, _ := newTestReplayChain(t, 16, testReplayTransfers)
+
+	for _, workers := range []int{1, 3, 8} {
+		var written []uint64
+		err := ReplayRange(bc, 2, 15, workers, nil, func(number uint64, doc string) error {
+			var block struct {
+				Header struct {
+					Number uint64 `json:"number"`
+				} `json:"blockHeader"`
+			}
+			if err := json.Unmarshal([]byte(doc), &block); err != nil {
+				t.Fatalf("workers %d: block #%d: invalid replay document: %v", workers, number, err)
+			}
+			if block.Header.Number != number {
+				t.Errorf("workers %d: document mismatch: have #%d, want #%d", workers, block.Header.Number, number)
+			}
+			written = append(written, number)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("workers %d: failed to replay range: %v", workers, err)
+		}
+		if len(written) != 14 {
+			t.Fatalf("workers %d: written block count mismatch: have %d, want %d", workers, len(written), 14)
+		}
+		for i, number := range written {
+			if number != uint64(i+2) {
+				t.Errorf("workers %d: write %d: block mismatch: have #%d, want #%d", workers, i, number, i+2)
+			}
+		}
+	}
+}
+
+// Tests that a range replay aborts on the first failure.
+func TestReplayRangeFailure(t *testing.T) {
+	bc, _ := newTestReplayChain(t, 8, testReplayTransfers)
+
+	// Fail on a write error
+	errWrite := errors.New("write failed")
+	var written int
+	err := ReplayRange(bc, 1, 8, 4, nil, func(number uint64, doc string) error {
+		if number == 4 {
+			return errWrite
+		}
+		written++
+		return nil
+	})
+	if err != errWrite {
+		t.Errorf("write failure mismatch: have %v, want %v", err, errWrite)
+	}
+	if written != 3 {
+		t.Errorf("written block count mismatch: have %d, want %d", written, 3)
+	}
+	// Fail on a replay error
+	if err := ReplayRange(bc, 6, 12, 4, nil, func(uint64, string) error { return nil }); err == nil {
+		t.Errorf("replayed beyond the chain head")
+	}
+}
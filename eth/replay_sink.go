@@ -0,0 +1,513 @@
+package eth
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/logger"
+	"github.com/ethereum/go-ethereum/logger/glog"
+)
+
+// ReplaySink receives the replay documents of blocks as they are imported.
+type ReplaySink interface {
+	// WriteBlock emits the replay document of the block with the given number.
+	WriteBlock(number uint64, doc []byte) error
+
+	// Close flushes and releases the sink.
+	Close() error
+}
+
+// ReplaySinkConfig configures the replay outputs of a node.
+type ReplaySinkConfig struct {
+	// Dir is the directory the outputs requested over RPC are confined to. RPC
+	// outputs are disabled if empty.
+	Dir string
+
+	RotateSize   uint64 // compressed bytes after which gzip sinks start a new file, 0 for never
+	RotateBlocks uint64 // blocks after which gzip sinks start a new file, 0 for never
+}
+
+var errReplayOutputDisabled = errors.New("replay outputs over RPC disabled, see --replayoutdir")
+
+// NewReplaySink creates a replay sink from its specification, one of:
+//
+//	<dir> or dir:<dir>   one <number>.json file per block in a directory
+//	file:<path>          one document per line appended to a file
+//	gzip:<dir>           one document per line in gzip compressed files, rotated as configured, see ReadReplayGzip
+//	ldb:<dir>            a LevelDB database keyed by block number, see ReadReplayDocument
+//	unix:<path>          one document per line streamed to every client of a Unix socket
+//
+// The config sets the rotation of gzip sinks, and may be nil.
+//
+// Gzip and ldb sinks store the code of documents replayed with DedupCode once
+// across all their documents rather than once per document: the code tables are
+// moved aside, into the code.ndjson file of gzip sinks and under code-<hash>
+// keys of ldb sinks, and restored by the readers.
+func NewReplaySink(spec string, config *ReplaySinkConfig) (ReplaySink, error) {
+	kind, path, err := parseReplaySink(spec)
+	if err != nil {
+		return nil, err
+	}
+	return newReplaySink(kind, path, config)
+}
+
+// NewSandboxedReplaySink is like NewReplaySink, but for specifications supplied
+// over RPC: paths are relative to the configured output directory and may not
+// leave it.
+func NewSandboxedReplaySink(spec string, config *ReplaySinkConfig) (ReplaySink, error) {
+	kind, path, err := parseReplaySink(spec)
+	if err != nil {
+		return nil, err
+	}
+	if path, err = config.sandboxPath(path); err != nil {
+		return nil, err
+	}
+	return newReplaySink(kind, path, config)
+}
+
+// parseReplaySink splits a sink specification into its kind and path.
+func parseReplaySink(spec string) (string, string, error) {
+	if spec == "" {
+		return "", "", errors.New("empty replay sink")
+	}
+	for _, kind := range []string{"dir", "file", "gzip", "ldb", "unix"} {
+		if strings.HasPrefix(spec, kind+":") {
+			return kind, strings.TrimPrefix(spec, kind+":"), nil
+		}
+	}
+	return "dir", spec, nil
+}
+
+// replaySinkAppends reports whether a sink appends the documents to its output
+// rather than storing them by block number, so that writing a block twice
+// duplicates it.
+func replaySinkAppends(spec string) bool {
+	kind, _, err := parseReplaySink(spec)
+	return err == nil && (kind == "file" || kind == "gzip")
+}
+
+func newReplaySink(kind, path string, config *ReplaySinkConfig) (ReplaySink, error) {
+	switch kind {
+	case "file":
+		return newReplayFileSink(path)
+	case "gzip":
+		if config == nil {
+			config = new(ReplaySinkConfig)
+		}
+		return newReplayGzipSink(path, config.RotateSize, config.RotateBlocks)
+	case "ldb":
+		return newReplayDBSink(path)
+	case "unix":
+		return newReplaySocketSink(path)
+	}
+	return newReplayDirSink(path)
+}
+
+// sandboxPath resolves a path supplied over RPC within the output directory.
+// Existing symbolic links leading out of the directory are refused as well.
+func (c *ReplaySinkConfig) sandboxPath(path string) (string, error) {
+	if c == nil || c.Dir == "" {
+		return "", errReplayOutputDisabled
+	}
+	if path == "" || filepath.IsAbs(path) {
+		return "", fmt.Errorf("replay output path %q not relative to the output directory", path)
+	}
+	resolved := filepath.Join(c.Dir, path)
+	if !withinDir(c.Dir, resolved) {
+		return "", fmt.Errorf("replay output path %q outside the output directory", path)
+	}
+	if root, err := filepath.EvalSymlinks(c.Dir); err == nil {
+		for link := resolved; withinDir(c.Dir, link) && link != filepath.Clean(c.Dir); link = filepath.Dir(link) {
+			if target, err := filepath.EvalSymlinks(link); err == nil {
+				if !withinDir(root, target) {
+					return "", fmt.Errorf("replay output path %q outside the output directory", path)
+				}
+				break
+			}
+		}
+	}
+	return resolved, nil
+}
+
+// withinDir reports whether path lies within dir.
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// writeReplayFile replaces the file at path with the output of write, gzip
+// compressed if the path ends in ".gz". The output goes into a temporary file
+// first, so a failed write leaves any previous file intact.
+func writeReplayFile(path string, write func(w io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	var (
+		w  io.Writer = file
+		gz *gzip.Writer
+	)
+	if strings.HasSuffix(path, ".gz") {
+		gz = gzip.NewWriter(file)
+		w = gz
+	}
+	err = file.Chmod(0644)
+	if err == nil {
+		err = write(w)
+	}
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// replayDirSink writes every document into its own file in a directory, the
+// layout of the replay command.
+type replayDirSink struct {
+	dir string
+}
+
+func newReplayDirSink(dir string) (*replayDirSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &replayDirSink{dir: dir}, nil
+}
+
+func (s *replayDirSink) WriteBlock(number uint64, doc []byte) error {
+	return ioutil.WriteFile(filepath.Join(s.dir, fmt.Sprintf("%d.json", number)), doc, 0644)
+}
+
+func (s *replayDirSink) Close() error { return nil }
+
+// replayFileSink appends the documents to a single file, one per line.
+type replayFileSink struct {
+	file *os.File
+}
+
+func newReplayFileSink(path string) (*replayFileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &replayFileSink{file: file}, nil
+}
+
+func (s *replayFileSink) WriteBlock(number uint64, doc []byte) error {
+	if _, err := s.file.Write(doc); err != nil {
+		return err
+	}
+	_, err := s.file.Write([]byte{'\n'})
+	return err
+}
+
+func (s *replayFileSink) Close() error { return s.file.Close() }
+
+// replayGzipSink writes the documents into gzip compressed files in a directory,
+// one per line. A new file, named after its first block, is started whenever
+// the current one reaches the configured size or number of blocks. The code of
+// deduplicated documents goes into a code file shared by all files.
+type replayGzipSink struct {
+	dir       string
+	maxSize   uint64
+	maxBlocks uint64
+
+	file   *os.File
+	size   *countingWriter
+	gz     *gzip.Writer
+	blocks uint64
+
+	codeFile *os.File        // code of deduplicated documents, shared by all files
+	codes    map[string]bool // hashes of the code in the code file
+}
+
+func newReplayGzipSink(dir string, maxSize, maxBlocks uint64) (*replayGzipSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &replayGzipSink{dir: dir, maxSize: maxSize, maxBlocks: maxBlocks, codes: make(map[string]bool)}
+
+	// Load the code written by previous runs, cutting off any incomplete line
+	file, err := os.OpenFile(filepath.Join(dir, replayCodeFile), os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	codes, size, err := readReplayCodes(file)
+	if err == nil {
+		err = file.Truncate(size)
+	}
+	if err == nil {
+		_, err = file.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", file.Name(), err)
+	}
+	for hash := range codes {
+		s.codes[hash] = true
+	}
+	s.codeFile = file
+	return s, nil
+}
+
+func (s *replayGzipSink) WriteBlock(number uint64, doc []byte) error {
+	// Keep the code aside first, so documents never reference code not written
+	doc, hashes, table, err := splitReplayCodes(doc)
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if s.codes[hash] {
+			continue
+		}
+		if s.codeFile == nil {
+			if s.codeFile, err = os.OpenFile(filepath.Join(s.dir, replayCodeFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+				return err
+			}
+		}
+		line, _ := json.Marshal(map[string]string{hash: table[hash]})
+		if _, err := s.codeFile.Write(append(line, '\n')); err != nil {
+			return err
+		}
+		s.codes[hash] = true
+	}
+	if s.file == nil {
+		file, err := os.OpenFile(filepath.Join(s.dir, fmt.Sprintf("%d.ndjson.gz", number)), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		s.file, s.size, s.blocks = file, &countingWriter{w: file}, 0
+		s.gz = gzip.NewWriter(s.size)
+	}
+	if _, err := s.gz.Write(doc); err != nil {
+		return err
+	}
+	if _, err := s.gz.Write([]byte{'\n'}); err != nil {
+		return err
+	}
+	// Flush every document, so that the blocks written survive a crash
+	if err := s.gz.Flush(); err != nil {
+		return err
+	}
+	s.blocks++
+	if (s.maxSize > 0 && s.size.n >= s.maxSize) || (s.maxBlocks > 0 && s.blocks >= s.maxBlocks) {
+		return s.finish()
+	}
+	return nil
+}
+
+func (s *replayGzipSink) Close() error {
+	err := s.finish()
+	if s.codeFile != nil {
+		if closeErr := s.codeFile.Close(); err == nil {
+			err = closeErr
+		}
+		s.codeFile = nil
+	}
+	return err
+}
+
+// finish completes the current file, the next block written starts a new one.
+func (s *replayGzipSink) finish() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.gz.Close()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.file, s.gz = nil, nil
+	return err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += uint64(n)
+	return n, err
+}
+
+// replayDBSink stores the documents in a LevelDB database, keyed by the big
+// endian block number. The code of deduplicated documents is stored by hash.
+type replayDBSink struct {
+	db *ethdb.LDBDatabase
+}
+
+func newReplayDBSink(dir string) (*replayDBSink, error) {
+	db, err := ethdb.NewLDBDatabase(dir, 16, 16)
+	if err != nil {
+		return nil, err
+	}
+	return &replayDBSink{db: db}, nil
+}
+
+func (s *replayDBSink) WriteBlock(number uint64, doc []byte) error {
+	doc, hashes, table, err := splitReplayCodes(doc)
+	if err != nil {
+		return err
+	}
+	batch := s.db.NewBatch()
+	for _, hash := range hashes {
+		if _, err := s.db.Get(replayCodeKey(hash)); err != nil {
+			batch.Put(replayCodeKey(hash), []byte(table[hash]))
+		}
+	}
+	batch.Put(replayDocumentKey(number), doc)
+	return batch.Write()
+}
+
+func (s *replayDBSink) Close() error {
+	s.db.Close()
+	return nil
+}
+
+func replayDocumentKey(number uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, number)
+	return key
+}
+
+const (
+	// replaySocketTimeout is the time a socket client is given to accept a document.
+	replaySocketTimeout = 5 * time.Second
+
+	// replaySocketBacklog is the number of documents queued for a socket client
+	// before it is considered too slow and dropped.
+	replaySocketBacklog = 64
+)
+
+// replaySocketSink listens on a Unix socket and streams the documents to every
+// connected client, one per line. Clients only receive the blocks imported
+// while they are connected, and are dropped if they fail to keep up.
+//
+// Every client is served by its own goroutine from a bounded queue, so that a
+// stalled client neither holds up the import nor the other clients.
+type replaySocketSink struct {
+	listener net.Listener
+	conns    map[net.Conn]chan []byte // queued documents of each client
+	lock     sync.Mutex
+}
+
+func newReplaySocketSink(path string) (*replaySocketSink, error) {
+	// Remove any stale socket left behind by a previous run, but nothing else
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	s := &replaySocketSink{
+		listener: listener,
+		conns:    make(map[net.Conn]chan []byte),
+	}
+	go s.accept()
+	return s, nil
+}
+
+// accept registers the incoming clients until the listener is closed.
+func (s *replaySocketSink) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		queue := make(chan []byte, replaySocketBacklog)
+		s.lock.Lock()
+		s.conns[conn] = queue
+		s.lock.Unlock()
+
+		go s.serve(conn, queue)
+	}
+}
+
+// serve writes the documents queued for a client until it is dropped.
+func (s *replaySocketSink) serve(conn net.Conn, queue chan []byte) {
+	for line := range queue {
+		conn.SetWriteDeadline(time.Now().Add(replaySocketTimeout))
+		if _, err := conn.Write(line); err != nil {
+			glog.V(logger.Debug).Infof("Dropping replay client %v: %v", conn.RemoteAddr(), err)
+			s.lock.Lock()
+			s.drop(conn)
+			s.lock.Unlock()
+			return
+		}
+	}
+}
+
+// drop disconnects a client and stops its writer. The lock must be held.
+func (s *replaySocketSink) drop(conn net.Conn) {
+	if queue, ok := s.conns[conn]; ok {
+		close(queue)
+		conn.Close()
+		delete(s.conns, conn)
+	}
+}
+
+func (s *replaySocketSink) WriteBlock(number uint64, doc []byte) error {
+	// Copy the document once for all clients, as they write it out later
+	line := make([]byte, len(doc)+1)
+	copy(line, doc)
+	line[len(doc)] = '\n'
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for conn, queue := range s.conns {
+		select {
+		case queue <- line:
+		default:
+			glog.V(logger.Debug).Infof("Dropping replay client %v: %d documents behind", conn.RemoteAddr(), replaySocketBacklog)
+			s.drop(conn)
+		}
+	}
+	return nil
+}
+
+func (s *replaySocketSink) Close() error {
+	err := s.listener.Close()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for conn := range s.conns {
+		s.drop(conn)
+	}
+	return err
+}
@@ -0,0 +1,47 @@
+package eth
+
+import (
+	"io/ioutil"
+
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/replay"
+)
+
+// maxReplayStatsBlocks is the number of blocks debug_replayStats replays in a
+// single call.
+const maxReplayStatsBlocks = 10000
+
+// ReplayBlockStats replays the canonical block with the given number and
+// returns the statistics of the instructions it executed. The code traces are
+// not written out, making this much cheaper than replaying the documents.
+func ReplayBlockStats(bc *core.BlockChain, number uint64) (*replay.ReplayStats, error) {
+	stats := replay.NewReplayStats()
+	config := &replay.ReplayConfig{Preset: replay.PresetStateDiff, Stats: stats}
+	if err := writeReplayBlock(ioutil.Discard, bc, bc.Config(), nil, number, config, nil); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// ReplayRangeStats computes the statistics of the canonical blocks between
+// first and last (inclusive) concurrently on the given number of workers, and
+// returns their roll-up. The stats of every block are also handed to the block
+// callback in block order, if given.
+func ReplayRangeStats(bc *core.BlockChain, first, last uint64, workers int, block func(number uint64, stats *replay.ReplayStats) error) (*replay.ReplayStats, error) {
+	replayer := func(number uint64) (interface{}, error) {
+		return ReplayBlockStats(bc, number)
+	}
+	total := replay.NewReplayStats()
+	err := replayRange(first, last, workers, replayer, func(number uint64, result interface{}) error {
+		stats := result.(*replay.ReplayStats)
+		total.Add(stats)
+		if block != nil {
+			return block(number, stats)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return total, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/replay"
+)
+
+// Tests that the replay stats agree with the code traces of the replayed blocks.
+func TestReplayBlockStats(t *testing.T) {
+	bc, _ := newTestReplayChain(t, 4, testReplayForwarder)
+
+	for number := uint64(1); number <= 4; number++ {
+		stats, err := ReplayBlockStats(bc, number)
+		if err != nil {
+			t.Fatalf("block %d: failed to compute stats: %v", number, err)
+		}
+		block := replayLimited(t, bc, number, nil)
+
+		want := replay.NewReplayStats()
+		want.Blocks, want.Transactions = 1, uint64(len(block.Transactions))
+		for _, tx := range block.Transactions {
+			for _, trace := range tx.Traces {
+				gas := uint64(trace.GasUsed)
+				if trace.Name == "CALL" {
+					gas -= uint64(trace.CallGas)
+				}
+				want.Instructions++
+				if want.Opcodes[trace.Name] == nil {
+					want.Opcodes[trace.Name] = new(replay.StatCount)
+				}
+				want.Opcodes[trace.Name].Count++
+				want.Opcodes[trace.Name].Gas += gas
+				if want.Contracts[trace.Address.Hex()] == nil {
+					want.Contracts[trace.Address.Hex()] = new(replay.StatCount)
+				}
+				want.Contracts[trace.Address.Hex()].Count++
+				want.Contracts[trace.Address.Hex()].Gas += gas
+				want.Depths[trace.CallDepth]++
+			}
+		}
+		if !reflect.DeepEqual(stats, want) {
+			t.Errorf("block %d: stats mismatch:\nhave %+v\nwant %+v", number, stats, want)
+		}
+	}
+	// The forwarded gas is not counted by the call itself, only the base, value
+	// transfer and new account costs less the stipend
+	stats, _ := ReplayBlockStats(bc, 2)
+	if call := stats.Opcodes["CALL"]; call == nil || call.Count != 1 || call.Gas != 40+9000+25000-2300 {
+		t.Errorf("call stats mismatch: %+v", call)
+	}
+	if stats.Contracts[crypto.CreateAddress(testBank.Address, 0).Hex()] == nil {
+		t.Errorf("forwarder missing from the contract stats")
+	}
+}
+
+// Tests that range stats roll up the stats of their blocks.
+func TestReplayRangeStats(t *testing.T) {
+	bc, _ := newTestReplayChain(t, 4, testReplayForwarder)
+
+	var (
+		numbers []uint64
+		want    = replay.NewReplayStats()
+	)
+	total, err := ReplayRangeStats(bc, 1, 4, 3, func(number uint64, stats *replay.ReplayStats) error {
+		numbers = append(numbers, number)
+		want.Add(stats)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to compute stats: %v", err)
+	}
+	if !reflect.DeepEqual(numbers, []uint64{1, 2, 3, 4}) {
+		t.Errorf("block order mismatch: %v", numbers)
+	}
+	if !reflect.DeepEqual(total, want) || total.Blocks != 4 || total.Transactions != 4 {
+		t.Errorf("roll-up mismatch: have %+v, want %+v", total, want)
+	}
+	var buf bytes.Buffer
+	if err := total.WriteCSV(&buf, "total"); err != nil {
+		t.Fatalf("failed to write CSV: %v", err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	if lines[0] != "total,blocks,,4," || !strings.Contains(buf.String(), "\ntotal,opcode,CALL,3,") {
+		t.Errorf("CSV output mismatch:\n%s", buf.String())
+	}
+}
+
+// Tests that the stats API refuses ranges beyond the per call limit.
+func TestReplayStatsAPILimit(t *testing.T) {
+	bc, _ := newTestReplayChain(t, 2, testReplayCounter)
+	api := NewPrivateDebugAPI(bc.Config(), &Ethereum{blockchain: bc})
+
+	if _, err := api.ReplayStats(1, maxReplayStatsBlocks+1); err == nil || !strings.Contains(err.Error(), "limit") {
+		t.Errorf("range over the limit not refused: %v", err)
+	}
+	stats, err := api.ReplayStats(1, 2)
+	if err != nil {
+		t.Fatalf("failed to compute stats: %v", err)
+	}
+	if stats.Blocks != 2 {
+		t.Errorf("block count mismatch: have %d, want 2", stats.Blocks)
+	}
+}
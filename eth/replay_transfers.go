@@ -0,0 +1,193 @@
+package eth
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/replay/schema"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// transferPrefix is the prefix of the transfer entries of the replay index. The
+// keys of storage writes are longer than those of transfers, so the two never
+// mix in prefix scans.
+var transferPrefix = []byte("transfer-")
+
+// transferKeyLength is the length of the index key of a transfer: the prefix,
+// the address (20 bytes), the block number (8 bytes) and the position of the
+// transfer within the block (4 bytes).
+var transferKeyLength = len(transferPrefix) + common.AddressLength + 12
+
+// maxTransfersPerPage is the number of transfers returned by a single call of
+// deepinsight_getTransfers.
+const maxTransfersPerPage = 1000
+
+var errInvalidTransferCursor = errors.New("invalid transfer cursor")
+
+// IndexedTransfer is an ether transfer recorded by the replay index, as listed in
+// the transferTrace of the replayed block.
+type IndexedTransfer struct {
+	Block uint64       `json:"block"`
+	Tx    int          `json:"tx"`  // index of the transaction within the block, -1 for rewards
+	Seq   int          `json:"seq"` // sequence number of the instruction, -1 if unknown
+	From  string       `json:"from"`
+	To    string       `json:"to"`
+	Value *hexutil.Big `json:"value"`
+	Type  string       `json:"type"`
+}
+
+// indexTransfers adds the transfers of a replayed block to a batch of the
+// replay index, under both the sending and the receiving address. Transfers
+// without value and the "NIL" ends of minted, prepaid and refunded ether are
+// not indexed.
+func indexTransfers(batch ethdb.Batch, block *schema.Block) error {
+	for i, transfer := range block.Transfers {
+		if transfer.Value == nil || transfer.Value.ToInt().Sign() == 0 {
+			continue
+		}
+		entry, err := json.Marshal(&IndexedTransfer{
+			Block: block.Header.Number,
+			Tx:    transfer.TxSeq,
+			Seq:   transfer.TraceSeq,
+			From:  transfer.From,
+			To:    transfer.To,
+			Value: (*hexutil.Big)(transfer.Value.ToInt()),
+			Type:  transfer.Type,
+		})
+		if err != nil {
+			return err
+		}
+		for _, addr := range []string{transfer.From, transfer.To} {
+			if !common.IsHexAddress(addr) {
+				continue
+			}
+			if err := batch.Put(transferKey(common.HexToAddress(addr), block.Header.Number, i), entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Transfers returns the indexed transfers from or to an address in the blocks
+// between first and last (inclusive), in chain order. At most limit transfers
+// are returned; if there are more, the cursor to continue from is returned too.
+// A nil cursor starts from the first block.
+func (idx *ReplayIndex) Transfers(addr common.Address, first, last uint64, cursor []byte, limit int) ([]*IndexedTransfer, []byte, error) {
+	prefix := append(common.CopyBytes(transferPrefix), addr.Bytes()...)
+
+	rng := util.BytesPrefix(prefix)
+	rng.Start = transferKey(addr, first, 0)
+	if cursor != nil {
+		if len(cursor) != 12 || binary.BigEndian.Uint64(cursor) < first {
+			return nil, nil, errInvalidTransferCursor
+		}
+		rng.Start = append(prefix, cursor...)
+	}
+	if last < math.MaxUint64 {
+		rng.Limit = transferKey(addr, last+1, 0)
+	}
+	var (
+		transfers []*IndexedTransfer
+		next      []byte
+		err       error
+	)
+	scanErr := idx.scanRange(rng, func(key, value []byte) bool {
+		if len(key) != transferKeyLength {
+			return true
+		}
+		if len(transfers) == limit {
+			next = key[len(prefix):]
+			return false
+		}
+		transfer := new(IndexedTransfer)
+		if err = json.Unmarshal(value, transfer); err != nil {
+			return false
+		}
+		transfers = append(transfers, transfer)
+		return true
+	})
+	if scanErr != nil {
+		return nil, nil, scanErr
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("corrupt transfer entry: %v", err)
+	}
+	return transfers, next, nil
+}
+
+// transferKey assembles the index key of a transfer of an address.
+func transferKey(addr common.Address, number uint64, pos int) []byte {
+	key := make([]byte, transferKeyLength)
+	copy(key, transferPrefix)
+	copy(key[len(transferPrefix):], addr.Bytes())
+	binary.BigEndian.PutUint64(key[len(transferPrefix)+common.AddressLength:], number)
+	binary.BigEndian.PutUint32(key[len(transferPrefix)+common.AddressLength+8:], uint32(pos))
+	return key
+}
+
+// TransferPage is a page of the indexed transfers of an address. Next is the
+// cursor of the following page, nil on the last one.
+type TransferPage struct {
+	Transfers []*IndexedTransfer `json:"transfers"`
+	Next      hexutil.Bytes      `json:"next"`
+}
+
+// PublicDeepInsightAPI provides queries of the ether transfers recorded by the
+// replay index, and of the writes replayed storage loads read. It is only
+// available if the node runs with the index enabled.
+type PublicDeepInsightAPI struct {
+	eth *Ethereum
+}
+
+// NewPublicDeepInsightAPI creates a new DeepInsight API.
+func NewPublicDeepInsightAPI(eth *Ethereum) *PublicDeepInsightAPI {
+	return &PublicDeepInsightAPI{eth: eth}
+}
+
+// GetTransfers returns the indexed ether transfers from and to an address in the
+// given block range, including internal ones made by contracts, rewards and
+// self destruct refunds. Results are paged: pass the next cursor of a page to
+// retrieve the following one.
+func (api *PublicDeepInsightAPI) GetTransfers(addr common.Address, fromBlock, toBlock rpc.BlockNumber, cursor *hexutil.Bytes) (*TransferPage, error) {
+	first, last := api.eth.ApiBackend.replayNumber(fromBlock), api.eth.ApiBackend.replayNumber(toBlock)
+	if first > last {
+		return nil, fmt.Errorf("invalid block range #%d-#%d", first, last)
+	}
+	var start []byte
+	if cursor != nil {
+		start = *cursor
+	}
+	transfers, next, err := api.eth.replayIndex.Transfers(addr, first, last, start, maxTransfersPerPage)
+	if err != nil {
+		return nil, err
+	}
+	if transfers == nil {
+		transfers = []*IndexedTransfer{}
+	}
+	return &TransferPage{Transfers: transfers, Next: next}, nil
+}
+
+// GetReplayLoadOrigin replays the transaction with the given hash and returns the
+// indexed write the SLOAD with the given sequence number reads, or nil if the
+// slot was not written by any indexed block before.
+func (api *PublicDeepInsightAPI) GetReplayLoadOrigin(txHash common.Hash, seq int) (*SlotWrite, error) {
+	_, _, number, index := core.GetTransaction(api.eth.chainDb, txHash)
+	doc, err := ReplayTransaction(api.eth.blockchain, api.eth.chainDb, txHash)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := schema.DecodeTransaction([]byte(doc))
+	if err != nil {
+		return nil, fmt.Errorf("invalid replay document: %v", err)
+	}
+	return api.eth.replayIndex.ResolveLoad(number, int(index), tx, seq)
+}
@@ -0,0 +1,139 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"io/ioutil"
+	"math"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// testReplayForwarder deploys a contract forwarding the value it receives to the
+// replay test address, then sends it ether in every following block.
+func testReplayForwarder(i int, block *core.BlockGen) {
+	signer := types.HomesteadSigner{}
+	if i == 0 {
+		// CALL(10000, testReplayAddr, CALLVALUE, 0, 0, 0, 0)
+		runtime := "60006000600060003473" + common.Bytes2Hex(testReplayAddr.Bytes()) + "612710f100"
+		code := common.FromHex("6023600c60003960236000f3" + runtime)
+		tx, _ := types.SignTx(types.NewContractCreation(block.TxNonce(testBank.Address), new(big.Int), big.NewInt(200000), nil, code), signer, testBankKey)
+		block.AddTx(tx)
+		return
+	}
+	tx, _ := types.SignTx(types.NewTransaction(block.TxNonce(testBank.Address), crypto.CreateAddress(testBank.Address, 0), big.NewInt(int64(1000*i)), big.NewInt(100000), nil, nil), signer, testBankKey)
+	block.AddTx(tx)
+}
+
+func TestReplayTransfersMemory(t *testing.T) {
+	db, _ := ethdb.NewMemDatabase()
+	testReplayTransfersIndex(t, db)
+}
+
+func TestReplayTransfersLevelDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replayindex")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := ethdb.NewLDBDatabase(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	testReplayTransfersIndex(t, db)
+}
+
+func testReplayTransfersIndex(t *testing.T, db ethdb.Database) {
+	index, err := NewReplayIndex(db)
+	if err != nil {
+		t.Fatalf("failed to create index: %v", err)
+	}
+	defer index.Close()
+
+	bc, _ := newTestReplayChain(t, 4, testReplayForwarder)
+	for number := uint64(1); number <= 4; number++ {
+		doc, err := ReplayBlockByNumber(bc, number)
+		if err != nil {
+			t.Fatalf("block %d: failed to replay: %v", number, err)
+		}
+		if err := index.IndexDocument([]byte(doc)); err != nil {
+			t.Fatalf("block %d: failed to index: %v", number, err)
+		}
+	}
+	// The forwarded ether reaches the test address through internal transfers only
+	transfers, next, err := index.Transfers(testReplayAddr, 0, math.MaxUint64, nil, 10)
+	if err != nil {
+		t.Fatalf("failed to list transfers: %v", err)
+	}
+	if next != nil {
+		t.Errorf("unexpected cursor %x", next)
+	}
+	if len(transfers) != 3 {
+		t.Fatalf("transfer count mismatch: have %d, want 3", len(transfers))
+	}
+	contract := crypto.CreateAddress(testBank.Address, 0)
+	for i, transfer := range transfers {
+		number := uint64(i + 2)
+		if transfer.Block != number || transfer.Tx != 0 || transfer.Type != "CallTransfer" {
+			t.Errorf("transfer %d: position mismatch: %+v", i, transfer)
+		}
+		if common.HexToAddress(transfer.From) != contract || common.HexToAddress(transfer.To) != testReplayAddr {
+			t.Errorf("transfer %d: ends mismatch: %s -> %s", i, transfer.From, transfer.To)
+		}
+		if transfer.Value.ToInt().Int64() != int64(1000*(i+1)) {
+			t.Errorf("transfer %d: value mismatch: have %v, want %d", i, transfer.Value.ToInt(), 1000*(i+1))
+		}
+	}
+	// The contract both received and forwarded the ether
+	transfers, _, err = index.Transfers(contract, 3, 3, nil, 10)
+	if err != nil {
+		t.Fatalf("failed to list transfers: %v", err)
+	}
+	if len(transfers) != 2 || transfers[0].Type != "ExternalCallTransfer" || transfers[1].Type != "CallTransfer" {
+		t.Errorf("contract transfers mismatch: %+v", transfers)
+	}
+	// Paging visits every transfer exactly once
+	var (
+		paged  int
+		cursor []byte
+	)
+	for {
+		page, next, err := index.Transfers(contract, 0, math.MaxUint64, cursor, 4)
+		if err != nil {
+			t.Fatalf("failed to list transfers: %v", err)
+		}
+		paged += len(page)
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+	if paged != 6 {
+		t.Errorf("paged transfer count mismatch: have %d, want 6", paged)
+	}
+	if _, _, err := index.Transfers(contract, 3, 4, []byte{1}, 4); err != errInvalidTransferCursor {
+		t.Errorf("invalid cursor error mismatch: have %v, want %v", err, errInvalidTransferCursor)
+	}
+}
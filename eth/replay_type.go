@@ -11,72 +11,67 @@ import (
 	"github.com/ethereum/go-ethereum/replay"
 )
 
-var (
-	// Block level
-	blockInputStates  string
-	blockOutputStates string
-	//blockCreatedAccounts string
-)
-
-func blockInit() {
-	blockInputStates = ""
-	blockOutputStates = ""
-	//blockCreatedAccounts = ""
+// blockStates collects the block level account states of a single replay, so
+// that several blocks can be replayed concurrently.
+type blockStates struct {
+	input  string
+	output string
+	//created string
 }
 
-func addDaoForkBeforeState(statedb *state.StateDB) {
-	addInputStates(params.DAORefundContract, statedb)
+func (bs *blockStates) addDaoForkBeforeState(statedb *state.StateDB) {
+	bs.addInputStates(params.DAORefundContract, statedb)
 	for _, addr := range params.DAODrainList {
 		if account := statedb.GetStateObject(addr); account != nil {
-			addInputStates(addr, statedb)
+			bs.addInputStates(addr, statedb)
 		}
 	}
 }
 
-func addDaoForkAfterState(statedb *state.StateDB) {
-	addOutputStates(params.DAORefundContract, statedb)
+func (bs *blockStates) addDaoForkAfterState(statedb *state.StateDB) {
+	bs.addOutputStates(params.DAORefundContract, statedb)
 	for _, addr := range params.DAODrainList {
 		if account := statedb.GetStateObject(addr); account != nil {
-			addOutputStates(addr, statedb)
+			bs.addOutputStates(addr, statedb)
 		}
 	}
 }
 
-func setInputStates(blk *types.Block, db *state.StateDB) {
-	if blockInputStates != "" {
-		blockInputStates += ","
+func (bs *blockStates) setInputStates(blk *types.Block, db *state.StateDB) {
+	if bs.input != "" {
+		bs.input += ","
 	}
-	blockInputStates += strState(blk.Coinbase(), db)
+	bs.input += strState(blk.Coinbase(), db)
 	for _, uncle := range blk.Uncles() {
-		if blockInputStates != "" {
-			blockInputStates += ","
+		if bs.input != "" {
+			bs.input += ","
 		}
-		blockInputStates += strState(uncle.Coinbase, db)
+		bs.input += strState(uncle.Coinbase, db)
 	}
 }
 
-func setOutputStates(blk *types.Block, db *state.StateDB) {
-	if blockOutputStates != "" {
-		blockOutputStates += ","
+func (bs *blockStates) setOutputStates(blk *types.Block, db *state.StateDB) {
+	if bs.output != "" {
+		bs.output += ","
 	}
-	blockOutputStates += strState(blk.Coinbase(), db)
+	bs.output += strState(blk.Coinbase(), db)
 	for _, uncle := range blk.Uncles() {
-		blockOutputStates += "," + strState(uncle.Coinbase, db)
+		bs.output += "," + strState(uncle.Coinbase, db)
 	}
 }
 
-func addInputStates(addr common.Address, db *state.StateDB) {
-	if blockInputStates != "" {
-		blockInputStates += ","
+func (bs *blockStates) addInputStates(addr common.Address, db *state.StateDB) {
+	if bs.input != "" {
+		bs.input += ","
 	}
-	blockInputStates += strState(addr, db)
+	bs.input += strState(addr, db)
 }
 
-func addOutputStates(addr common.Address, db *state.StateDB) {
-	if blockOutputStates != "" {
-		blockOutputStates += ","
+func (bs *blockStates) addOutputStates(addr common.Address, db *state.StateDB) {
+	if bs.output != "" {
+		bs.output += ","
 	}
-	blockOutputStates += strState(addr, db)
+	bs.output += strState(addr, db)
 }
 
 func numField(name string, value uint64) string {
@@ -159,7 +154,7 @@ func strState(address common.Address, db *state.StateDB) string {
 		address.Hex(), db.GetCodeHash(address).Hex(), db.GetNonce(address), db.GetBalance(address).String())
 }
 
-func blkToJSON(blk *types.Block, db *state.StateDB, tracer replay.Tracer, bc *core.BlockChain) string {
+func blkToJSON(blk *types.Block, states *blockStates, tracer replay.Tracer, bc *core.BlockChain, extra ...string) string {
 	var (
 		fstr string
 	)
@@ -168,13 +163,16 @@ func blkToJSON(blk *types.Block, db *state.StateDB, tracer replay.Tracer, bc *co
 
 	fstr += "," + fmt.Sprintf("\"uncleBlockHeaderList\":%s", strBlockUncles(blk, bc))
 	fstr += "," + fmt.Sprintf("\"transferTrace\":%s", tracer.StrTransfer(int(blk.Number().Int64())))
-	fstr += "," + strJSONArray("blockInputStates", blockInputStates)
-	fstr += "," + strJSONArray("blockOutputStates", blockOutputStates)
+	fstr += "," + strJSONArray("blockInputStates", states.input)
+	fstr += "," + strJSONArray("blockOutputStates", states.output)
 	if blk.Number().Int64() == 0 {
 		fstr += "," + strJSONArray("blockCreatedAccounts", "")
 	} else {
 		fstr += "," + strJSONArray("blockCreatedAccounts", tracer.StrBlockCreatedAccounts())
 	}
-	fstr += "}"
+	for _, field := range extra {
+		fstr += "," + field
+	}
+	fstr += "," + numField("schemaVersion", replay.SchemaVersion)
 	return fstr
 }
@@ -1,7 +1,10 @@
 package eth
 
 import (
+	"bytes"
 	"fmt"
+	"hash"
+	"io"
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -10,90 +13,315 @@ import (
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/crypto/sha3"
+	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/logger"
 	"github.com/ethereum/go-ethereum/logger/glog"
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/replay"
 )
 
-// replayBlock simulate the Processor()
-func replayBlock(block *types.Block, statedb *state.StateDB, cfg *params.ChainConfig, bc *core.BlockChain) string {
+// ReplayBlockByNumber re-executes the canonical block with the given number on
+// top of its parent's state and returns its DeepInsight replay document.
+func ReplayBlockByNumber(bc *core.BlockChain, number uint64) (string, error) {
+	var buf bytes.Buffer
+	if err := WriteReplayBlock(&buf, bc, number, nil); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// WriteReplayBlock re-executes the canonical block with the given number on top
+// of its parent's state, streaming its DeepInsight replay document into w. The
+// code traces are limited according to config, if given.
+//
+// Transactions are written out one at a time, so memory is bounded by the
+// largest transaction of the block rather than by the whole document. The code
+// trace of a transaction is still held in full until it is written, as its
+// provenance is resolved over all of its instructions.
+func WriteReplayBlock(w io.Writer, bc *core.BlockChain, number uint64, config *replay.ReplayConfig) error {
+	return writeReplayBlock(w, bc, bc.Config(), nil, number, config, nil)
+}
+
+// writeReplayBlock streams the replay document of a canonical block, executed
+// under the chain rules of cfg, into w. If chainDb is given, the replay is
+// verified against the receipts stored in it. If invalid is given, transactions
+// the rules reject are left out of the document and recorded there instead.
+func writeReplayBlock(w io.Writer, bc *core.BlockChain, cfg *params.ChainConfig, chainDb ethdb.Database, number uint64, config *replay.ReplayConfig, invalid map[int]error) error {
+	block := bc.GetBlockByNumber(number)
+	if block == nil {
+		return fmt.Errorf("block #%d not found", number)
+	}
+	// The genesis block is replayed on top of an empty state
+	root := common.Hash{}
+	if number > 0 {
+		parent := bc.GetBlock(block.ParentHash(), number-1)
+		if parent == nil {
+			return fmt.Errorf("parent of block #%d not found", number)
+		}
+		root = parent.Root()
+	}
+	statedb, err := bc.StateAt(root)
+	if err != nil {
+		return fmt.Errorf("state of block #%d unavailable: %v", number, err)
+	}
+	// The genesis allocation is not executed, so there is nothing to verify
+	var verifier *replayVerifier
+	if chainDb != nil && number > 0 {
+		if verifier, err = newReplayVerifier(chainDb, block); err != nil {
+			return err
+		}
+	}
+	if _, _, _, err = replayBlock(w, block, statedb, cfg, bc, vm.Config{}, verifier, config, invalid); err != nil {
+		return err
+	}
+	if verifier != nil {
+		return verifier.err()
+	}
+	return nil
+}
+
+// replayTxError is returned by replayBlock when a transaction fails to apply,
+// telling the RPC and CLI replays which one. The block processor returns the
+// error of the transaction itself, as core.StateProcessor does.
+type replayTxError struct {
+	index  int
+	number uint64
+	err    error
+}
+
+func (e *replayTxError) Error() string {
+	return fmt.Sprintf("transaction %d of block #%d failed: %v", e.index, e.number, e.err)
+}
+
+// replayBlock simulate the Processor(), streaming the replay document into w
+// one transaction at a time. It returns the receipts, logs and gas used by the
+// block just like the Processor does. If a verifier is given, the results are
+// checked against the chain and the outcome recorded in the document. The code
+// traces written are limited according to config, if given.
+//
+// A transaction failing to apply fails the block with a *replayTxError, unless
+// invalid is given: the
+// transaction is then rolled back, left out of the document and its error
+// recorded in invalid by its index, as if the block had been produced without it.
+func replayBlock(w io.Writer, block *types.Block, statedb *state.StateDB, cfg *params.ChainConfig, bc *core.BlockChain, vmCfg vm.Config, verifier *replayVerifier, config *replay.ReplayConfig, invalid map[int]error) (types.Receipts, []*types.Log, *big.Int, error) {
 	var (
-		//receipts     types.Receipts
+		receipts     types.Receipts
 		totalUsedGas = big.NewInt(0)
 		header       = block.Header()
-		//allLogs      []*types.Log
-		gp        = new(core.GasPool).AddGas(block.GasLimit())
-		tracer    = replay.ReplayTracer{}
-		blkString string
+		allLogs      []*types.Log
+		gp           = new(core.GasPool).AddGas(block.GasLimit())
+		tracer       = replay.ReplayTracer{}
+		hook         = replayHook(&tracer, config)
+		states       = new(blockStates)
+		out          = w
+		hasher       hash.Hash
 	)
 	// Init block level data
-	blockInit()
-	tracer.BlockInit()
-	blkString += fmt.Sprintf("{\"transactionList\":[")
-	setInputStates(block, statedb)
+	hook.BlockInit()
+	if err := tracer.SetConfig(config); err != nil {
+		return nil, nil, nil, err
+	}
+	if config != nil && config.ContentHash {
+		hasher = sha3.NewKeccak256()
+		w = io.MultiWriter(w, hasher)
+	}
+	if _, err := io.WriteString(w, "{\"transactionList\":["); err != nil {
+		return nil, nil, nil, err
+	}
+	states.setInputStates(block, statedb)
 	// Mutate the the block and state according to any hard-fork specs
 	if cfg.DAOForkSupport && cfg.DAOForkBlock != nil && cfg.DAOForkBlock.Cmp(block.Number()) == 0 {
-		addDaoForkBeforeState(statedb)
-		ApplyDAOHardFork(statedb, &tracer)
-		addDaoForkAfterState(statedb)
+		states.addDaoForkBeforeState(statedb)
+		ApplyDAOHardFork(statedb, hook)
+		states.addDaoForkAfterState(statedb)
 	}
 
 	// Iterate over and process the individual transactions
 	for i, tx := range block.Transactions() {
-		//fmt.Println("tx:", i)
-		tracer.TxInit(i)
-		statedb.StartRecord(tx.Hash(), block.Hash(), i)
-		nonce, gasPrice, startGas := tx.Nonce(), tx.GasPrice().Uint64(), tx.Gas().Uint64()
-		tracer.SetInputAccount(block.Coinbase(), statedb.GetCodeHash(block.Coinbase()),
-			statedb.GetBalance(block.Coinbase()), statedb.GetNonce(block.Coinbase()))
-
-		receipt, _, _ := replayApplyTransaction(cfg, bc, gp, statedb, header, tx, totalUsedGas, vm.Config{}, &tracer)
-		/*
-			if err != nil {
+		snapshot, gas := statedb.Snapshot(), new(big.Int).Set((*big.Int)(gp))
+		receipt, err := replayTracedTransaction(i, tx, block, statedb, cfg, bc, gp, totalUsedGas, vmCfg, &tracer, hook)
+		if err != nil {
+			if invalid == nil {
+				return nil, nil, nil, &replayTxError{index: i, number: block.NumberU64(), err: err}
+			}
+			statedb.RevertToSnapshot(snapshot)
+			(*big.Int)(gp).Set(gas)
+			tracer.DiscardTransfers(i)
+			invalid[i] = err
+			continue
+		}
+		if len(receipts) != 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
 				return nil, nil, nil, err
 			}
-		*/
-		strData := ""
-		strInit := ""
-		strToAddr := ""
-		if tx.To() == nil {
-			strInit = "0x" + common.Bytes2Hex(tx.Data())
-			strToAddr = "NIL"
-		} else {
-			strData = "0x" + common.Bytes2Hex(tx.Data())
-			strToAddr = tx.To().Hex()
 		}
+		receipts = append(receipts, receipt)
+		allLogs = append(allLogs, receipt.Logs...)
+		if verifier != nil {
+			verifier.checkReceipt(i, receipt)
+		}
+		if config != nil && config.Stats != nil {
+			tracer.CollectStats(config.Stats)
+		}
+		if err := tracer.WriteTransaction(w); err != nil {
+			return nil, nil, nil, err
+		}
+	}
 
-		v, r, s := tx.RawSignatureValues()
+	AccumulateRewards(statedb, header, block.Uncles(), hook)
+	if config != nil && config.Stats != nil {
+		config.Stats.Blocks++
+	}
 
-		tracer.StrTxBasic(nonce, gasPrice, startGas, receipt.GasUsed.Uint64(),
-			strData, strInit, strToAddr, tx.Value().String(),
-			v.Int64(), r.String(), s.String(), tx.Hash().Hex())
+	states.setOutputStates(block, statedb)
 
-		tracer.ScanTrace()
-		for _, key := range tracer.GetInputAccounts() {
-			addr := common.HexToAddress(key)
-			tracer.SetOutputAccount(addr, statedb.GetCodeHash(addr), statedb.GetBalance(addr), statedb.GetNonce(addr))
-		}
+	var extra []string
+	if verifier != nil {
+		verifier.verifyState(statedb, bc)
+		extra = append(extra, verifier.field())
+	}
+	if config != nil && config.DedupCode {
+		extra = append(extra, tracer.CodeTableField())
+	}
+	if _, err := io.WriteString(w, "]"+blkToJSON(block, states, &tracer, bc, extra...)); err != nil {
+		return nil, nil, nil, err
+	}
+	end := "}"
+	if hasher != nil {
+		end = replay.ContentHashField(hasher) + end
+	}
+	if _, err := io.WriteString(out, end); err != nil {
+		return nil, nil, nil, err
+	}
+	return receipts, allLogs, totalUsedGas, nil
+}
 
-		if i != 0 {
-			blkString += fmt.Sprintf(",")
-		}
+// replayHook returns the tracer to hook into the EVM when replaying under the
+// given replay tracer: the tracer itself, or a MultiTracer also feeding the
+// tracers of the config.
+func replayHook(tracer *replay.ReplayTracer, config *replay.ReplayConfig) replay.Tracer {
+	if config == nil || len(config.Tracers) == 0 {
+		return tracer
+	}
+	return replay.NewMultiTracer(tracer, config.Tracers...)
+}
 
-		blkString += tracer.StrTransaction()
+// replayTracedTransaction executes the i-th transaction of the block under the
+// given tracer, leaving its results in the tracer to be written out. The hooks
+// of the execution go to hook, which feeds the tracer.
+func replayTracedTransaction(i int, tx *types.Transaction, block *types.Block, statedb *state.StateDB, cfg *params.ChainConfig, bc *core.BlockChain, gp *core.GasPool, usedGas *big.Int, vmCfg vm.Config, tracer *replay.ReplayTracer, hook replay.Tracer) (*types.Receipt, error) {
+	hook.TxInit(i)
+	statedb.StartRecord(tx.Hash(), block.Hash(), i)
+	nonce, gasPrice, startGas := tx.Nonce(), tx.GasPrice().Uint64(), tx.Gas().Uint64()
+	hook.SetInputAccount(block.Coinbase(), statedb.GetCodeHash(block.Coinbase()),
+		statedb.GetBalance(block.Coinbase()), statedb.GetNonce(block.Coinbase()))
 
-		tracer.ValidateTransfer(i)
+	receipt, _, err := replayApplyTransaction(cfg, bc, gp, statedb, block.Header(), tx, usedGas, vmCfg, tracer, hook)
+	if err != nil {
+		return nil, err
+	}
+	strData := ""
+	strInit := ""
+	strToAddr := ""
+	if tx.To() == nil {
+		strInit = "0x" + common.Bytes2Hex(tx.Data())
+		strToAddr = "NIL"
+	} else {
+		strData = "0x" + common.Bytes2Hex(tx.Data())
+		strToAddr = tx.To().Hex()
 	}
 
-	AccumulateRewards(statedb, header, block.Uncles(), &tracer)
+	v, r, s := tx.RawSignatureValues()
 
-	setOutputStates(block, statedb)
+	hook.StrTxBasic(nonce, gasPrice, startGas, receipt.GasUsed.Uint64(),
+		strData, strInit, strToAddr, tx.Value().String(),
+		v.Int64(), r.String(), s.String(), tx.Hash().Hex())
 
-	blkString += "]"
-	blkString += blkToJSON(block, statedb, &tracer, bc)
+	hook.ScanTrace()
+	for _, key := range hook.GetInputAccounts() {
+		addr := common.HexToAddress(key)
+		hook.SetOutputAccount(addr, statedb.GetCodeHash(addr), statedb.GetBalance(addr), statedb.GetNonce(addr))
+	}
+	hook.ValidateTransfer(i)
+
+	return receipt, nil
+}
 
-	return blkString
+// ReplayTransaction re-executes the block holding the transaction with the given
+// hash up to and including it, and returns the replay document of that single
+// transaction along with its transfers.
+func ReplayTransaction(bc *core.BlockChain, chainDb ethdb.Database, hash common.Hash) (string, error) {
+	var buf bytes.Buffer
+	if err := WriteReplayTransaction(&buf, bc, chainDb, hash, nil); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// WriteReplayTransaction re-executes the block holding the transaction with the
+// given hash up to and including it, streaming the replay document of that single
+// transaction along with its transfers into w. The code trace is limited
+// according to config, if given.
+func WriteReplayTransaction(w io.Writer, bc *core.BlockChain, chainDb ethdb.Database, hash common.Hash, config *replay.ReplayConfig) error {
+	tx, blockHash, number, index := core.GetTransaction(chainDb, hash)
+	if tx == nil {
+		return fmt.Errorf("transaction %x not found", hash)
+	}
+	block := bc.GetBlock(blockHash, number)
+	if block == nil {
+		return fmt.Errorf("block %x not found", blockHash)
+	}
+	parent := bc.GetBlock(block.ParentHash(), number-1)
+	if parent == nil {
+		return fmt.Errorf("parent of block %x not found", blockHash)
+	}
+	statedb, err := bc.StateAt(parent.Root())
+	if err != nil {
+		return fmt.Errorf("state of block %x unavailable: %v", blockHash, err)
+	}
+	return replayTransaction(w, block, statedb, bc.Config(), bc, int(index), config)
+}
+
+// replayTransaction executes the transactions of the block preceding the one at
+// the given index without tracing, and replays the one at the index itself.
+func replayTransaction(w io.Writer, block *types.Block, statedb *state.StateDB, cfg *params.ChainConfig, bc *core.BlockChain, index int, config *replay.ReplayConfig) error {
+	var (
+		header  = block.Header()
+		usedGas = big.NewInt(0)
+		gp      = new(core.GasPool).AddGas(block.GasLimit())
+		tracer  = replay.ReplayTracer{}
+		hook    = replayHook(&tracer, config)
+	)
+	hook.BlockInit()
+	if err := tracer.SetConfig(config); err != nil {
+		return err
+	}
+	if cfg.DAOForkSupport && cfg.DAOForkBlock != nil && cfg.DAOForkBlock.Cmp(block.Number()) == 0 {
+		core.ApplyDAOHardFork(statedb)
+	}
+	txs := block.Transactions()
+	for i, tx := range txs[:index] {
+		statedb.StartRecord(tx.Hash(), block.Hash(), i)
+		if _, _, err := core.ApplyTransaction(cfg, bc, gp, statedb, header, tx, usedGas, vm.Config{}); err != nil {
+			return fmt.Errorf("transaction %d of block %x failed: %v", i, block.Hash(), err)
+		}
+	}
+	if _, err := replayTracedTransaction(index, txs[index], block, statedb, cfg, bc, gp, usedGas, vm.Config{}, &tracer, hook); err != nil {
+		return fmt.Errorf("transaction %d of block %x failed: %v", index, block.Hash(), err)
+	}
+
+	return tracer.WriteTransaction(w, txDocumentFields(&tracer, index, config)...)
+}
+
+// txDocumentFields returns the fields closing the standalone document of the
+// transaction at the given index, written by the tracer under config.
+func txDocumentFields(tracer *replay.ReplayTracer, index int, config *replay.ReplayConfig) []string {
+	fields := []string{fmt.Sprintf("\"transferTrace\":%s", tracer.StrTxTransfer(index))}
+	if config != nil && config.DedupCode {
+		fields = append(fields, tracer.CodeTableField())
+	}
+	return append(fields, numField("schemaVersion", replay.SchemaVersion))
 }
 
 // AccumulateRewards credits the coinbase of the given block with the
@@ -128,7 +356,7 @@ func AccumulateRewards(statedb *state.StateDB, header *types.Header, uncles []*t
 }
 
 // replayApplyTransaction is a modified version of ApplyTransaction in core package
-func replayApplyTransaction(config *params.ChainConfig, bc *core.BlockChain, gp *core.GasPool, statedb *state.StateDB, header *types.Header, tx *types.Transaction, usedGas *big.Int, cfg vm.Config, tracer *replay.ReplayTracer) (*types.Receipt, *big.Int, error) {
+func replayApplyTransaction(config *params.ChainConfig, bc *core.BlockChain, gp *core.GasPool, statedb *state.StateDB, header *types.Header, tx *types.Transaction, usedGas *big.Int, cfg vm.Config, tracer *replay.ReplayTracer, hook replay.Tracer) (*types.Receipt, *big.Int, error) {
 	msg, err := tx.AsMessage(types.MakeSigner(config, header.Number))
 	if err != nil {
 		return nil, nil, err
@@ -136,14 +364,14 @@ func replayApplyTransaction(config *params.ChainConfig, bc *core.BlockChain, gp
 	addr := msg.From()
 	tracer.TxBasic += fmt.Sprintf("\"sender\":\"%s\"", addr.Hex())
 
-	tracer.SetInputAccount(addr, statedb.GetCodeHash(addr), statedb.GetBalance(addr), statedb.GetNonce(addr))
+	hook.SetInputAccount(addr, statedb.GetCodeHash(addr), statedb.GetBalance(addr), statedb.GetNonce(addr))
 
 	if msg.To() != nil {
 		address := *msg.To()
 		if !statedb.Exist(address) {
-			tracer.AddTxCreatedAccount(address)
+			hook.AddTxCreatedAccount(address)
 		}
-		tracer.SetInputAccount(address, statedb.GetCodeHash(address),
+		hook.SetInputAccount(address, statedb.GetCodeHash(address),
 			statedb.GetBalance(address), statedb.GetNonce(address))
 	}
 
@@ -151,7 +379,7 @@ func replayApplyTransaction(config *params.ChainConfig, bc *core.BlockChain, gp
 	context := core.NewEVMContext(msg, header, bc)
 	// Create a new environment which holds all relevant information
 	// about the transaction and calling mechanisms.
-	vmenv := vm.NewReplayEVM(context, statedb, config, cfg, tracer)
+	vmenv := vm.NewReplayEVM(context, statedb, config, cfg, hook)
 
 	// Apply the transaction to the current state (included in the env)
 	_, gas, err := core.ApplyMessage(vmenv, msg, gp)
@@ -169,8 +397,8 @@ func replayApplyTransaction(config *params.ChainConfig, bc *core.BlockChain, gp
 	// if the transaction created a contract, store the creation address in the receipt.
 	if msg.To() == nil {
 		receipt.ContractAddress = crypto.CreateAddress(vmenv.Context.Origin, tx.Nonce())
-		if tracer.GetTxFailReason() == "" {
-			tracer.SetCreatedAddress(receipt.ContractAddress)
+		if hook.GetTxFailReason() == "" {
+			hook.SetCreatedAddress(receipt.ContractAddress)
 		}
 	}
 
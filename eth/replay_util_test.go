@@ -0,0 +1,368 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/replay"
+	"github.com/ethereum/go-ethereum/replay/provenance"
+	"github.com/ethereum/go-ethereum/replay/schema"
+)
+
+var (
+	testReplayKey, _ = crypto.HexToECDSA("8a1f9a8f95be41cd7ccb6168179afb4504aefe388d1e14474d32c45c72ce7b7a")
+	testReplayAddr   = crypto.PubkeyToAddress(testReplayKey.PublicKey)
+)
+
+// newTestReplayChain creates a blockchain with the given number of blocks
+// generated on top of a genesis funding the test bank.
+func newTestReplayChain(t *testing.T, blocks int, generator func(int, *core.BlockGen)) (*core.BlockChain, ethdb.Database) {
+	var (
+		db, _       = ethdb.NewMemDatabase()
+		genesis     = core.WriteGenesisBlockForTesting(db, testBank)
+		chainConfig = &params.ChainConfig{HomesteadBlock: big.NewInt(0)}
+	)
+	blockchain, err := core.NewBlockChain(db, chainConfig, new(core.FakePow), new(event.TypeMux), vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to create blockchain: %v", err)
+	}
+	chain, _ := core.GenerateChain(chainConfig, genesis, db, blocks, generator)
+	if _, err := blockchain.InsertChain(chain); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	return blockchain, db
+}
+
+// testReplayTransfers fills every block with a few plain value transfers.
+func testReplayTransfers(i int, block *core.BlockGen) {
+	signer := types.HomesteadSigner{}
+	for j := 0; j < 3; j++ {
+		tx, _ := types.SignTx(types.NewTransaction(block.TxNonce(testBank.Address), testReplayAddr, big.NewInt(int64(1000*(j+1))), params.TxGas, nil, nil), signer, testBankKey)
+		block.AddTx(tx)
+	}
+}
+
+// testReplayContract deploys a contract whose constructor touches the stack,
+// memory and storage, producing a code trace to replay.
+func testReplayContract(i int, block *core.BlockGen) {
+	// MSTORE(0, 42); SSTORE(1, SHA3(0, 32)); CODECOPY(0, 0, CODESIZE); RETURN(0, 32)
+	code := common.FromHex("602a60005260206000206001553860006000396020600080f3")
+	tx, _ := types.SignTx(types.NewContractCreation(block.TxNonce(testBank.Address), new(big.Int), big.NewInt(100000), nil, code), types.HomesteadSigner{}, testBankKey)
+	block.AddTx(tx)
+}
+
+// Tests that blocks can be replayed by number into valid documents.
+func TestReplayBlockByNumber(t *testing.T) {
+	bc, _ := newTestReplayChain(t, 2, testReplayTransfers)
+
+	for number := uint64(1); number <= 2; number++ {
+		doc, err := ReplayBlockByNumber(bc, number)
+		if err != nil {
+			t.Fatalf("block #%d: failed to replay: %v", number, err)
+		}
+		var block struct {
+			TransactionList []json.RawMessage `json:"transactionList"`
+		}
+		if err := json.Unmarshal([]byte(doc), &block); err != nil {
+			t.Fatalf("block #%d: invalid replay document: %v", number, err)
+		}
+		if len(block.TransactionList) != 3 {
+			t.Errorf("block #%d: transaction count mismatch: have %d, want %d", number, len(block.TransactionList), 3)
+		}
+	}
+	if _, err := ReplayBlockByNumber(bc, 3); err == nil {
+		t.Errorf("replayed non-existent block")
+	}
+}
+
+// failingWriter is an io.Writer accepting a limited number of bytes.
+type failingWriter struct {
+	limit int
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	if len(b) > w.limit {
+		n := w.limit
+		w.limit = 0
+		return n, errors.New("writer full")
+	}
+	w.limit -= len(b)
+	return len(b), nil
+}
+
+// Tests that streamed replay documents match the buffered ones, and that write
+// failures are reported back.
+func TestWriteReplayBlock(t *testing.T) {
+	bc, _ := newTestReplayChain(t, 1, testReplayTransfers)
+
+	doc, err := ReplayBlockByNumber(bc, 1)
+	if err != nil {
+		t.Fatalf("failed to replay block: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := WriteReplayBlock(&buf, bc, 1, nil); err != nil {
+		t.Fatalf("failed to stream block: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte(doc)) {
+		t.Errorf("streamed document mismatch:\nhave %s\nwant %s", buf.String(), doc)
+	}
+	for _, limit := range []int{0, 10, len(doc) / 2, len(doc) - 1} {
+		if err := WriteReplayBlock(&failingWriter{limit: limit}, bc, 1, nil); err == nil {
+			t.Errorf("limit %d: write failure not reported", limit)
+		}
+	}
+}
+
+// Tests that single transactions can be replayed by hash, producing the same
+// results as replaying their whole block.
+func TestReplayTransaction(t *testing.T) {
+	bc, db := newTestReplayChain(t, 1, testReplayTransfers)
+
+	for i, tx := range bc.GetBlockByNumber(1).Transactions() {
+		doc, err := ReplayTransaction(bc, db, tx.Hash())
+		if err != nil {
+			t.Fatalf("tx %d: failed to replay: %v", i, err)
+		}
+		var replayed struct {
+			Hash          string `json:"hash"`
+			GasUsed       uint64 `json:"gasUsed"`
+			TransferTrace []struct {
+				Type  string `json:"type"`
+				Value string `json:"value"`
+				TxSeq int    `json:"txSeqNo"`
+			} `json:"transferTrace"`
+		}
+		if err := json.Unmarshal([]byte(doc), &replayed); err != nil {
+			t.Fatalf("tx %d: invalid replay document: %v", i, err)
+		}
+		if replayed.Hash != tx.Hash().Hex() {
+			t.Errorf("tx %d: hash mismatch: have %s, want %s", i, replayed.Hash, tx.Hash().Hex())
+		}
+		if replayed.GasUsed != params.TxGas.Uint64() {
+			t.Errorf("tx %d: gas used mismatch: have %d, want %d", i, replayed.GasUsed, params.TxGas.Uint64())
+		}
+		var found bool
+		for _, transfer := range replayed.TransferTrace {
+			if transfer.TxSeq != i {
+				t.Errorf("tx %d: foreign transfer %s in tx %d", i, transfer.Type, transfer.TxSeq)
+			}
+			if transfer.Type == "ExternalCallTransfer" {
+				if transfer.Value != tx.Value().String() {
+					t.Errorf("tx %d: transfer value mismatch: have %s, want %s", i, transfer.Value, tx.Value())
+				}
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("tx %d: value transfer missing", i)
+		}
+	}
+}
+
+// Tests that replay documents decode into the typed schema, and that the
+// decoded traces encode back into the layout of the tracer.
+func TestReplaySchema(t *testing.T) {
+	bc, db := newTestReplayChain(t, 1, testReplayContract)
+
+	doc, err := ReplayBlockByNumber(bc, 1)
+	if err != nil {
+		t.Fatalf("failed to replay block: %v", err)
+	}
+	block, err := schema.DecodeBlock([]byte(doc))
+	if err != nil {
+		t.Fatalf("failed to decode block: %v", err)
+	}
+	if block.SchemaVersion != schema.Version {
+		t.Errorf("schema version mismatch: have %d, want %d", block.SchemaVersion, schema.Version)
+	}
+	if block.Header.Number != 1 || block.Header.Hash != bc.GetBlockByNumber(1).Hash() {
+		t.Errorf("header mismatch: have #%d [%x]", block.Header.Number, block.Header.Hash)
+	}
+	if len(block.Transactions) != 1 {
+		t.Fatalf("transaction count mismatch: have %d, want %d", len(block.Transactions), 1)
+	}
+	tx := block.Transactions[0]
+	if tx.To != "NIL" || len(tx.Traces) == 0 || tx.InstructionCount != len(tx.Traces) {
+		t.Fatalf("contract creation not traced: to %s, %d traces, %d instructions", tx.To, len(tx.Traces), tx.InstructionCount)
+	}
+	// Compare every trace against its raw encoding
+	var raw struct {
+		Transactions []struct {
+			Traces []json.RawMessage `json:"codeTrace"`
+		} `json:"transactionList"`
+	}
+	if err := json.Unmarshal([]byte(doc), &raw); err != nil {
+		t.Fatalf("invalid replay document: %v", err)
+	}
+	for i, trace := range tx.Traces {
+		enc, err := json.Marshal(trace)
+		if err != nil {
+			t.Fatalf("trace %d: failed to encode: %v", i, err)
+		}
+		var have, want interface{}
+		json.Unmarshal(enc, &have)
+		json.Unmarshal(raw.Transactions[0].Traces[i], &want)
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("trace %d: encoding mismatch:\nhave %s\nwant %s", i, enc, raw.Transactions[0].Traces[i])
+		}
+	}
+	// Standalone transaction documents decode too
+	txdoc, err := ReplayTransaction(bc, db, tx.Hash)
+	if err != nil {
+		t.Fatalf("failed to replay transaction: %v", err)
+	}
+	single, err := schema.DecodeTransaction([]byte(txdoc))
+	if err != nil {
+		t.Fatalf("failed to decode transaction: %v", err)
+	}
+	if single.Hash != tx.Hash || len(single.Traces) != len(tx.Traces) || len(single.Transfers) == 0 {
+		t.Errorf("transaction mismatch: have %x with %d traces, %d transfers", single.Hash, len(single.Traces), len(single.Transfers))
+	}
+}
+
+// Tests that storage loads of slots written by an earlier transaction of the
+// same block refer back to the writing transaction.
+func TestReplayCrossTxStorage(t *testing.T) {
+	counter := crypto.CreateAddress(testBank.Address, 0)
+	bc, _ := newTestReplayChain(t, 2, func(i int, block *core.BlockGen) {
+		signer := types.HomesteadSigner{}
+		switch i {
+		case 0:
+			// Deploy a counter running SSTORE(0, SLOAD(0) + 1)
+			code := common.FromHex("600a600c600039600a6000f3" + "600054600101600055" + "00")
+			tx, _ := types.SignTx(types.NewContractCreation(block.TxNonce(testBank.Address), new(big.Int), big.NewInt(100000), nil, code), signer, testBankKey)
+			block.AddTx(tx)
+		case 1:
+			// Increment the counter twice within the same block
+			for j := 0; j < 2; j++ {
+				tx, _ := types.SignTx(types.NewTransaction(block.TxNonce(testBank.Address), counter, new(big.Int), big.NewInt(100000), nil, nil), signer, testBankKey)
+				block.AddTx(tx)
+			}
+		}
+	})
+	doc, err := ReplayBlockByNumber(bc, 2)
+	if err != nil {
+		t.Fatalf("failed to replay block: %v", err)
+	}
+	block, err := schema.DecodeBlock([]byte(doc))
+	if err != nil {
+		t.Fatalf("failed to decode block: %v", err)
+	}
+	// The first increment loads pre-block storage, the second the first's write
+	first, second := block.Transactions[0].Traces, block.Transactions[1].Traces
+	if src := first[1].StackOutput.Src[0]; src.Type != "storage" || src.TxSeq != nil {
+		t.Errorf("tx 0: load source mismatch: have %s (tx %v)", src.Type, src.TxSeq)
+	}
+	src := second[1].StackOutput.Src[0]
+	if src.Type != schema.SourceCrossTx || src.InstrSeq != 1 || src.TxSeq == nil || *src.TxSeq != 0 || src.TxInstrSeq == nil || *src.TxInstrSeq != 5 {
+		t.Fatalf("tx 1: load source mismatch: have %s (tx %v, instr %v), want %s (tx 0, instr 5)", src.Type, src.TxSeq, src.TxInstrSeq, schema.SourceCrossTx)
+	}
+	// Slicing the second write ends in the first one
+	slice, err := provenance.BackwardSlice(block.Transactions[1], 5, "storeValue")
+	if err != nil {
+		t.Fatalf("failed to slice: %v", err)
+	}
+	var found bool
+	for _, root := range slice.Roots {
+		if root.Type == provenance.RootCrossTx {
+			found = root.Seq == 1 && root.Origin != nil && *root.Origin.TxSeq == 0
+		}
+	}
+	if !found {
+		t.Errorf("cross transaction root missing from slice")
+	}
+	// The loaded slot is still reported as input state of the second increment
+	for _, state := range block.Transactions[1].InputStates {
+		if state.Address == counter {
+			if len(state.Storage) != 1 {
+				t.Errorf("tx 1: input storage mismatch: have %v", state.Storage)
+			}
+			return
+		}
+	}
+	t.Errorf("tx 1: counter input state missing")
+}
+
+// Tests that replaying a block is deterministic down to the byte, and that the
+// content hashes of the documents can be checked.
+func TestReplayDeterministic(t *testing.T) {
+	bc, db := newTestReplayChain(t, 3, testReplayCounter)
+	config := &replay.ReplayConfig{ContentHash: true}
+
+	for number := uint64(1); number <= 3; number++ {
+		var first []byte
+		for i := 0; i < 8; i++ {
+			var buf bytes.Buffer
+			if err := WriteReplayBlock(&buf, bc, number, config); err != nil {
+				t.Fatalf("block %d: failed to replay: %v", number, err)
+			}
+			if first == nil {
+				first = buf.Bytes()
+			} else if !bytes.Equal(first, buf.Bytes()) {
+				t.Fatalf("block %d: replay %d differs from the first", number, i)
+			}
+		}
+		if err := schema.CheckContentHash(first); err != nil {
+			t.Errorf("block %d: %v", number, err)
+		}
+		block, err := schema.DecodeBlock(first)
+		if err != nil {
+			t.Fatalf("block %d: failed to decode: %v", number, err)
+		}
+		if block.ContentHash == nil {
+			t.Errorf("block %d: content hash missing", number)
+		}
+		for i, tx := range block.Transactions {
+			if tx.ContentHash == nil {
+				t.Errorf("block %d, tx %d: content hash missing", number, i)
+			}
+		}
+	}
+	// Standalone transaction documents are hashed too
+	tx := bc.GetBlockByNumber(2).Transactions()[1]
+	var buf bytes.Buffer
+	if err := WriteReplayTransaction(&buf, bc, db, tx.Hash(), config); err != nil {
+		t.Fatalf("failed to replay transaction: %v", err)
+	}
+	if err := schema.CheckContentHash(buf.Bytes()); err != nil {
+		t.Errorf("transaction: %v", err)
+	}
+	// Tampered and unhashed documents are rejected
+	tampered := bytes.Replace(buf.Bytes(), []byte(`"SSTORE"`), []byte(`"SLOAD"`), 1)
+	if err := schema.CheckContentHash(tampered); err == nil {
+		t.Errorf("tampered document accepted")
+	}
+	doc, _ := ReplayBlockByNumber(bc, 2)
+	if err := schema.CheckContentHash([]byte(doc)); err == nil {
+		t.Errorf("unhashed document accepted")
+	}
+}
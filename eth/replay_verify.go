@@ -0,0 +1,118 @@
+package eth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/replay"
+	"github.com/ethereum/go-ethereum/replay/schema"
+)
+
+// ReplayMismatchError is returned by verified replays diverging from the chain.
+// The replay document is still written, recording the mismatches.
+type ReplayMismatchError struct {
+	Number     uint64
+	Mismatches []*schema.Mismatch
+}
+
+func (e *ReplayMismatchError) Error() string {
+	m := e.Mismatches[0]
+	return fmt.Sprintf("replay of block #%d diverged from the chain in %d places, first tx %d %s: have %s, want %s", e.Number, len(e.Mismatches), m.Tx, m.Field, m.Have, m.Want)
+}
+
+// replayVerifier checks the results of a replayed block against the receipts
+// and state root stored in the chain, as the block validator would.
+type replayVerifier struct {
+	block      *types.Block
+	receipts   types.Receipts // receipts stored for the block
+	mismatches []*schema.Mismatch
+}
+
+// newReplayVerifier creates a verifier for a canonical block, failing if its
+// receipts are not available.
+func newReplayVerifier(chainDb ethdb.Database, block *types.Block) (*replayVerifier, error) {
+	receipts := core.GetBlockReceipts(chainDb, block.Hash(), block.NumberU64())
+	if len(receipts) != len(block.Transactions()) {
+		return nil, fmt.Errorf("receipts of block #%d unavailable", block.NumberU64())
+	}
+	return &replayVerifier{block: block, receipts: receipts}, nil
+}
+
+// mismatch records a divergence of the replay.
+func (v *replayVerifier) mismatch(tx int, field, have, want string) {
+	v.mismatches = append(v.mismatches, &schema.Mismatch{Tx: tx, Field: field, Have: have, Want: want})
+}
+
+// checkReceipt compares the receipt of a replayed transaction with the stored one.
+func (v *replayVerifier) checkReceipt(i int, receipt *types.Receipt) {
+	want := v.receipts[i]
+	if receipt.CumulativeGasUsed.Cmp(want.CumulativeGasUsed) != 0 {
+		v.mismatch(i, "cumulativeGasUsed", receipt.CumulativeGasUsed.String(), want.CumulativeGasUsed.String())
+	}
+	if receipt.Bloom != want.Bloom {
+		v.mismatch(i, "logsBloom", hexutil.Encode(receipt.Bloom[:]), hexutil.Encode(want.Bloom[:]))
+	}
+	if !bytes.Equal(receipt.PostState, want.PostState) {
+		v.mismatch(i, "postState", hexutil.Encode(receipt.PostState), hexutil.Encode(want.PostState))
+	}
+}
+
+// checkRoot compares the state after the replayed block with its header.
+func (v *replayVerifier) checkRoot(root common.Hash) {
+	if root != v.block.Root() {
+		v.mismatch(-1, "stateRoot", root.Hex(), v.block.Root().Hex())
+	}
+}
+
+// verifyState finishes the verification of a replayed block once the rewards
+// have been applied.
+func (v *replayVerifier) verifyState(statedb *state.StateDB, bc *core.BlockChain) {
+	v.checkRoot(statedb.IntermediateRoot(bc.Config().IsEIP158(v.block.Number())))
+}
+
+// field returns the verification outcome as a block document field.
+func (v *replayVerifier) field() string {
+	verification := &schema.Verification{Verified: len(v.mismatches) == 0, Mismatches: v.mismatches}
+	if verification.Mismatches == nil {
+		verification.Mismatches = []*schema.Mismatch{}
+	}
+	enc, _ := json.Marshal(verification)
+	return fmt.Sprintf("\"verification\":%s", enc)
+}
+
+// err returns the error to report for the verified block, if it diverged.
+func (v *replayVerifier) err() error {
+	if len(v.mismatches) == 0 {
+		return nil
+	}
+	return &ReplayMismatchError{Number: v.block.NumberU64(), Mismatches: v.mismatches}
+}
+
+// VerifyReplayBlockByNumber is like ReplayBlockByNumber, but also verifies the
+// replay against the receipts and state root stored in the chain. If the replay
+// diverged, the document recording the mismatches is returned along with a
+// *ReplayMismatchError.
+func VerifyReplayBlockByNumber(bc *core.BlockChain, chainDb ethdb.Database, number uint64) (string, error) {
+	var buf bytes.Buffer
+	err := VerifyReplayBlock(&buf, bc, chainDb, number, nil)
+	if _, ok := err.(*ReplayMismatchError); err != nil && !ok {
+		return "", err
+	}
+	return buf.String(), err
+}
+
+// VerifyReplayBlock is like WriteReplayBlock, but also verifies the replay
+// against the receipts and state root stored in the chain. If the replay
+// diverged, the document recording the mismatches is written in full and a
+// *ReplayMismatchError returned.
+func VerifyReplayBlock(w io.Writer, bc *core.BlockChain, chainDb ethdb.Database, number uint64, config *replay.ReplayConfig) error {
+	return writeReplayBlock(w, bc, bc.Config(), chainDb, number, config, nil)
+}
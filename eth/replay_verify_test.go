@@ -0,0 +1,97 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/replay/schema"
+)
+
+// Tests that replays of a healthy chain verify cleanly.
+func TestVerifyReplayBlock(t *testing.T) {
+	bc, db := newTestReplayChain(t, 3, testReplayCounter)
+
+	for number := uint64(0); number <= 3; number++ {
+		doc, err := VerifyReplayBlockByNumber(bc, db, number)
+		if err != nil {
+			t.Fatalf("block %d: failed to verify: %v", number, err)
+		}
+		block, err := schema.DecodeBlock([]byte(doc))
+		if err != nil {
+			t.Fatalf("block %d: failed to decode: %v", number, err)
+		}
+		// The genesis block is not executed, so cannot be verified
+		if number == 0 {
+			if block.Verification != nil {
+				t.Errorf("block %d: unexpected verification: %+v", number, block.Verification)
+			}
+			continue
+		}
+		if block.Verification == nil || !block.Verification.Verified || len(block.Verification.Mismatches) != 0 {
+			t.Errorf("block %d: verification mismatch: have %+v", number, block.Verification)
+		}
+	}
+	// Plain replays carry no verification outcome
+	doc, _ := ReplayBlockByNumber(bc, 1)
+	if block, _ := schema.DecodeBlock([]byte(doc)); block.Verification != nil {
+		t.Errorf("unverified replay has verification: %+v", block.Verification)
+	}
+}
+
+// Tests that replays diverging from the stored receipts are reported, both in
+// the document and as an error.
+func TestVerifyReplayBlockMismatch(t *testing.T) {
+	bc, db := newTestReplayChain(t, 3, testReplayCounter)
+
+	// Tamper with the stored receipts of the second block
+	block := bc.GetBlockByNumber(2)
+	receipts := core.GetBlockReceipts(db, block.Hash(), 2)
+	receipts[1].CumulativeGasUsed = new(big.Int).Add(receipts[1].CumulativeGasUsed, big.NewInt(1))
+	if err := core.WriteBlockReceipts(db, block.Hash(), 2, receipts); err != nil {
+		t.Fatalf("failed to write receipts: %v", err)
+	}
+	doc, err := VerifyReplayBlockByNumber(bc, db, 2)
+	mismatch, ok := err.(*ReplayMismatchError)
+	if !ok {
+		t.Fatalf("mismatch not reported: have %v", err)
+	}
+	if mismatch.Number != 2 || len(mismatch.Mismatches) != 1 || mismatch.Mismatches[0].Tx != 1 || mismatch.Mismatches[0].Field != "cumulativeGasUsed" {
+		t.Errorf("mismatch error content: have %v", mismatch)
+	}
+	decoded, err := schema.DecodeBlock([]byte(doc))
+	if err != nil {
+		t.Fatalf("failed to decode diverging document: %v", err)
+	}
+	if v := decoded.Verification; v == nil || v.Verified || len(v.Mismatches) != 1 {
+		t.Errorf("document verification mismatch: have %+v", v)
+	}
+	// Verified range replays write the diverging block and stop there
+	var written []uint64
+	err = VerifyReplayRange(bc, db, 1, 3, 2, nil, func(number uint64, doc string) error {
+		written = append(written, number)
+		return nil
+	})
+	if _, ok := err.(*ReplayMismatchError); !ok {
+		t.Fatalf("range mismatch not reported: have %v", err)
+	}
+	if len(written) != 2 || written[1] != 2 {
+		t.Errorf("written blocks mismatch: have %v, want [1 2]", written)
+	}
+}
@@ -0,0 +1,279 @@
+package eth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/replay"
+	"github.com/ethereum/go-ethereum/replay/schema"
+)
+
+// ReplayRules are changes to the chain rules a block is replayed under, keyed
+// by fork: homestead, dao, eip150, eip155 and eip158 take the block number the
+// fork activates at or "off", daoSupport takes "true" or "false".
+type ReplayRules map[string]string
+
+// UnmarshalJSON implements json.Unmarshaler, also accepting block numbers and
+// daoSupport as plain JSON numbers and booleans.
+func (r *ReplayRules) UnmarshalJSON(input []byte) error {
+	var dec map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(input))
+	decoder.UseNumber()
+	if err := decoder.Decode(&dec); err != nil {
+		return err
+	}
+	*r = make(ReplayRules, len(dec))
+	for fork, value := range dec {
+		(*r)[fork] = fmt.Sprint(value)
+	}
+	return nil
+}
+
+// Apply returns a copy of the chain config with the rules changed.
+func (r ReplayRules) Apply(config *params.ChainConfig) (*params.ChainConfig, error) {
+	cfg := *config
+	for fork, value := range r {
+		if fork == "daoSupport" {
+			support, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid daoSupport %q", value)
+			}
+			cfg.DAOForkSupport = support
+			continue
+		}
+		var block *big.Int
+		if value != "off" {
+			var ok bool
+			if block, ok = new(big.Int).SetString(value, 0); !ok || block.Sign() < 0 {
+				return nil, fmt.Errorf("invalid %s block %q", fork, value)
+			}
+		}
+		switch fork {
+		case "homestead":
+			cfg.HomesteadBlock = block
+		case "dao":
+			cfg.DAOForkBlock = block
+		case "eip150":
+			cfg.EIP150Block = block
+		case "eip155":
+			cfg.EIP155Block = block
+		case "eip158":
+			cfg.EIP158Block = block
+		default:
+			return nil, fmt.Errorf("unknown fork %q", fork)
+		}
+	}
+	return &cfg, nil
+}
+
+// ReplayWhatIf is the difference between the canonical replay of a block and
+// its replay under alternative chain rules. Only the transactions whose replay
+// changed are listed.
+type ReplayWhatIf struct {
+	Block          uint64              `json:"block"`
+	Config         *params.ChainConfig `json:"config"` // the alternative rules replayed under
+	Transactions   []*ReplayTxDiff     `json:"transactions"`
+	RemovedRewards []*schema.Transfer  `json:"removedRewards,omitempty"` // transfers not bound to a transaction
+	AddedRewards   []*schema.Transfer  `json:"addedRewards,omitempty"`
+}
+
+// ReplayTxDiff is the difference between the canonical replay of a transaction
+// and its replay under alternative rules. Unchanged aspects are left out.
+// Transactions the alternative rules reject carry the error they are rejected
+// with, and differ from their canonical replay as if they had never executed.
+type ReplayTxDiff struct {
+	Index            int                    `json:"index"`
+	Hash             common.Hash            `json:"hash"`
+	Invalid          string                 `json:"invalid,omitempty"`
+	GasUsed          *ReplayChange          `json:"gasUsed,omitempty"`
+	FailReason       *ReplayChange          `json:"failReason,omitempty"`
+	RemovedTransfers []*schema.Transfer     `json:"removedTransfers,omitempty"`
+	AddedTransfers   []*schema.Transfer     `json:"addedTransfers,omitempty"`
+	Storage          []*ReplayStorageChange `json:"storage,omitempty"`
+}
+
+// ReplayChange is a value of the canonical replay and its alternative.
+type ReplayChange struct {
+	Canonical interface{} `json:"canonical"`
+	WhatIf    interface{} `json:"whatIf"`
+}
+
+// ReplayStorageChange is a storage slot written with a different value, or
+// written in one replay only (the value of the other being null).
+type ReplayStorageChange struct {
+	Account common.Address `json:"account"`
+	Slot    string         `json:"slot"`
+	ReplayChange
+}
+
+// ReplayBlockWithRules replays the canonical block with the given number both
+// under the rules of the chain and under the rules changed as given, and
+// returns how the replays differ.
+func ReplayBlockWithRules(bc *core.BlockChain, number uint64, rules ReplayRules) (*ReplayWhatIf, error) {
+	cfg, err := rules.Apply(bc.Config())
+	if err != nil {
+		return nil, err
+	}
+	canonical, err := replayStateDiff(bc, bc.Config(), number, nil)
+	if err != nil {
+		return nil, err
+	}
+	invalid := make(map[int]error)
+	whatIf, err := replayStateDiff(bc, cfg, number, invalid)
+	if err != nil {
+		return nil, fmt.Errorf("under the given rules: %v", err)
+	}
+	diff := DiffReplayBlocks(canonical, whatIf)
+	diff.Config = cfg
+	for _, txDiff := range diff.Transactions {
+		if err, ok := invalid[txDiff.Index]; ok {
+			txDiff.Invalid = err.Error()
+		}
+	}
+	return diff, nil
+}
+
+// replayStateDiff replays a block under the given rules without code traces.
+// Transactions the rules reject are recorded in invalid if given, see replayBlock.
+func replayStateDiff(bc *core.BlockChain, cfg *params.ChainConfig, number uint64, invalid map[int]error) (*schema.Block, error) {
+	var buf bytes.Buffer
+	if err := writeReplayBlock(&buf, bc, cfg, nil, number, &replay.ReplayConfig{Preset: replay.PresetStateDiff}, invalid); err != nil {
+		return nil, err
+	}
+	return schema.DecodeBlock(buf.Bytes())
+}
+
+// DiffReplayBlocks compares two replays of the same block. Transactions are
+// matched by hash, the ones missing from the alternative replay are diffed
+// against an empty replay.
+func DiffReplayBlocks(canonical, whatIf *schema.Block) *ReplayWhatIf {
+	diff := &ReplayWhatIf{Transactions: []*ReplayTxDiff{}}
+	if canonical.Header != nil {
+		diff.Block = canonical.Header.Number
+	}
+	canonicalTransfers, whatIfTransfers := transfersByTx(canonical.Transfers), transfersByTx(whatIf.Transfers)
+	diff.RemovedRewards, diff.AddedRewards = diffTransfers(canonicalTransfers[-1], whatIfTransfers[-1])
+
+	replayed := make(map[common.Hash]*schema.Transaction, len(whatIf.Transactions))
+	for _, tx := range whatIf.Transactions {
+		replayed[tx.Hash] = tx
+	}
+	for i, tx := range canonical.Transactions {
+		alt, ok := replayed[tx.Hash]
+		if !ok {
+			alt = &schema.Transaction{Hash: tx.Hash}
+		}
+		txDiff := &ReplayTxDiff{Index: i, Hash: tx.Hash}
+		if tx.GasUsed != alt.GasUsed {
+			txDiff.GasUsed = &ReplayChange{tx.GasUsed, alt.GasUsed}
+		}
+		if tx.FailReason != alt.FailReason {
+			txDiff.FailReason = &ReplayChange{tx.FailReason, alt.FailReason}
+		}
+		txDiff.RemovedTransfers, txDiff.AddedTransfers = diffTransfers(canonicalTransfers[i], whatIfTransfers[i])
+		txDiff.Storage = diffStorage(tx.OutputStates, alt.OutputStates)
+
+		if !ok || txDiff.GasUsed != nil || txDiff.FailReason != nil || txDiff.RemovedTransfers != nil || txDiff.AddedTransfers != nil || txDiff.Storage != nil {
+			diff.Transactions = append(diff.Transactions, txDiff)
+		}
+	}
+	return diff
+}
+
+// transfersByTx groups transfers by the index of their transaction, -1 for the
+// ones not bound to a transaction.
+func transfersByTx(transfers []*schema.Transfer) map[int][]*schema.Transfer {
+	grouped := make(map[int][]*schema.Transfer)
+	for _, transfer := range transfers {
+		grouped[transfer.TxSeq] = append(grouped[transfer.TxSeq], transfer)
+	}
+	return grouped
+}
+
+// diffTransfers returns the transfers only present in a, and the ones only
+// present in b. Transfers are told apart by their ends, value and type.
+func diffTransfers(a, b []*schema.Transfer) (removed, added []*schema.Transfer) {
+	key := func(t *schema.Transfer) string {
+		return fmt.Sprintf("%s %s %v %s", t.From, t.To, t.Value, t.Type)
+	}
+	counts := make(map[string]int)
+	for _, t := range b {
+		counts[key(t)]++
+	}
+	for _, t := range a {
+		if k := key(t); counts[k] > 0 {
+			counts[k]--
+		} else {
+			removed = append(removed, t)
+		}
+	}
+	for _, t := range b {
+		if k := key(t); counts[k] > 0 {
+			counts[k]--
+			added = append(added, t)
+		}
+	}
+	return removed, added
+}
+
+// diffStorage compares the storage written by two replays of a transaction.
+func diffStorage(a, b []*schema.OutputState) []*ReplayStorageChange {
+	type slotKey struct {
+		account common.Address
+		slot    string
+	}
+	var (
+		keys   []slotKey
+		values = make(map[slotKey][2]hexutil.Bytes)
+	)
+	for i, states := range [][]*schema.OutputState{a, b} {
+		for _, state := range states {
+			for slot, content := range state.Storage {
+				k := slotKey{state.Address, slot}
+				v, ok := values[k]
+				if !ok {
+					keys = append(keys, k)
+				}
+				v[i] = content.Value
+				values[k] = v
+			}
+		}
+	}
+	var changes replayStorageChanges
+	for _, k := range keys {
+		v := values[k]
+		if v[0] != nil && v[1] != nil && bytes.Equal(v[0], v[1]) {
+			continue
+		}
+		change := &ReplayStorageChange{Account: k.account, Slot: k.slot}
+		if v[0] != nil {
+			change.Canonical = v[0]
+		}
+		if v[1] != nil {
+			change.WhatIf = v[1]
+		}
+		changes = append(changes, change)
+	}
+	sort.Sort(changes)
+	return changes
+}
+
+// replayStorageChanges sorts storage changes by account and slot.
+type replayStorageChanges []*ReplayStorageChange
+
+func (c replayStorageChanges) Len() int      { return len(c) }
+func (c replayStorageChanges) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c replayStorageChanges) Less(i, j int) bool {
+	if c[i].Account != c[j].Account {
+		return bytes.Compare(c[i].Account[:], c[j].Account[:]) < 0
+	}
+	return c[i].Slot < c[j].Slot
+}
@@ -0,0 +1,170 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/replay/schema"
+)
+
+// testReplayTightCounter deploys the counter of testReplayCounter, then calls it
+// with just enough gas for its first increment under Homestead rules.
+func testReplayTightCounter(i int, block *core.BlockGen) {
+	if i == 0 {
+		testReplayCounter(i, block)
+		return
+	}
+	tx, _ := types.SignTx(types.NewTransaction(block.TxNonce(testBank.Address), crypto.CreateAddress(testBank.Address, 0), new(big.Int), big.NewInt(41100), nil, nil), types.HomesteadSigner{}, testBankKey)
+	block.AddTx(tx)
+}
+
+// Tests that replaying under alternative rules reports the transactions whose
+// execution changed.
+func TestReplayBlockWithRules(t *testing.T) {
+	bc, _ := newTestReplayChain(t, 2, testReplayTightCounter)
+
+	// Unchanged rules yield no differences
+	diff, err := ReplayBlockWithRules(bc, 2, ReplayRules{"daoSupport": "true"})
+	if err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+	if len(diff.Transactions) != 0 || diff.RemovedRewards != nil || diff.AddedRewards != nil {
+		t.Errorf("unexpected differences: %+v", diff)
+	}
+	// The repriced SLOAD runs the call out of gas, losing its storage write
+	if diff, err = ReplayBlockWithRules(bc, 2, ReplayRules{"eip150": "0"}); err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+	if !diff.Config.IsEIP150(big.NewInt(2)) || diff.Block != 2 {
+		t.Errorf("config mismatch: block %d, %v", diff.Block, diff.Config)
+	}
+	if len(diff.Transactions) != 1 {
+		t.Fatalf("changed transaction count mismatch: have %d, want 1", len(diff.Transactions))
+	}
+	tx := diff.Transactions[0]
+	if tx.GasUsed == nil || tx.GasUsed.Canonical != uint64(41062) || tx.GasUsed.WhatIf != uint64(41100) {
+		t.Errorf("gas used mismatch: %+v", tx.GasUsed)
+	}
+	if len(tx.Storage) != 1 || tx.Storage[0].Account != crypto.CreateAddress(testBank.Address, 0) || tx.Storage[0].WhatIf != nil {
+		t.Fatalf("storage changes mismatch: %+v", tx.Storage)
+	}
+	if value := tx.Storage[0].Canonical.(hexutil.Bytes); new(big.Int).SetBytes(value).Int64() != 1 {
+		t.Errorf("canonical storage value mismatch: have %x, want 1", value)
+	}
+}
+
+// Tests that transactions rejected under the alternative rules are reported as
+// invalid, while the rest of the block is still replayed.
+func TestReplayBlockWithRulesInvalid(t *testing.T) {
+	var (
+		key, _      = crypto.GenerateKey()
+		sender      = core.GenesisAccount{Address: crypto.PubkeyToAddress(key.PublicKey), Balance: big.NewInt(1000000)}
+		db, _       = ethdb.NewMemDatabase()
+		genesis     = core.WriteGenesisBlockForTesting(db, testBank, sender)
+		chainConfig = &params.ChainConfig{ChainId: big.NewInt(1), HomesteadBlock: big.NewInt(0), EIP155Block: big.NewInt(0)}
+	)
+	bc, err := core.NewBlockChain(db, chainConfig, new(core.FakePow), new(event.TypeMux), vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to create blockchain: %v", err)
+	}
+	// A replay protected transfer, followed by an unprotected one of another sender
+	var protected, plain *types.Transaction
+	chain, _ := core.GenerateChain(chainConfig, genesis, db, 1, func(i int, block *core.BlockGen) {
+		protected, _ = types.SignTx(types.NewTransaction(0, testReplayAddr, big.NewInt(1000), params.TxGas, nil, nil), types.NewEIP155Signer(chainConfig.ChainId), testBankKey)
+		plain, _ = types.SignTx(types.NewTransaction(0, testReplayAddr, big.NewInt(2000), params.TxGas, nil, nil), types.HomesteadSigner{}, key)
+		block.AddTx(protected)
+		block.AddTx(plain)
+	})
+	if _, err := bc.InsertChain(chain); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	diff, err := ReplayBlockWithRules(bc, 1, ReplayRules{"eip155": "off"})
+	if err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+	if len(diff.Transactions) != 1 {
+		t.Fatalf("changed transaction count mismatch: have %d, want 1", len(diff.Transactions))
+	}
+	tx := diff.Transactions[0]
+	if tx.Index != 0 || tx.Hash != protected.Hash() || tx.Invalid == "" {
+		t.Errorf("invalid transaction mismatch: %+v", tx)
+	}
+	if !hasReplayTransfer(tx.RemovedTransfers, 0, "1000") || tx.AddedTransfers != nil {
+		t.Errorf("transfer changes mismatch: removed %v, added %v", tx.RemovedTransfers, tx.AddedTransfers)
+	}
+	// The transaction following the rejected one is replayed all the same
+	invalid := make(map[int]error)
+	whatIf, err := replayStateDiff(bc, diff.Config, 1, invalid)
+	if err != nil {
+		t.Fatalf("failed to replay: %v", err)
+	}
+	if len(whatIf.Transactions) != 1 || whatIf.Transactions[0].Hash != plain.Hash() {
+		t.Errorf("replayed transactions mismatch: %+v", whatIf.Transactions)
+	}
+	if !hasReplayTransfer(whatIf.Transfers, 1, "2000") || hasReplayTransfer(whatIf.Transfers, 0, "1000") {
+		t.Errorf("replayed transfers mismatch: %v", whatIf.Transfers)
+	}
+	if len(invalid) != 1 || invalid[0] == nil {
+		t.Errorf("invalid transactions mismatch: %v", invalid)
+	}
+}
+
+// hasReplayTransfer reports whether the transaction with the given index moved
+// the given value to testReplayAddr.
+func hasReplayTransfer(transfers []*schema.Transfer, tx int, value string) bool {
+	for _, transfer := range transfers {
+		if transfer.TxSeq == tx && common.HexToAddress(transfer.To) == testReplayAddr && transfer.Value.String() == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Tests that rule changes are parsed from both strings and JSON values.
+func TestReplayRules(t *testing.T) {
+	var rules ReplayRules
+	if err := json.Unmarshal([]byte(`{"eip150": 2463000, "eip155": "off", "daoSupport": false}`), &rules); err != nil {
+		t.Fatalf("failed to decode rules: %v", err)
+	}
+	cfg, err := rules.Apply(params.MainnetChainConfig)
+	if err != nil {
+		t.Fatalf("failed to apply rules: %v", err)
+	}
+	if cfg.EIP150Block.Uint64() != 2463000 || cfg.EIP155Block != nil || cfg.DAOForkSupport {
+		t.Errorf("config mismatch: %v", cfg)
+	}
+	if params.MainnetChainConfig.EIP155Block == nil || !params.MainnetChainConfig.DAOForkSupport {
+		t.Errorf("base config modified")
+	}
+	for _, invalid := range []ReplayRules{{"frontier": "0"}, {"eip158": "-1"}, {"eip158": "soon"}, {"daoSupport": "maybe"}} {
+		if _, err := invalid.Apply(params.MainnetChainConfig); err == nil {
+			t.Errorf("invalid rules %v accepted", invalid)
+		}
+	}
+}
@@ -19,11 +19,11 @@ package ethapi
 import (
 	"bytes"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
 	"math/big"
-	"os"
 	"strings"
 	"time"
 
@@ -40,6 +40,9 @@ import (
 	"github.com/ethereum/go-ethereum/logger"
 	"github.com/ethereum/go-ethereum/logger/glog"
 	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/replay"
+	"github.com/ethereum/go-ethereum/replay/provenance"
+	"github.com/ethereum/go-ethereum/replay/schema"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/syndtr/goleveldb/leveldb"
@@ -457,20 +460,39 @@ func (s *PublicBlockChainAPI) GetBlockByNumber(ctx context.Context, blockNr rpc.
 	return nil, err
 }
 
-// GetReplayBlockByNumber returns the requested block. When blockNr is -1 the chain head is returned. When fullTx is true all
-// transactions in the block are returned in full detail, otherwise only the transaction hash is returned.
-func (s *PublicBlockChainAPI) GetReplayBlockByNumber(ctx context.Context, blockNr rpc.BlockNumber, fullTx bool) string {
-	return s.b.ReplayBlockByNumber(ctx, blockNr)
+// GetReplayBlockByNumber returns the replay document of the requested block, as
+// described by the replay/schema package. When blockNr is -1 the chain head is
+// replayed. The fullTx flag is accepted for compatibility and ignored. The
+// optional config limits the code traces emitted.
+func (s *PublicBlockChainAPI) GetReplayBlockByNumber(ctx context.Context, blockNr rpc.BlockNumber, fullTx bool, config *replay.ReplayConfig) (json.RawMessage, error) {
+	doc, err := s.b.ReplayBlockByNumber(ctx, blockNr, config)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(doc), nil
 }
 
-// SaveReplayBlock returns the requested block. When blockNr is -1 the chain head is returned. When fullTx is true all
-// transactions in the block are returned in full detail, otherwise only the transaction hash is returned.
-func (s *PublicBlockChainAPI) SaveReplayBlock(ctx context.Context, blockNr rpc.BlockNumber, fileName string) string {
-	ans := s.b.ReplayBlockByNumber(ctx, blockNr)
-	fp, _ := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0666)
-	defer fp.Close()
-	fp.WriteString(ans)
-	return ans
+// SaveReplayBlock replays the requested block and saves its replay document as
+// the given file of the node's replay output directory, gzip compressed if the
+// name ends in ".gz". The name is relative to the output directory and may not
+// leave it; an existing file is replaced. When blockNr is -1 the chain head is
+// replayed. The optional config limits the code traces emitted.
+func (s *PublicBlockChainAPI) SaveReplayBlock(ctx context.Context, blockNr rpc.BlockNumber, name string, config *replay.ReplayConfig) (bool, error) {
+	if err := s.b.SaveReplayBlock(ctx, blockNr, name, config); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetReplayTransaction re-executes the block holding the given transaction and
+// returns the replay document of that transaction, including its transfers. The
+// optional config limits the code trace emitted.
+func (s *PublicBlockChainAPI) GetReplayTransaction(ctx context.Context, txHash common.Hash, config *replay.ReplayConfig) (json.RawMessage, error) {
+	doc, err := s.b.ReplayTransaction(ctx, txHash, config)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(doc), nil
 }
 
 // GetBlockByHash returns the requested block. When fullTx is true all transactions in the block are returned in full
@@ -591,23 +613,17 @@ type CallArgs struct {
 	Data     hexutil.Bytes   `json:"data"`
 }
 
-func (s *PublicBlockChainAPI) doCall(ctx context.Context, args CallArgs, blockNr rpc.BlockNumber) (string, *big.Int, error) {
-	defer func(start time.Time) { glog.V(logger.Debug).Infof("call took %v", time.Since(start)) }(time.Now())
-
-	state, header, err := s.b.StateAndHeaderByNumber(ctx, blockNr)
-	if state == nil || err != nil {
-		return "0x", common.Big0, err
-	}
+// callMessage converts the arguments of a call into a message, filling in the
+// default sender, gas and gas price if none were set.
+func callMessage(b Backend, args CallArgs) types.Message {
 	// Set sender address or use a default if none specified
 	addr := args.From
 	if addr == (common.Address{}) {
-		if wallets := s.b.AccountManager().Wallets(); len(wallets) > 0 {
+		if wallets := b.AccountManager().Wallets(); len(wallets) > 0 {
 			if accounts := wallets[0].Accounts(); len(accounts) > 0 {
 				addr = accounts[0].Address
 			}
 		}
-	} else {
-		addr = args.From
 	}
 	// Set default gas & gas price if none were set
 	gas, gasPrice := args.Gas.ToInt(), args.GasPrice.ToInt()
@@ -617,7 +633,17 @@ func (s *PublicBlockChainAPI) doCall(ctx context.Context, args CallArgs, blockNr
 	if gasPrice.Cmp(common.Big0) == 0 {
 		gasPrice = new(big.Int).Mul(big.NewInt(50), common.Shannon)
 	}
-	msg := types.NewMessage(addr, args.To, 0, args.Value.ToInt(), gas, gasPrice, args.Data, false)
+	return types.NewMessage(addr, args.To, 0, args.Value.ToInt(), gas, gasPrice, args.Data, false)
+}
+
+func (s *PublicBlockChainAPI) doCall(ctx context.Context, args CallArgs, blockNr rpc.BlockNumber) (string, *big.Int, error) {
+	defer func(start time.Time) { glog.V(logger.Debug).Infof("call took %v", time.Since(start)) }(time.Now())
+
+	state, header, err := s.b.StateAndHeaderByNumber(ctx, blockNr)
+	if state == nil || err != nil {
+		return "0x", common.Big0, err
+	}
+	msg := callMessage(s.b, args)
 
 	// Execute the call and return
 	vmenv, vmError, err := s.b.GetVMEnv(ctx, msg, state, header)
@@ -785,6 +811,101 @@ func (s *PublicBlockChainAPI) rpcOutputBlock(b *types.Block, inclTx bool, fullTx
 	return fields, nil
 }
 
+// PublicReplayAPI provides the analyses of replayed transactions and calls. They
+// re-execute whole blocks under the replay tracer, and are served in the
+// deepinsight namespace rather than next to the cheap eth queries.
+type PublicReplayAPI struct {
+	b Backend
+}
+
+// NewPublicReplayAPI creates a new replay analysis API.
+func NewPublicReplayAPI(b Backend) *PublicReplayAPI {
+	return &PublicReplayAPI{b}
+}
+
+// GetReplaySlice replays the given transaction and returns the backward slice of
+// an operand of one of its instructions: every instruction that contributed to
+// the value, along with the calldata, storage, code or environment roots it
+// originates from. The operand is a stack input name as emitted in the replay
+// document (e.g. "storeValue"), "output" or "memory".
+func (s *PublicReplayAPI) GetReplaySlice(ctx context.Context, txHash common.Hash, seq int, operand string) (*provenance.Slice, error) {
+	doc, err := s.b.ReplayTransaction(ctx, txHash, nil)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := schema.DecodeTransaction([]byte(doc))
+	if err != nil {
+		return nil, err
+	}
+	return provenance.BackwardSlice(tx, seq, operand)
+}
+
+// GetReplayGraph replays the given transaction and renders its data flow graph
+// in the DOT language of Graphviz, restricted to the slice feeding the given
+// instruction if a sequence number is specified. See provenance.WriteDOT.
+func (s *PublicReplayAPI) GetReplayGraph(ctx context.Context, txHash common.Hash, seq *int) (string, error) {
+	doc, err := s.b.ReplayTransaction(ctx, txHash, nil)
+	if err != nil {
+		return "", err
+	}
+	tx, err := schema.DecodeTransaction([]byte(doc))
+	if err != nil {
+		return "", err
+	}
+	from := -1
+	if seq != nil {
+		if *seq < 0 {
+			return "", fmt.Errorf("invalid instruction sequence number %d", *seq)
+		}
+		from = *seq
+	}
+	var buf bytes.Buffer
+	if err := provenance.WriteDOT(&buf, tx, from); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// GetReplayTaint replays the given transaction and propagates a taint source
+// forward through it, returning every instruction, storage write, log, call and
+// transfer the tainted values flow into. See provenance.ParseTaintSource for the
+// accepted sources.
+func (s *PublicReplayAPI) GetReplayTaint(ctx context.Context, txHash common.Hash, source string) (*provenance.Taint, error) {
+	src, err := provenance.ParseTaintSource(source)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := s.b.ReplayTransaction(ctx, txHash, nil)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := schema.DecodeTransaction([]byte(doc))
+	if err != nil {
+		return nil, err
+	}
+	return provenance.ForwardTaint(tx, src), nil
+}
+
+// ReplayCall executes the given call on the state of the given block like Call
+// does, but under the replay tracer. It returns the replay document the call
+// would have produced as a transaction, so that the provenance of a pending or
+// hypothetical transaction can be analyzed before it is mined. The optional
+// config limits the code trace emitted.
+func (s *PublicReplayAPI) ReplayCall(ctx context.Context, args CallArgs, blockNr rpc.BlockNumber, config *replay.ReplayConfig) (json.RawMessage, error) {
+	state, header, err := s.b.StateAndHeaderByNumber(ctx, blockNr)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, fmt.Errorf("state of block %d unavailable", blockNr)
+	}
+	doc, err := s.b.ReplayCall(ctx, callMessage(s.b, args), state, header, config)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(doc), nil
+}
+
 // RPCTransaction represents a transaction that will serialize to the RPC representation of a transaction
 type RPCTransaction struct {
 	BlockHash        common.Hash     `json:"blockHash"`
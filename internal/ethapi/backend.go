@@ -29,6 +29,7 @@ import (
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/replay"
 	"github.com/ethereum/go-ethereum/rpc"
 	"golang.org/x/net/context"
 )
@@ -65,7 +66,10 @@ type Backend interface {
 	CurrentBlock() *types.Block
 
 	// Additional APIs
-	ReplayBlockByNumber(ctx context.Context, blockNr rpc.BlockNumber) string
+	ReplayBlockByNumber(ctx context.Context, blockNr rpc.BlockNumber, config *replay.ReplayConfig) (string, error)
+	SaveReplayBlock(ctx context.Context, blockNr rpc.BlockNumber, name string, config *replay.ReplayConfig) error
+	ReplayTransaction(ctx context.Context, txHash common.Hash, config *replay.ReplayConfig) (string, error)
+	ReplayCall(ctx context.Context, msg core.Message, state State, header *types.Header, config *replay.ReplayConfig) (string, error)
 }
 
 type State interface {
@@ -93,6 +97,11 @@ func GetAPIs(apiBackend Backend, solcPath string) []rpc.API {
 			Version:   "1.0",
 			Service:   NewPublicTransactionPoolAPI(apiBackend),
 			Public:    true,
+		}, {
+			Namespace: "deepinsight",
+			Version:   "1.0",
+			Service:   NewPublicReplayAPI(apiBackend),
+			Public:    true,
 		}, {
 			Namespace: "txpool",
 			Version:   "1.0",
@@ -18,16 +18,18 @@
 package web3ext
 
 var Modules = map[string]string{
-	"admin":      Admin_JS,
-	"chequebook": Chequebook_JS,
-	"debug":      Debug_JS,
-	"eth":        Eth_JS,
-	"miner":      Miner_JS,
-	"net":        Net_JS,
-	"personal":   Personal_JS,
-	"rpc":        RPC_JS,
-	"shh":        Shh_JS,
-	"txpool":     TxPool_JS,
+	"admin":       Admin_JS,
+	"chequebook":  Chequebook_JS,
+	"debug":       Debug_JS,
+	"deepinsight": DeepInsight_JS,
+	"eth":         Eth_JS,
+	"miner":       Miner_JS,
+	"net":         Net_JS,
+	"personal":    Personal_JS,
+	"rpc":         RPC_JS,
+	"shh":         Shh_JS,
+	"trace":       Trace_JS,
+	"txpool":      TxPool_JS,
 }
 
 const Chequebook_JS = `
@@ -294,12 +296,90 @@ web3._extend({
 			call: 'debug_preimage',
 			params: 1,
 			inputFormatter: [null]
+		}),
+		new web3._extend.Method({
+			name: 'replayBlockWithRules',
+			call: 'debug_replayBlockWithRules',
+			params: 2
+		}),
+		new web3._extend.Method({
+			name: 'replayStats',
+			call: 'debug_replayStats',
+			params: 2
 		})
 	],
 	properties: []
 });
 `
 
+const DeepInsight_JS = `
+web3._extend({
+	property: 'deepinsight',
+	methods:
+	[
+		new web3._extend.Method({
+			name: 'getTransfers',
+			call: 'deepinsight_getTransfers',
+			params: 4,
+			inputFormatter: [web3._extend.formatters.inputAddressFormatter, web3._extend.formatters.inputBlockNumberFormatter, web3._extend.formatters.inputBlockNumberFormatter, null]
+		}),
+		new web3._extend.Method({
+			name: 'getReplaySlice',
+			call: 'deepinsight_getReplaySlice',
+			params: 3
+		}),
+		new web3._extend.Method({
+			name: 'getReplayGraph',
+			call: 'deepinsight_getReplayGraph',
+			params: 2
+		}),
+		new web3._extend.Method({
+			name: 'getReplayTaint',
+			call: 'deepinsight_getReplayTaint',
+			params: 2
+		}),
+		new web3._extend.Method({
+			name: 'getReplayLoadOrigin',
+			call: 'deepinsight_getReplayLoadOrigin',
+			params: 2
+		}),
+		new web3._extend.Method({
+			name: 'replayCall',
+			call: 'deepinsight_replayCall',
+			params: 3,
+			inputFormatter: [web3._extend.formatters.inputCallFormatter, web3._extend.formatters.inputDefaultBlockNumberFormatter, null]
+		}),
+		new web3._extend.Method({
+			name: 'startJob',
+			call: 'deepinsight_startJob',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'stopJob',
+			call: 'deepinsight_stopJob',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'resumeJob',
+			call: 'deepinsight_resumeJob',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'getJob',
+			call: 'deepinsight_getJob',
+			params: 1
+		})
+	],
+	properties:
+	[
+		new web3._extend.Property({
+			name: 'jobs',
+			getter: 'deepinsight_listJobs'
+		})
+	]
+});
+`
+
 const Eth_JS = `
 web3._extend({
 	property: 'eth',
@@ -341,6 +421,11 @@ web3._extend({
 			},
 			params: 2,
 			inputFormatter: [web3._extend.formatters.inputBlockNumberFormatter, web3._extend.utils.toHex]
+		}),
+		new web3._extend.Method({
+			name: 'getReplaySlotHistory',
+			call: 'eth_getReplaySlotHistory',
+			params: 2
 		})
 	],
 	properties:
@@ -494,6 +579,33 @@ web3._extend({
 });
 `
 
+const Trace_JS = `
+web3._extend({
+	property: 'trace',
+	methods:
+	[
+		new web3._extend.Method({
+			name: 'block',
+			call: 'trace_block',
+			params: 1,
+			inputFormatter: [web3._extend.formatters.inputBlockNumberFormatter]
+		}),
+		new web3._extend.Method({
+			name: 'transaction',
+			call: 'trace_transaction',
+			params: 1
+		}),
+		new web3._extend.Method({
+			name: 'replayBlockTransactions',
+			call: 'trace_replayBlockTransactions',
+			params: 2,
+			inputFormatter: [web3._extend.formatters.inputBlockNumberFormatter, null]
+		})
+	],
+	properties: []
+});
+`
+
 const TxPool_JS = `
 web3._extend({
 	property: 'txpool',
@@ -17,6 +17,7 @@
 package les
 
 import (
+	"errors"
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/accounts"
@@ -31,10 +32,15 @@ import (
 	"github.com/ethereum/go-ethereum/internal/ethapi"
 	"github.com/ethereum/go-ethereum/light"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/replay"
 	"github.com/ethereum/go-ethereum/rpc"
 	"golang.org/x/net/context"
 )
 
+// errReplayUnsupported is returned by the replay methods, as a light client has
+// no local state to re-execute blocks on.
+var errReplayUnsupported = errors.New("replay not supported in light mode")
+
 type LesApiBackend struct {
 	eth *LightEthereum
 	gpo *gasprice.LightPriceOracle
@@ -68,8 +74,20 @@ func (b *LesApiBackend) BlockByNumber(ctx context.Context, blockNr rpc.BlockNumb
 	return b.GetBlock(ctx, header.Hash())
 }
 
-func (b *LesApiBackend) ReplayBlockByNumber(ctx context.Context, blockNr rpc.BlockNumber) string {
-	return ""
+func (b *LesApiBackend) ReplayBlockByNumber(ctx context.Context, blockNr rpc.BlockNumber, config *replay.ReplayConfig) (string, error) {
+	return "", errReplayUnsupported
+}
+
+func (b *LesApiBackend) SaveReplayBlock(ctx context.Context, blockNr rpc.BlockNumber, name string, config *replay.ReplayConfig) error {
+	return errReplayUnsupported
+}
+
+func (b *LesApiBackend) ReplayTransaction(ctx context.Context, txHash common.Hash, config *replay.ReplayConfig) (string, error) {
+	return "", errReplayUnsupported
+}
+
+func (b *LesApiBackend) ReplayCall(ctx context.Context, msg core.Message, state ethapi.State, header *types.Header, config *replay.ReplayConfig) (string, error) {
+	return "", errReplayUnsupported
 }
 
 func (b *LesApiBackend) StateAndHeaderByNumber(ctx context.Context, blockNr rpc.BlockNumber) (ethapi.State, *types.Header, error) {
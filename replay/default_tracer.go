@@ -62,6 +62,10 @@ func (r *DefaultTracer) StrTransfer(seq int) string {
 	return ""
 }
 
+func (r *DefaultTracer) StrTxTransfer(seq int) string {
+	return ""
+}
+
 func (r *DefaultTracer) StrTxBasic(nonce, gasPrice, startGas, gasUsed uint64, data, init, to, value string, v int64, r_, s, hash string) {
 
 }
@@ -130,7 +134,7 @@ func (r *DefaultTracer) InitTrace(name string, pc int, gas int, calldepth int) i
 	return 0
 }
 func (r *DefaultTracer) AddMemSize(seq int, before, after int)                               {}
-func (r *DefaultTracer) AddGas(seq int, gas int64)                                           {}
+func (r *DefaultTracer) SetCallGas(seq int, gas, left int64)                                 {}
 func (r *DefaultTracer) SetStackInput(seq int, num int)                                      {}
 func (r *DefaultTracer) SetStackOutput(seq int, val *big.Int)                                {}
 func (r *DefaultTracer) SetMemoryInput(seq int, offset *big.Int, size *big.Int)              {}
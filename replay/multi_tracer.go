@@ -0,0 +1,345 @@
+package replay
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// MultiTracer is a Tracer forwarding every hook to several tracers, so that a
+// single execution can feed several analyses at once.
+//
+// The first tracer is the primary one: it alone answers the queries the EVM
+// makes (sequence numbers, call depth, simulated stack and memory, created
+// accounts, ...), while every tracer receives every hook. The sequence numbers
+// passed to the hooks are thus those assigned by the primary tracer; secondary
+// tracers numbering instructions must do so the same way, counting InitTrace
+// calls from zero at every TxInit.
+type MultiTracer struct {
+	tracers []Tracer
+}
+
+// NewMultiTracer creates a tracer forwarding to the primary tracer and all the
+// others, in order.
+func NewMultiTracer(primary Tracer, others ...Tracer) *MultiTracer {
+	return &MultiTracer{tracers: append([]Tracer{primary}, others...)}
+}
+
+// Tracers returns the tracers hooks are forwarded to, the primary one first.
+func (m *MultiTracer) Tracers() []Tracer {
+	return m.tracers
+}
+
+// Init
+func (m *MultiTracer) BlockInit() {
+	for _, t := range m.tracers {
+		t.BlockInit()
+	}
+}
+
+func (m *MultiTracer) TxInit(seq int) {
+	for _, t := range m.tracers {
+		t.TxInit(seq)
+	}
+}
+
+// Transfer
+func (m *MultiTracer) AddTransfer(from string, to string, balance *big.Int, reason string) {
+	for _, t := range m.tracers {
+		t.AddTransfer(from, to, balance, reason)
+	}
+}
+
+func (m *MultiTracer) SetTransferSeq() {
+	for _, t := range m.tracers {
+		t.SetTransferSeq()
+	}
+}
+
+func (m *MultiTracer) ValidateTransfer(seq int) {
+	for _, t := range m.tracers {
+		t.ValidateTransfer(seq)
+	}
+}
+
+// Refund
+func (m *MultiTracer) SetRefundGas(refund *big.Int) {
+	for _, t := range m.tracers {
+		t.SetRefundGas(refund)
+	}
+}
+
+// Account Management
+func (m *MultiTracer) AddBlockCreatedAccount(addr common.Address) {
+	for _, t := range m.tracers {
+		t.AddBlockCreatedAccount(addr)
+	}
+}
+
+func (m *MultiTracer) AddTxCreatedAccount(addr common.Address) {
+	for _, t := range m.tracers {
+		t.AddTxCreatedAccount(addr)
+	}
+}
+
+func (m *MultiTracer) GetTxCreatedAccounts() []common.Address {
+	return m.tracers[0].GetTxCreatedAccounts()
+}
+
+func (m *MultiTracer) GetCreatedAccounts() map[string]int {
+	return m.tracers[0].GetCreatedAccounts()
+}
+
+func (m *MultiTracer) SetCreatedAddress(addr common.Address) {
+	for _, t := range m.tracers {
+		t.SetCreatedAddress(addr)
+	}
+}
+
+func (m *MultiTracer) SetSuicidedAddress(seq int, addr common.Address) {
+	for _, t := range m.tracers {
+		t.SetSuicidedAddress(seq, addr)
+	}
+}
+
+func (m *MultiTracer) GetSuicidedAccounts() map[int]string {
+	return m.tracers[0].GetSuicidedAccounts()
+}
+
+func (m *MultiTracer) IsCreated(addr common.Address) bool {
+	return m.tracers[0].IsCreated(addr)
+}
+
+// Code Management
+func (m *MultiTracer) AddCode(addr common.Address, code []byte) {
+	for _, t := range m.tracers {
+		t.AddCode(addr, code)
+	}
+}
+
+// To string/Dump
+func (m *MultiTracer) StrBlockCreatedAccounts() string {
+	return m.tracers[0].StrBlockCreatedAccounts()
+}
+
+func (m *MultiTracer) StrTransaction() string {
+	return m.tracers[0].StrTransaction()
+}
+
+func (m *MultiTracer) StrTransfer(seq int) string {
+	return m.tracers[0].StrTransfer(seq)
+}
+
+func (m *MultiTracer) StrTxTransfer(seq int) string {
+	return m.tracers[0].StrTxTransfer(seq)
+}
+
+func (m *MultiTracer) StrTxBasic(nonce, gasPrice, startGas, gasUsed uint64, data, init, to, value string, v int64, r, s, hash string) {
+	for _, t := range m.tracers {
+		t.StrTxBasic(nonce, gasPrice, startGas, gasUsed, data, init, to, value, v, r, s, hash)
+	}
+}
+
+// Failure
+func (m *MultiTracer) FailCreate(startPos int, err error) {
+	for _, t := range m.tracers {
+		t.FailCreate(startPos, err)
+	}
+}
+
+func (m *MultiTracer) FailTx(err error) {
+	for _, t := range m.tracers {
+		t.FailTx(err)
+	}
+}
+
+func (m *MultiTracer) Fail(seq int, err error, rollback bool) {
+	for _, t := range m.tracers {
+		t.Fail(seq, err, rollback)
+	}
+}
+
+func (m *MultiTracer) GetTxFailReason() string {
+	return m.tracers[0].GetTxFailReason()
+}
+
+// State
+func (m *MultiTracer) SetInputAccount(addr common.Address, codeHash common.Hash, balance *big.Int, nonce uint64) {
+	for _, t := range m.tracers {
+		t.SetInputAccount(addr, codeHash, balance, nonce)
+	}
+}
+
+func (m *MultiTracer) SetOutputAccount(addr common.Address, codeHash common.Hash, balance *big.Int, nonce uint64) {
+	for _, t := range m.tracers {
+		t.SetOutputAccount(addr, codeHash, balance, nonce)
+	}
+}
+
+func (m *MultiTracer) GetInputAccounts() []string {
+	return m.tracers[0].GetInputAccounts()
+}
+
+// Simulate environment
+func (m *MultiTracer) GetDepth() int {
+	return m.tracers[0].GetDepth()
+}
+
+func (m *MultiTracer) EnterEnv(addr common.Address) {
+	for _, t := range m.tracers {
+		t.EnterEnv(addr)
+	}
+}
+
+func (m *MultiTracer) ExitEnv() {
+	for _, t := range m.tracers {
+		t.ExitEnv()
+	}
+}
+
+func (m *MultiTracer) RevertStore() {
+	for _, t := range m.tracers {
+		t.RevertStore()
+	}
+}
+
+func (m *MultiTracer) ResizeMemory(size int) {
+	for _, t := range m.tracers {
+		t.ResizeMemory(size)
+	}
+}
+
+func (m *MultiTracer) MemLen() int {
+	return m.tracers[0].MemLen()
+}
+
+func (m *MultiTracer) SetMemory(seq int) {
+	for _, t := range m.tracers {
+		t.SetMemory(seq)
+	}
+}
+
+// Pop pops the simulated stack of every tracer, returning the primary's top.
+func (m *MultiTracer) Pop() Content {
+	c := m.tracers[0].Pop()
+	for _, t := range m.tracers[1:] {
+		t.Pop()
+	}
+	return c
+}
+
+func (m *MultiTracer) Top() Content {
+	return m.tracers[0].Top()
+}
+
+func (m *MultiTracer) Push(c Content) {
+	for _, t := range m.tracers {
+		t.Push(c)
+	}
+}
+
+func (m *MultiTracer) Swap(n int) {
+	for _, t := range m.tracers {
+		t.Swap(n)
+	}
+}
+
+func (m *MultiTracer) Dup(n int) {
+	for _, t := range m.tracers {
+		t.Dup(n)
+	}
+}
+
+func (m *MultiTracer) Loc(id int) Content {
+	return m.tracers[0].Loc(id)
+}
+
+func (m *MultiTracer) StackLen() int {
+	return m.tracers[0].StackLen()
+}
+
+// Precompiled
+func (m *MultiTracer) IsPrecompiled(addr common.Address) bool {
+	return m.tracers[0].IsPrecompiled(addr)
+}
+
+func (m *MultiTracer) SetPrecompiledMemIO(seq int) {
+	for _, t := range m.tracers {
+		t.SetPrecompiledMemIO(seq)
+	}
+}
+
+func (m *MultiTracer) SetPrecompiled(addr common.Address, gas, err int, input, output []byte) {
+	for _, t := range m.tracers {
+		t.SetPrecompiled(addr, gas, err, input, output)
+	}
+}
+
+// Trace
+func (m *MultiTracer) ScanTrace() {
+	for _, t := range m.tracers {
+		t.ScanTrace()
+	}
+}
+
+func (m *MultiTracer) GetSeq() int {
+	return m.tracers[0].GetSeq()
+}
+
+// InitTrace starts a trace in every tracer, returning the primary's sequence
+// number.
+func (m *MultiTracer) InitTrace(name string, pc int, gas int, calldepth int) int {
+	seq := m.tracers[0].InitTrace(name, pc, gas, calldepth)
+	for _, t := range m.tracers[1:] {
+		t.InitTrace(name, pc, gas, calldepth)
+	}
+	return seq
+}
+
+func (m *MultiTracer) AddMemSize(seq int, before, after int) {
+	for _, t := range m.tracers {
+		t.AddMemSize(seq, before, after)
+	}
+}
+
+func (m *MultiTracer) SetCallGas(seq int, gas, left int64) {
+	for _, t := range m.tracers {
+		t.SetCallGas(seq, gas, left)
+	}
+}
+
+func (m *MultiTracer) SetStackInput(seq int, num int) {
+	for _, t := range m.tracers {
+		t.SetStackInput(seq, num)
+	}
+}
+
+func (m *MultiTracer) SetStackOutput(seq int, val *big.Int) {
+	for _, t := range m.tracers {
+		t.SetStackOutput(seq, val)
+	}
+}
+
+func (m *MultiTracer) SetMemoryInput(seq int, offset *big.Int, size *big.Int) {
+	for _, t := range m.tracers {
+		t.SetMemoryInput(seq, offset, size)
+	}
+}
+
+func (m *MultiTracer) SetMemoryOutput(seq int, offset *big.Int, size *big.Int, val []byte) {
+	for _, t := range m.tracers {
+		t.SetMemoryOutput(seq, offset, size, val)
+	}
+}
+
+func (m *MultiTracer) AddStackInput(idx int, argN int) {
+	for _, t := range m.tracers {
+		t.AddStackInput(idx, argN)
+	}
+}
+
+func (m *MultiTracer) SetCreated() {
+	for _, t := range m.tracers {
+		t.SetCreated()
+	}
+}
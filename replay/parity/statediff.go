@@ -0,0 +1,160 @@
+package parity
+
+import (
+	"encoding/json"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/replay/schema"
+)
+
+// StateDiff is the Parity stateDiff of a transaction: the changes it made to the
+// accounts it modified, keyed by hex address.
+type StateDiff map[string]*AccountDiff
+
+// AccountDiff is the change of a single account. Storage is keyed by hex slot.
+type AccountDiff struct {
+	Balance *Diff            `json:"balance"`
+	Nonce   *Diff            `json:"nonce"`
+	Code    *Diff            `json:"code"`
+	Storage map[string]*Diff `json:"storage"`
+}
+
+// Diff is the change of a single value, holding the hex encoded value before
+// and after the transaction. From is empty for values born, To for values that
+// died with their account.
+type Diff struct {
+	From string
+	To   string
+}
+
+// MarshalJSON implements json.Marshaler, encoding the diff as "=" if the value
+// is unchanged, {"+": to} if born, {"-": from} if died and
+// {"*": {"from": from, "to": to}} otherwise.
+func (d *Diff) MarshalJSON() ([]byte, error) {
+	switch {
+	case d.From == d.To:
+		return []byte(`"="`), nil
+	case d.From == "":
+		return json.Marshal(map[string]string{"+": d.To})
+	case d.To == "":
+		return json.Marshal(map[string]string{"-": d.From})
+	default:
+		return json.Marshal(map[string]map[string]string{"*": {"from": d.From, "to": d.To}})
+	}
+}
+
+// changed reports whether the diff holds a change.
+func (d *Diff) changed() bool {
+	return d.From != d.To
+}
+
+// StorageReader returns the value a storage slot held before a transaction.
+type StorageReader func(addr common.Address, slot common.Hash) common.Hash
+
+// TransactionStateDiff derives the state changes of a replayed transaction
+// from its input and output states.
+//
+// Replay documents only hold the original values of the storage slots the
+// transaction read. The original values of slots written without being read
+// first are looked up with pre if given, and such slots are left out of the
+// diff otherwise.
+func TransactionStateDiff(tx *schema.Transaction, pre StorageReader) StateDiff {
+	var (
+		inputs  = make(map[common.Address]*schema.InputState)
+		outputs = make(map[common.Address]*schema.OutputState)
+		created = make(map[common.Address]bool)
+		deleted = make(map[common.Address]bool)
+		code    = make(map[common.Address]string)
+	)
+	for _, state := range tx.InputStates {
+		inputs[state.Address] = state
+	}
+	for _, state := range tx.OutputStates {
+		outputs[state.Address] = state
+	}
+	for _, addr := range tx.CreatedAccounts {
+		created[common.HexToAddress(addr)] = true
+	}
+	for _, addr := range tx.DeletedAccounts {
+		deleted[common.HexToAddress(addr)] = true
+	}
+	for addr, c := range tx.Code {
+		code[common.HexToAddress(addr)] = hexutil.Encode(common.FromHex(c))
+	}
+	diff := make(StateDiff)
+	for addr, out := range outputs {
+		in := inputs[addr]
+		if in == nil {
+			continue
+		}
+		// Accounts missing before or after the transaction have no code hash
+		// at all, e.g. the targets of failed creations
+		born := in.CodeHash == (common.Hash{}) || created[addr]
+		died := deleted[addr]
+		if born && (died || out.CodeHash == (common.Hash{})) {
+			continue
+		}
+		account := &AccountDiff{
+			Balance: &Diff{From: encodeBig(in.Balance), To: encodeBig(out.Balance)},
+			Nonce:   &Diff{From: hexutil.EncodeUint64(in.Nonce), To: hexutil.EncodeUint64(out.Nonce)},
+			Code:    &Diff{From: accountCode(addr, in.CodeHash, code), To: accountCode(addr, out.CodeHash, code)},
+			Storage: make(map[string]*Diff),
+		}
+		// Written slots, compared against what the transaction read or the
+		// state before it
+		for key, val := range out.Storage {
+			slot := common.HexToHash(key)
+			var from common.Hash
+			if orig, ok := in.Storage[key]; ok {
+				from = common.HexToHash(orig)
+			} else if born {
+				from = common.Hash{}
+			} else if pre != nil {
+				from = pre(addr, slot)
+			} else {
+				continue
+			}
+			if to := common.BytesToHash(val.Value); from != to || died {
+				account.Storage[slot.Hex()] = &Diff{From: from.Hex(), To: to.Hex()}
+			}
+		}
+		switch {
+		case born:
+			account.Balance.From, account.Nonce.From, account.Code.From = "", "", ""
+			for _, d := range account.Storage {
+				d.From = ""
+			}
+		case died:
+			account.Balance.To, account.Nonce.To, account.Code.To = "", "", ""
+			for _, d := range account.Storage {
+				d.To = ""
+			}
+		}
+		if !account.Balance.changed() && !account.Nonce.changed() && !account.Code.changed() && len(account.Storage) == 0 {
+			continue
+		}
+		diff[addr.Hex()] = account
+	}
+	return diff
+}
+
+// accountCode returns the hex encoded code with the given hash of an account.
+func accountCode(addr common.Address, hash common.Hash, code map[common.Address]string) string {
+	if c, ok := code[addr]; ok && hash != (common.Hash{}) && hash != emptyCodeHash {
+		return c
+	}
+	return "0x"
+}
+
+// emptyCodeHash is the code hash of accounts without code.
+var emptyCodeHash = common.HexToHash("c5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470")
+
+// encodeBig hex encodes a decimal of a replay document.
+func encodeBig(d *schema.Decimal) string {
+	if d == nil {
+		return hexutil.EncodeBig(new(big.Int))
+	}
+	return hexutil.EncodeBig(d.ToInt())
+}
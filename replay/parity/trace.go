@@ -0,0 +1,463 @@
+// Package parity derives Parity style traces from replay documents.
+//
+// Parity's trace module describes a transaction as the tree of calls, creates
+// and self destructs it executed, flattened in depth first order with every
+// node addressed by its path from the root. The replay code traces hold every
+// executed instruction along with its call depth, so the tree is rebuilt by
+// walking the instructions of each call frame, without executing anything.
+package parity
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/replay"
+	"github.com/ethereum/go-ethereum/replay/schema"
+)
+
+// Trace types.
+const (
+	TypeCall    = "call"
+	TypeCreate  = "create"
+	TypeSuicide = "suicide"
+	TypeReward  = "reward"
+)
+
+// errIncomplete is returned for transactions whose code trace was limited by a
+// replay config, leaving out instructions the call tree is derived from.
+var errIncomplete = errors.New("incomplete code trace, replay without limits")
+
+// Trace is a single node of the call tree of a transaction. The block and
+// transaction fields are only set on traces returned for whole blocks or
+// looked up by transaction hash.
+type Trace struct {
+	Action       interface{} `json:"action"` // CallAction, CreateAction, SuicideAction or RewardAction
+	Result       interface{} `json:"result"` // CallResult or CreateResult, nil for failed frames
+	Error        string      `json:"error,omitempty"`
+	Subtraces    int         `json:"subtraces"`
+	TraceAddress []int       `json:"traceAddress"`
+	Type         string      `json:"type"`
+
+	BlockHash           *common.Hash `json:"blockHash,omitempty"`
+	BlockNumber         *uint64      `json:"blockNumber,omitempty"`
+	TransactionHash     *common.Hash `json:"transactionHash,omitempty"`
+	TransactionPosition *int         `json:"transactionPosition,omitempty"`
+}
+
+// CallAction is a message call: callType is one of "call", "callcode" and
+// "delegatecall".
+type CallAction struct {
+	CallType string         `json:"callType"`
+	From     common.Address `json:"from"`
+	To       common.Address `json:"to"`
+	Gas      hexutil.Uint64 `json:"gas"`
+	Input    hexutil.Bytes  `json:"input"`
+	Value    *hexutil.Big   `json:"value"`
+}
+
+// CallResult is the outcome of a successful message call.
+type CallResult struct {
+	GasUsed hexutil.Uint64 `json:"gasUsed"`
+	Output  hexutil.Bytes  `json:"output"`
+}
+
+// CreateAction is a contract creation.
+type CreateAction struct {
+	From  common.Address `json:"from"`
+	Gas   hexutil.Uint64 `json:"gas"`
+	Init  hexutil.Bytes  `json:"init"`
+	Value *hexutil.Big   `json:"value"`
+}
+
+// CreateResult is the outcome of a successful contract creation.
+type CreateResult struct {
+	Address common.Address `json:"address"`
+	Code    hexutil.Bytes  `json:"code"`
+	GasUsed hexutil.Uint64 `json:"gasUsed"`
+}
+
+// SuicideAction is the self destruct of a contract, leaving its balance to the
+// refund address.
+type SuicideAction struct {
+	Address       common.Address `json:"address"`
+	Balance       *hexutil.Big   `json:"balance"`
+	RefundAddress common.Address `json:"refundAddress"`
+}
+
+// RewardAction is the mining reward of a block or an included uncle.
+type RewardAction struct {
+	Author     common.Address `json:"author"`
+	RewardType string         `json:"rewardType"` // "block" or "uncle"
+	Value      *hexutil.Big   `json:"value"`
+}
+
+// errorNames maps the failure reasons of replay documents to the messages
+// Parity reports.
+var errorNames = map[string]string{
+	"OutOfGas":            "Out of gas",
+	"CodeStorageOutOfGas": "Out of gas",
+	"InvalidDest":         "Bad jump destination",
+	"InvalidInstruction":  "Bad instruction",
+	"LackOfStackItems":    "Stack underflow",
+	"StackOverflow":       "Out of stack",
+	"InsufficientBalance": "Insufficient balance",
+}
+
+// errorName converts a replay failure reason into its Parity message.
+func errorName(failInfo string) string {
+	if name, ok := errorNames[failInfo]; ok {
+		return name
+	}
+	return failInfo
+}
+
+// TransactionTraces derives the call tree of a replayed transaction, in the
+// depth first order of Parity's trace_transaction. Homestead tells whether the
+// transaction was executed under the Homestead rules, which raised the
+// intrinsic gas of contract creations. The output returned is the data the
+// transaction returned, or the deployed code for contract creations.
+func TransactionTraces(tx *schema.Transaction, homestead bool) ([]*Trace, hexutil.Bytes, error) {
+	if tx.Omitted > 0 || tx.Truncated {
+		return nil, nil, errIncomplete
+	}
+	b := newBuilder(tx)
+
+	// The top level frame receives the gas left after paying the intrinsic gas
+	var (
+		creation = tx.To == "NIL"
+		input    = common.FromHex(tx.Data)
+		value    = tx.Value.ToInt()
+	)
+	if creation {
+		input = common.FromHex(tx.Init)
+	}
+	intrinsic := core.IntrinsicGas(input, creation, homestead).Uint64()
+	if intrinsic > tx.StartGas {
+		return nil, nil, fmt.Errorf("intrinsic gas %d above start gas %d", intrinsic, tx.StartGas)
+	}
+	gas := tx.StartGas - intrinsic
+
+	root := &Trace{TraceAddress: []int{}}
+	if creation {
+		root.Type = TypeCreate
+		root.Action = &CreateAction{From: tx.Sender, Gas: hexutil.Uint64(gas), Init: input, Value: (*hexutil.Big)(value)}
+	} else {
+		root.Type = TypeCall
+		root.Action = &CallAction{CallType: "call", From: tx.Sender, To: common.HexToAddress(tx.To), Gas: hexutil.Uint64(gas), Input: input, Value: (*hexutil.Big)(value)}
+	}
+	b.out = append(b.out, root)
+
+	var to common.Address
+	if creation {
+		to = crypto.CreateAddress(tx.Sender, tx.Nonce)
+	} else {
+		to = common.HexToAddress(tx.To)
+	}
+	frame, err := b.frame(root, 1, to, value)
+	if err != nil {
+		return nil, nil, err
+	}
+	if frame.failed || tx.FailReason != "" {
+		root.Error = errorName(frame.failInfo)
+		if tx.FailReason != "" {
+			root.Error = errorName(tx.FailReason)
+		}
+		return b.out, hexutil.Bytes{}, nil
+	}
+	used := frame.gasUsed
+	if creation {
+		code := b.code[to]
+		// The code deposit is charged after the init code ran
+		used += uint64(len(code)) * params.CreateDataGas.Uint64()
+		root.Result = &CreateResult{Address: to, Code: code, GasUsed: hexutil.Uint64(used)}
+		return b.out, code, nil
+	}
+	root.Result = &CallResult{GasUsed: hexutil.Uint64(used), Output: frame.output}
+	return b.out, frame.output, nil
+}
+
+// BlockTraces derives the call trees of all the transactions of a replayed
+// block, followed by its mining rewards, in the order of Parity's trace_block.
+func BlockTraces(block *schema.Block, config *params.ChainConfig) ([]*Trace, error) {
+	var (
+		hash      = block.Header.Hash
+		number    = block.Header.Number
+		homestead = config.IsHomestead(new(big.Int).SetUint64(number))
+		traces    []*Trace
+	)
+	for i, tx := range block.Transactions {
+		txTraces, _, err := TransactionTraces(tx, homestead)
+		if err != nil {
+			return nil, fmt.Errorf("transaction %d: %v", i, err)
+		}
+		for _, trace := range txTraces {
+			trace.Localize(hash, number, tx.Hash, i)
+		}
+		traces = append(traces, txTraces...)
+	}
+	for _, reward := range Rewards(block) {
+		reward.BlockHash, reward.BlockNumber = &hash, &number
+		traces = append(traces, reward)
+	}
+	return traces, nil
+}
+
+// Rewards returns the reward traces of the miner and the uncles of a replayed
+// block, as recorded in its transfers.
+func Rewards(block *schema.Block) []*Trace {
+	var rewards []*Trace
+	for _, transfer := range block.Transfers {
+		var kind string
+		switch transfer.Type {
+		case "MinerReward":
+			kind = "block"
+		case "UncleReward":
+			kind = "uncle"
+		default:
+			continue
+		}
+		rewards = append(rewards, &Trace{
+			Action:       &RewardAction{Author: common.HexToAddress(transfer.To), RewardType: kind, Value: (*hexutil.Big)(transfer.Value.ToInt())},
+			TraceAddress: []int{},
+			Type:         TypeReward,
+		})
+	}
+	return rewards
+}
+
+// Localize sets the block and transaction a trace belongs to.
+func (t *Trace) Localize(blockHash common.Hash, blockNumber uint64, txHash common.Hash, txIndex int) {
+	t.BlockHash, t.BlockNumber = &blockHash, &blockNumber
+	t.TransactionHash, t.TransactionPosition = &txHash, &txIndex
+}
+
+// builder walks the code trace of a transaction, collecting the traces of the
+// frames it runs into.
+type builder struct {
+	traces []*schema.Trace
+	bySeq  map[int]*schema.Trace
+	code   map[common.Address]hexutil.Bytes
+	pos    int // next instruction to visit
+	out    []*Trace
+}
+
+func newBuilder(tx *schema.Transaction) *builder {
+	b := &builder{
+		traces: tx.Traces,
+		bySeq:  make(map[int]*schema.Trace, len(tx.Traces)),
+		code:   make(map[common.Address]hexutil.Bytes, len(tx.Code)),
+	}
+	for _, trace := range tx.Traces {
+		b.bySeq[trace.Seq] = trace
+	}
+	for addr, code := range tx.Code {
+		b.code[common.HexToAddress(addr)] = common.FromHex(code)
+	}
+	return b
+}
+
+// frameResult is the outcome of a call frame, as seen from its own instructions.
+type frameResult struct {
+	gasUsed  uint64        // gas spent by the instructions of the frame and its callees
+	output   hexutil.Bytes // data returned by the frame
+	failed   bool          // whether the frame itself failed
+	failInfo string
+}
+
+// frame visits the instructions of the call frame traced by parent, executed at
+// the given depth on behalf of the given address with the given call value. The
+// calls, creates and self destructs of the frame are appended to the output as
+// children of parent.
+func (b *builder) frame(parent *Trace, depth int, addr common.Address, value *big.Int) (*frameResult, error) {
+	var (
+		res  = new(frameResult)
+		last *schema.Trace
+		gas  int64
+	)
+	for b.pos < len(b.traces) && b.traces[b.pos].CallDepth >= depth {
+		in := b.traces[b.pos]
+		b.pos++
+		if in.CallDepth > depth {
+			return nil, fmt.Errorf("instruction %d at depth %d outside of any call", in.Seq, in.CallDepth)
+		}
+		last = in
+		gas += int64(in.GasUsed)
+
+		switch {
+		case isCall(in.Name):
+			if in.CallGas == -1 {
+				// The frame failed before handing any gas to the callee
+				continue
+			}
+			gas -= in.CallGasLeft
+			if in.Name == "CREATE" {
+				// The gas handed to the init code is not part of the instruction cost
+				gas += in.CallGas
+			}
+			if err := b.call(parent, in, depth, addr, value); err != nil {
+				return nil, err
+			}
+		case in.Name == "SELFDESTRUCT":
+			if err := b.suicide(parent, in, addr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if last == nil {
+		return res, nil
+	}
+	// Failures roll back every instruction of the frame, while failed callees
+	// only mark the call instruction that ran them
+	if last.Reverted != 0 && !(isCall(last.Name) && last.CallGas != -1) {
+		res.failed, res.failInfo = true, last.FailInfo
+		return res, nil
+	}
+	if gas > 0 {
+		res.gasUsed = uint64(gas)
+	}
+	if last.Name == "RETURN" && last.MemoryInput != nil {
+		res.output = last.MemoryInput.Value
+	}
+	return res, nil
+}
+
+// call appends the trace of the call or create instruction in, made by the frame
+// of parent, and visits the frame of its callee.
+func (b *builder) call(parent *Trace, in *schema.Trace, depth int, addr common.Address, value *big.Int) error {
+	trace := b.child(parent)
+
+	names := replay.StackInputNames(in.Name, len(in.StackInputs))
+	operand := func(name string) (*big.Int, error) {
+		for i, n := range names {
+			if n == name && i < len(in.StackInputs) {
+				return b.value(in.StackInputs[i])
+			}
+		}
+		return nil, fmt.Errorf("instruction %d (%s) lacks operand %s", in.Seq, in.Name, name)
+	}
+	var input hexutil.Bytes
+	if in.MemoryInput != nil {
+		input = in.MemoryInput.Value
+	}
+	// The callee succeeded iff the instruction pushed a non-zero result
+	if in.StackOutput == nil {
+		return fmt.Errorf("instruction %d (%s) lacks output", in.Seq, in.Name)
+	}
+	success := new(big.Int).SetBytes(in.StackOutput.Value).Sign() != 0
+
+	var (
+		callee      = addr
+		calleeValue = value
+	)
+	if in.Name == "CREATE" {
+		v, err := operand("value")
+		if err != nil {
+			return err
+		}
+		trace.Type = TypeCreate
+		trace.Action = &CreateAction{From: addr, Gas: hexutil.Uint64(in.CallGas), Init: input, Value: (*hexutil.Big)(v)}
+		if success {
+			callee = common.BytesToAddress(in.StackOutput.Value)
+		}
+		calleeValue = v
+	} else {
+		to, err := operand("to")
+		if err != nil {
+			return err
+		}
+		action := &CallAction{CallType: strings.ToLower(in.Name), From: addr, To: common.BigToAddress(to), Gas: hexutil.Uint64(in.CallGas), Input: input}
+		if in.Name == "DELEGATECALL" {
+			action.Value = (*hexutil.Big)(value)
+		} else if calleeValue, err = operand("value"); err != nil {
+			return err
+		} else {
+			action.Value = (*hexutil.Big)(calleeValue)
+		}
+		if in.Name == "CALL" {
+			callee = action.To
+		}
+		trace.Type = TypeCall
+		trace.Action = action
+	}
+	// Callees with code run their own frame right after the instruction
+	frame := new(frameResult)
+	if b.pos < len(b.traces) && b.traces[b.pos].CallDepth == depth+1 {
+		var err error
+		if frame, err = b.frame(trace, depth+1, callee, calleeValue); err != nil {
+			return err
+		}
+	}
+	if !success {
+		trace.Error = errorName(in.FailInfo)
+		if trace.Error == "" {
+			trace.Error = errorName(frame.failInfo)
+		}
+		return nil
+	}
+	used := uint64(in.CallGas - in.CallGasLeft)
+	if in.Name == "CREATE" {
+		trace.Result = &CreateResult{Address: callee, Code: b.code[callee], GasUsed: hexutil.Uint64(used)}
+		return nil
+	}
+	output := frame.output
+	if output == nil && in.MemoryOutput != nil {
+		// Precompiled contracts run no code, their output is only known from
+		// the memory the caller copied it to
+		output = in.MemoryOutput.Value
+	}
+	if output == nil {
+		output = hexutil.Bytes{}
+	}
+	trace.Result = &CallResult{GasUsed: hexutil.Uint64(used), Output: output}
+	return nil
+}
+
+// suicide appends the trace of the self destruct instruction in, executed by
+// the frame of parent on behalf of the given address.
+func (b *builder) suicide(parent *Trace, in *schema.Trace, addr common.Address) error {
+	if len(in.StackInputs) == 0 || in.StackOutput == nil {
+		return fmt.Errorf("instruction %d (%s) lacks operands", in.Seq, in.Name)
+	}
+	to, err := b.value(in.StackInputs[0])
+	if err != nil {
+		return err
+	}
+	trace := b.child(parent)
+	trace.Type = TypeSuicide
+	trace.Action = &SuicideAction{
+		Address:       addr,
+		Balance:       (*hexutil.Big)(new(big.Int).SetBytes(in.StackOutput.Value)),
+		RefundAddress: common.BigToAddress(to),
+	}
+	return nil
+}
+
+// child appends a new trace below parent.
+func (b *builder) child(parent *Trace) *Trace {
+	trace := &Trace{TraceAddress: append(append([]int{}, parent.TraceAddress...), parent.Subtraces)}
+	parent.Subtraces++
+	b.out = append(b.out, trace)
+	return trace
+}
+
+// value returns the stack output of the instruction with the given sequence
+// number.
+func (b *builder) value(seq int) (*big.Int, error) {
+	trace, ok := b.bySeq[seq]
+	if !ok || trace.StackOutput == nil {
+		return nil, fmt.Errorf("operand producer %d not in trace", seq)
+	}
+	return new(big.Int).SetBytes(trace.StackOutput.Value), nil
+}
+
+// isCall reports whether an instruction hands gas to a callee.
+func isCall(name string) bool {
+	return name == "CALL" || name == "CALLCODE" || name == "DELEGATECALL" || name == "CREATE"
+}
@@ -0,0 +1,185 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package parity
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/replay/schema"
+)
+
+// loadBlocks decodes a golden replay document of the replay package.
+func loadBlocks(t *testing.T, name string) []*schema.Block {
+	blocks, err := schema.DecodeFile(filepath.Join("..", "testdata", "golden", name))
+	if err != nil {
+		t.Fatalf("failed to load %s: %v", name, err)
+	}
+	return blocks
+}
+
+// summary renders the shape of a trace: its type, address, error and gas used.
+func summary(trace *Trace) string {
+	s := fmt.Sprintf("%s%v", trace.Type, trace.TraceAddress)
+	switch res := trace.Result.(type) {
+	case *CallResult:
+		s += fmt.Sprintf(" gas %d", res.GasUsed)
+	case *CreateResult:
+		s += fmt.Sprintf(" gas %d at %x", res.GasUsed, res.Address)
+	}
+	if trace.Error != "" {
+		s += " " + trace.Error
+	}
+	return s
+}
+
+var transactionTracesTests = []struct {
+	doc  string
+	tx   int
+	want []string
+}{
+	// Nested calls running out of gas and an inner contract creation
+	{"calls.json", 0, []string{
+		"call[] gas 110723",
+		"call[0] gas 77403",
+		"call[0 0] Out of gas",
+		"create[0 1] gas 209 at 74d38446783959c4609c44da51d352561e6fcbbd",
+		"call[1] Out of gas",
+		"call[1 0] Out of gas",
+	}},
+	// Self destruct and a plain transfer
+	{"suicide.json", 0, []string{"call[] gas 3", "suicide[0]"}},
+	{"suicide.json", 1, []string{"call[] gas 0"}},
+	// Top level call and creation running out of gas
+	{"outofgas.json", 0, []string{"call[] Out of gas"}},
+	{"outofgas.json", 1, []string{"create[] Out of gas"}},
+	// Precompiled contracts, running no code of their own
+	{"precompiles.json", 0, []string{"call[] gas 124095", "call[0] gas 72", "call[1] gas 720", "call[2] gas 18", "call[3] gas 3000"}},
+}
+
+// Tests that the call trees derived from replay documents have the expected
+// shape and gas usage.
+func TestTransactionTraces(t *testing.T) {
+	for i, tt := range transactionTracesTests {
+		tx := loadBlocks(t, tt.doc)[0].Transactions[tt.tx]
+		traces, _, err := TransactionTraces(tx, true)
+		if err != nil {
+			t.Fatalf("test %d: failed to derive traces: %v", i, err)
+		}
+		var have []string
+		for _, trace := range traces {
+			have = append(have, summary(trace))
+		}
+		if !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("test %d: traces mismatch:\nhave %q\nwant %q", i, have, tt.want)
+		}
+	}
+}
+
+// Tests that the gas used by the top level frame accounts for all the gas of
+// successful transactions without refunds.
+func TestTransactionTracesGas(t *testing.T) {
+	for _, doc := range []string{"memory.json", "calls.json", "precompiles.json", "daofork.json"} {
+		for _, block := range loadBlocks(t, doc) {
+			for i, tx := range block.Transactions {
+				traces, _, err := TransactionTraces(tx, true)
+				if err != nil {
+					t.Fatalf("%s: tx %d: failed to derive traces: %v", doc, i, err)
+				}
+				res, ok := traces[0].Result.(*CallResult)
+				if !ok || tx.TotalRefund != 0 {
+					continue
+				}
+				intrinsic := core.IntrinsicGas(common.FromHex(tx.Data), false, true).Uint64()
+				if have := uint64(res.GasUsed) + intrinsic; have != tx.GasUsed {
+					t.Errorf("%s: tx %d: gas mismatch: have %d, want %d", doc, i, have, tx.GasUsed)
+				}
+			}
+		}
+	}
+}
+
+// Tests that the traces of a block are localized and followed by its reward.
+func TestBlockTraces(t *testing.T) {
+	block := loadBlocks(t, "suicide.json")[0]
+	traces, err := BlockTraces(block, &params.ChainConfig{HomesteadBlock: new(big.Int)})
+	if err != nil {
+		t.Fatalf("failed to derive traces: %v", err)
+	}
+	if len(traces) != 4 {
+		t.Fatalf("trace count mismatch: have %d, want 4", len(traces))
+	}
+	for i, want := range []int{0, 0, 1} {
+		if pos := traces[i].TransactionPosition; pos == nil || *pos != want {
+			t.Errorf("trace %d: position mismatch: have %v, want %d", i, pos, want)
+		}
+		if hash := traces[i].TransactionHash; hash == nil || *hash != block.Transactions[want].Hash {
+			t.Errorf("trace %d: transaction hash mismatch: have %v", i, hash)
+		}
+	}
+	reward := traces[3]
+	if reward.Type != TypeReward || reward.TransactionHash != nil || *reward.BlockNumber != block.Header.Number {
+		t.Errorf("reward trace mismatch: %+v", reward)
+	}
+	action := traces[1].Action.(*SuicideAction)
+	if action.RefundAddress != common.HexToAddress("0x0302") || action.Balance.ToInt().Int64() != 12345 {
+		t.Errorf("suicide action mismatch: %+v", action)
+	}
+}
+
+// Tests that state diffs report born and died accounts and look up the original
+// values of written slots.
+func TestTransactionStateDiff(t *testing.T) {
+	encode := func(diff StateDiff) string {
+		enc, _ := json.Marshal(diff)
+		return string(enc)
+	}
+	tx := loadBlocks(t, "suicide.json")[0].Transactions[0]
+	diff := encode(TransactionStateDiff(tx, nil))
+	for _, want := range []string{
+		`"0x0000000000000000000000000000000000000301":{"balance":{"-":"0x3039"},"nonce":{"-":"0x0"},"code":{"-":"0x730000000000000000000000000000000000000302ff"},"storage":{}}`,
+		`"0x0000000000000000000000000000000000000302":{"balance":{"+":"0x3039"},"nonce":{"+":"0x0"},"code":{"+":"0x"},"storage":{}}`,
+	} {
+		if !strings.Contains(diff, want) {
+			t.Errorf("state diff lacks %s:\n%s", want, diff)
+		}
+	}
+	// Slots written without being read are only known with a storage reader
+	tx = loadBlocks(t, "memory.json")[0].Transactions[0]
+	if diff := TransactionStateDiff(tx, nil); diff["0x0000000000000000000000000000000000000101"] != nil {
+		t.Errorf("unexpected diff of written slots without reader: %s", encode(diff))
+	}
+	pre := func(addr common.Address, slot common.Hash) common.Hash {
+		return common.BigToHash(big.NewInt(1))
+	}
+	account := TransactionStateDiff(tx, pre)["0x0000000000000000000000000000000000000101"]
+	if account == nil || len(account.Storage) != 2 {
+		t.Fatalf("written slots mismatch: %s", encode(TransactionStateDiff(tx, pre)))
+	}
+	slot := account.Storage[common.Hash{}.Hex()]
+	if slot == nil || slot.From != common.BigToHash(big.NewInt(1)).Hex() {
+		t.Errorf("slot diff mismatch: %+v", slot)
+	}
+}
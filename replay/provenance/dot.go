@@ -0,0 +1,128 @@
+package provenance
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/replay"
+	"github.com/ethereum/go-ethereum/replay/schema"
+)
+
+// WriteDOT renders the data flow graph of a replayed transaction in the DOT
+// language of Graphviz. Nodes are instructions, labeled with their sequence
+// number, opcode, pc, contract and call depth; an edge leads from an instruction
+// to each instruction using its output, labeled with the stack operand or the
+// memory byte range it flows into. Instructions that were reverted are drawn
+// dashed and in red, roots are drawn as boxes.
+//
+// If seq is not negative, only the slice feeding the instruction with that
+// sequence number (e.g. an SSTORE, CALL or LOG) is drawn. Otherwise the whole
+// transaction is, leaving out the instructions not exchanging values with any
+// other (e.g. JUMPDEST).
+func WriteDOT(w io.Writer, tx *schema.Transaction, seq int) error {
+	g := newGraph(tx)
+
+	// Collect the instructions to draw
+	nodes := make(map[int]bool)
+	if seq >= 0 {
+		if _, ok := g.traces[seq]; !ok {
+			return fmt.Errorf("instruction %d not in trace", seq)
+		}
+		queue := []int{seq}
+		for len(queue) > 0 {
+			next := queue[0]
+			queue = queue[1:]
+			if nodes[next] {
+				continue
+			}
+			nodes[next] = true
+			queue = append(queue, g.deps[next]...)
+		}
+	} else {
+		for user, deps := range g.deps {
+			for _, dep := range deps {
+				nodes[user], nodes[dep] = true, true
+			}
+		}
+	}
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "digraph %q {\n", tx.Hash.Hex())
+	fmt.Fprintf(out, "\tnode [shape=ellipse, fontname=\"monospace\"];\n")
+	fmt.Fprintf(out, "\tedge [fontname=\"monospace\", fontsize=10];\n")
+
+	for _, next := range sortedSeqs(nodes) {
+		trace := g.traces[next]
+		attrs := []string{fmt.Sprintf("label=%q", fmt.Sprintf("#%d %s\npc %d, depth %d\n%s", next, trace.Name, trace.PC, trace.CallDepth, trace.Address.Hex()))}
+		if typ := g.rootType(next); typ != "" {
+			attrs = append(attrs, "shape=box", fmt.Sprintf("xlabel=%q", typ))
+		}
+		if next == seq {
+			attrs = append(attrs, "peripheries=2")
+		}
+		if trace.Reverted != 0 {
+			attrs = append(attrs, "style=dashed", "color=red", "fontcolor=red")
+		}
+		fmt.Fprintf(out, "\tn%d [%s];\n", next, strings.Join(attrs, ", "))
+	}
+	for _, user := range sortedSeqs(nodes) {
+		labels := g.edgeLabels(user)
+		for _, dep := range g.deps[user] {
+			if !nodes[dep] {
+				continue
+			}
+			fmt.Fprintf(out, "\tn%d -> n%d [label=%q];\n", dep, user, strings.Join(labels[dep], "\n"))
+		}
+	}
+	fmt.Fprintf(out, "}\n")
+	return out.Flush()
+}
+
+// edgeLabels describes how the outputs of the instructions an instruction
+// depends on flow into it: the names of the stack operands they are used as,
+// the byte ranges of the memory read (mem[from:to]) and the byte ranges of the
+// output they are copied into (out[from:to]). The operands of an instruction
+// copying bytes into the output, such as the calldata range of a CALLDATACOPY
+// read back by an MLOAD, are labeled with the copying instruction (via #seq).
+func (g *graph) edgeLabels(seq int) map[int][]string {
+	var (
+		trace  = g.traces[seq]
+		labels = make(map[int][]string)
+		seen   = make(map[string]bool)
+	)
+	add := func(dep int, label string) {
+		if key := fmt.Sprintf("%d %s", dep, label); !seen[key] {
+			seen[key] = true
+			labels[dep] = append(labels[dep], label)
+		}
+	}
+	names := replay.StackInputNames(trace.Name, len(trace.StackInputs))
+	for i, dep := range trace.StackInputs {
+		if i < len(names) {
+			add(dep, names[i])
+		} else {
+			add(dep, fmt.Sprintf("input%d", i))
+		}
+	}
+	if trace.MemoryInput != nil {
+		for _, src := range trace.MemoryInput.Src {
+			add(src.InstrSeq, fmt.Sprintf("mem[%d:%d]", src.OutputOffset, src.OutputOffset+src.Length))
+		}
+	}
+	for _, content := range []*schema.Content{trace.StackOutput, trace.MemoryOutput} {
+		if content == nil {
+			continue
+		}
+		for _, src := range content.Src {
+			if src.InstrSeq == seq {
+				continue
+			}
+			add(src.InstrSeq, fmt.Sprintf("out[%d:%d]", src.OutputOffset, src.OutputOffset+src.Length))
+			for _, id := range src.OperandIDs {
+				add(id, fmt.Sprintf("via #%d", src.InstrSeq))
+			}
+		}
+	}
+	return labels
+}
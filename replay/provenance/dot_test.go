@@ -0,0 +1,82 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package provenance
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Tests that the graph of a slice contains exactly the instructions feeding the
+// sliced one, with their operands and memory ranges.
+func TestWriteDOTSlice(t *testing.T) {
+	tx := loadTransaction(t, "creation.json")
+
+	var buf bytes.Buffer
+	if err := WriteDOT(&buf, tx, 15); err != nil {
+		t.Fatalf("failed to render graph: %v", err)
+	}
+	want := `digraph "0x35b3fd074dd84be9cd8e52878a9cfed6a7dec739ebd324a9f2d405816f29b461" {
+	node [shape=ellipse, fontname="monospace"];
+	edge [fontname="monospace", fontsize=10];
+	n8 [label="#8 PUSH1\npc 10, depth 1\n0x3a220f351252089d385b29beca14e27f204c296a", shape=box, xlabel="code"];
+	n13 [label="#13 SHA3\npc 19, depth 1\n0x3a220f351252089d385b29beca14e27f204c296a"];
+	n14 [label="#14 PUSH1\npc 20, depth 1\n0x3a220f351252089d385b29beca14e27f204c296a", shape=box, xlabel="code"];
+	n15 [label="#15 SSTORE\npc 22, depth 1\n0x3a220f351252089d385b29beca14e27f204c296a", peripheries=2];
+	n8 -> n13 [label="mem[0:32]"];
+	n13 -> n15 [label="storeValue"];
+	n14 -> n15 [label="storeStart"];
+}
+`
+	if buf.String() != want {
+		t.Errorf("graph mismatch:\nhave:\n%s\nwant:\n%s", buf.String(), want)
+	}
+	if err := WriteDOT(&buf, tx, 100); err == nil {
+		t.Errorf("rendered slice of non-existent instruction")
+	}
+}
+
+// Tests that the graph of a transaction labels values copied through memory
+// and marks reverted instructions.
+func TestWriteDOTTransaction(t *testing.T) {
+	tx := loadTransaction(t, "call.json")
+	for _, trace := range tx.Traces {
+		if trace.Seq == 9 {
+			trace.Reverted = 1
+		}
+	}
+	var buf bytes.Buffer
+	if err := WriteDOT(&buf, tx, -1); err != nil {
+		t.Fatalf("failed to render graph: %v", err)
+	}
+	graph := buf.String()
+	for _, line := range []string{
+		`n1 [label="#1 CALLDATALOAD\npc 2, depth 1\n0x3a220f351252089d385b29beca14e27f204c296a", shape=box, xlabel="calldata"];`,
+		`n9 [label="#9 MLOAD\npc 15, depth 1\n0x3a220f351252089d385b29beca14e27f204c296a", style=dashed, color=red, fontcolor=red];`,
+		`n1 -> n3 [label="storeValue"];`,
+		`n7 -> n9 [label="out[0:1]"];`,
+		`n4 -> n9 [label="via #7"];`,
+	} {
+		if !strings.Contains(graph, "\t"+line+"\n") {
+			t.Errorf("graph misses %s:\n%s", line, graph)
+		}
+	}
+	if strings.Contains(graph, "STOP") {
+		t.Errorf("graph contains isolated instructions:\n%s", graph)
+	}
+}
@@ -0,0 +1,190 @@
+// Package provenance answers data flow questions over the code traces of
+// replayed transactions.
+//
+// Every value emitted by the replay tracer carries the sequence numbers of the
+// instructions it was computed from. Together these references form a data
+// dependency graph per transaction, which this package walks backwards (what
+// influenced a value) and forwards (what a value influenced).
+package provenance
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/replay"
+	"github.com/ethereum/go-ethereum/replay/schema"
+)
+
+// Root source types, the origins a value can ultimately be traced back to.
+const (
+	RootCalldata    = "calldata"    // transaction input, via CALLDATALOAD or CALLDATACOPY
+	RootStorage     = "storage"     // contract storage as it was before the transaction
+	RootCode        = "code"        // constants embedded in the code, such as PUSH operands
+	RootEnvironment = "environment" // execution context, such as CALLER or CALLVALUE
+	RootBlock       = "block"       // block context, such as TIMESTAMP or BLOCKHASH
+	RootCrossTx     = "crossTx"     // storage written by an earlier transaction of the block
+)
+
+// graph is the data dependency graph of the code trace of a transaction.
+type graph struct {
+	tx     *schema.Transaction
+	traces map[int]*schema.Trace
+	deps   map[int][]int // instructions each instruction's output is computed from
+	users  map[int][]int // instructions computed from each instruction's output
+}
+
+// newGraph builds the dependency graph of a replayed transaction.
+func newGraph(tx *schema.Transaction) *graph {
+	g := &graph{
+		tx:     tx,
+		traces: make(map[int]*schema.Trace, len(tx.Traces)),
+		deps:   make(map[int][]int, len(tx.Traces)),
+		users:  make(map[int][]int),
+	}
+	for _, trace := range tx.Traces {
+		g.traces[trace.Seq] = trace
+	}
+	for _, trace := range tx.Traces {
+		deps := g.collectDeps(trace)
+		g.deps[trace.Seq] = deps
+		for _, dep := range deps {
+			g.users[dep] = append(g.users[dep], trace.Seq)
+		}
+	}
+	return g
+}
+
+// collectDeps gathers the instructions the output of a trace is computed from.
+// Instructions without output of their own (e.g. SSTORE, LOG) depend on their
+// stack operands.
+func (g *graph) collectDeps(trace *schema.Trace) []int {
+	set := make(map[int]bool)
+	add := func(seq int) {
+		if _, ok := g.traces[seq]; ok && seq != trace.Seq {
+			set[seq] = true
+		}
+	}
+	var sources []*schema.Source
+	if trace.StackOutput != nil {
+		sources = append(sources, trace.StackOutput.Src...)
+	}
+	if trace.MemoryOutput != nil {
+		sources = append(sources, trace.MemoryOutput.Src...)
+	}
+	for _, src := range sources {
+		add(src.InstrSeq)
+		for _, id := range src.OperandIDs {
+			add(id)
+		}
+	}
+	if trace.MemoryInput != nil {
+		for _, src := range trace.MemoryInput.Src {
+			add(src.InstrSeq)
+		}
+	}
+	if len(sources) == 0 {
+		for _, seq := range trace.StackInputs {
+			add(seq)
+		}
+	}
+	return sortedSeqs(set)
+}
+
+// rootType returns the root source type of the output of an instruction, or an
+// empty string if the output is derived from other instructions.
+func (g *graph) rootType(seq int) string {
+	trace := g.traces[seq]
+	switch trace.Name {
+	case "CALLDATALOAD", "CALLDATACOPY":
+		return RootCalldata
+	case "SLOAD":
+		// Only the first load of a slot reads pre-transaction storage
+		if trace.StackOutput != nil && len(trace.StackOutput.Src) > 0 {
+			if src := trace.StackOutput.Src[0]; src.InstrSeq != seq {
+				return ""
+			} else if src.Type == schema.SourceCrossTx {
+				return RootCrossTx
+			}
+		}
+		return RootStorage
+	}
+	var sources []*schema.Source
+	if trace.StackOutput != nil {
+		sources = append(sources, trace.StackOutput.Src...)
+	}
+	if trace.MemoryOutput != nil {
+		sources = append(sources, trace.MemoryOutput.Src...)
+	}
+	for _, src := range sources {
+		if src.InstrSeq != seq {
+			continue
+		}
+		switch src.Type {
+		case RootCalldata, RootStorage, RootCode, RootEnvironment, RootBlock:
+			return src.Type
+		}
+	}
+	return ""
+}
+
+// operandSeqs resolves an operand of an instruction to the instructions that
+// produced its value. The operand is either "output" (or empty) for the value
+// produced by the instruction itself, "memory" for the memory it reads, or a
+// stack input given by its name in the replay document or by its index.
+func (g *graph) operandSeqs(seq int, operand string) ([]int, error) {
+	trace, ok := g.traces[seq]
+	if !ok {
+		return nil, fmt.Errorf("instruction %d not in trace", seq)
+	}
+	switch operand {
+	case "", "output":
+		if trace.StackOutput == nil && trace.MemoryOutput == nil {
+			return nil, fmt.Errorf("instruction %d (%s) has no output", seq, trace.Name)
+		}
+		return []int{seq}, nil
+
+	case "memory":
+		if trace.MemoryInput == nil {
+			return nil, fmt.Errorf("instruction %d (%s) reads no memory", seq, trace.Name)
+		}
+		set := make(map[int]bool)
+		for _, src := range trace.MemoryInput.Src {
+			if _, ok := g.traces[src.InstrSeq]; ok {
+				set[src.InstrSeq] = true
+			}
+		}
+		return sortedSeqs(set), nil
+	}
+	names := replay.StackInputNames(trace.Name, len(trace.StackInputs))
+	for i, name := range names {
+		if name == operand && i < len(trace.StackInputs) {
+			return []int{trace.StackInputs[i]}, nil
+		}
+	}
+	if i, err := strconv.Atoi(operand); err == nil && i >= 0 && i < len(trace.StackInputs) {
+		return []int{trace.StackInputs[i]}, nil
+	}
+	return nil, fmt.Errorf("instruction %d (%s) has no operand %q, have %v", seq, trace.Name, operand, names)
+}
+
+// value returns the output value of an instruction as an integer, or nil if the
+// instruction produced no stack output.
+func (g *graph) value(seq int) *big.Int {
+	trace, ok := g.traces[seq]
+	if !ok || trace.StackOutput == nil {
+		return nil
+	}
+	return new(big.Int).SetBytes(trace.StackOutput.Value)
+}
+
+// sortedSeqs returns the members of a sequence number set in ascending order.
+func sortedSeqs(set map[int]bool) []int {
+	seqs := make([]int, 0, len(set))
+	for seq := range set {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	return seqs
+}
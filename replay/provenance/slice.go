@@ -0,0 +1,93 @@
+package provenance
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/replay/schema"
+)
+
+// Slice is the backward data flow slice of an instruction operand: every
+// instruction that contributed to its value, and the roots the value ultimately
+// originates from.
+type Slice struct {
+	Tx           common.Hash    `json:"tx"`
+	Seq          int            `json:"seq"`
+	Operand      string         `json:"operand"`
+	Instructions []*Instruction `json:"instructions"`
+	Roots        []*Root        `json:"roots"`
+}
+
+// Instruction is an instruction contributing to a sliced value.
+type Instruction struct {
+	Seq     int            `json:"seq"`
+	Name    string         `json:"name"`
+	PC      int            `json:"pc"`
+	Address common.Address `json:"accountAddr"`
+	Deps    []int          `json:"deps"` // contributing instructions this one is computed from
+}
+
+// Root is an origin of a sliced value.
+type Root struct {
+	Seq    int           `json:"seq"`
+	Opcode string        `json:"opcode"`
+	Type   string        `json:"type"`
+	Value  hexutil.Bytes `json:"value,omitempty"`
+
+	// Origin is the storage write of an earlier transaction in the block the
+	// value was loaded from, for crossTx roots.
+	Origin *schema.Source `json:"origin,omitempty"`
+}
+
+// BackwardSlice computes the backward slice of an operand of the instruction
+// with the given sequence number. See operandSeqs for the accepted operands.
+func BackwardSlice(tx *schema.Transaction, seq int, operand string) (*Slice, error) {
+	g := newGraph(tx)
+	start, err := g.operandSeqs(seq, operand)
+	if err != nil {
+		return nil, err
+	}
+	// Walk the dependencies of the operand, visiting every instruction once
+	var (
+		visited = make(map[int]bool)
+		queue   = append([]int(nil), start...)
+	)
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		if visited[next] {
+			continue
+		}
+		visited[next] = true
+		queue = append(queue, g.deps[next]...)
+	}
+	slice := &Slice{
+		Tx:           tx.Hash,
+		Seq:          seq,
+		Operand:      operand,
+		Instructions: []*Instruction{},
+		Roots:        []*Root{},
+	}
+	for _, next := range sortedSeqs(visited) {
+		trace := g.traces[next]
+		slice.Instructions = append(slice.Instructions, &Instruction{
+			Seq:     next,
+			Name:    trace.Name,
+			PC:      trace.PC,
+			Address: trace.Address,
+			Deps:    g.deps[next],
+		})
+		if typ := g.rootType(next); typ != "" {
+			root := &Root{Seq: next, Opcode: trace.Name, Type: typ}
+			if trace.StackOutput != nil {
+				root.Value = trace.StackOutput.Value
+				if typ == RootCrossTx {
+					root.Origin = trace.StackOutput.Src[0]
+				}
+			} else if trace.MemoryOutput != nil {
+				root.Value = trace.MemoryOutput.Value
+			}
+			slice.Roots = append(slice.Roots, root)
+		}
+	}
+	return slice, nil
+}
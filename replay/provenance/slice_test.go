@@ -0,0 +1,115 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package provenance
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/replay/schema"
+)
+
+// loadTransaction loads a replayed transaction document from the testdata.
+//
+// creation.json is the replay of a contract creation running:
+//
+//	SSTORE(1, (SLOAD(0) + TIMESTAMP) * CALLVALUE)
+//	MSTORE(0, 42); SSTORE(2, SHA3(0, 32))
+//	CALL(10000, CALLER, TIMESTAMP, 0, 0, 0, 0)
+//	LOG1(0, 32, CALLVALUE)
+//
+// call.json is the replay of a message call with 68 bytes of input, running:
+//
+//	SSTORE(0, CALLDATALOAD(4))
+//	CALLDATACOPY(0, 36, 32); SSTORE(1, MLOAD(0))
+func loadTransaction(t *testing.T, name string) *schema.Transaction {
+	doc, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", name, err)
+	}
+	tx, err := schema.DecodeTransaction(doc)
+	if err != nil {
+		t.Fatalf("failed to decode %s: %v", name, err)
+	}
+	return tx
+}
+
+var backwardSliceTests = []struct {
+	seq     int
+	operand string
+	instrs  []int
+	roots   map[int]string
+}{
+	// SSTORE value computed from storage, block and environment
+	{7, "storeValue", []int{0, 1, 2, 3, 4, 5}, map[int]string{0: RootCode, 1: RootStorage, 2: RootBlock, 4: RootEnvironment}},
+	// Same value addressed by operand index and by its producer's output
+	{7, "1", []int{0, 1, 2, 3, 4, 5}, map[int]string{0: RootCode, 1: RootStorage, 2: RootBlock, 4: RootEnvironment}},
+	{5, "output", []int{0, 1, 2, 3, 4, 5}, map[int]string{0: RootCode, 1: RootStorage, 2: RootBlock, 4: RootEnvironment}},
+	// SSTORE value hashed from memory
+	{15, "storeValue", []int{8, 13}, map[int]string{8: RootCode}},
+	// CALL value and target
+	{23, "value", []int{20}, map[int]string{20: RootBlock}},
+	{23, "to", []int{21}, map[int]string{21: RootEnvironment}},
+	// LOG data read from memory
+	{27, "memory", []int{8}, map[int]string{8: RootCode}},
+}
+
+// Tests that backward slices collect all contributing instructions and roots.
+func TestBackwardSlice(t *testing.T) {
+	tx := loadTransaction(t, "creation.json")
+
+	for i, tt := range backwardSliceTests {
+		slice, err := BackwardSlice(tx, tt.seq, tt.operand)
+		if err != nil {
+			t.Errorf("test %d: failed to slice: %v", i, err)
+			continue
+		}
+		var instrs []int
+		for _, instr := range slice.Instructions {
+			instrs = append(instrs, instr.Seq)
+		}
+		if !reflect.DeepEqual(instrs, tt.instrs) {
+			t.Errorf("test %d: instructions mismatch: have %v, want %v", i, instrs, tt.instrs)
+		}
+		roots := make(map[int]string)
+		for _, root := range slice.Roots {
+			roots[root.Seq] = root.Type
+		}
+		if !reflect.DeepEqual(roots, tt.roots) {
+			t.Errorf("test %d: roots mismatch: have %v, want %v", i, roots, tt.roots)
+		}
+	}
+}
+
+// Tests that invalid slice requests are rejected.
+func TestBackwardSliceInvalid(t *testing.T) {
+	tx := loadTransaction(t, "creation.json")
+
+	if _, err := BackwardSlice(tx, 100, ""); err == nil {
+		t.Errorf("sliced non-existent instruction")
+	}
+	if _, err := BackwardSlice(tx, 7, "output"); err == nil {
+		t.Errorf("sliced output of SSTORE")
+	}
+	if _, err := BackwardSlice(tx, 7, "topic0"); err == nil {
+		t.Errorf("sliced unknown operand")
+	}
+	if _, err := BackwardSlice(tx, 5, "memory"); err == nil {
+		t.Errorf("sliced memory of MUL")
+	}
+}
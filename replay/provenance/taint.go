@@ -0,0 +1,285 @@
+package provenance
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/replay"
+	"github.com/ethereum/go-ethereum/replay/schema"
+)
+
+// Taint source kinds.
+const (
+	SourceCalldata  = "calldata"  // a byte range of the transaction input
+	SourceCallValue = "callvalue" // the value sent along with the transaction
+	SourceStorage   = "storage"   // a storage slot as it was before the transaction, including earlier writes of the block
+	SourceOpcode    = "opcode"    // the output of an environment opcode
+)
+
+// sinkOps are the instructions whose tainted operands are reported as sinks.
+var sinkOps = map[string]bool{
+	"SSTORE": true, "LOG0": true, "LOG1": true, "LOG2": true, "LOG3": true, "LOG4": true,
+	"CALL": true, "CALLCODE": true, "DELEGATECALL": true, "CREATE": true, "SELFDESTRUCT": true,
+}
+
+// TaintSource selects the values a forward taint analysis starts from.
+type TaintSource struct {
+	Kind   string
+	Offset uint64   // first calldata byte, for calldata sources
+	Length uint64   // number of calldata bytes, 0 for all of them
+	Slot   *big.Int // storage slot, nil for any slot
+	Opcode string   // opcode name, for opcode sources
+}
+
+// ParseTaintSource parses a taint source specification, one of:
+//
+//	calldata[:<offset>[:<length>]]
+//	callvalue
+//	storage[:<slot>]
+//	<OPCODE> (e.g. TIMESTAMP, BLOCKHASH, CALLER)
+func ParseTaintSource(spec string) (*TaintSource, error) {
+	parts := strings.Split(spec, ":")
+	switch strings.ToLower(parts[0]) {
+	case SourceCalldata:
+		src := &TaintSource{Kind: SourceCalldata}
+		if len(parts) > 3 {
+			return nil, fmt.Errorf("invalid calldata source %q", spec)
+		}
+		var err error
+		if len(parts) > 1 {
+			if src.Offset, err = strconv.ParseUint(parts[1], 0, 64); err != nil {
+				return nil, fmt.Errorf("invalid calldata offset %q", parts[1])
+			}
+		}
+		if len(parts) > 2 {
+			if src.Length, err = strconv.ParseUint(parts[2], 0, 64); err != nil {
+				return nil, fmt.Errorf("invalid calldata length %q", parts[2])
+			}
+		}
+		return src, nil
+
+	case SourceCallValue:
+		if len(parts) > 1 {
+			return nil, fmt.Errorf("invalid callvalue source %q", spec)
+		}
+		return &TaintSource{Kind: SourceCallValue}, nil
+
+	case SourceStorage:
+		src := &TaintSource{Kind: SourceStorage}
+		if len(parts) > 2 {
+			return nil, fmt.Errorf("invalid storage source %q", spec)
+		}
+		if len(parts) > 1 {
+			slot, ok := new(big.Int).SetString(parts[1], 0)
+			if !ok {
+				return nil, fmt.Errorf("invalid storage slot %q", parts[1])
+			}
+			src.Slot = slot
+		}
+		return src, nil
+	}
+	if len(parts) > 1 || parts[0] == "" {
+		return nil, fmt.Errorf("invalid taint source %q", spec)
+	}
+	return &TaintSource{Kind: SourceOpcode, Opcode: strings.ToUpper(parts[0])}, nil
+}
+
+// String implements fmt.Stringer, returning the specification of the source.
+func (s *TaintSource) String() string {
+	switch s.Kind {
+	case SourceCalldata:
+		return fmt.Sprintf("calldata:%d:%d", s.Offset, s.Length)
+	case SourceStorage:
+		if s.Slot != nil {
+			return fmt.Sprintf("storage:%#x", s.Slot)
+		}
+		return "storage"
+	case SourceOpcode:
+		return s.Opcode
+	}
+	return s.Kind
+}
+
+// matches reports whether the output of an instruction is a taint source.
+func (s *TaintSource) matches(g *graph, trace *schema.Trace) bool {
+	switch s.Kind {
+	case SourceCalldata:
+		// Only the outermost call reads the transaction input
+		if trace.CallDepth != 1 || len(trace.StackInputs) == 0 {
+			return false
+		}
+		var start, size *big.Int
+		switch trace.Name {
+		case "CALLDATALOAD":
+			start, size = g.value(trace.StackInputs[0]), big.NewInt(32)
+		case "CALLDATACOPY":
+			if len(trace.StackInputs) < 3 {
+				return false
+			}
+			start, size = g.value(trace.StackInputs[1]), g.value(trace.StackInputs[2])
+		default:
+			return false
+		}
+		if start == nil || size == nil || size.Sign() == 0 {
+			return false
+		}
+		// Check whether the read range overlaps the tainted one, which extends
+		// to the end of the input if no length is given
+		end := new(big.Int).Add(start, size)
+		if end.Cmp(new(big.Int).SetUint64(s.Offset)) <= 0 {
+			return false
+		}
+		return s.Length == 0 || start.Cmp(new(big.Int).SetUint64(s.Offset+s.Length)) < 0
+
+	case SourceCallValue:
+		return trace.Name == "CALLVALUE" && trace.CallDepth == 1
+
+	case SourceStorage:
+		if trace.Name != "SLOAD" || len(trace.StackInputs) == 0 {
+			return false
+		}
+		if root := g.rootType(trace.Seq); root != RootStorage && root != RootCrossTx {
+			return false
+		}
+		if s.Slot == nil {
+			return true
+		}
+		slot := g.value(trace.StackInputs[0])
+		return slot != nil && slot.Cmp(s.Slot) == 0
+
+	case SourceOpcode:
+		return trace.Name == s.Opcode
+	}
+	return false
+}
+
+// Taint is the result of a forward taint analysis of a transaction: every
+// instruction computed from a tainted value, along with the tainted state
+// writes, logs, calls and transfers.
+type Taint struct {
+	Tx           common.Hash        `json:"tx"`
+	Block        uint64             `json:"block,omitempty"` // set by BlockTaint
+	Source       string             `json:"source"`
+	Sources      []int              `json:"sources"`      // instructions producing the tainted values
+	Instructions []int              `json:"instructions"` // instructions computed from tainted values
+	Sinks        []*Sink            `json:"sinks"`
+	Transfers    []*schema.Transfer `json:"transfers"`
+}
+
+// Sink is a state changing instruction with tainted operands.
+type Sink struct {
+	Seq      int            `json:"seq"`
+	Name     string         `json:"name"`
+	PC       int            `json:"pc"`
+	Address  common.Address `json:"accountAddr"`
+	Operands []string       `json:"operands"`
+}
+
+// Tainted reports whether any tainted value reached a sink.
+func (t *Taint) Tainted() bool {
+	return len(t.Sinks) > 0 || len(t.Transfers) > 0
+}
+
+// ForwardTaint propagates the given taint source through a standalone replayed
+// transaction.
+func ForwardTaint(tx *schema.Transaction, src *TaintSource) *Taint {
+	return forwardTaint(tx, tx.Transfers, src)
+}
+
+// BlockTaint propagates the given taint source through every transaction of a
+// replayed block.
+func BlockTaint(block *schema.Block, src *TaintSource) []*Taint {
+	taints := make([]*Taint, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		var transfers []*schema.Transfer
+		for _, transfer := range block.Transfers {
+			if transfer.TxSeq == i {
+				transfers = append(transfers, transfer)
+			}
+		}
+		taints[i] = forwardTaint(tx, transfers, src)
+		if block.Header != nil {
+			taints[i].Block = block.Header.Number
+		}
+	}
+	return taints
+}
+
+// forwardTaint propagates a taint source through a transaction, matching the
+// tainted calls against the given transfers.
+func forwardTaint(tx *schema.Transaction, transfers []*schema.Transfer, src *TaintSource) *Taint {
+	g := newGraph(tx)
+
+	// Seed the taint from the source instructions and propagate it to their users
+	var (
+		sources = make(map[int]bool)
+		tainted = make(map[int]bool)
+		queue   []int
+	)
+	for _, trace := range tx.Traces {
+		if src.matches(g, trace) {
+			sources[trace.Seq] = true
+			queue = append(queue, trace.Seq)
+		}
+	}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		if tainted[next] {
+			continue
+		}
+		tainted[next] = true
+		queue = append(queue, g.users[next]...)
+	}
+	taint := &Taint{
+		Tx:           tx.Hash,
+		Source:       src.String(),
+		Sources:      sortedSeqs(sources),
+		Instructions: sortedSeqs(tainted),
+		Sinks:        []*Sink{},
+		Transfers:    []*schema.Transfer{},
+	}
+	// Collect the sinks reached, naming the operands carrying the taint
+	sinks := make(map[int]bool)
+	for _, seq := range taint.Instructions {
+		trace := g.traces[seq]
+		if !sinkOps[trace.Name] {
+			continue
+		}
+		var operands []string
+		names := replay.StackInputNames(trace.Name, len(trace.StackInputs))
+		for i, input := range trace.StackInputs {
+			if tainted[input] && i < len(names) {
+				operands = append(operands, names[i])
+			}
+		}
+		if trace.MemoryInput != nil {
+			for _, mem := range trace.MemoryInput.Src {
+				if tainted[mem.InstrSeq] {
+					operands = append(operands, "memory")
+					break
+				}
+			}
+		}
+		if len(operands) == 0 {
+			continue
+		}
+		sinks[seq] = true
+		taint.Sinks = append(taint.Sinks, &Sink{
+			Seq:      seq,
+			Name:     trace.Name,
+			PC:       trace.PC,
+			Address:  trace.Address,
+			Operands: operands,
+		})
+	}
+	for _, transfer := range transfers {
+		if sinks[transfer.TraceSeq] {
+			taint.Transfers = append(taint.Transfers, transfer)
+		}
+	}
+	return taint
+}
@@ -0,0 +1,142 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package provenance
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/replay/schema"
+)
+
+var forwardTaintTests = []struct {
+	doc       string
+	source    string
+	sources   []int
+	sinks     map[int][]string
+	transfers []string
+}{
+	// Timestamp dependent storage write and payout
+	{"creation.json", "TIMESTAMP", []int{2, 20}, map[int][]string{7: {"storeValue"}, 23: {"value"}}, []string{"CallTransfer"}},
+	// Caller controlled call target
+	{"creation.json", "caller", []int{21}, map[int][]string{23: {"to"}}, []string{"CallTransfer"}},
+	{"creation.json", "callvalue", []int{4, 24}, map[int][]string{7: {"storeValue"}, 27: {"topic0"}}, nil},
+	{"creation.json", "storage:0", []int{1}, map[int][]string{7: {"storeValue"}}, nil},
+	{"creation.json", "storage:5", nil, map[int][]string{}, nil},
+	{"creation.json", "calldata", nil, map[int][]string{}, nil},
+	// Input bytes flowing into storage through the stack and through memory
+	{"call.json", "calldata", []int{1, 7}, map[int][]string{3: {"storeValue"}, 11: {"storeValue"}}, nil},
+	{"call.json", "calldata:4:32", []int{1}, map[int][]string{3: {"storeValue"}}, nil},
+	{"call.json", "calldata:40:4", []int{7}, map[int][]string{11: {"storeValue"}}, nil},
+	{"call.json", "calldata:0:4", nil, map[int][]string{}, nil},
+	// Calldata tainted from an offset only, reads ending before it stay clean
+	{"call.json", "calldata:36", []int{7}, map[int][]string{11: {"storeValue"}}, nil},
+	{"call.json", "calldata:68", nil, map[int][]string{}, nil},
+}
+
+// Tests that taint propagates from its sources into the sinks it reaches.
+func TestForwardTaint(t *testing.T) {
+	for i, tt := range forwardTaintTests {
+		src, err := ParseTaintSource(tt.source)
+		if err != nil {
+			t.Fatalf("test %d: failed to parse source: %v", i, err)
+		}
+		taint := ForwardTaint(loadTransaction(t, tt.doc), src)
+
+		var sources []int
+		if len(taint.Sources) > 0 {
+			sources = taint.Sources
+		}
+		if !reflect.DeepEqual(sources, tt.sources) {
+			t.Errorf("test %d: sources mismatch: have %v, want %v", i, sources, tt.sources)
+		}
+		sinks := make(map[int][]string)
+		for _, sink := range taint.Sinks {
+			sinks[sink.Seq] = sink.Operands
+		}
+		if !reflect.DeepEqual(sinks, tt.sinks) {
+			t.Errorf("test %d: sinks mismatch: have %v, want %v", i, sinks, tt.sinks)
+		}
+		var transfers []string
+		for _, transfer := range taint.Transfers {
+			transfers = append(transfers, transfer.Type)
+		}
+		if !reflect.DeepEqual(transfers, tt.transfers) {
+			t.Errorf("test %d: transfers mismatch: have %v, want %v", i, transfers, tt.transfers)
+		}
+		if taint.Tainted() != (len(tt.sinks) > 0) {
+			t.Errorf("test %d: taint flag mismatch: have %v", i, taint.Tainted())
+		}
+	}
+}
+
+// Tests that block level taint matches the transfers of each transaction.
+func TestBlockTaint(t *testing.T) {
+	tx := loadTransaction(t, "creation.json")
+	block := &schema.Block{
+		Header:       &schema.Header{Number: 9},
+		Transactions: []*schema.Transaction{loadTransaction(t, "call.json"), tx},
+		Transfers:    []*schema.Transfer{{Type: "MinerReward", TxSeq: -1, TraceSeq: -1}},
+	}
+	for _, transfer := range tx.Transfers {
+		moved := *transfer
+		moved.TxSeq = 1
+		block.Transfers = append(block.Transfers, &moved)
+	}
+	src, _ := ParseTaintSource("TIMESTAMP")
+	taints := BlockTaint(block, src)
+	if len(taints) != 2 {
+		t.Fatalf("result count mismatch: have %d, want %d", len(taints), 2)
+	}
+	if taints[0].Tainted() {
+		t.Errorf("tx 0: tainted without timestamp use")
+	}
+	if taints[1].Block != 9 {
+		t.Errorf("tx 1: block number mismatch: have %d, want %d", taints[1].Block, 9)
+	}
+	if len(taints[1].Transfers) != 1 || taints[1].Transfers[0].TraceSeq != 23 {
+		t.Errorf("tx 1: tainted transfers mismatch: have %v", taints[1].Transfers)
+	}
+}
+
+// Tests taint source specification parsing.
+func TestParseTaintSource(t *testing.T) {
+	valid := map[string]string{
+		"calldata":        "calldata:0:0",
+		"calldata:4":      "calldata:4:0",
+		"calldata:0x4:32": "calldata:4:32",
+		"CallValue":       "callvalue",
+		"storage":         "storage",
+		"storage:10":      "storage:0xa",
+		"timestamp":       "TIMESTAMP",
+	}
+	for spec, want := range valid {
+		src, err := ParseTaintSource(spec)
+		if err != nil {
+			t.Errorf("%q: failed to parse: %v", spec, err)
+			continue
+		}
+		if src.String() != want {
+			t.Errorf("%q: source mismatch: have %s, want %s", spec, src, want)
+		}
+	}
+	for _, spec := range []string{"", "calldata:x", "calldata:1:2:3", "callvalue:1", "storage:zz", "TIMESTAMP:1"} {
+		if _, err := ParseTaintSource(spec); err == nil {
+			t.Errorf("%q: invalid source accepted", spec)
+		}
+	}
+}
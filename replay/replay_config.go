@@ -0,0 +1,187 @@
+package replay
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Presets of the replay config, selecting the parts of a transaction to emit.
+const (
+	// PresetStorageTransfers emits only the storage accesses of the code trace,
+	// along with the states and transfers.
+	PresetStorageTransfers = "storageTransfers"
+
+	// PresetStateDiff emits no code trace at all, only the input and output
+	// states, created and deleted accounts and transfers.
+	PresetStateDiff = "stateDiff"
+)
+
+// ReplayConfig limits the instructions emitted in the code traces of replay
+// documents. An instruction is emitted only if it passes every configured
+// filter. The zero config emits everything.
+//
+// With ContentHash set, every transaction and block document ends with the
+// Keccak256 hash of its own content, see schema.CheckContentHash.
+//
+// With DedupCode, transactions reference the code they touched by hash in their
+// codeRefs instead of embedding it in their codeStorage, and every block and
+// standalone transaction document carries each piece of code only once, in its
+// codeTable. The schema package decoders inflate such documents back.
+//
+// The filters only apply when documents are written: the tracer still records
+// every instruction, so provenance is computed over the complete execution and
+// the sources of emitted instructions may refer to instructions left out.
+type ReplayConfig struct {
+	Preset          string           `json:"preset,omitempty"`
+	Accounts        []common.Address `json:"accounts,omitempty"`        // only emit instructions executed by these accounts
+	ExcludeAccounts []common.Address `json:"excludeAccounts,omitempty"` // never emit instructions executed by these accounts
+	Opcodes         []string         `json:"opcodes,omitempty"`         // only emit these opcodes
+	MaxDepth        int              `json:"maxDepth,omitempty"`        // only emit instructions up to this call depth
+	MaxInstructions int              `json:"maxInstructions,omitempty"` // truncate code traces after this many instructions
+	ContentHash     bool             `json:"contentHash,omitempty"`     // append content hashes to the documents
+	DedupCode       bool             `json:"dedupCode,omitempty"`       // reference code by hash from a per document table
+
+	// Tracers are fed the same hooks as the replay tracer during the replay,
+	// see MultiTracer. They are shared by all the blocks replayed with the
+	// config, which ReplayRange replays concurrently.
+	Tracers []Tracer `json:"-"`
+
+	// Stats, if set, is fed the instructions of every transaction replayed with
+	// the config, see ReplayTracer.CollectStats. Unlike tracers, stats must not
+	// be shared by concurrent replays.
+	Stats *ReplayStats `json:"-"`
+}
+
+// Limited reports whether the config leaves anything out of the documents.
+func (c *ReplayConfig) Limited() bool {
+	return c.Preset != "" || len(c.Accounts) > 0 || len(c.ExcludeAccounts) > 0 || len(c.Opcodes) > 0 || c.MaxDepth > 0 || c.MaxInstructions > 0
+}
+
+// Validate checks the config for unknown presets and negative limits.
+func (c *ReplayConfig) Validate() error {
+	switch c.Preset {
+	case "", PresetStorageTransfers, PresetStateDiff:
+	default:
+		return fmt.Errorf("unknown replay preset %q", c.Preset)
+	}
+	if c.MaxDepth < 0 {
+		return fmt.Errorf("negative replay max depth %d", c.MaxDepth)
+	}
+	if c.MaxInstructions < 0 {
+		return fmt.Errorf("negative replay instruction cap %d", c.MaxInstructions)
+	}
+	return nil
+}
+
+// traceFilter is the compiled form of a replay config, matched against every
+// instruction of the trace log when writing it.
+type traceFilter struct {
+	accounts map[common.Address]bool
+	excluded map[common.Address]bool
+	opcodes  map[string]bool
+	storage  bool // only storage accesses, for PresetStorageTransfers
+	noTrace  bool // no code trace at all, for PresetStateDiff
+	maxDepth int
+	limit    int
+}
+
+// newTraceFilter compiles a replay config. A nil or unlimited config yields a
+// nil filter, emitting everything.
+func newTraceFilter(c *ReplayConfig) (*traceFilter, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if !c.Limited() {
+		return nil, nil
+	}
+	f := &traceFilter{
+		storage:  c.Preset == PresetStorageTransfers,
+		noTrace:  c.Preset == PresetStateDiff,
+		maxDepth: c.MaxDepth,
+		limit:    c.MaxInstructions,
+	}
+	if len(c.Accounts) > 0 {
+		f.accounts = make(map[common.Address]bool)
+		for _, addr := range c.Accounts {
+			f.accounts[addr] = true
+		}
+	}
+	if len(c.ExcludeAccounts) > 0 {
+		f.excluded = make(map[common.Address]bool)
+		for _, addr := range c.ExcludeAccounts {
+			f.excluded[addr] = true
+		}
+	}
+	if len(c.Opcodes) > 0 {
+		f.opcodes = make(map[string]bool)
+		for _, op := range c.Opcodes {
+			f.opcodes[strings.ToUpper(op)] = true
+		}
+	}
+	return f, nil
+}
+
+// keep reports whether an instruction passes the filter, regardless of the
+// instruction cap.
+func (f *traceFilter) keep(t *Trace) bool {
+	if f.noTrace {
+		return false
+	}
+	if f.storage && t.Basic.OpName != "SLOAD" && t.Basic.OpName != "SSTORE" {
+		return false
+	}
+	if f.opcodes != nil && !f.opcodes[t.Basic.OpName] {
+		return false
+	}
+	if f.maxDepth > 0 && t.Basic.CallDepth > f.maxDepth {
+		return false
+	}
+	if f.accounts != nil || f.excluded != nil {
+		addr := common.HexToAddress(t.Basic.AccountAddr)
+		if f.accounts != nil && !f.accounts[addr] {
+			return false
+		}
+		if f.excluded[addr] {
+			return false
+		}
+	}
+	return true
+}
+
+// selectTraces returns the positions of the trace log to emit and whether the
+// instruction cap truncated them. A nil selection emits the whole log.
+func (r *ReplayTracer) selectTraces() ([]int, bool) {
+	f := r.filter
+	if f == nil {
+		return nil, false
+	}
+	selected := []int{}
+	for i := range r.traceLog {
+		if !f.keep(&r.traceLog[i]) {
+			continue
+		}
+		if f.limit > 0 && len(selected) == f.limit {
+			return selected, true
+		}
+		selected = append(selected, i)
+	}
+	return selected, false
+}
+
+// SetConfig limits the output of the documents written by the tracer from now
+// on. A nil config emits everything.
+func (r *ReplayTracer) SetConfig(config *ReplayConfig) error {
+	filter, err := newTraceFilter(config)
+	if err != nil {
+		return err
+	}
+	r.filter = filter
+	r.hashes = config != nil && config.ContentHash
+	r.dedup = config != nil && config.DedupCode
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
 )
 
@@ -15,13 +16,47 @@ func padding(s string, n int) string {
 	return zero + s
 }
 
+// sortedKeys returns the keys of a string keyed map in ascending order, so that
+// documents list addresses and slots in a canonical order.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]string:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]Content:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]accountState:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]int:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]uint64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*StatCount:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func strStore(w map[string]string) string {
 	fstr := ""
-	for k, v := range w {
+	for _, k := range sortedKeys(w) {
 		if fstr != "" {
 			fstr = fstr + ","
 		}
-		fstr += fmt.Sprintf("\"%s\":\"%s\"", padding(k, 64), padding(v, 64))
+		fstr += fmt.Sprintf("\"%s\":\"%s\"", padding(k, 64), padding(w[k], 64))
 	}
 	return "{" + fstr + "}"
 }
@@ -47,32 +82,38 @@ func (r *ReplayTracer) strAccount(val accountState, t string) string {
 	return "{" + fstr + "}"
 }
 
-func (r *ReplayTracer) strInputState() string {
-	fstr := ""
-	for _, v := range r.ioAccounts {
+func (r *ReplayTracer) writeInputState(e *encoder) {
+	first := true
+	e.str("[")
+	for _, k := range sortedKeys(r.ioAccounts) {
+		v := r.ioAccounts[k]
 		if v.beforeBalance == "invalid" {
 			continue
 		}
-		if fstr != "" {
-			fstr = fstr + ","
+		if !first {
+			e.str(",")
 		}
-		fstr += fmt.Sprintf("%s", r.strAccount(v, "input"))
+		first = false
+		e.str(r.strAccount(v, "input"))
 	}
-	return "[" + fstr + "]"
+	e.str("]")
 }
 
-func (r *ReplayTracer) strOutputState() string {
-	fstr := ""
-	for _, v := range r.ioAccounts {
+func (r *ReplayTracer) writeOutputState(e *encoder) {
+	first := true
+	e.str("[")
+	for _, k := range sortedKeys(r.ioAccounts) {
+		v := r.ioAccounts[k]
 		if v.afterBalance == "invalid" {
 			continue
 		}
-		if fstr != "" {
-			fstr = fstr + ","
+		if !first {
+			e.str(",")
 		}
-		fstr += fmt.Sprintf("%s", r.strAccount(v, "output"))
+		first = false
+		e.str(r.strAccount(v, "output"))
 	}
-	return "[" + fstr + "]"
+	e.str("]")
 }
 
 func (r *ReplayTracer) getInputStore(addr string) map[string]string {
@@ -92,11 +133,11 @@ func (r *ReplayTracer) getOutputStore(addr string) map[string]Content {
 func (r *ReplayTracer) strInputStore(addr string) string {
 	w := r.getInputStore(addr)
 	fstr := ""
-	for k, v := range w {
+	for _, k := range sortedKeys(w) {
 		if fstr != "" {
 			fstr += ","
 		}
-		fstr += fmt.Sprintf("\"0x%s\":\"0x%s\"", k, v)
+		fstr += fmt.Sprintf("\"0x%s\":\"0x%s\"", k, w[k])
 	}
 	fstr = ",\"storageContents\":{" + fstr + "}"
 	return fstr
@@ -106,11 +147,11 @@ func (r *ReplayTracer) strInputStore(addr string) string {
 func (r *ReplayTracer) strOutputStore(addr string) string {
 	w := r.getOutputStore(addr)
 	fstr := ""
-	for k, v := range w {
+	for _, k := range sortedKeys(w) {
 		if fstr != "" {
 			fstr += ","
 		}
-		fstr += fmt.Sprintf("\"0x%s\":%s", k, v)
+		fstr += fmt.Sprintf("\"0x%s\":%s", k, w[k])
 	}
 	fstr = ",\"storageContents\":{" + fstr + "}"
 	return fstr
@@ -121,7 +162,7 @@ func (r *ReplayTracer) strCreateSuicide() string {
 	fstr := ""
 
 	s := ""
-	for k := range r.GetCreatedAccounts() {
+	for _, k := range sortedKeys(r.GetCreatedAccounts()) {
 		if s != "" {
 			s = s + ","
 		}
@@ -130,15 +171,23 @@ func (r *ReplayTracer) strCreateSuicide() string {
 	s = "\"createdAccounts\":[" + s + "]"
 	fstr = fstr + s
 
+	// Deleted accounts are listed in the order they self destructed
+	suicided := r.GetSuicidedAccounts()
+	var seqs []int
+	for seq := range suicided {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+
 	s = ""
-	for k, v := range r.GetSuicidedAccounts() {
+	for _, k := range seqs {
 		if r.traceLog[k].Basic.Reverted == 1 {
 			continue
 		}
 		if s != "" {
 			s = s + ","
 		}
-		s = s + "\"" + v + "\""
+		s = s + "\"" + suicided[k] + "\""
 	}
 	s = "\"deletedAccounts\":[" + s + "]"
 	fstr = fstr + "," + s
@@ -146,71 +195,102 @@ func (r *ReplayTracer) strCreateSuicide() string {
 	return fstr
 }
 
-func (r *ReplayTracer) strCode() string {
-	fstr := ""
+func (r *ReplayTracer) writeCode(e *encoder) {
 	cnt := 0
-	fstr = fstr + "{"
-	for k, v := range r.codeStore {
+	e.str("{")
+	for _, k := range sortedKeys(r.codeStore) {
+		v := r.codeStore[k]
 		if v == "" || v == "0x" {
 			continue
 		}
 		if cnt != 0 {
-			fstr = fstr + ","
+			e.str(",")
 		}
 		cnt++
-		fstr = fstr + fmt.Sprintf("\"%s\":\"%s\"", padding(k, 40), v)
+		if r.dedup {
+			r.codeTable[r.codeHashes[k]] = v
+			v = r.codeHashes[k]
+		}
+		e.str(fmt.Sprintf("\"%s\":\"%s\"", padding(k, 40), v))
 	}
-	fstr = fstr + "}"
-	return fstr
+	e.str("}")
 }
 
-func (r *ReplayTracer) threadStrTrace(start, end int, buf *bytes.Buffer, wg *sync.WaitGroup) {
+// CodeTableField returns the codeTable field of documents written with
+// DedupCode: the code referenced by the transactions written since BlockInit
+// and by the current one, keyed by code hash.
+func (r *ReplayTracer) CodeTableField() string {
+	var buf bytes.Buffer
+	buf.WriteString("\"codeTable\":{")
+	if r.filter == nil || !(r.filter.storage || r.filter.noTrace) {
+		for addr, code := range r.codeStore {
+			r.codeTable[r.codeHashes[addr]] = code
+		}
+		for i, k := range sortedKeys(r.codeTable) {
+			if i != 0 {
+				buf.WriteString(",")
+			}
+			fmt.Fprintf(&buf, "\"%s\":\"%s\"", k, r.codeTable[k])
+		}
+	}
+	buf.WriteString("}")
+	return buf.String()
+}
+
+func (r *ReplayTracer) threadStrTrace(selected []int, start, end int, buf *bytes.Buffer, wg *sync.WaitGroup) {
 	for i := start; i < end; i++ {
 		if i != 0 {
 			buf.WriteString(",")
 		}
-		tmp, _ := json.Marshal(r.traceLog[i])
+		pos := i
+		if selected != nil {
+			pos = selected[i]
+		}
+		tmp, _ := json.Marshal(r.traceLog[pos])
 		buf.Write(tmp)
 	}
 	wg.Done()
 }
 
-func (r *ReplayTracer) strTrace() string {
+// writeTrace streams the selected positions of the trace log in batches, each
+// encoded concurrently and flushed in order, so only a bounded number of traces
+// is held in memory. A nil selection writes the whole log.
+func (r *ReplayTracer) writeTrace(e *encoder, selected []int) {
 	var (
 		wg        sync.WaitGroup
 		subBuf    = [20]bytes.Buffer{}
 		threadNum = 1
 		batch     = 1000
-		fstr      string
+		total     = len(r.traceLog)
 	)
-
-	if len(r.traceLog) > 1000 {
+	if selected != nil {
+		total = len(selected)
+	}
+	if total > 1000 {
 		threadNum = 8
 	}
 
-	fstr = fstr + "["
+	e.str("[")
 	seq := 0
-	for seq < len(r.traceLog) {
+	for seq < total && e.err == nil {
 		subBuf = [20]bytes.Buffer{}
 		for i := 0; i < threadNum; i++ {
-			if seq == len(r.traceLog) {
+			if seq == total {
 				break
 			}
 			stPos := seq
 			enPos := seq + batch
-			if enPos >= len(r.traceLog) {
-				enPos = len(r.traceLog) - 1
+			if enPos >= total {
+				enPos = total - 1
 			}
 			seq = enPos + 1
 			wg.Add(1)
-			go r.threadStrTrace(stPos, enPos+1, &subBuf[i], &wg)
+			go r.threadStrTrace(selected, stPos, enPos+1, &subBuf[i], &wg)
 		}
 		wg.Wait()
 		for i := 0; i < threadNum; i++ {
-			//fp.Write(subBuf[i].Bytes())
-			fstr = fstr + subBuf[i].String()
+			e.write(subBuf[i].Bytes())
 		}
 	}
-	fstr = fstr + "]"
-	return fstr
+	e.str("]")
 }
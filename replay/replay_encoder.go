@@ -0,0 +1,34 @@
+package replay
+
+import (
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// encoder streams a replay document into a writer, remembering the first write
+// error so that it only needs to be checked once the document is done.
+type encoder struct {
+	w   io.Writer
+	err error
+}
+
+func (e *encoder) str(s string) {
+	if e.err == nil {
+		_, e.err = io.WriteString(e.w, s)
+	}
+}
+
+func (e *encoder) write(b []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+// ContentHashField returns the field closing a document with the hash of its
+// content so far, as computed by the given Keccak256 hasher.
+func ContentHashField(hasher hash.Hash) string {
+	return fmt.Sprintf(",\"contentHash\":\"%s\"", common.BytesToHash(hasher.Sum(nil)).Hex())
+}
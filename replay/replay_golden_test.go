@@ -0,0 +1,223 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package replay_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/eth"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/replay/schema"
+)
+
+var update = flag.Bool("update", false, "regenerate the golden replay documents")
+
+var (
+	goldenKey, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	goldenAddr   = crypto.PubkeyToAddress(goldenKey.PublicKey)
+
+	// Contracts preloaded into the genesis of the golden chains
+	memoryAddr  = common.HexToAddress("0x0101")
+	outerAddr   = common.HexToAddress("0x0201")
+	innerAddr   = common.HexToAddress("0x0202")
+	loopAddr    = common.HexToAddress("0x0203")
+	suicideAddr = common.HexToAddress("0x0301")
+	heirAddr    = common.HexToAddress("0x0302")
+	precompAddr = common.HexToAddress("0x0401")
+	goldenRecvr = common.HexToAddress("0x0501")
+	goldenAlloc = map[common.Address]string{
+		// Splices memory with MSTORE, MSTORE8 and an unaligned MLOAD, hashes an
+		// unaligned range with SHA3 and stores the hash and the first calldata word
+		memoryAddr: "7f" + "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20" +
+			"600052" + "60ff600553" + "600351" + "604052" + "6030601020" + "600055" + "600035600155" + "00",
+
+		// Calls the inner contract with plenty of gas and then with too little
+		// gas for it to finish, storing both outcomes
+		outerAddr: "6000600060006000600073" + innerAddr.Hex()[2:] + "62030d40f1600055" +
+			"6000600060006000600073" + innerAddr.Hex()[2:] + "612000f1600155" + "00",
+
+		// Stores a flag, calls the looping contract which runs out of gas, stores
+		// its outcome and creates a contract, storing its address
+		innerAddr: "6001600055" + "6000600060006000600073" + loopAddr.Hex()[2:] + "6064f1600155" +
+			"6460016000f3600052" + "6005601b6000f0600255" + "00",
+
+		// Loops until it runs out of gas
+		loopAddr: "5b600056",
+
+		// Self destructs, leaving its balance to the heir
+		suicideAddr: "73" + heirAddr.Hex()[2:] + "ff",
+
+		// Runs sha256, ripemd160 and identity over memory, ecrecover over garbage,
+		// and stores the identity output
+		precompAddr: "60ab600052" +
+			"60206020602060006000600261" + "2710f150" +
+			"60206040602060006000600361" + "2710f150" +
+			"60206060602060206000600461" + "2710f150" +
+			"60206080608060006000600161" + "2710f150" +
+			"606051600055" + "00",
+	}
+)
+
+// goldenTest is a chain of blocks whose replays are checked against a golden file.
+type goldenTest struct {
+	name      string
+	blocks    int
+	daoFork   *big.Int // block to apply the DAO hard fork at, if any
+	generator func(i int, block *core.BlockGen)
+}
+
+// goldenTx signs a transaction of the golden account into the block.
+func goldenTx(block *core.BlockGen, to *common.Address, value int64, gas int64, data []byte) {
+	var tx *types.Transaction
+	if to == nil {
+		tx = types.NewContractCreation(block.TxNonce(goldenAddr), big.NewInt(value), big.NewInt(gas), nil, data)
+	} else {
+		tx = types.NewTransaction(block.TxNonce(goldenAddr), *to, big.NewInt(value), big.NewInt(gas), nil, data)
+	}
+	tx, _ = types.SignTx(tx, types.HomesteadSigner{}, goldenKey)
+	block.AddTx(tx)
+}
+
+var goldenTests = []goldenTest{
+	{name: "memory", blocks: 1, generator: func(i int, block *core.BlockGen) {
+		goldenTx(block, &memoryAddr, 0, 200000, common.FromHex("0xdeadbeef"))
+	}},
+	{name: "calls", blocks: 1, generator: func(i int, block *core.BlockGen) {
+		goldenTx(block, &outerAddr, 0, 500000, nil)
+	}},
+	{name: "suicide", blocks: 1, generator: func(i int, block *core.BlockGen) {
+		goldenTx(block, &suicideAddr, 0, 100000, nil)
+		goldenTx(block, &heirAddr, 1, 21000, nil)
+	}},
+	{name: "outofgas", blocks: 1, generator: func(i int, block *core.BlockGen) {
+		goldenTx(block, &loopAddr, 0, 21100, nil)
+		goldenTx(block, nil, 0, 53500, common.FromHex("5b600056"))
+	}},
+	{name: "precompiles", blocks: 1, generator: func(i int, block *core.BlockGen) {
+		goldenTx(block, &precompAddr, 0, 200000, nil)
+	}},
+	{name: "daofork", blocks: 3, daoFork: big.NewInt(2), generator: func(i int, block *core.BlockGen) {
+		goldenTx(block, &goldenRecvr, 1000, 21000, nil)
+	}},
+}
+
+// newGoldenChain creates a blockchain holding the blocks of a golden test on
+// top of a genesis preloading the golden contracts.
+func newGoldenChain(t *testing.T, test goldenTest) *core.BlockChain {
+	alloc := map[string]interface{}{
+		goldenAddr.Hex():  map[string]string{"balance": "1000000000000000000"},
+		suicideAddr.Hex(): map[string]string{"balance": "12345", "code": goldenAlloc[suicideAddr]},
+		// The first drained DAO account and the refund contract
+		params.DAODrainList[0].Hex():   map[string]string{"balance": "1000000"},
+		params.DAORefundContract.Hex(): map[string]string{"balance": "1"},
+	}
+	for addr, code := range goldenAlloc {
+		if addr != suicideAddr {
+			alloc[addr.Hex()] = map[string]string{"code": code}
+		}
+	}
+	genesis, _ := json.Marshal(map[string]interface{}{
+		"nonce":      "0x0",
+		"gasLimit":   fmt.Sprintf("0x%x", params.GenesisGasLimit),
+		"difficulty": fmt.Sprintf("0x%x", params.GenesisDifficulty),
+		"alloc":      alloc,
+	})
+	var (
+		db, _  = ethdb.NewMemDatabase()
+		config = &params.ChainConfig{HomesteadBlock: big.NewInt(0), DAOForkBlock: test.daoFork, DAOForkSupport: test.daoFork != nil}
+	)
+	block, err := core.WriteGenesisBlock(db, bytes.NewReader(genesis))
+	if err != nil {
+		t.Fatalf("failed to write genesis: %v", err)
+	}
+	blockchain, err := core.NewBlockChain(db, config, new(core.FakePow), new(event.TypeMux), vm.Config{})
+	if err != nil {
+		t.Fatalf("failed to create blockchain: %v", err)
+	}
+	chain, _ := core.GenerateChain(config, block, db, test.blocks, test.generator)
+	if _, err := blockchain.InsertChain(chain); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	return blockchain
+}
+
+// Tests that the replays of chains exercising the subtle parts of the tracer
+// match the golden documents in testdata/golden. Run with -update to regenerate
+// them after intended changes to the output, and review the diff.
+func TestReplayGolden(t *testing.T) {
+	for _, test := range goldenTests {
+		bc := newGoldenChain(t, test)
+
+		var out bytes.Buffer
+		for number := uint64(1); number <= uint64(test.blocks); number++ {
+			doc, err := eth.ReplayBlockByNumber(bc, number)
+			if err != nil {
+				t.Fatalf("%s: block %d: failed to replay: %v", test.name, number, err)
+			}
+			if _, err := schema.DecodeBlock([]byte(doc)); err != nil {
+				t.Fatalf("%s: block %d: invalid document: %v", test.name, number, err)
+			}
+			if err := json.Indent(&out, []byte(doc), "", "  "); err != nil {
+				t.Fatalf("%s: block %d: malformed document: %v", test.name, number, err)
+			}
+			out.WriteString("\n")
+		}
+		path := filepath.Join("testdata", "golden", test.name+".json")
+		if *update {
+			if err := ioutil.WriteFile(path, out.Bytes(), 0644); err != nil {
+				t.Fatalf("%s: failed to update golden file: %v", test.name, err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%s: failed to read golden file: %v", test.name, err)
+		}
+		if have := out.Bytes(); !bytes.Equal(have, want) {
+			t.Errorf("%s: replay differs from %s, first at line %d", test.name, path, firstDiffLine(have, want))
+		}
+	}
+}
+
+// firstDiffLine returns the first line number on which two documents differ.
+func firstDiffLine(a, b []byte) int {
+	al, bl := strings.Split(string(a), "\n"), strings.Split(string(b), "\n")
+	for i := 0; i < len(al) && i < len(bl); i++ {
+		if al[i] != bl[i] {
+			return i + 1
+		}
+	}
+	if len(al) < len(bl) {
+		return len(al) + 1
+	}
+	return len(bl) + 1
+}
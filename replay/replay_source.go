@@ -17,6 +17,13 @@ func (r *ReplayTracer) setSource(tp string, seq int) {
 				Offset:               0,
 				Length:               r.traceLog[seq].StackOutput.Val[0].Size,
 			}
+			// Slots written earlier in the block originate from the writing transaction
+			key := common.Bytes2Hex(common.LeftPadBytes(r.traceLog[seq].StackInput.Val[0].Val, 32))
+			if write, ok := r.blockStore[r.pAddr][key]; ok {
+				src.Type = "crossTx"
+				src.OriginTxSeq = write.tx
+				src.OriginTxInstructionSeq = write.seq
+			}
 			val.Src = append(val.Src, src)
 			r.saveStorage(addr, val)
 		}
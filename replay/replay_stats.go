@@ -0,0 +1,150 @@
+package replay
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ReplayStats aggregates the instructions executed by replayed transactions,
+// computed from the trace log of the replay tracer without writing it out. The
+// stats of several blocks are rolled up with Add.
+//
+// The gas of an instruction is the gas charged for the instruction itself, as
+// in the code trace, except for calls: the gas they forward to the callee is
+// counted where it is spent, i.e. by the instructions of the callee or by the
+// precompiled contract called.
+type ReplayStats struct {
+	Blocks       uint64                `json:"blocks"`
+	Transactions uint64                `json:"transactions"`
+	Instructions uint64                `json:"instructions"`
+	Opcodes      map[string]*StatCount `json:"opcodes"`     // by opcode name
+	Contracts    map[string]*StatCount `json:"contracts"`   // by executing contract
+	Depths       map[int]uint64        `json:"depths"`      // instructions by call depth
+	Precompiles  map[string]*StatCount `json:"precompiles"` // by precompile, e.g. V-SHA256
+	Failures     map[string]uint64     `json:"failures"`    // failing instructions by reason
+	TxFailures   map[string]uint64     `json:"txFailures"`  // failed transactions by reason
+}
+
+// StatCount is a number of executions and the gas they used.
+type StatCount struct {
+	Count uint64 `json:"count"`
+	Gas   uint64 `json:"gas"`
+}
+
+// NewReplayStats creates empty replay stats.
+func NewReplayStats() *ReplayStats {
+	return &ReplayStats{
+		Opcodes:     make(map[string]*StatCount),
+		Contracts:   make(map[string]*StatCount),
+		Depths:      make(map[int]uint64),
+		Precompiles: make(map[string]*StatCount),
+		Failures:    make(map[string]uint64),
+		TxFailures:  make(map[string]uint64),
+	}
+}
+
+// Add rolls the given stats up into s.
+func (s *ReplayStats) Add(other *ReplayStats) {
+	s.Blocks += other.Blocks
+	s.Transactions += other.Transactions
+	s.Instructions += other.Instructions
+	addCounts(s.Opcodes, other.Opcodes)
+	addCounts(s.Contracts, other.Contracts)
+	addCounts(s.Precompiles, other.Precompiles)
+	for depth, n := range other.Depths {
+		s.Depths[depth] += n
+	}
+	for reason, n := range other.Failures {
+		s.Failures[reason] += n
+	}
+	for reason, n := range other.TxFailures {
+		s.TxFailures[reason] += n
+	}
+}
+
+func addCounts(dst, src map[string]*StatCount) {
+	for key, count := range src {
+		dst[key] = dst[key].add(count.Count, count.Gas)
+	}
+}
+
+// add returns the count increased by the given executions, allocating it if nil.
+func (c *StatCount) add(count, gas uint64) *StatCount {
+	if c == nil {
+		c = new(StatCount)
+	}
+	c.Count += count
+	c.Gas += gas
+	return c
+}
+
+// WriteCSV writes the stats as CSV records of the form
+//
+//	<label>,<section>,<key>,<count>,<gas>
+//
+// with the sections blocks, transactions, instructions, opcode, contract, depth,
+// precompile, failure and txFailure, sorted by section and key. The gas column
+// is empty for the sections without gas.
+func (s *ReplayStats) WriteCSV(w io.Writer, label string) error {
+	out := csv.NewWriter(w)
+	record := func(section, key string, count uint64, gas string) {
+		out.Write([]string{label, section, key, strconv.FormatUint(count, 10), gas})
+	}
+	counts := func(section string, m map[string]*StatCount) {
+		for _, key := range sortedKeys(m) {
+			record(section, key, m[key].Count, strconv.FormatUint(m[key].Gas, 10))
+		}
+	}
+	record("blocks", "", s.Blocks, "")
+	record("transactions", "", s.Transactions, "")
+	record("instructions", "", s.Instructions, "")
+	counts("opcode", s.Opcodes)
+	counts("contract", s.Contracts)
+
+	var depths []int
+	for depth := range s.Depths {
+		depths = append(depths, depth)
+	}
+	sort.Ints(depths)
+	for _, depth := range depths {
+		record("depth", strconv.Itoa(depth), s.Depths[depth], "")
+	}
+	counts("precompile", s.Precompiles)
+	for _, reason := range sortedKeys(s.Failures) {
+		record("failure", reason, s.Failures[reason], "")
+	}
+	for _, reason := range sortedKeys(s.TxFailures) {
+		record("txFailure", reason, s.TxFailures[reason], "")
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// CollectStats adds the instructions of the current transaction to the stats.
+func (r *ReplayTracer) CollectStats(s *ReplayStats) {
+	s.Transactions++
+	if r.txFailReason != "" {
+		s.TxFailures[r.txFailReason]++
+	}
+	for i := range r.traceLog {
+		op := r.traceLog[i].Basic
+		gas := uint64(op.GasUsed)
+		if op.HasCallGas && op.OpName != "CREATE" && op.CallGas >= 0 && uint64(op.CallGas) <= gas {
+			gas -= uint64(op.CallGas)
+		}
+		if op.ExceptionTag == 1 && op.FailInfo != "" {
+			s.Failures[op.FailInfo]++
+		}
+		if strings.HasPrefix(op.OpName, "V-") {
+			s.Precompiles[op.OpName] = s.Precompiles[op.OpName].add(1, gas)
+			continue
+		}
+		s.Instructions++
+		s.Opcodes[op.OpName] = s.Opcodes[op.OpName].add(1, gas)
+		s.Contracts[op.AccountAddr] = s.Contracts[op.AccountAddr].add(1, gas)
+		s.Depths[op.CallDepth]++
+	}
+}
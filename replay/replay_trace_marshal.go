@@ -8,6 +8,10 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 )
 
+// SchemaVersion is the version of the replay document format, emitted in every
+// top level document so that consumers can detect incompatible changes.
+const SchemaVersion = 1
+
 // String return string
 func (s VarVal) String() string {
 	return common.Bytes2Big(s).String()
@@ -38,6 +42,9 @@ func (t Source) MarshalJSON() ([]byte, error) {
 	var fstr, s, ext string
 	s = fmt.Sprintf("\"offset\":%d,\"len\":%d,\"outputOffset\":%d,\"srcType\":\"%s\",\"opcode\":\"%s\",\"instrSeq\":%d",
 		t.Offset, t.Length, t.OutputOffset, t.Type, t.Opcode, t.OriginInstructionSeq)
+	if t.Type == "crossTx" {
+		s += fmt.Sprintf(",\"txSeq\":%d,\"txInstrSeq\":%d", t.OriginTxSeq, t.OriginTxInstructionSeq)
+	}
 	ext = array2JSON("opIds", t.OperandIDs) + array2JSON("opOffsets", t.OperandOffsets) +
 		array2JSON("opLens", t.OperandLens) + array2JSON("opOutputOffsets", t.OperandOutputOffsets) +
 		array2JSON("implicitOpValues", t.OperandContents)
@@ -82,75 +89,85 @@ func (s *OpStat) String() string {
 	if s.ExceptionTag != 0 {
 		fstr += fmt.Sprintf(",\"exceptionTag\":%d", s.ExceptionTag)
 	}
+	if s.HasCallGas {
+		fstr += fmt.Sprintf(",\"callGas\":%d,\"callGasLeft\":%d", s.CallGas, s.CallGasLeft)
+	}
 	return fstr
 }
 
+// StackInputNames returns the names under which the n stack inputs of the given
+// opcode are emitted in the replay document.
+func StackInputNames(op string, n int) []string {
+	var inputName []string
+	switch op {
+	case "SHA3":
+		inputName = []string{"memStart", "memSize"}
+	case "CALLDATACOPY":
+		inputName = []string{"memStart", "dataStart", "dataSize"}
+	case "CODECOPY":
+		inputName = []string{"memStart", "codeStart", "codeSize"}
+	case "EXTCODECOPY":
+		inputName = []string{"codeAddr", "memStart", "codeStart", "codeSize"}
+	case "EXP":
+		inputName = []string{"base", "exponent"}
+	case "MLOAD":
+		inputName = []string{"memStart"}
+	case "SSTORE", "MSTORE8", "MSTORE":
+		inputName = []string{"storeStart", "storeValue"}
+	case "JUMP":
+		inputName = []string{"opPc"}
+	case "JUMPI":
+		inputName = []string{"opPc", "jumpFlag"}
+	case "DUP1", "DUP2", "DUP3", "DUP4", "DUP5", "DUP6", "DUP7", "DUP8":
+		fallthrough
+	case "DUP9", "DUP10", "DUP11", "DUP12", "DUP13", "DUP14", "DUP15", "DUP16":
+		inputName = []string{"item"}
+	case "SWAP1", "SWAP2", "SWAP3", "SWAP4", "SWAP5", "SWAP6", "SWAP7", "SWAP8":
+		fallthrough
+	case "SWAP9", "SWAP10", "SWAP11", "SWAP12", "SWAP13", "SWAP14", "SWAP15", "SWAP16":
+		inputName = []string{"item0", "item1"}
+	case "LOG0":
+		inputName = []string{"memStart", "memSize"}
+	case "LOG1":
+		inputName = []string{"memStart", "memSize", "topic0"}
+	case "LOG2":
+		inputName = []string{"memStart", "memSize", "topic0", "topic1"}
+	case "LOG3":
+		inputName = []string{"memStart", "memSize", "topic0", "topic1", "topic2"}
+	case "LOG4":
+		inputName = []string{"memStart", "memSize", "topic0", "topic1", "topic2", "topic3"}
+	case "CREATE":
+		inputName = []string{"value", "memStart", "memSize"}
+	case "CALL", "CALLCODE":
+		inputName = []string{"gas", "to", "value", "memInStart", "memInSize", "memOutStart", "memOutSize"}
+	case "DELEGATECALL":
+		inputName = []string{"gas", "to", "memInStart", "memInSize", "memOutStart", "memOutSize"}
+	case "RETURN":
+		inputName = []string{"memStart", "memSize"}
+	case "SELFDESTRUCT":
+		inputName = []string{"to"}
+	case "POP":
+		inputName = []string{"itemValue"}
+
+	default:
+		for i := 0; i < n; i++ {
+			inputName = append(inputName, fmt.Sprintf("input%d", i))
+		}
+	}
+	return inputName
+}
+
 // MarshalJSON custom the JSON format of Trace
 func (t Trace) MarshalJSON() ([]byte, error) {
 	var basic, stkin, stkout, memin, memout string
 
 	basic = t.Basic.String()
-	if t.Basic.OpName == "SUICIDE" || t.Basic.OpName == "CALL" {
+	if t.Basic.OpName == "SELFDESTRUCT" || t.Basic.OpName == "CALL" {
 		basic += fmt.Sprintf(",\"newAccountCreated\":%d", t.Basic.IsCreatedNewAddress)
 	}
 
 	if t.StackInput != nil {
-		inputName := []string{}
-		switch t.Basic.OpName {
-		case "SHA3":
-			inputName = []string{"memStart", "memSize"}
-		case "CALLDATACOPY":
-			inputName = []string{"memStart", "dataStart", "dataSize"}
-		case "CODECOPY":
-			inputName = []string{"memStart", "codeStart", "codeSize"}
-		case "EXTCODECOPY":
-			inputName = []string{"codeAddr", "memStart", "codeStart", "codeSize"}
-		case "EXP":
-			inputName = []string{"base", "exponent"}
-		case "MLOAD":
-			inputName = []string{"memStart"}
-		case "SSTORE", "MSTORE8", "MSTORE":
-			inputName = []string{"storeStart", "storeValue"}
-		case "JUMP":
-			inputName = []string{"opPc"}
-		case "JUMPI":
-			inputName = []string{"opPc", "jumpFlag"}
-		case "DUP1", "DUP2", "DUP3", "DUP4", "DUP5", "DUP6", "DUP7", "DUP8":
-			fallthrough
-		case "DUP9", "DUP10", "DUP11", "DUP12", "DUP13", "DUP14", "DUP15", "DUP16":
-			inputName = []string{"item"}
-		case "SWAP1", "SWAP2", "SWAP3", "SWAP4", "SWAP5", "SWAP6", "SWAP7", "SWAP8":
-			fallthrough
-		case "SWAP9", "SWAP10", "SWAP11", "SWAP12", "SWAP13", "SWAP14", "SWAP15", "SWAP16":
-			inputName = []string{"item0", "item1"}
-		case "LOG0":
-			inputName = []string{"memStart", "memSize"}
-		case "LOG1":
-			inputName = []string{"memStart", "memSize", "topic0"}
-		case "LOG2":
-			inputName = []string{"memStart", "memSize", "topic0", "topic1"}
-		case "LOG3":
-			inputName = []string{"memStart", "memSize", "topic0", "topic1", "topic2"}
-		case "LOG4":
-			inputName = []string{"memStart", "memSize", "topic0", "topic1", "topic2", "topic3"}
-		case "CREATE":
-			inputName = []string{"value", "memStart", "memSize"}
-		case "CALL", "CALLCODE":
-			inputName = []string{"gas", "to", "value", "memInStart", "memInSize", "memOutStart", "memOutSize"}
-		case "DELEGATECALL":
-			inputName = []string{"gas", "to", "memInStart", "memInSize", "memOutStart", "memOutSize"}
-		case "RETURN":
-			inputName = []string{"memStart", "memSize"}
-		case "SUICIDE":
-			inputName = []string{"to"}
-		case "POP":
-			inputName = []string{"itemValue"}
-
-		default:
-			for i := 0; i < len(t.StackInput.Val); i++ {
-				inputName = append(inputName, fmt.Sprintf("input%d", i))
-			}
-		}
+		inputName := StackInputNames(t.Basic.OpName, len(t.StackInput.Val))
 		if len(inputName) != 0 {
 			for i, c := range t.StackInput.Val {
 				stkin += fmt.Sprintf("\"%s\": %d", inputName[i], c.Src[0].OriginInstructionSeq)
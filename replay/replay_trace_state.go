@@ -16,6 +16,18 @@ func (r *ReplayTracer) setIn(addr, key, val string) {
 	}
 }
 
+// setBlockStore records a slot written by the instruction seq of the current
+// transaction, so that later transactions of the block can refer back to it.
+func (r *ReplayTracer) setBlockStore(addr, key string, seq int) {
+	if r.blockStore == nil {
+		r.blockStore = make(writeStore)
+	}
+	if _, ok := r.blockStore[addr]; !ok {
+		r.blockStore[addr] = make(map[string]storeWrite)
+	}
+	r.blockStore[addr][key] = storeWrite{tx: r.TxID, seq: seq}
+}
+
 func (r *ReplayTracer) hasStore(addr, key string) bool {
 	if _, ok := r.storeOut[addr]; !ok {
 		return false
@@ -14,6 +14,9 @@ type OpStat struct {
 	BeforeMemSize       int
 	AfterMemSize        int
 	IsCreatedNewAddress int
+	CallGas             int64 // gas handed to the callee, for calls and creates
+	CallGasLeft         int64 // gas the callee left over, for calls and creates
+	HasCallGas          bool
 }
 
 // Source is a structure which trace the value
@@ -25,8 +28,11 @@ type Source struct {
 	Type                 string
 	Opcode               string
 	OriginInstructionSeq int
-	OperandIDs           []int
-	OperandContents      []int
+	// For crossTx ref. The transaction and instruction that wrote a loaded slot
+	OriginTxSeq            int
+	OriginTxInstructionSeq int
+	OperandIDs             []int
+	OperandContents        []int
 	// For partial ref. Should only be not-nil in MLOAD op (create new Source by merging all bytes)
 	OperandOffsets       []int
 	OperandLens          []int
@@ -1,11 +1,15 @@
 package replay
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/crypto/sha3"
 )
 
 type context map[string]Content
@@ -27,8 +31,15 @@ type accountState struct {
 type (
 	stringStore  map[string]map[string]string
 	contentStore map[string]map[string]Content
+	writeStore   map[string]map[string]storeWrite
 )
 
+// storeWrite is the instruction of a transaction that last wrote a slot.
+type storeWrite struct {
+	tx  int
+	seq int
+}
+
 type Trans struct {
 	From  string
 	To    string
@@ -52,12 +63,15 @@ type ReplayTracer struct {
 	txFailReason         string
 	txCreatedAccounts    []common.Address
 	codeStore            map[string]string
+	codeHashes           map[string]string // code hashes of codeStore, for DedupCode
+	codeTable            map[string]string // code of the written transactions by hash, for DedupCode
 	ioAccounts           map[string]accountState
 	refundGas            int
 	blockCreatedAccounts []string
 	traceLog             []Trace
 	storeIn              stringStore
 	storeOut             contentStore
+	blockStore           writeStore // slots written by earlier transactions of the block
 	createdAccounts      map[string]int
 	suicidedTrace        map[int]string
 	TxID                 int
@@ -66,6 +80,9 @@ type ReplayTracer struct {
 	transList            []Trans
 	TxBasic              string
 	strTx                []string
+	filter               *traceFilter // limits the instructions written, nil for all
+	hashes               bool         // whether documents end with their content hash
+	dedup                bool         // whether code is referenced by hash, see DedupCode
 }
 
 // Init
@@ -74,6 +91,8 @@ func (r *ReplayTracer) BlockInit() {
 	r.TxID = -1
 	r.strTx = []string{}
 	r.blockCreatedAccounts = []string{}
+	r.blockStore = make(writeStore)
+	r.codeTable = make(map[string]string)
 }
 
 func (r *ReplayTracer) TxInit(seq int) {
@@ -90,6 +109,7 @@ func (r *ReplayTracer) TxInit(seq int) {
 
 	r.ioAccounts = make(map[string]accountState)
 	r.codeStore = make(map[string]string)
+	r.codeHashes = make(map[string]string)
 
 	r.refundGas = 0
 
@@ -142,6 +162,16 @@ func (r *ReplayTracer) ValidateTransfer(seq int) {
 	}
 }
 
+// DiscardTransfers drops the transfers of the transaction with the given index,
+// for transactions rolled back as invalid.
+func (r *ReplayTracer) DiscardTransfers(seq int) {
+	for i, v := range r.transList {
+		if v.TxID == seq {
+			r.transList[i].Valid = -1
+		}
+	}
+}
+
 // Refund
 func (r *ReplayTracer) SetRefundGas(refund *big.Int) {
 	r.refundGas = int(refund.Uint64())
@@ -187,6 +217,9 @@ func (r *ReplayTracer) IsCreated(addr common.Address) bool {
 func (r *ReplayTracer) AddCode(addr common.Address, code []byte) {
 	if common.Bytes2Hex(code) != "" && common.Bytes2Hex(code) != "0x" {
 		r.codeStore[addr.Hex()] = "0x" + common.Bytes2Hex(code)
+		if r.dedup {
+			r.codeHashes[addr.Hex()] = crypto.Keccak256Hash(code).Hex()
+		}
 	}
 }
 
@@ -213,17 +246,58 @@ func (r *ReplayTracer) StrBlockCreatedAccounts() string {
 }
 
 func (r *ReplayTracer) StrTransaction() string {
-	fstr := "{" + r.TxBasic
-	fstr = fstr + "," + fmt.Sprintf("\"instructionCount\":%d", len(r.traceLog))
+	var buf bytes.Buffer
+	r.WriteTransaction(&buf)
+	return buf.String()
+}
+
+// WriteTransaction streams the replay document of the current transaction into
+// w, appending the given raw JSON fields to it.
+func (r *ReplayTracer) WriteTransaction(w io.Writer, fields ...string) error {
+	e := &encoder{w: w}
+	hasher := sha3.NewKeccak256()
+	if r.hashes {
+		e.w = io.MultiWriter(w, hasher)
+	}
+	e.str("{" + r.TxBasic)
+	e.str(fmt.Sprintf(",\"instructionCount\":%d", len(r.traceLog)))
 	if r.refundGas != 0 {
-		fstr = fstr + "," + fmt.Sprintf("\"totalRefund\":%d", r.refundGas)
+		e.str(fmt.Sprintf(",\"totalRefund\":%d", r.refundGas))
+	}
+	e.str(",\"inputStates\":")
+	r.writeInputState(e)
+	e.str(",\"outputStates\":")
+	r.writeOutputState(e)
+	e.str(fmt.Sprintf(",\"failReason\":\"%s\"", r.txFailReason))
+	e.str("," + r.strCreateSuicide())
+	if r.dedup {
+		e.str(",\"codeRefs\":")
+	} else {
+		e.str(",\"codeStorage\":")
 	}
-	fstr = fstr + "," + fmt.Sprintf("\"inputStates\":%s", r.strInputState())
-	fstr = fstr + "," + fmt.Sprintf("\"outputStates\":%s", r.strOutputState())
-	fstr = fstr + "," + fmt.Sprintf("\"failReason\":\"%s\"", r.txFailReason)
-	fstr = fstr + "," + r.strCreateSuicide()
-
-	return fstr + ",\"codeStorage\":" + r.strCode() + ",\"codeTrace\":" + r.strTrace() + "}"
+	if r.filter != nil && (r.filter.storage || r.filter.noTrace) {
+		e.str("{}")
+	} else {
+		r.writeCode(e)
+	}
+	selected, truncated := r.selectTraces()
+	e.str(",\"codeTrace\":")
+	r.writeTrace(e, selected)
+	if omitted := len(r.traceLog) - len(selected); selected != nil && omitted > 0 {
+		e.str(fmt.Sprintf(",\"omittedInstructions\":%d", omitted))
+	}
+	if truncated {
+		e.str(",\"codeTraceTruncated\":true")
+	}
+	for _, field := range fields {
+		e.str("," + field)
+	}
+	if r.hashes {
+		e.w = w
+		e.str(ContentHashField(hasher))
+	}
+	e.str("}")
+	return e.err
 }
 
 func (r *ReplayTracer) StrTransfer(seq int) string {
@@ -245,6 +319,21 @@ func (r *ReplayTracer) StrTransfer(seq int) string {
 	return "[" + fstr + "]"
 }
 
+func (r *ReplayTracer) StrTxTransfer(seq int) string {
+	fstr := ""
+	for _, v := range r.transList {
+		if v.TxID != seq || v.Valid == -1 {
+			continue
+		}
+		if fstr != "" {
+			fstr += ","
+		}
+		tmp, _ := json.Marshal(v)
+		fstr = fstr + fmt.Sprintf("%s", tmp)
+	}
+	return "[" + fstr + "]"
+}
+
 func (r *ReplayTracer) StrTxBasic(nonce, gasPrice, startGas, gasUsed uint64, data, init, to, value string, v int64, r_, s, hash string) {
 	if r.TxBasic != "" {
 		r.TxBasic += ","
@@ -333,11 +422,7 @@ func (r *ReplayTracer) SetOutputAccount(addr common.Address, codeHash common.Has
 }
 
 func (r *ReplayTracer) GetInputAccounts() []string {
-	tmp := []string{}
-	for k := range r.ioAccounts {
-		tmp = append(tmp, k)
-	}
-	return tmp
+	return append([]string{}, sortedKeys(r.ioAccounts)...)
 }
 
 // Simulate environment
@@ -594,6 +679,7 @@ func (r *ReplayTracer) ScanTrace() {
 			key := common.Bytes2Hex(common.LeftPadBytes(log.StackInput.Val[0].Val, 32))
 			val := log.StackInput.Val[1]
 			r.setOut(addr, key, val)
+			r.setBlockStore(addr, key, id)
 		} else if opName == "CALL" {
 			if log.Basic.IsCreatedNewAddress == 1 {
 				addr := "0x" + common.Bytes2Hex(common.LeftPadBytes(log.StackInput.Val[1].Val, 20))
@@ -604,7 +690,7 @@ func (r *ReplayTracer) ScanTrace() {
 			if addr != "0x0000000000000000000000000000000000000000" {
 				r.createdAccounts[addr] = 1
 			}
-		} else if opName == "SUICIDE" {
+		} else if opName == "SELFDESTRUCT" {
 			if log.Basic.IsCreatedNewAddress == 1 {
 				addr := "0x" + common.Bytes2Hex(common.LeftPadBytes(log.StackInput.Val[0].Val, 20))
 				r.createdAccounts[addr] = 1
@@ -643,8 +729,12 @@ func (r *ReplayTracer) AddMemSize(seq int, before, after int) {
 	r.traceLog[seq].Basic.AfterMemSize = after
 }
 
-func (r *ReplayTracer) AddGas(seq int, gas int64) {
-	r.refundGas = int(gas)
+// SetCallGas records the gas a call or create instruction handed to the callee
+// and the gas the callee left over.
+func (r *ReplayTracer) SetCallGas(seq int, gas, left int64) {
+	r.traceLog[seq].Basic.CallGas = gas
+	r.traceLog[seq].Basic.CallGasLeft = left
+	r.traceLog[seq].Basic.HasCallGas = true
 }
 
 func (r *ReplayTracer) SetStackInput(seq int, num int) {
@@ -712,7 +802,7 @@ func (r *ReplayTracer) SetStackOutput(seq int, val *big.Int) {
 		fallthrough
 	case "CREATE", "CALL", "CALLCODE", "DELEGATECALL":
 		r.setSource("computed", seq)
-	case "SUICIDE":
+	case "SELFDESTRUCT":
 		r.setSource("environment", seq)
 	default:
 	}
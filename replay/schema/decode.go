@@ -0,0 +1,389 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/replay"
+)
+
+// contentHashField is the start of the field closing documents replayed with
+// content hashes.
+const contentHashField = `,"contentHash":"`
+
+// Decoder reads replay block documents from an input stream. Both single block
+// files and merged range files holding one document per line are supported.
+// Documents replayed with DedupCode are inflated as they are decoded.
+type Decoder struct {
+	dec *json.Decoder
+}
+
+// NewDecoder returns a decoder reading block documents from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{dec: json.NewDecoder(r)}
+}
+
+// Decode reads the next block document from the stream. It returns io.EOF once
+// the stream is exhausted.
+func (d *Decoder) Decode() (*Block, error) {
+	block := new(Block)
+	if err := d.dec.Decode(block); err != nil {
+		return nil, err
+	}
+	if err := checkVersion(block.SchemaVersion); err != nil {
+		return nil, err
+	}
+	if err := block.Inflate(); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// DecodeFile loads all block documents from a replay output file.
+func DecodeFile(path string) ([]*Block, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		blocks []*Block
+		dec    = NewDecoder(f)
+	)
+	for {
+		block, err := dec.Decode()
+		if err == io.EOF {
+			return blocks, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: document %d: %v", path, len(blocks), err)
+		}
+		blocks = append(blocks, block)
+	}
+}
+
+// DecodeBlock decodes a single block document.
+func DecodeBlock(doc []byte) (*Block, error) {
+	block := new(Block)
+	if err := json.Unmarshal(doc, block); err != nil {
+		return nil, err
+	}
+	if err := checkVersion(block.SchemaVersion); err != nil {
+		return nil, err
+	}
+	if err := block.Inflate(); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// DecodeTransaction decodes a standalone transaction document.
+func DecodeTransaction(doc []byte) (*Transaction, error) {
+	tx := new(Transaction)
+	if err := json.Unmarshal(doc, tx); err != nil {
+		return nil, err
+	}
+	if err := checkVersion(tx.SchemaVersion); err != nil {
+		return nil, err
+	}
+	if err := tx.Inflate(); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// Inflate resolves the code references of a block document replayed with
+// DedupCode against its code table, restoring the codeStorage of every
+// transaction. Documents without code references are left as they are.
+func (b *Block) Inflate() error {
+	for i, tx := range b.Transactions {
+		if err := tx.inflate(b.CodeTable); err != nil {
+			return fmt.Errorf("transaction %d: %v", i, err)
+		}
+	}
+	b.CodeTable = nil
+	return nil
+}
+
+// Inflate resolves the code references of a standalone transaction document
+// replayed with DedupCode, like Block.Inflate.
+func (tx *Transaction) Inflate() error {
+	if err := tx.inflate(tx.CodeTable); err != nil {
+		return err
+	}
+	tx.CodeTable = nil
+	return nil
+}
+
+func (tx *Transaction) inflate(table CodeTable) error {
+	if tx.CodeRefs == nil {
+		return nil
+	}
+	tx.Code = make(map[string]string, len(tx.CodeRefs))
+	for addr, ref := range tx.CodeRefs {
+		code, ok := table[ref.Hex()]
+		if !ok {
+			return fmt.Errorf("code %x of account %s missing from code table", ref, addr)
+		}
+		tx.Code[addr] = code
+	}
+	tx.CodeRefs = nil
+	return nil
+}
+
+// CheckContentHash verifies the content hash closing a block or standalone
+// transaction document. The hash is the Keccak256 hash of the document bytes up
+// to the contentHash field, so identical replays hash identically.
+func CheckContentHash(doc []byte) error {
+	doc = bytes.TrimSpace(doc)
+	n := len(contentHashField) + 2*common.HashLength + 2 + len(`"}`)
+	if len(doc) < n || !bytes.HasPrefix(doc[len(doc)-n:], []byte(contentHashField)) || !bytes.HasSuffix(doc, []byte(`"}`)) {
+		return errors.New("document carries no content hash")
+	}
+	want := common.HexToHash(string(doc[len(doc)-n+len(contentHashField) : len(doc)-2]))
+	if have := crypto.Keccak256Hash(doc[:len(doc)-n]); have != want {
+		return fmt.Errorf("content hash mismatch: have %x, want %x", have, want)
+	}
+	return nil
+}
+
+// checkVersion rejects documents written in a newer format than understood.
+func checkVersion(version int) error {
+	if version > Version {
+		return fmt.Errorf("unsupported schema version %d, newest known %d", version, Version)
+	}
+	return nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler, defaulting the omitted sequence
+// numbers to -1.
+func (t *Transfer) UnmarshalJSON(input []byte) error {
+	type transfer Transfer
+	dec := transfer{TxSeq: -1, TraceSeq: -1}
+	if err := json.Unmarshal(input, &dec); err != nil {
+		return err
+	}
+	*t = Transfer(dec)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler, encoding the source as the
+// [instrSeq, offset, len, outputOffset] tuple used by the replay.
+func (s *MemorySource) MarshalJSON() ([]byte, error) {
+	return json.Marshal([4]int{s.InstrSeq, s.Offset, s.Length, s.OutputOffset})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *MemorySource) UnmarshalJSON(input []byte) error {
+	var dec [4]int
+	if err := json.Unmarshal(input, &dec); err != nil {
+		return err
+	}
+	s.InstrSeq, s.Offset, s.Length, s.OutputOffset = dec[0], dec[1], dec[2], dec[3]
+	return nil
+}
+
+// traceBasic is the fixed part of an encoded trace.
+type traceBasic struct {
+	Name              string         `json:"name"`
+	GasUsed           int            `json:"gasUsed"`
+	PC                int            `json:"pc"`
+	Seq               int            `json:"sequenceNo"`
+	Address           common.Address `json:"accountAddr"`
+	CallDepth         int            `json:"callDepth"`
+	Reverted          int            `json:"reverted"`
+	FailInfo          string         `json:"failInfo"`
+	BeforeMemSize     *int           `json:"beforeMemSize,omitempty"`
+	AfterMemSize      *int           `json:"afterMemSize,omitempty"`
+	ExceptionTag      int            `json:"exceptionTag,omitempty"`
+	CallGas           *int64         `json:"callGas,omitempty"`
+	CallGasLeft       *int64         `json:"callGasLeft,omitempty"`
+	NewAccountCreated *int           `json:"newAccountCreated,omitempty"`
+}
+
+// memoryKeys returns the keys under which the memory input and output of an
+// instruction are encoded.
+func (t *Trace) memoryKeys() (string, string) {
+	switch {
+	case strings.HasPrefix(t.Name, "V-") || (len(t.Name) > 5 && strings.HasSuffix(t.Name, "COPY")):
+		return "input", "output"
+	case t.MemoryInput != nil && t.MemoryOutput != nil:
+		return "memInData", "memOutData"
+	default:
+		return "memData", "memData"
+	}
+}
+
+// MarshalJSON implements json.Marshaler, producing the same layout as the
+// replay tracer.
+func (t *Trace) MarshalJSON() ([]byte, error) {
+	basic := traceBasic{
+		Name:         t.Name,
+		GasUsed:      t.GasUsed,
+		PC:           t.PC,
+		Seq:          t.Seq,
+		Address:      t.Address,
+		CallDepth:    t.CallDepth,
+		Reverted:     t.Reverted,
+		FailInfo:     t.FailInfo,
+		ExceptionTag: t.ExceptionTag,
+	}
+	if t.BeforeMemSize != -1 && t.AfterMemSize != -1 {
+		basic.BeforeMemSize, basic.AfterMemSize = &t.BeforeMemSize, &t.AfterMemSize
+	}
+	if t.Name == "SELFDESTRUCT" || t.Name == "CALL" {
+		basic.NewAccountCreated = &t.NewAccountCreated
+	}
+	if t.CallGas != -1 && t.CallGasLeft != -1 {
+		basic.CallGas, basic.CallGasLeft = &t.CallGas, &t.CallGasLeft
+	}
+	enc, err := json.Marshal(basic)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(enc[:len(enc)-1])
+
+	field := func(key string, val interface{}) error {
+		enc, err := json.Marshal(val)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(buf, ",%q:%s", key, enc)
+		return nil
+	}
+	for i, name := range replay.StackInputNames(t.Name, len(t.StackInputs)) {
+		if i < len(t.StackInputs) {
+			field(name, t.StackInputs[i])
+		}
+	}
+	if t.StackOutput != nil {
+		if err := field("output", t.StackOutput); err != nil {
+			return nil, err
+		}
+	}
+	inKey, outKey := t.memoryKeys()
+	if t.MemoryInput != nil {
+		if err := field(inKey, t.MemoryInput); err != nil {
+			return nil, err
+		}
+	}
+	if t.MemoryOutput != nil {
+		if err := field(outKey, t.MemoryOutput); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (t *Trace) UnmarshalJSON(input []byte) error {
+	var basic traceBasic
+	if err := json.Unmarshal(input, &basic); err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(input, &fields); err != nil {
+		return err
+	}
+	*t = Trace{
+		Name:          basic.Name,
+		GasUsed:       basic.GasUsed,
+		PC:            basic.PC,
+		Seq:           basic.Seq,
+		Address:       basic.Address,
+		CallDepth:     basic.CallDepth,
+		Reverted:      basic.Reverted,
+		FailInfo:      basic.FailInfo,
+		BeforeMemSize: -1,
+		AfterMemSize:  -1,
+		ExceptionTag:  basic.ExceptionTag,
+		CallGas:       -1,
+		CallGasLeft:   -1,
+	}
+	if basic.BeforeMemSize != nil && basic.AfterMemSize != nil {
+		t.BeforeMemSize, t.AfterMemSize = *basic.BeforeMemSize, *basic.AfterMemSize
+	}
+	if basic.NewAccountCreated != nil {
+		t.NewAccountCreated = *basic.NewAccountCreated
+	}
+	if basic.CallGas != nil && basic.CallGasLeft != nil {
+		t.CallGas, t.CallGasLeft = *basic.CallGas, *basic.CallGasLeft
+	}
+	// Stack inputs are keyed by operand name, only known for the opcode
+	for _, name := range replay.StackInputNames(t.Name, len(fields)) {
+		raw, ok := fields[name]
+		if !ok {
+			break
+		}
+		var seq int
+		if err := json.Unmarshal(raw, &seq); err != nil {
+			return fmt.Errorf("trace %d: stack input %s: %v", t.Seq, name, err)
+		}
+		t.StackInputs = append(t.StackInputs, seq)
+	}
+	// Memory accesses and the stack output share keys depending on the opcode
+	var err error
+	switch {
+	case strings.HasPrefix(t.Name, "V-") || (len(t.Name) > 5 && strings.HasSuffix(t.Name, "COPY")):
+		t.MemoryInput, err = decodeMemoryInput(fields["input"])
+		if err == nil {
+			t.MemoryOutput, err = decodeContent(fields["output"])
+		}
+	default:
+		t.StackOutput, err = decodeContent(fields["output"])
+		if err == nil {
+			if raw, ok := fields["memData"]; ok {
+				if t.Name == "MSTORE" || t.Name == "MSTORE8" {
+					t.MemoryOutput, err = decodeContent(raw)
+				} else if t.MemoryInput, err = decodeMemoryInput(raw); err != nil {
+					t.MemoryOutput, err = decodeContent(raw)
+				}
+			}
+		}
+		if err == nil {
+			if raw, ok := fields["memInData"]; ok {
+				t.MemoryInput, err = decodeMemoryInput(raw)
+			}
+		}
+		if err == nil {
+			if raw, ok := fields["memOutData"]; ok {
+				t.MemoryOutput, err = decodeContent(raw)
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("trace %d: %v", t.Seq, err)
+	}
+	return nil
+}
+
+func decodeContent(raw json.RawMessage) (*Content, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	c := new(Content)
+	if err := json.Unmarshal(raw, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func decodeMemoryInput(raw json.RawMessage) (*MemoryInput, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	m := new(MemoryInput)
+	if err := json.Unmarshal(raw, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
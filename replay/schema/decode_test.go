@@ -0,0 +1,69 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package schema
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Tests that merged range files are decoded document by document.
+func TestDecoderStream(t *testing.T) {
+	stream := `{"blockHeader":{"number":7,"difficulty":"131072"},"transferTrace":[{"from":"a","to":"b","value":"5","type":"MinerReward"}],"schemaVersion":1}
+{"blockHeader":{"number":8,"difficulty":"131136"},"transferTrace":[{"from":"a","to":"b","value":"1","type":"ExternalCallTransfer","txSeqNo":0,"traceSeqNo":3}],"schemaVersion":1}
+`
+	dec := NewDecoder(strings.NewReader(stream))
+	for number := uint64(7); number <= 8; number++ {
+		block, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("block #%d: failed to decode: %v", number, err)
+		}
+		if block.Header.Number != number {
+			t.Errorf("block number mismatch: have %d, want %d", block.Header.Number, number)
+		}
+	}
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("stream end mismatch: have %v, want %v", err, io.EOF)
+	}
+}
+
+// Tests that omitted transfer sequence numbers decode as unbound.
+func TestDecodeTransfer(t *testing.T) {
+	block, err := DecodeBlock([]byte(`{"transferTrace":[{"value":"5","type":"MinerReward"},{"value":"1","txSeqNo":2,"traceSeqNo":0}]}`))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if tr := block.Transfers[0]; tr.TxSeq != -1 || tr.TraceSeq != -1 {
+		t.Errorf("unbound transfer mismatch: have tx %d trace %d, want -1, -1", tr.TxSeq, tr.TraceSeq)
+	}
+	if tr := block.Transfers[1]; tr.TxSeq != 2 || tr.TraceSeq != 0 || tr.Value.String() != "1" {
+		t.Errorf("bound transfer mismatch: have tx %d trace %d value %v", tr.TxSeq, tr.TraceSeq, tr.Value)
+	}
+}
+
+// Tests that documents of a newer schema are rejected.
+func TestDecodeVersion(t *testing.T) {
+	doc := fmt.Sprintf(`{"schemaVersion":%d}`, Version+1)
+	if _, err := DecodeBlock([]byte(doc)); err == nil {
+		t.Errorf("newer block schema accepted")
+	}
+	if _, err := DecodeTransaction([]byte(doc)); err == nil {
+		t.Errorf("newer transaction schema accepted")
+	}
+}
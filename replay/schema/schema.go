@@ -0,0 +1,241 @@
+// Package schema contains the Go data model of DeepInsight replay documents.
+//
+// The replay tracer emits its documents as hand written JSON; the types in this
+// package describe that format field by field, so that consumers can load
+// replay output without re-parsing it into untyped maps.
+package schema
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/replay"
+)
+
+// Version is the newest document schema version this package understands.
+const Version = replay.SchemaVersion
+
+// Block is the replay document of a whole block.
+type Block struct {
+	Transactions    []*Transaction `json:"transactionList"`
+	Header          *Header        `json:"blockHeader"`
+	Uncles          []*Header      `json:"uncleBlockHeaderList"`
+	Transfers       []*Transfer    `json:"transferTrace"`
+	InputStates     []*Account     `json:"blockInputStates"`
+	OutputStates    []*Account     `json:"blockOutputStates"`
+	CreatedAccounts []string       `json:"blockCreatedAccounts"`
+	Verification    *Verification  `json:"verification,omitempty"` // only in verified replays
+	CodeTable       CodeTable      `json:"codeTable,omitempty"`    // only in deduplicated replays, see Inflate
+	SchemaVersion   int            `json:"schemaVersion"`
+	ContentHash     *common.Hash   `json:"contentHash,omitempty"` // only if requested, see CheckContentHash
+}
+
+// Verification is the outcome of checking a replayed block against the receipts
+// and state root stored in the chain.
+type Verification struct {
+	Verified   bool        `json:"verified"`
+	Mismatches []*Mismatch `json:"mismatches"`
+}
+
+// Mismatch is a replay result diverging from the chain.
+type Mismatch struct {
+	Tx    int    `json:"tx"`    // index of the transaction, -1 for the block itself
+	Field string `json:"field"` // cumulativeGasUsed, logsBloom, postState, receipts or stateRoot
+	Have  string `json:"have"`  // replayed value
+	Want  string `json:"want"`  // value stored in the chain
+}
+
+// Header is the header of a replayed block or one of its uncles.
+type Header struct {
+	Hash             common.Hash    `json:"ownHash"`
+	ParentHash       common.Hash    `json:"prevHash"`
+	UncleHash        common.Hash    `json:"uncleHash"`
+	Coinbase         common.Address `json:"coinBase"`
+	Root             common.Hash    `json:"stateRoot"`
+	TxHash           common.Hash    `json:"transactionRoot"`
+	ReceiptHash      common.Hash    `json:"receiptsRoot"`
+	Bloom            hexutil.Bytes  `json:"logBloom"`
+	Difficulty       *Decimal       `json:"difficulty"`
+	Number           uint64         `json:"number"`
+	GasLimit         uint64         `json:"gasLimit"`
+	GasUsed          uint64         `json:"gasUsed"`
+	Time             uint64         `json:"timestamp"`
+	Extra            hexutil.Bytes  `json:"extraData"`
+	MixDigest        common.Hash    `json:"mixHash"`
+	Nonce            hexutil.Uint64 `json:"nonce"`
+	TransactionCount int            `json:"transactionCount"`
+}
+
+// Transaction is the replay document of a single transaction. Transfers,
+// CodeTable and SchemaVersion are only set on standalone transaction documents,
+// SenderCredit only on replayed calls whose sender could not pay for them.
+type Transaction struct {
+	Sender           common.Address         `json:"sender"`
+	Nonce            uint64                 `json:"nonce"`
+	GasPrice         uint64                 `json:"gasPrice"`
+	StartGas         uint64                 `json:"startGas"`
+	GasUsed          uint64                 `json:"gasUsed"`
+	Data             string                 `json:"data"` // hex call data, empty for contract creations
+	Init             string                 `json:"init"` // hex init code, empty for message calls
+	To               string                 `json:"to"`   // recipient address, "NIL" for contract creations
+	Value            *Decimal               `json:"value"`
+	V                int64                  `json:"v"`
+	R                *Decimal               `json:"r"`
+	S                *Decimal               `json:"s"`
+	Hash             common.Hash            `json:"hash"`
+	InstructionCount int                    `json:"instructionCount"`
+	TotalRefund      int                    `json:"totalRefund,omitempty"`
+	InputStates      []*InputState          `json:"inputStates"`
+	OutputStates     []*OutputState         `json:"outputStates"`
+	FailReason       string                 `json:"failReason"`
+	CreatedAccounts  []string               `json:"createdAccounts"`
+	DeletedAccounts  []string               `json:"deletedAccounts"`
+	Code             map[string]string      `json:"codeStorage"`
+	CodeRefs         map[string]common.Hash `json:"codeRefs,omitempty"` // code hashes by account in deduplicated replays
+	Traces           []*Trace               `json:"codeTrace"`
+	Omitted          int                    `json:"omittedInstructions,omitempty"` // instructions filtered out of the code trace
+	Truncated        bool                   `json:"codeTraceTruncated,omitempty"`  // whether the instruction cap was hit
+	Transfers        []*Transfer            `json:"transferTrace,omitempty"`
+	CodeTable        CodeTable              `json:"codeTable,omitempty"`
+	SenderCredit     *Decimal               `json:"senderCredit,omitempty"` // balance credited to the sender of a call
+	SchemaVersion    int                    `json:"schemaVersion,omitempty"`
+	ContentHash      *common.Hash           `json:"contentHash,omitempty"` // only if requested, see CheckContentHash
+}
+
+// CodeTable holds the hex code referenced by the transactions of a document
+// replayed with DedupCode, keyed by hex code hash.
+type CodeTable map[string]string
+
+// Account is the basic state of an account.
+type Account struct {
+	Address  common.Address `json:"accountAddr"`
+	CodeHash common.Hash    `json:"codeHash"`
+	Nonce    uint64         `json:"nonce"`
+	Balance  *Decimal       `json:"balance"`
+}
+
+// InputState is the state of an account before a transaction, along with the
+// storage slots the transaction read from it.
+type InputState struct {
+	Account
+	Storage map[string]string `json:"storageContents"`
+}
+
+// OutputState is the state of an account after a transaction, along with the
+// storage slots the transaction wrote and the provenance of their values.
+type OutputState struct {
+	Account
+	IsSmart int                 `json:"isSmart"`
+	Storage map[string]*Content `json:"storageContents"`
+}
+
+// Transfer is a movement of ether recorded during the replay. TxSeq and
+// TraceSeq are -1 if the transfer is not bound to a transaction or instruction.
+type Transfer struct {
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Value    *Decimal `json:"value"`
+	Type     string   `json:"type"`
+	TxSeq    int      `json:"txSeqNo"`
+	TraceSeq int      `json:"traceSeqNo"`
+}
+
+// Trace is a single executed instruction.
+type Trace struct {
+	Name              string
+	GasUsed           int
+	PC                int
+	Seq               int
+	Address           common.Address
+	CallDepth         int
+	Reverted          int
+	FailInfo          string
+	BeforeMemSize     int // -1 if the instruction did not touch memory
+	AfterMemSize      int // -1 if the instruction did not touch memory
+	ExceptionTag      int
+	NewAccountCreated int
+	CallGas           int64 // gas handed to the callee of calls and creates, -1 for other instructions
+	CallGasLeft       int64 // gas left over by the callee of calls and creates, -1 for other instructions
+
+	// StackInputs are the sequence numbers of the instructions producing each
+	// stack operand, in operand order.
+	StackInputs  []int
+	StackOutput  *Content
+	MemoryInput  *MemoryInput
+	MemoryOutput *Content
+}
+
+// Content is a value along with the provenance of its bytes.
+type Content struct {
+	Value hexutil.Bytes `json:"value"`
+	Size  int           `json:"size"`
+	Src   []*Source     `json:"src"`
+}
+
+// SourceCrossTx is the type of storage load sources referring to the write of
+// an earlier transaction in the same block.
+const SourceCrossTx = "crossTx"
+
+// Source describes where (a range of) the bytes of a value originate from.
+type Source struct {
+	Offset               int    `json:"offset"`
+	Length               int    `json:"len"`
+	OutputOffset         int    `json:"outputOffset"`
+	Type                 string `json:"srcType"`
+	Opcode               string `json:"opcode"`
+	InstrSeq             int    `json:"instrSeq"`
+	TxSeq                *int   `json:"txSeq,omitempty"`      // writing transaction, for SourceCrossTx
+	TxInstrSeq           *int   `json:"txInstrSeq,omitempty"` // writing instruction, for SourceCrossTx
+	OperandIDs           []int  `json:"opIds,omitempty"`
+	OperandOffsets       []int  `json:"opOffsets,omitempty"`
+	OperandLens          []int  `json:"opLens,omitempty"`
+	OperandOutputOffsets []int  `json:"opOutputOffsets,omitempty"`
+	OperandContents      []int  `json:"implicitOpValues,omitempty"`
+}
+
+// MemoryInput is a memory range read by an instruction, in the compact form
+// the replay emits memory inputs in.
+type MemoryInput struct {
+	Value hexutil.Bytes   `json:"value"`
+	Size  int             `json:"size"`
+	Src   []*MemorySource `json:"src"`
+}
+
+// MemorySource is the origin of a byte range of a memory input.
+type MemorySource struct {
+	InstrSeq     int
+	Offset       int
+	Length       int
+	OutputOffset int
+}
+
+// Decimal is a big integer encoded as a quoted decimal string.
+type Decimal big.Int
+
+// MarshalJSON implements json.Marshaler.
+func (d *Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + (*big.Int)(d).String() + `"`), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Decimal) UnmarshalJSON(input []byte) error {
+	if len(input) < 2 || input[0] != '"' || input[len(input)-1] != '"' {
+		return fmt.Errorf("decimal %s not a string", input)
+	}
+	if _, ok := (*big.Int)(d).SetString(string(input[1:len(input)-1]), 10); !ok {
+		return fmt.Errorf("invalid decimal %s", input)
+	}
+	return nil
+}
+
+// ToInt converts d to a big.Int.
+func (d *Decimal) ToInt() *big.Int {
+	return (*big.Int)(d)
+}
+
+// String returns the decimal representation of d.
+func (d *Decimal) String() string {
+	return (*big.Int)(d).String()
+}
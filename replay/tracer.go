@@ -39,6 +39,7 @@ type Tracer interface {
 	StrBlockCreatedAccounts() string
 	StrTransaction() string
 	StrTransfer(seq int) string
+	StrTxTransfer(seq int) string
 	StrTxBasic(nonce, gasPrice, startGas, gasUsed uint64, data, init, to, value string, v int64, r, s, hash string)
 
 	// Failure
@@ -79,7 +80,7 @@ type Tracer interface {
 	GetSeq() int
 	InitTrace(name string, pc int, gas int, calldepth int) int
 	AddMemSize(seq int, before, after int)
-	AddGas(seq int, gas int64)
+	SetCallGas(seq int, gas, left int64)
 	SetStackInput(seq int, num int)
 	SetStackOutput(seq int, val *big.Int)
 	SetMemoryInput(seq int, offset *big.Int, size *big.Int)
@@ -32,7 +32,7 @@ const (
 	notificationBufferSize = 10000 // max buffered notifications before codec is closed
 
 	MetadataApi     = "rpc"
-	DefaultIPCApis  = "admin,debug,eth,miner,net,personal,shh,txpool,web3"
+	DefaultIPCApis  = "admin,debug,deepinsight,eth,miner,net,personal,shh,trace,txpool,web3"
 	DefaultHTTPApis = "eth,net,web3"
 )
 